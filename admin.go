@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// adminToken is set with -admin-token. Requests carrying it in X-Admin-Token
+// may moderate every channel. Empty disables admin access altogether
+var adminToken string
+
+func isAdmin(r *http.Request) bool {
+	token := r.Header.Get("X-Admin-Token")
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// canModerate is true for the channel moderators and for admins. Caller must
+// hold the subject lock
+func (s *subject) canModerate(r *http.Request) bool {
+	return isAdmin(r) || s.isModerator(actingUser(r))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Prometheus Alertmanager posts its notifications to a token integration (see
+// webhooks.go), which turns the channel into an alert feed:
+//
+//	receivers:
+//	- name: team
+//	  webhook_configs:
+//	  - url: https://chat.example.com/api/alertmanager/<integration id>/<token>
+//	    send_resolved: true
+//
+// Every notification becomes one message under the integration name. Its text
+// reads well anywhere, the alert field carries the same as a card for clients
+// that render one: the labels shared by the group, then the firing and the
+// resolved alerts, each with its own labels as fields. Groups with a critical
+// alert firing are posted urgent, with a warning high
+type alertmanagerPayload struct {
+	Version           string              `json:"version"`
+	GroupKey          string              `json:"groupKey"`
+	TruncatedAlerts   int                 `json:"truncatedAlerts"`
+	Status            string              `json:"status"`
+	Receiver          string              `json:"receiver"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Alerts            []alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// alertCard is what a message from Alertmanager carries in its alert field
+type alertCard struct {
+	Status    string       `json:"status"` // firing or resolved
+	Receiver  string       `json:"receiver,omitempty"`
+	GroupKey  string       `json:"group_key,omitempty"`
+	Labels    []alertField `json:"labels"`
+	Firing    []alertItem  `json:"firing"`
+	Resolved  []alertItem  `json:"resolved"`
+	Truncated int          `json:"truncated,omitempty"`
+	URL       string       `json:"url,omitempty"`
+}
+
+type alertItem struct {
+	Name        string       `json:"name"`
+	Summary     string       `json:"summary,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Fields      []alertField `json:"fields"`
+	StartsAt    time.Time    `json:"starts_at"`
+	EndsAt      *time.Time   `json:"ends_at,omitempty"`
+	URL         string       `json:"url,omitempty"`
+}
+
+type alertField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+const maxAlertmanagerBody = 1 << 20
+
+// the alerts of a group listed in the text, the card has them all
+const maxAlertsShown = 20
+
+// alertFields lists labels in name order, leaving out those in skip
+func alertFields(labels, skip map[string]string) []alertField {
+	fields := []alertField{}
+	for name, value := range labels {
+		if _, ok := skip[name]; !ok && name != "alertname" {
+			fields = append(fields, alertField{Name: name, Value: value})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+// card groups the alerts of a notification by status, the labels all of them
+// share go on the card and the rest on each alert
+func (p alertmanagerPayload) card() *alertCard {
+	card := &alertCard{
+		Status:    p.Status,
+		Receiver:  p.Receiver,
+		GroupKey:  p.GroupKey,
+		Labels:    alertFields(p.CommonLabels, nil),
+		Firing:    []alertItem{},
+		Resolved:  []alertItem{},
+		Truncated: p.TruncatedAlerts,
+		URL:       p.ExternalURL,
+	}
+	for _, alert := range p.Alerts {
+		item := alertItem{
+			Name:        alert.Labels["alertname"],
+			Summary:     alert.Annotations["summary"],
+			Description: alert.Annotations["description"],
+			Fields:      alertFields(alert.Labels, p.CommonLabels),
+			StartsAt:    alert.StartsAt,
+			URL:         alert.GeneratorURL,
+		}
+		if item.Summary == "" {
+			item.Summary = p.CommonAnnotations["summary"]
+		}
+		if alert.Status == "resolved" {
+			ends := alert.EndsAt
+			item.EndsAt = &ends
+			card.Resolved = append(card.Resolved, item)
+		} else {
+			card.Firing = append(card.Firing, item)
+		}
+	}
+	return card
+}
+
+// text is the card as a message: a heading like Alertmanager's own
+// "[FIRING:2] HighLatency (api prod)", then the alerts by status
+func (c *alertCard) text(groupLabels map[string]string) string {
+	heading := "[" + strings.ToUpper(c.Status)
+	if len(c.Firing) > 0 {
+		heading += ":" + strconv.Itoa(len(c.Firing))
+	}
+	heading += "]"
+	names := []string{}
+	for name := range groupLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rest := []string{}
+	for _, name := range names {
+		if name == "alertname" {
+			heading += " " + groupLabels[name]
+		} else {
+			rest = append(rest, groupLabels[name])
+		}
+	}
+	if len(rest) > 0 {
+		heading += " (" + strings.Join(rest, " ") + ")"
+	}
+
+	lines := []string{heading}
+	shown := 0
+	for _, section := range []struct {
+		title string
+		items []alertItem
+	}{{"Firing", c.Firing}, {"Resolved", c.Resolved}} {
+		if len(section.items) == 0 {
+			continue
+		}
+		lines = append(lines, "", section.title+":")
+		for _, item := range section.items {
+			if shown == maxAlertsShown {
+				break
+			}
+			shown++
+			line := "- " + item.Name
+			if item.Summary != "" {
+				line += ": " + item.Summary
+			}
+			lines = append(lines, line)
+			if len(item.Fields) > 0 {
+				pairs := []string{}
+				for _, f := range item.Fields {
+					pairs = append(pairs, f.Name+"="+f.Value)
+				}
+				lines = append(lines, "  "+strings.Join(pairs, " "))
+			}
+		}
+	}
+	if more := len(c.Firing) + len(c.Resolved) - shown + c.Truncated; more > 0 {
+		lines = append(lines, "", fmt.Sprintf("and %d more", more))
+	}
+	if len(c.Labels) > 0 {
+		pairs := []string{}
+		for _, f := range c.Labels {
+			pairs = append(pairs, f.Name+"="+f.Value)
+		}
+		lines = append(lines, "", "Labels: "+strings.Join(pairs, " "))
+	}
+	if c.URL != "" {
+		lines = append(lines, c.URL)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// priority is urgent while a critical alert fires and high for a warning
+func (c *alertCard) priority() string {
+	priority := ""
+	for _, item := range c.Firing {
+		for _, fields := range [][]alertField{c.Labels, item.Fields} {
+			for _, f := range fields {
+				if f.Name != "severity" {
+					continue
+				}
+				switch f.Value {
+				case "critical", "page":
+					return "urgent"
+				case "warning":
+					priority = "high"
+				}
+			}
+		}
+	}
+	return priority
+}
+
+// curl -X POST http://localhost:8000/api/alertmanager/<id>/<token> -d @notification.json
+func postAlertmanager(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hook, ok := tokenIntegration(vars["id"], vars["token"])
+	if !ok {
+		respondJSON(w, http.StatusNotFound, "No such integration")
+		return
+	}
+
+	defer r.Body.Close()
+	payload := alertmanagerPayload{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAlertmanagerBody)).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(payload.Alerts) == 0 {
+		respondJSON(w, http.StatusBadRequest, "No alerts")
+		return
+	}
+	card := payload.card()
+	mesg := msgPost{Message: card.text(payload.GroupLabels), Priority: card.priority(), Alert: card}
+	if mesg, ok := postAsIntegration(w, r, hook, mesg); ok {
+		respondJSON(w, http.StatusOK, map[string]int{"id": mesg.Id})
+	}
+}
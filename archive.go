@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Channels nothing changed in for longer than -archive-after, no message,
+// reply or setting, are written to dataDir and dropped from memory. The first
+// request that names an archived channel brings it back according to
+// -rehydrate:
+//
+//	lazy   settings come back, history stays on disk and is paged in on reads
+//	full   settings and the whole compressed history come back into memory
+//	never  archived channels are gone as far as clients can tell
+var archiveAfter time.Duration
+var rehydratePolicy = "lazy"
+
+const archiveInterval = 5 * time.Minute
+
+// archivedChannel is the on disk form of a subject
+type archivedChannel struct {
+	Title         string             `json:"title"`
+	Owner         string             `json:"owner"`
+	LastID        int                `json:"last_id"`
+	Moderators    map[string]bool    `json:"moderators"`
+	Trusted       map[string]bool    `json:"trusted"`
+	Private       bool               `json:"private"`
+	Members       map[string]bool    `json:"members"`
+	AllowGuests   bool               `json:"allow_guests"`
+	Frozen        bool               `json:"frozen"`
+	Retention     *archivedRetention `json:"retention,omitempty"`
+	Premoderate   bool               `json:"premoderate"`
+	Pending       []pendingPost      `json:"pending"`
+	NextPendingID int                `json:"next_pending_id"`
+	Expiring      map[int]time.Time  `json:"expiring"`
+	SlowMode      time.Duration      `json:"slow_mode,omitempty"`
+	Blocks        []archivedBlock    `json:"blocks,omitempty"`
+	Welcome       *welcomeMessage    `json:"welcome,omitempty"`
+	Welcomed      map[string]bool    `json:"welcomed,omitempty"`
+	// backups carry the messages themselves instead of blocks
+	Messages []storedPost `json:"messages,omitempty"`
+}
+
+// archivedRetention keeps the exact duration, retentionPolicy marshals max_age
+// for people
+type archivedRetention struct {
+	MaxAge      time.Duration `json:"max_age"`
+	MaxMessages int           `json:"max_messages"`
+}
+
+type archivedBlock struct {
+	First  int       `json:"first"`
+	Last   int       `json:"last"`
+	Count  int       `json:"count"`
+	Newest time.Time `json:"newest"`
+	Path   string    `json:"path"`
+}
+
+// rehydration metrics, served by getRehydrationStats
+var rehydrateMutex sync.Mutex
+var rehydrateStats struct {
+	Count       int           `json:"count"`
+	Failures    int           `json:"failures"`
+	TotalTime   time.Duration `json:"total_ns"`
+	LastTime    time.Duration `json:"last_ns"`
+	LastChannel string        `json:"last_channel"`
+}
+
+func archivePath(channel string) string {
+	return filepath.Join(dataDir, "archive", channel+".json")
+}
+
+// touch notes a change of the channel, which keeps it from being archived
+func (s *subject) touch() {
+	atomic.StoreInt64(&s.lastTouched, time.Now().UnixNano())
+}
+
+func (s *subject) touched() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastTouched))
+}
+
+func (s *subject) isArchived() bool {
+	return atomic.LoadInt32(&s.archived) == 1
+}
+
+// lockLive write-locks the subject, or the one that took its place when the
+// archive job dropped it before the lock was had: an archived subject takes
+// no writes, they would be lost with it. nil when the channel is gone, which
+// only happens with -rehydrate never
+func (s *subject) lockLive() *subject {
+	for s != nil {
+		s.Lock()
+		if !s.isArchived() {
+			return s
+		}
+		s.Unlock()
+		s = lookupSubject(s.title)
+	}
+	return nil
+}
+
+// lastActivity is when the newest message was posted. Caller must hold the
+// subject lock
+func (s *subject) lastActivity() time.Time {
+	if len(s.Messages) > 0 {
+		return s.Messages[len(s.Messages)-1].Created
+	}
+	if len(s.cold) > 0 {
+		return s.cold[len(s.cold)-1].newest
+	}
+	return time.Time{}
+}
+
+// settings is everything about the channel but its messages. Caller must hold
+// the subject lock
+func (s *subject) settings() archivedChannel {
+	a := archivedChannel{
+		Title:         s.title,
+		Owner:         s.owner,
+		LastID:        s.lastID,
+		Moderators:    copySet(s.moderators),
+		Trusted:       copySet(s.trusted),
+		Private:       s.private,
+		Members:       copySet(s.members),
+		AllowGuests:   s.allowGuests,
+		Frozen:        s.frozen,
+		Premoderate:   s.premoderate,
+		Pending:       append([]pendingPost(nil), s.pending...),
+		NextPendingID: s.nextPendingID,
+		Expiring:      make(map[int]time.Time, len(s.expiring)),
+		SlowMode:      s.slowMode,
+		Welcomed:      copySet(s.welcomed),
+	}
+	if s.welcome != nil {
+		welcome := *s.welcome
+		a.Welcome = &welcome
+	}
+	for id, at := range s.expiring {
+		a.Expiring[id] = at
+	}
+	if s.retention != nil {
+		a.Retention = &archivedRetention{s.retention.MaxAge, s.retention.MaxMessages}
+	}
+	return a
+}
+
+func copySet(set map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(set))
+	for key := range set {
+		copied[key] = true
+	}
+	return copied
+}
+
+// restoreSettings is the inverse of settings, the channel comes back empty
+func restoreSettings(a archivedChannel) *subject {
+	s := newSubject(a.Title, a.Owner)
+	s.applySettings(a)
+	return s
+}
+
+// applySettings replaces everything about the channel but its messages. Caller
+// must hold the subject write lock
+func (s *subject) applySettings(a archivedChannel) {
+	s.owner, s.lastID = a.Owner, a.LastID
+	s.moderators, s.trusted, s.members = copySet(a.Moderators), copySet(a.Trusted), copySet(a.Members)
+	s.private, s.allowGuests, s.frozen = a.Private, a.AllowGuests, a.Frozen
+	s.retention = nil
+	if a.Retention != nil {
+		s.retention = &retentionPolicy{MaxAge: a.Retention.MaxAge, MaxMessages: a.Retention.MaxMessages}
+	}
+	s.premoderate, s.pending, s.nextPendingID = a.Premoderate, a.Pending, a.NextPendingID
+	s.slowMode = a.SlowMode
+	s.welcome, s.welcomed = nil, copySet(a.Welcomed)
+	if a.Welcome != nil {
+		welcome := *a.Welcome
+		s.welcome = &welcome
+	}
+	s.expiring = make(map[int]time.Time, len(a.Expiring))
+	for id, at := range a.Expiring {
+		s.expiring[id] = at
+	}
+}
+
+// archive spills every message to disk and writes the channel settings next to
+// them. Caller must hold the subject write lock
+func (s *subject) archive() error {
+	for _, b := range s.cold {
+		if b.msgs != nil {
+			b.freeze(s.title)
+		}
+	}
+	size := coldBlockSize
+	if size <= 0 {
+		size = len(s.Messages)
+	}
+	for len(s.Messages) > 0 {
+		if size > len(s.Messages) {
+			size = len(s.Messages)
+		}
+		s.cold = append(s.cold, newColdBlock(s.title, s.Messages[:size]))
+		s.Messages = s.Messages[size:]
+	}
+
+	a := s.settings()
+	for _, b := range s.cold {
+		if b.path == "" {
+			return fmt.Errorf("block %d-%d of %s is not on disk", b.first, b.last, s.title)
+		}
+		a.Blocks = append(a.Blocks, archivedBlock{First: b.first, Last: b.last, Count: b.count, Newest: b.newest, Path: b.path})
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(archivePath(s.title)), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(archivePath(s.title), data, 0644); err != nil {
+		return err
+	}
+	for _, b := range s.cold {
+		dataToS3(b.path)
+	}
+	dataToS3(archivePath(s.title))
+	return nil
+}
+
+// archiveIdle drops the channels nothing changed in for archiveAfter from
+// memory. The subject is marked archived under its lock, a request that looked
+// it up just before takes the lock with lockLive and ends up writing to the
+// channel brought back from the archive instead
+func archiveIdle(now time.Time) {
+	if dataDir == "" || archiveAfter <= 0 || isMirror() {
+		return
+	}
+	for channel, subject := range allSubjects() {
+		subject.Lock()
+		if now.Sub(subject.touched()) < archiveAfter {
+			subject.Unlock()
+			continue
+		}
+		err := subject.archive()
+		if err == nil {
+			atomic.StoreInt32(&subject.archived, 1)
+		}
+		subject.Unlock()
+		if err != nil {
+			fmt.Println("Archiving", channel, "failed:", err)
+			continue
+		}
+		globalMapMutex.Lock()
+		if liveMessages[channel] == subject {
+			delete(liveMessages, channel)
+		}
+		globalMapMutex.Unlock()
+		publish(channel, "channel_archived", nil)
+		drainChannel(channel, "archived")
+	}
+}
+
+// rehydrate brings an archived channel back, nil when there is none or the
+// policy says archived channels stay archived
+func rehydrate(channel string) *subject {
+	if dataDir == "" || rehydratePolicy == "never" {
+		return nil
+	}
+	rehydrateMutex.Lock()
+	defer rehydrateMutex.Unlock()
+	if subject := lookupLive(channel); subject != nil {
+		// somebody else brought it back while we waited
+		return subject
+	}
+	data, err := ioutil.ReadFile(archivePath(channel))
+	if err != nil {
+		return nil
+	}
+	start := time.Now()
+	subject, err := restoreArchive(data)
+	if err != nil {
+		rehydrateStats.Failures++
+		fmt.Println("Rehydrating", channel, "failed:", err)
+		return nil
+	}
+
+	globalMapMutex.Lock()
+	liveMessages[channel] = subject
+	globalMapMutex.Unlock()
+	// the live subject owns the blocks now, a second archive rewrites this
+	os.Remove(archivePath(channel))
+
+	elapsed := time.Since(start)
+	rehydrateStats.Count++
+	rehydrateStats.TotalTime += elapsed
+	rehydrateStats.LastTime = elapsed
+	rehydrateStats.LastChannel = channel
+	publish(channel, "channel_rehydrated", nil)
+	return subject
+}
+
+func restoreArchive(data []byte) (*subject, error) {
+	a := archivedChannel{}
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	s := restoreSettings(a)
+	for _, ab := range a.Blocks {
+		b := &coldBlock{first: ab.First, last: ab.Last, count: ab.Count, newest: ab.Newest, path: ab.Path}
+		if rehydratePolicy == "full" {
+			var err error
+			if b.data, err = ioutil.ReadFile(b.path); err != nil {
+				return nil, err
+			}
+		}
+		s.cold = append(s.cold, b)
+	}
+	return s, nil
+}
+
+// archivedNames lists the channels archived to disk. Caller must hold
+// rehydrateMutex
+func archivedNames() []string {
+	names := []string{}
+	if dataDir == "" {
+		return names
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dataDir, "archive"))
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	return names
+}
+
+// archivedSnapshots reads the archived channels with all of their messages,
+// without bringing them back
+func archivedSnapshots() []archivedChannel {
+	rehydrateMutex.Lock()
+	defer rehydrateMutex.Unlock()
+	snapshots := []archivedChannel{}
+	for _, channel := range archivedNames() {
+		data, err := ioutil.ReadFile(archivePath(channel))
+		if err != nil {
+			continue
+		}
+		s, err := restoreArchive(data)
+		if err != nil {
+			fmt.Println("Reading archived", channel, "failed:", err)
+			continue
+		}
+		snapshots = append(snapshots, s.snapshot())
+	}
+	return snapshots
+}
+
+// leaveArchived takes the channels archived on disk out of a state rebuilt at
+// startup. Rehydrating removes the archive, so the archive of a channel holds
+// every change made to it and the channel stays on disk until it is named
+func leaveArchived(b *backup) {
+	rehydrateMutex.Lock()
+	archived := make(map[string]bool)
+	for _, channel := range archivedNames() {
+		archived[channel] = true
+	}
+	rehydrateMutex.Unlock()
+	kept := b.Channels[:0]
+	for _, a := range b.Channels {
+		if !archived[a.Title] {
+			kept = append(kept, a)
+		}
+	}
+	b.Channels = kept
+}
+
+// dropArchives deletes every archived channel with its history. Caller must
+// hold rehydrateMutex
+func dropArchives() {
+	for _, channel := range archivedNames() {
+		if data, err := ioutil.ReadFile(archivePath(channel)); err == nil {
+			if s, err := restoreArchive(data); err == nil {
+				for _, b := range s.cold {
+					b.discard()
+				}
+			}
+		}
+		os.Remove(archivePath(channel))
+	}
+}
+
+// curl -X GET http://localhost:8000/admin/rehydration -H 'X-Admin-Token: secret'
+func getRehydrationStats(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	rehydrateMutex.Lock()
+	defer rehydrateMutex.Unlock()
+	stats := map[string]interface{}{
+		"policy": rehydratePolicy,
+		"stats":  rehydrateStats,
+	}
+	if rehydrateStats.Count > 0 {
+		stats["average_ns"] = rehydrateStats.TotalTime / time.Duration(rehydrateStats.Count)
+	}
+	respondJSON(w, http.StatusOK, stats)
+}
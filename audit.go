@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The audit log records changes made with admin rights that have to be
+// accounted for later, who made them and when. With -data-dir every entry is
+// appended to audit.log there, one JSON object a line, and never rewritten.
+// The newest entries are also kept in memory for GET /admin/audit
+type auditEntry struct {
+	At       time.Time   `json:"at"`
+	Actor    string      `json:"actor"`
+	Action   string      `json:"action"`
+	Channel  string      `json:"channel,omitempty"`
+	Username string      `json:"username,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+const auditTailSize = 1000
+
+var auditMutex sync.Mutex
+var auditTail []auditEntry
+
+// actor names whoever made an admin request, the admin token alone makes
+// "admin"
+func actor(r *http.Request) string {
+	if username := actingUser(r); username != "" {
+		return username
+	}
+	return "admin"
+}
+
+func audit(entry auditEntry) {
+	entry.At = time.Now()
+	toSIEM(siemRecord{At: entry.At, Source: "audit", Type: entry.Action, Actor: entry.Actor, Channel: entry.Channel, Username: entry.Username, Data: entry.Data})
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	auditTail = append(auditTail, entry)
+	if len(auditTail) >= 2*auditTailSize {
+		auditTail = append([]auditEntry(nil), auditTail[len(auditTail)-auditTailSize:]...)
+	}
+	if dataDir == "" {
+		return
+	}
+	if err := appendAudit(entry); err != nil {
+		fmt.Println("Writing the audit log failed:", err)
+	}
+}
+
+func appendAudit(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, "audit.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// The newest audit entries, newest last
+// curl -X GET 'http://localhost:8000/admin/audit?limit=50' -H 'X-Admin-Token: secret'
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > auditTailSize {
+			respondJSON(w, http.StatusBadRequest, "limit should be between 1 and "+strconv.Itoa(auditTailSize))
+			return
+		}
+	}
+	auditMutex.Lock()
+	entries := auditTail
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	entries = append([]auditEntry{}, entries...)
+	auditMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string][]auditEntry{"entries": entries})
+}
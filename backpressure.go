@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load shedding. With -shed-high-water the node turns new posts, replies,
+// webhook posts and imports away with 503 and Retry-After while one of its
+// queues is filled beyond that share of what it holds, rather than letting
+// memory grow or the queue drop what it was given:
+//
+//	persistence  records held back by write-behind, full at 4 batches
+//	objects      uploads waiting for object storage
+//	siem         records waiting for the SIEM
+//	mqtt         messages waiting for the MQTT broker
+//	nats         messages waiting to be fanned out over NATS
+//	kafka        messages and replies waiting to be produced to Kafka
+//	fanout       the share of stream listeners with their buffer backed up,
+//	             counted from 10 listeners on so a few slow readers do not
+//	             stop everybody from posting
+//
+// The queues are measured every shedInterval, posts only look at the outcome.
+// How full each queue is and how many posts were turned away because of it
+// are on /metrics
+var shedHighWater float64
+
+const shedInterval = 100 * time.Millisecond
+const writeQueueBatches = 4
+const shedMinListeners = 10
+
+var shedMutex sync.RWMutex
+var queueFill = make(map[string]float64)
+var overloaded string // the fullest queue over the high water mark, "" when none
+var shedPosts = map[string]*int64{"persistence": new(int64), "objects": new(int64), "siem": new(int64), "mqtt": new(int64), "nats": new(int64), "kafka": new(int64), "fanout": new(int64)}
+
+// measureQueues is the job keeping queueFill and overloaded up to date
+func measureQueues(now time.Time) {
+	fill := make(map[string]float64)
+	if writeDelay > 0 {
+		walMutex.Lock()
+		held := len(pending)
+		walMutex.Unlock()
+		fill["persistence"] = float64(held) / float64(writeQueueBatches*writeBatch)
+	}
+	if s3Queue != nil {
+		fill["objects"] = float64(len(s3Queue)) / float64(cap(s3Queue))
+	}
+	if siemQueue != nil {
+		fill["siem"] = float64(len(siemQueue)) / float64(cap(siemQueue))
+	}
+	if mqttQueue != nil {
+		fill["mqtt"] = float64(len(mqttQueue)) / float64(cap(mqttQueue))
+	}
+	if natsQueue != nil {
+		fill["nats"] = float64(len(natsQueue)) / float64(cap(natsQueue))
+	}
+	if kafkaQueue != nil {
+		fill["kafka"] = float64(len(kafkaQueue)) / float64(cap(kafkaQueue))
+	}
+	total, backedUp := broker.backedUp(shedHighWater)
+	if total >= shedMinListeners {
+		fill["fanout"] = float64(backedUp) / float64(total)
+	}
+
+	fullest := ""
+	for queue, f := range fill {
+		if f >= shedHighWater && (fullest == "" || f > fill[fullest]) {
+			fullest = queue
+		}
+	}
+	shedMutex.Lock()
+	queueFill, overloaded = fill, fullest
+	shedMutex.Unlock()
+}
+
+// shed answers 503 when the node is over its high water mark
+func shed(w http.ResponseWriter) bool {
+	if shedHighWater <= 0 {
+		return false
+	}
+	shedMutex.RLock()
+	queue := overloaded
+	shedMutex.RUnlock()
+	if queue == "" {
+		return false
+	}
+	atomic.AddInt64(shedPosts[queue], 1)
+	w.Header().Set("Retry-After", "1")
+	respondJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+		"error": "The node is overloaded, try again later",
+		"queue": queue,
+	})
+	return true
+}
+
+// writeShedMetrics adds how full the queues are and the posts shed to /metrics
+func writeShedMetrics(b *strings.Builder) {
+	shedMutex.RLock()
+	queues := make([]string, 0, len(queueFill))
+	for queue := range queueFill {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	b.WriteString("# TYPE messaging_queue_fill gauge\n")
+	b.WriteString("# HELP messaging_queue_fill Share of a queue in use, posts are shed from -shed-high-water on.\n")
+	for _, queue := range queues {
+		fmt.Fprintf(b, "messaging_queue_fill{queue=%q} %g\n", queue, queueFill[queue])
+	}
+	shedMutex.RUnlock()
+	b.WriteString("# TYPE messaging_shed_posts counter\n")
+	b.WriteString("# HELP messaging_shed_posts Posts turned away with 503 because of a full queue.\n")
+	for _, queue := range []string{"fanout", "kafka", "mqtt", "nats", "objects", "persistence", "siem"} {
+		fmt.Fprintf(b, "messaging_shed_posts_total{queue=%q} %d\n", queue, atomic.LoadInt64(shedPosts[queue]))
+	}
+}
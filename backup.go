@@ -0,0 +1,662 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A backup is a single gzipped JSON document with every channel, its messages
+// and settings, and the state living outside channels: username claims, users
+// and their sessions, guests, invites, aliases, integrations, outgoing
+// webhooks, reminders, drafts, read markers, notification preferences, push
+// devices, blocks, quote backlinks, legal holds, feature switches, channel
+// templates and incidents. Each channel is snapshotted under its own lock, so
+// every channel is consistent in itself without stopping the node.
+//
+//	messaging-service backup -server http://localhost:8000 -admin-token secret -o backup.json.gz
+//	messaging-service restore -server http://localhost:8000 -admin-token secret -i backup.json.gz
+//
+// Nodes running with -pitr-window can also go back to an earlier time, see wal.go
+const backupVersion = 1
+
+type backup struct {
+	Version  int               `json:"version"`
+	TakenAt  time.Time         `json:"taken_at"`
+	Node     string            `json:"node"`
+	Channels []archivedChannel `json:"channels"`
+	globalState
+}
+
+// globalState is everything kept outside channels
+type globalState struct {
+	Claims       map[string]string            `json:"claims"`    // username -> token
+	Passwords    map[string]string            `json:"passwords"` // username -> bcrypt hash
+	Sessions     []session                    `json:"sessions"`
+	Guests       []guest                      `json:"guests"`
+	Invites      []invite                     `json:"invites"`
+	Aliases      map[string]string            `json:"aliases"`
+	Integrations []storedIntegration          `json:"integrations"`
+	Webhooks     []storedWebhook              `json:"webhooks"`
+	Reminders    []reminder                   `json:"reminders"`
+	Drafts       []draft                      `json:"drafts"`
+	ReadMarkers  map[string]map[string]int    `json:"read_markers"`
+	Preferences  map[string]notificationPrefs `json:"notification_preferences"`
+	Devices      map[string][]device          `json:"devices"`
+	DigestsSent  map[string]time.Time         `json:"digests_sent"`
+	Blocks       map[string][]string          `json:"blocks"` // blocker -> blocked
+	QuotedBy     []backlink                   `json:"quoted_by"`
+	ChannelHolds map[string]legalHold         `json:"channel_holds"`
+	UserHolds    map[string]legalHold         `json:"user_holds"`
+	Features     map[string]bool              `json:"features"` // switched away from the default
+	Templates    []channelTemplate            `json:"templates"`
+	Incidents    []incident                   `json:"incidents"`
+}
+
+// storedIntegration keeps the secret, which the API never shows again
+type storedIntegration struct {
+	integration
+	Secret string `json:"secret"`
+}
+
+// globalEntry is a change of a single entry of globalState, what the log
+// records instead of the whole of it. Set is the field by its JSON name, Key
+// the entry, a map key or the entryKey of a list element. The entries of maps
+// of maps are keyed "outer/inner", see markerEntry. Without a Value the entry
+// is removed, without a Key the whole set is emptied
+type globalEntry struct {
+	Set   string          `json:"set"`
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// keyed are the elements of the lists of globalState
+type keyed interface {
+	entryKey() string
+}
+
+func (s session) entryKey() string           { return s.Token }
+func (g guest) entryKey() string             { return g.Username }
+func (inv invite) entryKey() string          { return inv.Token }
+func (s storedIntegration) entryKey() string { return s.Id }
+func (s storedWebhook) entryKey() string     { return s.Id }
+func (rem reminder) entryKey() string        { return rem.Id }
+func (d draft) entryKey() string             { return draftEntry(d.Username, d.Channel, d.ThreadID) }
+func (b backlink) entryKey() string          { return backlinkEntry(b.Quoted, b.Quoting) }
+func (t channelTemplate) entryKey() string   { return t.Name }
+func (inc incident) entryKey() string        { return strconv.Itoa(inc.Id) }
+
+func draftEntry(username, channel string, threadID int) string {
+	return username + "/" + channel + "/" + strconv.Itoa(threadID)
+}
+
+// markerEntry is the read marker of username in channel. Channel names have
+// no slash, usernames may
+func markerEntry(username, channel string) string {
+	return username + "/" + channel
+}
+
+func backlinkEntry(quoted, quoting messageRef) string {
+	return fmt.Sprintf("%s/%d>%s/%d", quoted.Channel, quoted.Id, quoting.Channel, quoting.Id)
+}
+
+// the fields of globalState by their JSON names
+var globalSets = func() map[string]int {
+	sets := make(map[string]int)
+	t := reflect.TypeOf(globalState{})
+	for i := 0; i < t.NumField(); i++ {
+		sets[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	return sets
+}()
+
+// value decodes the Value of e as a t, invalid for none
+func (e globalEntry) value(t reflect.Type) (reflect.Value, error) {
+	if e.Value == nil {
+		return reflect.Value{}, nil
+	}
+	value := reflect.New(t)
+	if err := json.Unmarshal(e.Value, value.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("%s %s: %v", e.Set, e.Key, err)
+	}
+	return value.Elem(), nil
+}
+
+// apply makes the change of e
+func (g *globalState) apply(e globalEntry) error {
+	i, ok := globalSets[e.Set]
+	if !ok {
+		return errors.New("no such global set " + e.Set)
+	}
+	set := reflect.ValueOf(g).Elem().Field(i)
+	if e.Key == "" {
+		set.Set(reflect.Zero(set.Type()))
+		return nil
+	}
+	if set.Kind() == reflect.Map && set.Type().Elem().Kind() == reflect.Map {
+		if set.IsNil() {
+			set.Set(reflect.MakeMap(set.Type()))
+		}
+		cut := strings.LastIndex(e.Key, "/")
+		if cut < 0 {
+			return fmt.Errorf("%s %s: not an outer/inner key", e.Set, e.Key)
+		}
+		outer, inner := reflect.ValueOf(e.Key[:cut]), e.Key[cut+1:]
+		entries := set.MapIndex(outer)
+		if !entries.IsValid() {
+			entries = reflect.MakeMap(set.Type().Elem())
+			set.SetMapIndex(outer, entries)
+		}
+		value, err := e.value(entries.Type().Elem())
+		if err != nil {
+			return err
+		}
+		entries.SetMapIndex(reflect.ValueOf(inner), value)
+		if entries.Len() == 0 {
+			set.SetMapIndex(outer, reflect.Value{})
+		}
+		return nil
+	}
+	value, err := e.value(set.Type().Elem())
+	if err != nil {
+		return err
+	}
+	if set.Kind() == reflect.Map {
+		if set.IsNil() {
+			set.Set(reflect.MakeMap(set.Type()))
+		}
+		set.SetMapIndex(reflect.ValueOf(e.Key), value)
+		return nil
+	}
+	kept := reflect.MakeSlice(set.Type(), 0, set.Len()+1)
+	for j := 0; j < set.Len(); j++ {
+		if set.Index(j).Interface().(keyed).entryKey() != e.Key {
+			kept = reflect.Append(kept, set.Index(j))
+		}
+	}
+	if value.IsValid() {
+		kept = reflect.Append(kept, value)
+	}
+	set.Set(kept)
+	return nil
+}
+
+// snapshot is the channel settings together with all of its messages. Caller
+// must hold the subject lock
+func (s *subject) snapshot() archivedChannel {
+	a := s.settings()
+	for _, mesg := range s.all() {
+		a.Messages = append(a.Messages, storeMessage(mesg))
+	}
+	return a
+}
+
+func restoreSnapshot(a archivedChannel) *subject {
+	s := restoreSettings(a)
+	for _, sp := range a.Messages {
+		s.Messages = append(s.Messages, sp.message())
+	}
+	return s
+}
+
+func takeBackup() backup {
+	b := backup{
+		Version:  backupVersion,
+		Node:     nodeID,
+		Channels: []archivedChannel{},
+	}
+	for _, subject := range allSubjects() {
+		subject.RLock()
+		b.Channels = append(b.Channels, subject.snapshot())
+		subject.RUnlock()
+	}
+	b.Channels = append(b.Channels, archivedSnapshots()...)
+	b.globalState = takeGlobals()
+	b.TakenAt = time.Now()
+	return b
+}
+
+func takeGlobals() globalState {
+	g := globalState{
+		Claims:       make(map[string]string),
+		Guests:       []guest{},
+		Invites:      []invite{},
+		Aliases:      make(map[string]string),
+		Integrations: []storedIntegration{},
+		Reminders:    []reminder{},
+		Drafts:       []draft{},
+		ReadMarkers:  make(map[string]map[string]int),
+		Preferences:  make(map[string]notificationPrefs),
+		Devices:      make(map[string][]device),
+		DigestsSent:  make(map[string]time.Time),
+		Blocks:       make(map[string][]string),
+		QuotedBy:     []backlink{},
+		ChannelHolds: make(map[string]legalHold),
+		UserHolds:    make(map[string]legalHold),
+		Features:     make(map[string]bool),
+		Templates:    []channelTemplate{},
+		Incidents:    []incident{},
+	}
+	claimsMutex.RLock()
+	for username, token := range claims {
+		g.Claims[username] = token
+	}
+	claimsMutex.RUnlock()
+	g.Passwords, g.Sessions = takeUsers()
+	guestsMutex.Lock()
+	for _, guest := range guests {
+		g.Guests = append(g.Guests, *guest)
+	}
+	guestsMutex.Unlock()
+	invitesMutex.Lock()
+	for _, inv := range invites {
+		g.Invites = append(g.Invites, *inv)
+	}
+	invitesMutex.Unlock()
+	aliasesMutex.RLock()
+	for alias, channel := range aliases {
+		g.Aliases[alias] = channel
+	}
+	aliasesMutex.RUnlock()
+	integrationsMutex.Lock()
+	for _, hook := range integrations {
+		g.Integrations = append(g.Integrations, storedIntegration{integration: *hook, Secret: hook.secret})
+	}
+	integrationsMutex.Unlock()
+	g.Webhooks = takeWebhooks()
+	g.Reminders = takeReminders()
+	draftsMutex.Lock()
+	for _, mine := range drafts {
+		for _, d := range mine {
+			g.Drafts = append(g.Drafts, *d)
+		}
+	}
+	draftsMutex.Unlock()
+	markersMutex.Lock()
+	for username, markers := range readMarkers {
+		g.ReadMarkers[username] = make(map[string]int, len(markers))
+		for channel, lastRead := range markers {
+			g.ReadMarkers[username][channel] = lastRead
+		}
+	}
+	markersMutex.Unlock()
+	prefsMutex.Lock()
+	for username, p := range preferences {
+		g.Preferences[username] = p
+	}
+	prefsMutex.Unlock()
+	devicesMutex.Lock()
+	for username, list := range devices {
+		for _, d := range list {
+			g.Devices[username] = append(g.Devices[username], *d)
+		}
+	}
+	devicesMutex.Unlock()
+	digestsMutex.Lock()
+	for username, sent := range digestsSent {
+		g.DigestsSent[username] = sent
+	}
+	digestsMutex.Unlock()
+	blocksMutex.RLock()
+	for username, blocked := range blocks {
+		for name := range blocked {
+			g.Blocks[username] = append(g.Blocks[username], name)
+		}
+	}
+	blocksMutex.RUnlock()
+	quotesMutex.Lock()
+	for quoted, refs := range quotedBy {
+		for _, quoting := range refs {
+			g.QuotedBy = append(g.QuotedBy, backlink{quoted, quoting})
+		}
+	}
+	quotesMutex.Unlock()
+	holdsMutex.RLock()
+	for channel, hold := range channelHolds {
+		g.ChannelHolds[channel] = hold
+	}
+	for username, hold := range userHolds {
+		g.UserHolds[username] = hold
+	}
+	holdsMutex.RUnlock()
+	featuresMutex.RLock()
+	for name, enabled := range featureOverrides {
+		g.Features[name] = enabled
+	}
+	featuresMutex.RUnlock()
+	templatesMutex.RLock()
+	for _, t := range templates {
+		g.Templates = append(g.Templates, t)
+	}
+	templatesMutex.RUnlock()
+	incidentsMutex.Lock()
+	for _, inc := range incidents {
+		g.Incidents = append(g.Incidents, inc.copied())
+	}
+	incidentsMutex.Unlock()
+	return g
+}
+
+// restoreBackup replaces the whole state of the node with the backup. Open
+// streams are drained since what they were following is gone
+func restoreBackup(b backup) error {
+	if err := installBackup(b, false); err != nil {
+		return err
+	}
+	drainAll("restored")
+	// the log can not explain how the node got here, a fresh snapshot can.
+	// Mirrors start over
+	appendWAL(walRecord{Kind: "restored"})
+	storeBackup(takeBackup())
+	takeSnapshot(time.Now())
+	return nil
+}
+
+// installBackup swaps the state of the node for the backup and nothing else.
+// keepArchives is for startup, the channels archived on disk stay there
+// instead of being replaced
+func installBackup(b backup, keepArchives bool) error {
+	if b.Version != backupVersion {
+		return fmt.Errorf("backup version %d is not supported", b.Version)
+	}
+	if keepArchives {
+		leaveArchived(&b)
+	}
+	subjects := make(map[string]*subject, len(b.Channels))
+	for _, a := range b.Channels {
+		subjects[a.Title] = restoreSnapshot(a)
+	}
+
+	// holding rehydrateMutex keeps archived channels from coming back meanwhile
+	rehydrateMutex.Lock()
+	if !keepArchives {
+		dropArchives()
+	}
+	globalMapMutex.Lock()
+	old := liveMessages
+	liveMessages = subjects
+	globalMapMutex.Unlock()
+	rehydrateMutex.Unlock()
+	for _, subject := range old {
+		subject.Lock()
+		for _, block := range subject.cold {
+			block.discard()
+		}
+		subject.Unlock()
+	}
+
+	restoreGlobals(b.globalState)
+	return nil
+}
+
+func restoreGlobals(g globalState) {
+	claimsMutex.Lock()
+	claims = make(map[string]string)
+	claimTokens = make(map[string]string)
+	claimSkeletons = make(map[string]string)
+	for username, token := range g.Claims {
+		claims[username] = token
+		claimTokens[token] = username
+		claimSkeletons[skeleton(username)] = username
+	}
+	claimsMutex.Unlock()
+	restoreUsers(g.Passwords, g.Sessions)
+	guestsMutex.Lock()
+	guests = make(map[string]*guest)
+	for i := range g.Guests {
+		guests[g.Guests[i].Username] = &g.Guests[i]
+	}
+	guestsMutex.Unlock()
+	invitesMutex.Lock()
+	invites = make(map[string]*invite)
+	for i := range g.Invites {
+		invites[g.Invites[i].Token] = &g.Invites[i]
+	}
+	invitesMutex.Unlock()
+	aliasesMutex.Lock()
+	aliases = make(map[string]string)
+	for alias, channel := range g.Aliases {
+		aliases[alias] = channel
+	}
+	aliasesMutex.Unlock()
+	integrationsMutex.Lock()
+	integrations = make(map[string]*integration)
+	for _, stored := range g.Integrations {
+		hook := stored.integration
+		hook.secret = stored.Secret
+		if hook.Auth == "" {
+			hook.Auth = "signature"
+		}
+		integrations[hook.Id] = &hook
+	}
+	integrationsMutex.Unlock()
+	restoreWebhooks(g.Webhooks)
+	restoreReminders(g.Reminders)
+	draftsMutex.Lock()
+	drafts = make(map[string]map[draftKey]*draft)
+	for i := range g.Drafts {
+		d := &g.Drafts[i]
+		if drafts[d.Username] == nil {
+			drafts[d.Username] = make(map[draftKey]*draft)
+		}
+		drafts[d.Username][draftKey{d.Channel, d.ThreadID}] = d
+	}
+	draftsMutex.Unlock()
+	markersMutex.Lock()
+	readMarkers = make(map[string]map[string]int)
+	for username, markers := range g.ReadMarkers {
+		readMarkers[username] = make(map[string]int, len(markers))
+		for channel, lastRead := range markers {
+			readMarkers[username][channel] = lastRead
+		}
+	}
+	markersMutex.Unlock()
+	prefsMutex.Lock()
+	preferences = make(map[string]notificationPrefs)
+	for username, p := range g.Preferences {
+		preferences[username] = p
+	}
+	prefsMutex.Unlock()
+	devicesMutex.Lock()
+	devices = make(map[string][]*device)
+	for username, list := range g.Devices {
+		for i := range list {
+			devices[username] = append(devices[username], &list[i])
+		}
+	}
+	devicesMutex.Unlock()
+	digestsMutex.Lock()
+	digestsSent = make(map[string]time.Time)
+	for username, sent := range g.DigestsSent {
+		digestsSent[username] = sent
+	}
+	digestsMutex.Unlock()
+	blocksMutex.Lock()
+	blocks = make(map[string]map[string]bool)
+	for username, blocked := range g.Blocks {
+		blocks[username] = make(map[string]bool, len(blocked))
+		for _, name := range blocked {
+			blocks[username][name] = true
+		}
+	}
+	blocksMutex.Unlock()
+	quotesMutex.Lock()
+	quotedBy = make(map[messageRef][]messageRef)
+	for _, link := range g.QuotedBy {
+		quotedBy[link.Quoted] = append(quotedBy[link.Quoted], link.Quoting)
+	}
+	quotesMutex.Unlock()
+	holdsMutex.Lock()
+	channelHolds = make(map[string]legalHold)
+	for channel, hold := range g.ChannelHolds {
+		channelHolds[channel] = hold
+	}
+	userHolds = make(map[string]legalHold)
+	for username, hold := range g.UserHolds {
+		userHolds[username] = hold
+	}
+	holdsMutex.Unlock()
+	featuresMutex.Lock()
+	featureOverrides = make(map[string]bool)
+	for name, enabled := range g.Features {
+		featureOverrides[name] = enabled
+	}
+	featuresMutex.Unlock()
+	templatesMutex.Lock()
+	templates = make(map[string]channelTemplate)
+	for _, t := range g.Templates {
+		templates[t.Name] = t
+	}
+	templatesMutex.Unlock()
+	incidentsMutex.Lock()
+	incidents = make(map[int]*incident)
+	lastIncidentID = 0
+	for i := range g.Incidents {
+		inc := &g.Incidents[i]
+		incidents[inc.Id] = inc
+		if inc.Id > lastIncidentID {
+			lastIncidentID = inc.Id
+		}
+	}
+	incidentsMutex.Unlock()
+}
+
+// With as_of the backup is the state the node had back then, see stateAsOf
+// curl http://localhost:8000/admin/backup -H 'X-Admin-Token: secret' -o backup.json.gz
+func getBackup(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	b := backup{}
+	if r.URL.Query().Get("as_of") == "" {
+		b = takeBackup()
+	} else {
+		asOf, err := parseAsOf(r)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if b, _, _, err = stateAsOf(asOf); err != nil {
+			respondJSON(w, http.StatusConflict, err.Error())
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=backup-"+b.TakenAt.UTC().Format("20060102T150405Z")+".json.gz")
+	zw := gzip.NewWriter(w)
+	json.NewEncoder(zw).Encode(b)
+	zw.Close()
+}
+
+// A backup written by POST /admin/backup is named with file instead of uploaded
+// curl -X POST http://localhost:8000/admin/restore -H 'X-Admin-Token: secret' --data-binary @backup.json.gz
+// curl -X POST 'http://localhost:8000/admin/restore?file=backup-20261015T150405Z.tar.gz' -H 'X-Admin-Token: secret'
+func postRestore(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	defer r.Body.Close()
+	in := io.Reader(r.Body)
+	if file := r.URL.Query().Get("file"); file != "" {
+		if file != filepath.Base(file) || strings.HasPrefix(file, ".") {
+			respondJSON(w, http.StatusBadRequest, "file should name a backup in the backup directory")
+			return
+		}
+		f, err := os.Open(filepath.Join(backupDir, file))
+		if err != nil {
+			respondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		defer f.Close()
+		in = f
+	}
+	b, err := readBackup(in)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := restoreBackup(b); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"taken_at": b.TakenAt, "channels": len(b.Channels)})
+}
+
+// adminCommand implements the backup, restore, recover and promote
+// subcommands, thin clients of the admin endpoints of a running node
+func adminCommand(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	server := flags.String("server", "http://localhost:8000", "base URL of the node")
+	token := flags.String("admin-token", "", "admin token of the node")
+	var file, asOf *string
+	switch command {
+	case "backup":
+		file = flags.String("o", "backup.json.gz", "backup file to write")
+		asOf = flags.String("as-of", "", "back up the state at this RFC 3339 time instead of the current one")
+	case "restore":
+		file = flags.String("i", "backup.json.gz", "backup file to read")
+	case "recover":
+		asOf = flags.String("as-of", "", "RFC 3339 time to bring the node back to")
+	}
+	flags.Parse(args)
+
+	client := &http.Client{}
+	var req *http.Request
+	var err error
+	switch command {
+	case "backup":
+		req, err = http.NewRequest("GET", *server+"/admin/backup?as_of="+url.QueryEscape(*asOf), nil)
+	case "recover":
+		req, err = http.NewRequest("POST", *server+"/admin/recover?as_of="+url.QueryEscape(*asOf), nil)
+	case "promote":
+		req, err = http.NewRequest("POST", *server+"/admin/promote", nil)
+	default:
+		in, openErr := os.Open(*file)
+		if openErr != nil {
+			return openErr
+		}
+		defer in.Close()
+		req, err = http.NewRequest("POST", *server+"/admin/restore", in)
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Admin-Token", *token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(resp.Status + ": " + string(msg))
+	}
+	if command != "backup" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	out, err := os.Create(*file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return err
+	}
+	fmt.Println("Backup written to", *file)
+	return out.Close()
+}
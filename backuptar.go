@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// POST /admin/backup writes the backup to a tar.gz in -backup-dir on the node
+// instead of sending it, for backups taken by cron next to the data:
+//
+//	manifest.json         version, taken_at and node
+//	globals.json          the state kept outside channels
+//	channels/{name}.json  a channel with its messages, one file each
+//
+// Channels are snapshotted and written one at a time, only the channel being
+// copied is locked. POST /admin/restore takes these as well as the gzipped
+// JSON of GET /admin/backup, uploaded or named with ?file= in -backup-dir
+var backupDir = "backups"
+
+type backupManifest struct {
+	Version int       `json:"version"`
+	TakenAt time.Time `json:"taken_at"`
+	Node    string    `json:"node"`
+}
+
+func writeTarEntry(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// writeBackupTar writes every channel and the global state to path, the file
+// shows up complete or not at all. Returns how many channels went in
+func writeBackupTar(path string) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	channels := 0
+	err = writeTarEntry(tw, "manifest.json", backupManifest{Version: backupVersion, TakenAt: time.Now(), Node: nodeID})
+	for _, subject := range allSubjects() {
+		if err != nil {
+			break
+		}
+		subject.RLock()
+		a := subject.snapshot()
+		subject.RUnlock()
+		err = writeTarEntry(tw, "channels/"+a.Title+".json", a)
+		channels++
+	}
+	if err == nil {
+		for _, a := range archivedSnapshots() {
+			if err = writeTarEntry(tw, "channels/"+a.Title+".json", a); err != nil {
+				break
+			}
+			channels++
+		}
+	}
+	if err == nil {
+		err = writeTarEntry(tw, "globals.json", takeGlobals())
+	}
+	for _, closer := range []io.Closer{tw, zw} {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return channels, os.Rename(tmp, path)
+}
+
+// readBackup reads a gzipped backup, a tar of POST /admin/backup or the JSON
+// of GET /admin/backup
+func readBackup(r io.Reader) (backup, error) {
+	b := backup{}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return b, err
+	}
+	br := bufio.NewReader(zr)
+	if start, err := br.Peek(1); err == nil && start[0] == '{' {
+		err = json.NewDecoder(br).Decode(&b)
+		return b, err
+	}
+
+	manifest, globals := false, false
+	tr := tar.NewReader(br)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return b, err
+		}
+		decoder := json.NewDecoder(tr)
+		switch {
+		case header.Name == "manifest.json":
+			m := backupManifest{}
+			if err := decoder.Decode(&m); err != nil {
+				return b, fmt.Errorf("%s: %v", header.Name, err)
+			}
+			b.Version, b.TakenAt, b.Node = m.Version, m.TakenAt, m.Node
+			manifest = true
+		case header.Name == "globals.json":
+			if err := decoder.Decode(&b.globalState); err != nil {
+				return b, fmt.Errorf("%s: %v", header.Name, err)
+			}
+			globals = true
+		case strings.HasPrefix(header.Name, "channels/"):
+			a := archivedChannel{}
+			if err := decoder.Decode(&a); err != nil {
+				return b, fmt.Errorf("%s: %v", header.Name, err)
+			}
+			b.Channels = append(b.Channels, a)
+		}
+	}
+	if !manifest || !globals {
+		return b, errors.New("not a backup, manifest.json or globals.json is missing")
+	}
+	return b, nil
+}
+
+// curl -X POST http://localhost:8000/admin/backup -H 'X-Admin-Token: secret'
+func postBackup(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	start := time.Now()
+	path := filepath.Join(backupDir, "backup-"+start.UTC().Format("20060102T150405Z")+".tar.gz")
+	channels, err := writeBackupTar(path)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Writing the backup failed: "+err.Error())
+		return
+	}
+	toS3(path, "backups/"+filepath.Base(path))
+	audit(auditEntry{Actor: actor(r), Action: "backup_written", Data: map[string]interface{}{"path": path, "channels": channels}})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"path": path, "channels": channels, "duration_ns": time.Since(start)})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// A user can block others: their messages, replies and reactions disappear
+// from what the blocker lists and streams, and their mentions no longer notify
+// the blocker. The blocked user is not told. What the blocker reads is
+// filtered by their reader, see readaccess.go
+const maxBlocks = 1000
+
+var blocksMutex sync.RWMutex
+var blocks = make(map[string]map[string]bool) // blocker -> blocked
+
+// logBlocks records who username blocks now. Caller must hold blocksMutex
+func logBlocks(username string) {
+	if len(blocks[username]) == 0 {
+		logGlobal("blocks_changed", "blocks", username, nil)
+		return
+	}
+	blocked := []string{}
+	for name := range blocks[username] {
+		blocked = append(blocked, name)
+	}
+	logGlobal("blocks_changed", "blocks", username, blocked)
+}
+
+// blockedBy returns who username blocked, nil for nobody
+func blockedBy(username string) map[string]bool {
+	blocksMutex.RLock()
+	defer blocksMutex.RUnlock()
+	if len(blocks[username]) == 0 {
+		return nil
+	}
+	blocked := make(map[string]bool, len(blocks[username]))
+	for name := range blocks[username] {
+		blocked[name] = true
+	}
+	return blocked
+}
+
+func hasBlocked(username, author string) bool {
+	blocksMutex.RLock()
+	defer blocksMutex.RUnlock()
+	return blocks[username][author]
+}
+
+// curl -X GET http://localhost:8000/blocks -H 'Authorization: Bearer <token>' -v
+func getBlocks(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Blocking needs a registered username or a guest token")
+		return
+	}
+	list := []string{}
+	for name := range blockedBy(username) {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	respondJSON(w, http.StatusOK, map[string][]string{"blocked": list})
+}
+
+// curl -X PUT http://localhost:8000/blocks/sandy -H 'Authorization: Bearer <token>' -v
+func putBlock(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	blocked := normalizeUsername(vars["username"])
+
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Blocking needs a registered username or a guest token")
+		return
+	}
+	if blocked == "" || blocked == username {
+		respondJSON(w, http.StatusBadRequest, "Can not block this username")
+		return
+	}
+	blocksMutex.Lock()
+	if blocks[username] == nil {
+		blocks[username] = make(map[string]bool)
+	}
+	if !blocks[username][blocked] && len(blocks[username]) >= maxBlocks {
+		blocksMutex.Unlock()
+		respondJSON(w, http.StatusForbidden, "Too many blocked users")
+		return
+	}
+	blocks[username][blocked] = true
+	logBlocks(username)
+	blocksMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string]string{"blocked": blocked})
+}
+
+// curl -X DELETE http://localhost:8000/blocks/sandy -H 'Authorization: Bearer <token>' -v
+func deleteBlock(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	blocked := normalizeUsername(vars["username"])
+
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Blocking needs a registered username or a guest token")
+		return
+	}
+	blocksMutex.Lock()
+	found := blocks[username][blocked]
+	delete(blocks[username], blocked)
+	if len(blocks[username]) == 0 {
+		delete(blocks, username)
+	}
+	if found {
+		logBlocks(username)
+	}
+	blocksMutex.Unlock()
+	if !found {
+		respondJSON(w, http.StatusNotFound, "This username is not blocked")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"unblocked": blocked})
+}
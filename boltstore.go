@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Embedded key value storage, durable without a database server or SQL:
+//
+//	messaging-service -storage bolt -db ./messages.bolt
+//
+// The settings of every channel are in the bucket channels by name, the
+// messages with their threads in the bucket messages keyed channel/seq, the
+// id zero padded so a channel is one run of keys in id order. The state kept
+// outside channels is the one key of globals, the entries changed since it was
+// written are in global_entries keyed set/entry. Each record is one bbolt
+// transaction.
+//
+// By default a record is on disk before the change is acknowledged.
+// -db-sync-interval batches the fsyncs instead, a crash loses at most that
+// long of changes. The file is locked, only one node opens it at a time
+var dbSyncInterval time.Duration
+
+var boltChannels = []byte("channels")
+var boltMessages = []byte("messages")
+var boltGlobals = []byte("globals")
+var boltEntries = []byte("global_entries")
+var boltStateKey = []byte("state")
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBolt(path string) (*boltStore, error) {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, errors.New(path + " is open in another process")
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltChannels, boltMessages, boltGlobals, boltEntries} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	if dbSyncInterval > 0 {
+		bdb.NoSync = true
+		go func() {
+			for range time.Tick(dbSyncInterval) {
+				if err := bdb.Sync(); err != nil {
+					fmt.Println("Syncing", path, "failed:", err)
+				}
+			}
+		}()
+	}
+	return &boltStore{db: bdb}, nil
+}
+
+// close syncs whatever the batching left behind
+func (bs *boltStore) close() error {
+	if err := bs.db.Sync(); err != nil {
+		return err
+	}
+	return bs.db.Close()
+}
+
+func messagePrefix(channel string) []byte {
+	return []byte(channel + "/")
+}
+
+func messageKey(channel string, id int) []byte {
+	return []byte(fmt.Sprintf("%s/%010d", channel, id))
+}
+
+// channelKeys are the keys of the messages of channel, those below before only
+// unless it is 0
+func channelKeys(messages *bolt.Bucket, channel string, before int) [][]byte {
+	prefix := messagePrefix(channel)
+	keys := [][]byte{}
+	c := messages.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if before > 0 {
+			if id, _ := strconv.Atoi(string(k[len(prefix):])); id >= before {
+				break
+			}
+		}
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return keys
+}
+
+func (bs *boltStore) load() (backup, error) {
+	b := backup{Version: backupVersion, TakenAt: time.Now(), Node: nodeID, Channels: []archivedChannel{}}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(boltMessages)
+		err := tx.Bucket(boltChannels).ForEach(func(name, settings []byte) error {
+			a := archivedChannel{}
+			if err := json.Unmarshal(settings, &a); err != nil {
+				return fmt.Errorf("channel %s: %v", name, err)
+			}
+			prefix := messagePrefix(string(name))
+			c := messages.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				sp := storedPost{}
+				if err := json.Unmarshal(v, &sp); err != nil {
+					return fmt.Errorf("message %s: %v", k, err)
+				}
+				a.upsert(sp)
+			}
+			b.Channels = append(b.Channels, a)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if state := tx.Bucket(boltGlobals).Get(boltStateKey); state != nil {
+			if err := json.Unmarshal(state, &b.globalState); err != nil {
+				return err
+			}
+		}
+		entries := []globalEntry{}
+		err = tx.Bucket(boltEntries).ForEach(func(k, v []byte) error {
+			key := strings.SplitN(string(k), "/", 2)
+			entries = append(entries, globalEntry{Set: key[0], Key: key[1], Value: storedValue(string(v))})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return b.globalState.applyEntries(entries)
+	})
+	sort.Slice(b.Channels, func(i, j int) bool { return b.Channels[i].Title < b.Channels[j].Title })
+	return b, err
+}
+
+// bbolt can not be interrupted, a batch is only given up before it starts
+func (bs *boltStore) apply(ctx context.Context, records []walRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, rec := range records {
+			if err := boltChange(tx, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func boltChange(tx *bolt.Tx, rec walRecord) error {
+	channels, messages := tx.Bucket(boltChannels), tx.Bucket(boltMessages)
+	channel := rec.Channel
+	switch rec.Kind {
+	case "message":
+		return putMessage(messages, channel, *rec.Message)
+	case "removed":
+		for _, id := range rec.Removed {
+			if err := messages.Delete(messageKey(channel, id)); err != nil {
+				return err
+			}
+		}
+		if rec.Before > 0 {
+			return deleteKeys(messages, channelKeys(messages, channel, rec.Before))
+		}
+	case "settings":
+		return putSettings(channels, *rec.Settings)
+	case "channel":
+		if err := deleteKeys(messages, channelKeys(messages, channel, 0)); err != nil {
+			return err
+		}
+		if err := putSettings(channels, *rec.Settings); err != nil {
+			return err
+		}
+		for _, sp := range rec.Settings.Messages {
+			if err := putMessage(messages, channel, sp); err != nil {
+				return err
+			}
+		}
+	case "dropped":
+		if err := deleteKeys(messages, channelKeys(messages, channel, 0)); err != nil {
+			return err
+		}
+		return channels.Delete([]byte(channel))
+	case "global":
+		entries := tx.Bucket(boltEntries)
+		prefix := []byte(rec.Global.Set + "/")
+		if rec.Global.Key == "" {
+			keys := [][]byte{}
+			c := entries.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			if err := deleteKeys(entries, keys); err != nil {
+				return err
+			}
+		}
+		return entries.Put(append(prefix, rec.Global.Key...), []byte(rec.Global.Value))
+	case "globals":
+		state, err := json.Marshal(rec.Globals)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(boltEntries); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(boltEntries); err != nil {
+			return err
+		}
+		return tx.Bucket(boltGlobals).Put(boltStateKey, state)
+	case "restored":
+		// restoreBackup writes the new state right after
+		for _, name := range [][]byte{boltChannels, boltMessages, boltGlobals, boltEntries} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unknown record kind " + rec.Kind)
+	}
+	return nil
+}
+
+func deleteKeys(bucket *bolt.Bucket, keys [][]byte) error {
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putSettings(channels *bolt.Bucket, a archivedChannel) error {
+	a.Messages = nil
+	settings, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return channels.Put([]byte(a.Title), settings)
+}
+
+func putMessage(messages *bolt.Bucket, channel string, sp storedPost) error {
+	body, err := json.Marshal(sp)
+	if err != nil {
+		return err
+	}
+	return messages.Put(messageKey(channel, sp.Id), body)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The broker is the one path events take from the handlers causing them to
+// whatever consumes them. Handlers publish into it, /events, /ws, the thread
+// and sync streams and the firehose subscribe to it, and consumers inside the
+// node, like the SIEM forwarding, register a handler with it. A new consumer
+// subscribes like the others instead of being called from the handlers.
+//
+// Events published to a channel reach its subscribers and the subscribers of
+// allChannels. Events published to a userChannel are meant for that user alone
+// and never reach allChannels
+type eventBroker struct {
+	sync.RWMutex
+	listeners map[string]map[listener]filter
+	handlers  map[string][]func(event)
+	published int64
+	dropped   int64 // events a full listener missed
+}
+
+// listener receives events for a single channel. Buffered so a slow reader does
+// not hold the publisher (which is usually inside the channel critical region)
+type listener chan event
+
+const listenerBuffer = 64
+
+// filter decides whether a listener wants an event, nil wants everything
+type filter func(event) bool
+
+var broker = &eventBroker{listeners: make(map[string]map[listener]filter), handlers: make(map[string][]func(event))}
+
+// Publish fans ev out and never blocks: a listener whose buffer is full misses
+// the event rather than stalling every poster on the channel
+func (b *eventBroker) Publish(channel string, ev event) {
+	atomic.AddInt64(&b.published, 1)
+	if slaTarget > 0 && ev.PublishedUS == 0 {
+		ev.PublishedUS = nowMicros()
+	}
+	keys := []string{channel}
+	if !strings.HasPrefix(channel, userChannel("")) {
+		keys = append(keys, allChannels)
+	}
+	b.RLock()
+	defer b.RUnlock()
+	for _, key := range keys {
+		for _, handle := range b.handlers[key] {
+			handle(ev)
+		}
+		for l, keep := range b.listeners[key] {
+			if keep != nil && !keep(ev) {
+				continue
+			}
+			select {
+			case l <- ev:
+			default:
+				atomic.AddInt64(&b.dropped, 1)
+			}
+		}
+	}
+}
+
+// Subscribe listens on the channel until Unsubscribe. keep is evaluated by the
+// publisher so events nobody asked for never take buffer space or bandwidth
+func (b *eventBroker) Subscribe(channel string, keep filter) listener {
+	l := make(listener, listenerBuffer)
+	b.Lock()
+	defer b.Unlock()
+	if b.listeners[channel] == nil {
+		b.listeners[channel] = make(map[listener]filter)
+	}
+	b.listeners[channel][l] = keep
+	return l
+}
+
+func (b *eventBroker) Unsubscribe(channel string, l listener) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.listeners[channel], l)
+	if len(b.listeners[channel]) == 0 {
+		delete(b.listeners, channel)
+	}
+}
+
+// Handle calls handle with every event of the channel for as long as the node
+// runs. It is called by the publisher, often inside the channel critical
+// region, and has to return right away
+func (b *eventBroker) Handle(channel string, handle func(event)) {
+	b.Lock()
+	defer b.Unlock()
+	b.handlers[channel] = append(b.handlers[channel], handle)
+}
+
+// backedUp counts the listeners and those with at least share of their
+// buffer taken
+func (b *eventBroker) backedUp(share float64) (total, full int) {
+	b.RLock()
+	defer b.RUnlock()
+	for _, channel := range b.listeners {
+		for l := range channel {
+			total++
+			if float64(len(l)) >= share*float64(cap(l)) {
+				full++
+			}
+		}
+	}
+	return total, full
+}
+
+// publish is the short way for handlers to publish an event about channel
+func publish(channel, kind string, data interface{}) {
+	broker.Publish(channel, event{Type: kind, Channel: channel, Data: data})
+}
+
+// notifyUser sends an event about channel to the sync streams of username
+// only, it is nobody else's business
+func notifyUser(username, channel, kind string, data interface{}) {
+	broker.Publish(userChannel(username), event{Type: kind, Channel: channel, Data: data})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// apiVersions are the versions of the HTTP API this build speaks, a client
+// should check for the one it was written against
+var apiVersions = []string{"1"}
+
+const serviceVersion = "0.01"
+
+type streamKind struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Admin  bool   `json:"admin,omitempty"`
+}
+
+// What this node offers, so clients of different ages can adapt: the API
+// versions, the features switched on, how streams are served, how requests
+// authenticate and the limits posts run into. Limits of 0 are unlimited
+// curl -X GET http://localhost:8000/capabilities
+func getCapabilities(w http.ResponseWriter, r *http.Request) {
+	auth := []string{"username", "claim_token", "session_token"}
+	if featureEnabled("guests") {
+		auth = append(auth, "guest_token")
+	}
+	if featureEnabled("integrations") {
+		auth = append(auth, "webhook_signature")
+	}
+	if adminToken != "" {
+		auth = append(auth, "admin_token")
+	}
+	streams := []streamKind{}
+	if featureEnabled("streams") {
+		streams = append(streams,
+			streamKind{Path: "/{channel}/events", Format: "ndjson"},
+			streamKind{Path: "/{channel}/ws", Format: "websocket"},
+			streamKind{Path: "/{channel}/thread/{message_id}/events", Format: "ndjson"},
+			streamKind{Path: "/sync/events", Format: "ndjson"},
+		)
+		if grpcPort != "" {
+			streams = append(streams, streamKind{Path: "/messaging.Messaging/Subscribe", Format: "grpc"})
+		}
+	}
+	if cdcBacklog > 0 {
+		streams = append(streams, streamKind{Path: "/cdc", Format: "ndjson", Admin: true})
+	}
+	streams = append(streams, streamKind{Path: "/admin/firehose", Format: "ndjson", Admin: true})
+	// clients ack published_us while latency is measured, see sla.go
+	sla := ""
+	if slaTarget > 0 {
+		sla = slaTarget.String()
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"version":      serviceVersion,
+		"api_versions": apiVersions,
+		"features":     allFeatures(),
+		"streams":      streams,
+		"auth":         auth,
+		"push":         pushPlatforms(),
+		"sla":          sla,
+		"limits": map[string]interface{}{
+			"max_snippet_bytes":          maxSnippetSize,
+			"max_voice_note_bytes":       maxVoiceNoteSize,
+			"max_voice_note_ms":          maxVoiceNote / time.Millisecond,
+			"max_quote_length":           maxQuoteLength,
+			"max_draft_length":           maxDraftLength,
+			"max_location_label":         maxLocationLabel,
+			"max_emoji_length":           maxEmojiLength,
+			"max_webhook_body_bytes":     maxWebhookBody,
+			"max_channels":               maxChannels,
+			"max_channel_messages":       maxChannelMessages,
+			"channel_rate":               channelRate,
+			"channel_burst":              channelBurst,
+			"max_streams":                maxStreams,
+			"max_streams_per_client":     maxStreamsPerClient,
+			"max_streams_per_user":       maxStreamsPerUser,
+			"max_channel_subscribers":    maxChannelSubscribers,
+			"max_request_timeout_ms":     maxRequestTimeout / time.Millisecond,
+			"default_request_timeout_ms": requestTimeout / time.Millisecond,
+		},
+	})
+}
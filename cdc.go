@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// /cdc streams every change of the node in order, each numbered with an offset
+// that only grows, so external systems can keep derived views reliably:
+//
+//	{"offset": 42, "at": "2026-10-15T09:30:00Z", "type": "message_created", "channel": "foo", "data": {...}}
+//
+// A client that lost its stream comes back with ?after= the last offset it
+// handled, after=0 asks for everything still available. The newest
+// -cdc-backlog changes are kept in memory, older ones are read from the
+// write-ahead log when there is one (see wal.go). An offset that is in neither
+// is answered with 410 Gone, the view has to be rebuilt, from a backup for
+// instance. The types are
+//
+//	message_created, message_updated   data is the message
+//	message_deleted                    data has the message_ids
+//	messages_expired                   retention dropped every id below data.before_id
+//	channel_created, channel_updated, channel_replaced, membership_changed,
+//	roles_changed, message_queued, message_quarantined, message_approved,
+//	message_rejected, member_welcomed  data is the channel settings
+//	channel_closed                     the channel is gone
+//	restored                           the whole state was replaced, views have to be rebuilt
+//
+// Claims, guests, invites and integrations hold secrets and are left out
+var cdcBacklog = 10000
+
+type change struct {
+	Offset  int64       `json:"offset"`
+	At      time.Time   `json:"at"`
+	Type    string      `json:"type"`
+	Channel string      `json:"channel,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// changeOf is what /cdc shows of a record, false for records it leaves out
+func changeOf(rec walRecord) (change, bool) {
+	c := change{Offset: rec.Offset, At: rec.At, Type: rec.Change, Channel: rec.Channel}
+	switch rec.Kind {
+	case "message":
+		c.Data = rec.Message.msgPost
+		if c.Type == "" {
+			c.Type = "message_updated"
+		}
+	case "removed":
+		if rec.Before > 0 {
+			c.Type, c.Data = "messages_expired", map[string]int{"before_id": rec.Before}
+		} else {
+			c.Type, c.Data = "message_deleted", map[string][]int{"message_ids": rec.Removed}
+		}
+	case "settings":
+		c.Data = rec.Settings
+		if c.Type == "" {
+			c.Type = "channel_updated"
+		}
+	case "channel":
+		settings := *rec.Settings
+		settings.Messages = nil
+		c.Type, c.Data = "channel_replaced", settings
+	case "dropped":
+		c.Type = "channel_closed"
+	case "restored":
+		c.Type = "restored"
+	default:
+		return c, false
+	}
+	return c, true
+}
+
+// Takes after= the last offset handled and channel= to follow a single channel
+// curl -N 'http://localhost:8000/cdc?after=41' -H 'X-Admin-Token: secret'
+func streamCDC(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	if cdcBacklog <= 0 {
+		respondJSON(w, http.StatusNotFound, "Change data capture is off")
+		return
+	}
+	query := r.URL.Query()
+	// without after= the stream starts with the next change
+	after := int64(math.MaxInt64)
+	if query.Get("after") != "" {
+		var err error
+		if after, err = strconv.ParseInt(query.Get("after"), 10, 64); err != nil || after < 0 {
+			respondJSON(w, http.StatusBadRequest, "after should be an offset")
+			return
+		}
+	}
+	channel := ""
+	if query.Get("channel") != "" {
+		channel = resolveChannel(query.Get("channel"))
+	}
+
+	feed := make(chan walRecord, feedBuffer)
+	missed, newest := subscribe(feed, false, after)
+	defer unsubscribe(feed)
+	if after != math.MaxInt64 && after > newest {
+		respondJSON(w, http.StatusGone, map[string]interface{}{"error": "Offset is ahead of this node, it was restarted without a write-ahead log", "newest_offset": newest})
+		return
+	}
+	if len(missed) > 0 && missed[0].Offset > after+1 {
+		older, ok := readLog(after, missed[0].Offset)
+		if !ok {
+			respondJSON(w, http.StatusGone, map[string]interface{}{"error": "Offset is too old", "oldest_offset": missed[0].Offset})
+			return
+		}
+		missed = append(older, missed...)
+	}
+
+	drain := drainSignal(allChannels)
+	flusher := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	send := func(rec walRecord) bool {
+		if channel != "" && rec.Channel != "" && rec.Channel != channel {
+			return true
+		}
+		c, ok := changeOf(rec)
+		return !ok || encoder.Encode(c) == nil
+	}
+	for _, rec := range missed {
+		if !send(rec) {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case rec, ok := <-feed:
+			// a closed feed fell behind, the client resumes from its offset
+			if !ok || !send(rec) {
+				return
+			}
+		case <-drain.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
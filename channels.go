@@ -0,0 +1,241 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Channel names are case insensitive: "Foo" and "foo" are the same channel and
+// the lower case form is the one stored everywhere. On top of that a channel
+// may have aliases, other names that lead to it
+var aliasesMutex sync.RWMutex
+var aliases = make(map[string]string) // alias -> channel
+
+func canonicalChannel(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// resolveChannel turns whatever name a client used into the channel it means
+func resolveChannel(name string) string {
+	channel := canonicalChannel(name)
+	aliasesMutex.RLock()
+	defer aliasesMutex.RUnlock()
+	if target, ok := aliases[channel]; ok {
+		return target
+	}
+	return channel
+}
+
+// channelMiddleware rewrites the {channel} route variable to its resolved form
+// before any handler sees it, so no handler has to remember to
+func channelMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if channel, ok := vars["channel"]; ok {
+			vars["channel"] = resolveChannel(channel)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// curl -X GET http://localhost:8000/gdgsas022/aliases -v
+func getAliases(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	list := []string{}
+	aliasesMutex.RLock()
+	for alias, target := range aliases {
+		if target == channel {
+			list = append(list, alias)
+		}
+	}
+	aliasesMutex.RUnlock()
+	sort.Strings(list)
+	respondJSON(w, http.StatusOK, map[string]interface{}{"channel": channel, "aliases": list})
+}
+
+// curl -X PUT http://localhost:8000/gdgsas022/aliases/general -H 'X-Username: arthur' -v
+func putAlias(w http.ResponseWriter, r *http.Request) {
+	setAlias(w, r, true)
+}
+
+func deleteAlias(w http.ResponseWriter, r *http.Request) {
+	setAlias(w, r, false)
+}
+
+func setAlias(w http.ResponseWriter, r *http.Request, add bool) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	alias := canonicalChannel(vars["alias"])
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only moderators can change aliases")
+		return
+	}
+	if add && (alias == channel || lookupSubject(alias) != nil) {
+		respondJSON(w, http.StatusConflict, "A channel with this name exists")
+		return
+	}
+
+	aliasesMutex.Lock()
+	if target, taken := aliases[alias]; add && taken && target != channel {
+		aliasesMutex.Unlock()
+		respondJSON(w, http.StatusConflict, "Alias already points to another channel")
+		return
+	}
+	if !add && aliases[alias] != channel {
+		aliasesMutex.Unlock()
+		respondJSON(w, http.StatusBadRequest, "Provided alias does not exist!")
+		return
+	}
+	if add {
+		aliases[alias] = channel
+		logGlobal("alias_added", "aliases", alias, channel)
+		publish(channel, "alias_added", map[string]string{"alias": alias})
+	} else {
+		delete(aliases, alias)
+		logGlobal("alias_removed", "aliases", alias, nil)
+		publish(channel, "alias_removed", map[string]string{"alias": alias})
+	}
+	aliasesMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string]string{"alias": alias, "channel": channel})
+}
+
+// mergeCaseVariants is the migration for channels created before names were
+// case insensitive: every group of names differing only in case ("Foo", "foo")
+// becomes a single lower case channel. Archived variants are brought back
+// first. Returns the merged channels with the names that went into them
+func mergeCaseVariants() map[string][]string {
+	if dataDir != "" {
+		files, _ := ioutil.ReadDir(filepath.Join(dataDir, "archive"))
+		for _, file := range files {
+			name := strings.TrimSuffix(file.Name(), ".json")
+			if name != canonicalChannel(name) {
+				rehydrate(name)
+				rehydrate(canonicalChannel(name))
+			}
+		}
+	}
+
+	globalMapMutex.Lock()
+	defer globalMapMutex.Unlock()
+	groups := make(map[string][]string)
+	for name := range liveMessages {
+		groups[canonicalChannel(name)] = append(groups[canonicalChannel(name)], name)
+	}
+	merged := make(map[string][]string)
+	for channel, names := range groups {
+		if len(names) == 1 && names[0] == channel {
+			continue
+		}
+		sort.Strings(names)
+		variants := make([]*subject, len(names))
+		for i, name := range names {
+			variants[i] = liveMessages[name]
+			delete(liveMessages, name)
+			logDropped(name)
+		}
+		liveMessages[channel] = mergeSubjects(channel, variants)
+		liveMessages[channel].logChannel()
+		merged[channel] = names
+	}
+
+	invitesMutex.Lock()
+	for _, inv := range invites {
+		if channel := canonicalChannel(inv.Channel); channel != inv.Channel {
+			inv.Channel = channel
+			logGlobal("invite_changed", "invites", inv.Token, inv)
+		}
+	}
+	invitesMutex.Unlock()
+	return merged
+}
+
+// mergeSubjects builds one channel out of several. Messages are interleaved by
+// creation time and numbered again, roles and members are united and the
+// strictest setting wins. Variants are locked one at a time
+func mergeSubjects(channel string, variants []*subject) *subject {
+	merged := newSubject(channel, "")
+	merged.allowGuests = true
+	messages := []msgPost{}
+	var founded time.Time
+	for _, v := range variants {
+		v.Lock()
+		history := v.all()
+		messages = append(messages, history...)
+		// the oldest variant keeps its owner
+		if len(history) > 0 && (founded.IsZero() || history[0].Created.Before(founded)) {
+			merged.owner, founded = v.owner, history[0].Created
+		} else if merged.owner == "" {
+			merged.owner = v.owner
+		}
+		for username := range v.moderators {
+			merged.moderators[username] = true
+		}
+		for username := range v.trusted {
+			merged.trusted[username] = true
+		}
+		for username := range v.members {
+			merged.members[username] = true
+		}
+		merged.private = merged.private || v.private
+		merged.allowGuests = merged.allowGuests && v.allowGuests
+		merged.frozen = merged.frozen || v.frozen
+		merged.premoderate = merged.premoderate || v.premoderate
+		if merged.retention == nil {
+			merged.retention = v.retention
+		}
+		if merged.welcome == nil {
+			merged.welcome = v.welcome
+		}
+		for username := range v.welcomed {
+			merged.welcomed[username] = true
+		}
+		for _, p := range v.pending {
+			merged.nextPendingID++
+			p.PendingId = merged.nextPendingID
+			merged.pending = append(merged.pending, p)
+		}
+		for _, b := range v.cold {
+			b.discard()
+		}
+		v.Unlock()
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Created.Before(messages[j].Created) })
+	for _, mesg := range messages {
+		merged.lastID++
+		mesg.Id = merged.lastID
+		mesg.Permalink = permalink(channel, mesg.Id)
+		if mesg.ExpiresAt != nil {
+			merged.expiring[mesg.Id] = *mesg.ExpiresAt
+		}
+		merged.Messages = append(merged.Messages, mesg)
+	}
+	return merged
+}
+
+// Runs the case merge migration on demand, it also runs once at startup
+// curl -X POST http://localhost:8000/admin/migrations/merge-channel-case -H 'X-Admin-Token: secret'
+func postMergeCaseVariants(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]map[string][]string{"merged": mergeCaseVariants()})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// Closing a channel writes it to a log file in -closed-dir and forgets it. The
+// file is named by the date and the owner of the channel so it can be found
+// later, e.g. closed/2026-10-15_150405_arthur_gdgsas022.log, and holds one JSON
+// object a line: the channel settings first, then every message with its
+// thread. GET /archive/{channel} reads it back. The name is free again
+// afterwards, the webhooks, integrations and reminders of the channel are
+// removed with it. Channels on legal hold can not be closed, the hold has to be
+// lifted first
+var closedDir = "closed"
+
+type closedHeader struct {
+	Type     string          `json:"type"` // channel
+	Channel  string          `json:"channel"`
+	ClosedAt time.Time       `json:"closed_at"`
+	ClosedBy string          `json:"closed_by"`
+	Settings archivedChannel `json:"settings"`
+}
+
+type closedMessage struct {
+	Type string `json:"type"` // message
+	storedPost
+}
+
+// closedLogPath is where a channel closed at now goes, names are kept to
+// letters, digits and dashes
+func closedLogPath(channel, owner string, now time.Time) string {
+	safe := func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+			return r
+		}
+		return '_'
+	}
+	if owner == "" {
+		owner = "unknown"
+	}
+	name := now.UTC().Format("2006-01-02_150405") + "_" + strings.Map(safe, owner) + "_" + channel + ".log"
+	return filepath.Join(closedDir, name)
+}
+
+// writeClosedLog writes the channel to path, the file shows up complete or
+// not at all
+func writeClosedLog(path string, header closedHeader, messages []storedPost) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	err = enc.Encode(header)
+	for _, sp := range messages {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(closedMessage{Type: "message", storedPost: sp})
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// closedLogs lists the logs of channel closed on date, every one when date is
+// empty, oldest first
+func closedLogs(channel, date string) []string {
+	files, _ := ioutil.ReadDir(closedDir)
+	paths := []string{}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, "_"+channel+".log") && strings.HasPrefix(name, date) {
+			paths = append(paths, filepath.Join(closedDir, name))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func readClosedLog(path string) (closedHeader, []storedPost, error) {
+	header := closedHeader{}
+	messages := []storedPost{}
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	if err := dec.Decode(&header); err != nil {
+		return header, nil, err
+	}
+	for dec.More() {
+		line := closedMessage{}
+		if err := dec.Decode(&line); err != nil {
+			return header, nil, err
+		}
+		messages = append(messages, line.storedPost)
+	}
+	return header, messages, nil
+}
+
+// Reads a closed channel back with the same shape as GET /{channel}/messages.
+// Without a date every time the channel was closed is served, oldest first
+// curl -X GET 'http://localhost:8000/archive/gdgsas022?date=2026-10-15'
+func getClosedChannel(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	date := r.URL.Query().Get("date")
+	if date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			respondJSON(w, http.StatusBadRequest, "date should look like 2026-10-15")
+			return
+		}
+		// the date of the file name ends in an underscore
+		date += "_"
+	}
+	paths := closedLogs(channel, date)
+	if len(paths) == 0 {
+		respondJSON(w, http.StatusNotFound, "No closed channel for this date")
+		return
+	}
+	rd := readerOf(r)
+	messages := []msgPost{}
+	for _, path := range paths {
+		header, stored, err := readClosedLog(path)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Reading the channel log failed: "+err.Error())
+			return
+		}
+		if !rd.mayRead(restoreSettings(header.Settings)) {
+			respondJSON(w, http.StatusForbidden, "This channel is private")
+			return
+		}
+		for _, sp := range stored {
+			messages = append(messages, sp.message())
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string][]msgPost{"messages": rd.visible(messages)})
+}
+
+// Only the channel owner or an admin closes a channel
+// curl -X POST http://localhost:8000/gdgsas022/close -H 'X-Username: arthur'
+func closeChannel(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if channelOnHold(channel) {
+		respondJSON(w, http.StatusConflict, "Channel is on legal hold")
+		return
+	}
+	subject.RLock()
+	allowed := isAdmin(r) || (actingUser(r) != "" && actingUser(r) == subject.owner)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only the channel owner can close it")
+		return
+	}
+	path, messages, err := closeSubject(channel, subject, actor(r))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Writing the channel log failed: "+err.Error())
+		return
+	}
+	audit(auditEntry{Actor: actor(r), Action: "channel_closed", Channel: channel, Data: map[string]interface{}{"path": path, "messages": len(messages)}})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"path": path, "messages": len(messages)})
+}
+
+// closeSubject writes the channel to its log, forgets it and tells the streams.
+// Returns the path of the log and the messages that went in
+func closeSubject(channel string, subject *subject, by string) (string, []storedPost, error) {
+	// Critical region
+	if subject = subject.lockLive(); subject == nil {
+		return "", nil, errors.New("the channel is gone")
+	}
+	now := time.Now()
+	a := subject.snapshot()
+	messages := a.Messages
+	a.Messages = nil
+	path := closedLogPath(channel, subject.owner, now)
+	err := writeClosedLog(path, closedHeader{Type: "channel", Channel: channel, ClosedAt: now, ClosedBy: by, Settings: a}, messages)
+	if err != nil {
+		subject.Unlock()
+		return "", nil, err
+	}
+	// posts that looked the channel up already are refused until it is gone
+	subject.frozen = true
+	cold := subject.cold
+	subject.Unlock()
+	forgetChannel(channel, subject, cold)
+	fmt.Println("Closed", channel, "to", path)
+	toS3(path, "closed/"+filepath.Base(path))
+	publish(channel, "channel_closed", map[string]string{"path": path})
+	drainChannel(channel, "closed")
+	return path, messages, nil
+}
+
+// forgetChannel drops a frozen channel that was written out elsewhere, along
+// with its cold blocks and the webhooks, integrations and reminders of the
+// channel. Whoever takes the name next starts clean
+func forgetChannel(channel string, subject *subject, cold []*coldBlock) {
+	globalMapMutex.Lock()
+	dropped := liveMessages[channel] == subject
+	if dropped {
+		delete(liveMessages, channel)
+		logDropped(channel)
+	}
+	globalMapMutex.Unlock()
+	for _, b := range cold {
+		b.discard()
+	}
+	if dropped {
+		forgetWebhooks(channel)
+		forgetIntegrations(channel)
+		forgetReminders(channel)
+	}
+}
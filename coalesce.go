@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Request coalescing. When many clients poll a channel with the same last_id
+// at once, the first of them builds the listing and encodes it, and those
+// asking for the same thing while it does wait for it and are answered with
+// the very same bytes, instead of each copying the messages and encoding them
+// again. Nothing is kept once the answer is out, a request coming after it
+// builds a new one
+type flight struct {
+	done   chan struct{}
+	status int
+	body   []byte
+}
+
+var flightsMutex sync.Mutex
+var flights = make(map[string]*flight)
+var coalescedReads int64
+
+// coalesce answers with what render returns, shared by every request for key
+// that comes while it runs
+func coalesce(key string, render func() (int, []byte)) (int, []byte) {
+	flightsMutex.Lock()
+	if f := flights[key]; f != nil {
+		flightsMutex.Unlock()
+		atomic.AddInt64(&coalescedReads, 1)
+		<-f.done
+		return f.status, f.body
+	}
+	f := &flight{done: make(chan struct{})}
+	flights[key] = f
+	flightsMutex.Unlock()
+
+	defer func() {
+		flightsMutex.Lock()
+		delete(flights, key)
+		flightsMutex.Unlock()
+		close(f.done)
+	}()
+	f.status, f.body = render()
+	return f.status, f.body
+}
+
+// listingKey tells apart the listings GET /messages can answer with, the ones
+// with the same key are the same bytes
+func listingKey(r *http.Request, channel string, lastID, limit int) string {
+	return channel + "\x00" + strconv.Itoa(lastID) + "\x00" + strconv.Itoa(limit) + "\x00" + r.URL.Query().Get("system") + "\x00" + readerOf(r).key()
+}
+
+// renderListing encodes newer as GET /messages answers it. Caller must hold the
+// subject lock
+func (s *subject) renderListing(newer []msgPost, lastID int) (int, []byte) {
+	if len(newer) == 0 {
+		return encodeJSON(http.StatusBadRequest, "No new message after last_id")
+	}
+	return encodeJSON(http.StatusOK, map[string]interface{}{"messages": newer, "pages": s.sources(lastID, newer[len(newer)-1].Id)})
+}
+
+// encodeJSON is the body respondJSON would write for payload
+func encodeJSON(status int, payload interface{}) (int, []byte) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	return status, body
+}
+
+func respondEncoded(w http.ResponseWriter, status int, body []byte) {
+	if status != http.StatusInternalServerError {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Old history of big channels is rarely read, so it is kept gzipped in blocks
+// of coldBlockSize messages. The newest hotMessages always stay plain in
+// Messages. Reads decompress a copy, writes (a reply, a reaction, a lock) thaw
+// the block in place and the compactor packs it again on its next round.
+// With -data-dir the packed blocks go to disk and are paged back in on reads,
+// so memory follows the hot tail of each channel instead of its whole history
+var coldBlockSize = 1000
+var hotMessages = 1000
+var dataDir string
+
+const compactInterval = time.Minute
+
+type coldBlock struct {
+	first, last int // id range
+	count       int
+	newest      time.Time // creation time of the last message
+	data        []byte    // gzipped storedPosts, nil while thawed or on disk
+	path        string    // file holding data once spilled to dataDir
+	msgs        []msgPost // set while thawed
+}
+
+// storedPost carries the reactions, the full snippet body and the audio of a
+// voice note too, which are not part of the API form
+type storedPost struct {
+	msgPost
+	Reactions     map[string][]string `json:"reactions,omitempty"`
+	SnippetBody   string              `json:"snippet_body,omitempty"`
+	VoiceNoteData []byte              `json:"voice_note_data,omitempty"`
+}
+
+func storeMessage(mesg msgPost) storedPost {
+	sp := storedPost{msgPost: mesg, Reactions: mesg.reactions}
+	if mesg.Snippet != nil {
+		sp.SnippetBody = mesg.Snippet.body
+	}
+	if mesg.VoiceNote != nil {
+		sp.VoiceNoteData = mesg.VoiceNote.data
+	}
+	return sp
+}
+
+// message is the inverse of storeMessage
+func (sp storedPost) message() msgPost {
+	mesg := sp.msgPost
+	mesg.reactions = sp.Reactions
+	if mesg.Snippet != nil {
+		sn := *mesg.Snippet
+		sn.body = sp.SnippetBody
+		mesg.Snippet = &sn
+	}
+	if mesg.VoiceNote != nil {
+		vn := *mesg.VoiceNote
+		vn.data = sp.VoiceNoteData
+		mesg.VoiceNote = &vn
+	}
+	return mesg
+}
+
+func newColdBlock(channel string, msgs []msgPost) *coldBlock {
+	b := &coldBlock{msgs: append([]msgPost(nil), msgs...)}
+	b.freeze(channel)
+	return b
+}
+
+// freeze compresses a thawed block and spills it to disk when there is a
+// dataDir. A block that fails to compress simply stays thawed, one that fails
+// to be written stays compressed in memory
+func (b *coldBlock) freeze(channel string) {
+	b.first, b.last, b.count = b.msgs[0].Id, b.msgs[len(b.msgs)-1].Id, len(b.msgs)
+	b.newest = b.msgs[len(b.msgs)-1].Created
+	stored := make([]storedPost, len(b.msgs))
+	for i, mesg := range b.msgs {
+		stored[i] = storeMessage(mesg)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(stored); err != nil {
+		return
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+	b.data = buf.Bytes()
+	b.msgs = nil
+	if dataDir != "" {
+		b.spill(channel)
+	}
+}
+
+func (b *coldBlock) spill(channel string) {
+	dir := filepath.Join(dataDir, "history", channel)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d-%d.json.gz", b.first, b.last))
+	if err := ioutil.WriteFile(path, b.data, 0644); err != nil {
+		return
+	}
+	if b.path != "" && b.path != path {
+		os.Remove(b.path)
+	}
+	b.path = path
+	b.data = nil
+}
+
+// discard removes the on disk copy of a block that is being dropped
+func (b *coldBlock) discard() {
+	if b.path != "" {
+		os.Remove(b.path)
+	}
+}
+
+// messages returns the block content, decompressing a fresh copy unless the
+// block is thawed
+func (b *coldBlock) messages() []msgPost {
+	if b.msgs != nil {
+		return b.msgs
+	}
+	data := b.data
+	if data == nil && b.path != "" {
+		var err error
+		if data, err = ioutil.ReadFile(b.path); err != nil {
+			return nil
+		}
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+	stored := []storedPost{}
+	if err := json.NewDecoder(zr).Decode(&stored); err != nil {
+		return nil
+	}
+	msgs := make([]msgPost, len(stored))
+	for i, sp := range stored {
+		msgs[i] = sp.message()
+	}
+	return msgs
+}
+
+// thaw keeps the block decompressed so its messages can be changed in place.
+// The file of a spilled block stays until the block is frozen again. Caller
+// must hold the subject write lock
+func (b *coldBlock) thaw() {
+	if b.msgs == nil {
+		b.msgs = b.messages()
+		b.data = nil
+	}
+}
+
+// set recomputes the bookkeeping of a thawed block after messages were taken
+// out of it
+func (b *coldBlock) set(msgs []msgPost) {
+	b.msgs = msgs
+	b.first, b.last, b.count = msgs[0].Id, msgs[len(msgs)-1].Id, len(msgs)
+	b.newest = msgs[len(msgs)-1].Created
+}
+
+// coldMessage looks id up in the compressed history. With thaw the block is
+// decompressed in place and the message may be modified, which needs the
+// subject write lock. Otherwise a copy is returned
+func (s *subject) coldMessage(id int, thaw bool) *msgPost {
+	i := sort.Search(len(s.cold), func(i int) bool { return s.cold[i].last >= id })
+	if i == len(s.cold) || id < s.cold[i].first {
+		return nil
+	}
+	b := s.cold[i]
+	if thaw {
+		b.thaw()
+	}
+	msgs := b.messages()
+	j := sort.Search(len(msgs), func(j int) bool { return msgs[j].Id >= id })
+	if j < len(msgs) && msgs[j].Id == id {
+		return &msgs[j]
+	}
+	return nil
+}
+
+// pageSource says where a range of ids in a listing was read from: memory for
+// the plain tail and thawed blocks, compressed for blocks packed in memory and
+// disk for blocks paged in from dataDir
+type pageSource struct {
+	Source string `json:"source"`
+	First  int    `json:"first_id"`
+	Last   int    `json:"last_id"`
+}
+
+// sources describes the pages after(lastID) puts together up to the id
+// through, one a block and one for the plain tail. Caller must hold the subject
+// lock
+func (s *subject) sources(lastID, through int) []pageSource {
+	pages := []pageSource{}
+	add := func(source string, first, last int) {
+		if first <= lastID {
+			first = lastID + 1
+		}
+		if first > through {
+			return
+		}
+		if last > through {
+			last = through
+		}
+		pages = append(pages, pageSource{source, first, last})
+	}
+	for _, b := range s.cold {
+		switch {
+		case b.last <= lastID:
+		case b.msgs != nil:
+			add("memory", b.first, b.last)
+		case b.data != nil:
+			add("compressed", b.first, b.last)
+		default:
+			add("disk", b.first, b.last)
+		}
+	}
+	if n := len(s.Messages); n > 0 && s.Messages[n-1].Id > lastID {
+		add("memory", s.Messages[0].Id, s.Messages[n-1].Id)
+	}
+	return pages
+}
+
+// firstHotID is the id of the oldest message kept uncompressed
+func (s *subject) firstHotID() int {
+	if len(s.Messages) > 0 {
+		return s.Messages[0].Id
+	}
+	return s.lastID + 1
+}
+
+// oldestID is the id of the oldest message still held, 0 when there is none
+func (s *subject) oldestID() int {
+	if len(s.cold) > 0 {
+		return s.cold[0].first
+	}
+	if len(s.Messages) > 0 {
+		return s.Messages[0].Id
+	}
+	return 0
+}
+
+// count is the number of messages held, compressed or not
+func (s *subject) count() int {
+	count := len(s.Messages)
+	for _, b := range s.cold {
+		count += b.count
+	}
+	return count
+}
+
+// all returns every message of the channel, oldest first
+func (s *subject) all() []msgPost {
+	return s.after(0)
+}
+
+// compact packs thawed blocks again and moves the oldest hot messages into
+// new blocks while there are more than hotMessages of them. Caller must hold
+// the subject write lock
+func (s *subject) compact() {
+	for _, b := range s.cold {
+		if b.msgs != nil {
+			b.freeze(s.title)
+		}
+	}
+	for coldBlockSize > 0 && len(s.Messages) >= coldBlockSize+hotMessages {
+		s.cold = append(s.cold, newColdBlock(s.title, s.Messages[:coldBlockSize]))
+		// copy so the compressed messages can actually be garbage collected
+		s.Messages = append([]msgPost(nil), s.Messages[coldBlockSize:]...)
+	}
+}
+
+// compactAll compresses the cold history of every channel
+func compactAll(now time.Time) {
+	for _, subject := range allSubjects() {
+		subject.Lock()
+		subject.compact()
+		subject.Unlock()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Materialized counters. Channel stats, unread counts and the legacy messages
+// of a username are read from counters kept up to date as messages come and
+// go, instead of walking the history, which may have to be decompressed or
+// read back from disk for it. They are built with a single walk the first time
+// a channel needs them, a channel restored or rehydrated starts over that way.
+// Totals for quotas and retention come from count(), which the cold blocks
+// already keep
+type channelCounters struct {
+	ids        []int          // of every message, ascending
+	users      map[string]int // messages by username
+	unverified map[string]int // messages posted before the username was claimed
+	days       map[string]int // messages by UTC day, 2006-01-02
+}
+
+// countersOf returns the counters of the channel, building them when needed.
+// Caller must hold the subject lock and not change what it gets back
+func (s *subject) countersOf() *channelCounters {
+	s.countersMutex.Lock()
+	defer s.countersMutex.Unlock()
+	if s.counters == nil {
+		c := &channelCounters{users: make(map[string]int), unverified: make(map[string]int), days: make(map[string]int)}
+		for _, mesg := range s.all() {
+			c.add(mesg, 1)
+		}
+		s.counters = c
+	}
+	return s.counters
+}
+
+// tally counts mesg in, or out with -1, when the counters are built. Caller
+// must hold the subject write lock
+func (s *subject) tally(mesg msgPost, delta int) {
+	s.countersMutex.Lock()
+	defer s.countersMutex.Unlock()
+	if s.counters != nil {
+		s.counters.add(mesg, delta)
+	}
+}
+
+func (c *channelCounters) add(mesg msgPost, delta int) {
+	i := sort.SearchInts(c.ids, mesg.Id)
+	found := i < len(c.ids) && c.ids[i] == mesg.Id
+	switch {
+	case delta > 0 && found, delta < 0 && !found:
+		return
+	case delta > 0:
+		c.ids = append(c.ids, 0)
+		copy(c.ids[i+1:], c.ids[i:])
+		c.ids[i] = mesg.Id
+	default:
+		c.ids = append(c.ids[:i], c.ids[i+1:]...)
+	}
+	bump(c.users, mesg.Username, delta)
+	if !mesg.Verified {
+		bump(c.unverified, mesg.Username, delta)
+	}
+	bump(c.days, mesg.Created.UTC().Format("2006-01-02"), delta)
+}
+
+func bump(counts map[string]int, key string, delta int) {
+	if counts[key] += delta; counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// newerThan counts the messages with an id above id
+func (c *channelCounters) newerThan(id int) int {
+	return len(c.ids) - sort.SearchInts(c.ids, id+1)
+}
+
+type dayCount struct {
+	Day      string `json:"day"`
+	Messages int    `json:"messages"`
+}
+
+// Message counts of the channel, in all, by username and by day
+// curl -X GET http://localhost:8000/gdgsas022/stats -v
+func getChannelStats(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canAccess(actingUser(r)) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	c := subject.countersOf()
+	days := []dayCount{}
+	for day, n := range c.days {
+		days = append(days, dayCount{day, n})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"channel":  channel,
+		"messages": len(c.ids),
+		"last_id":  subject.lastID,
+		"users":    c.users,
+		"days":     days,
+	})
+}
+
+// untally counts out messages about to be dropped, without reading them back
+// when the counters are not built. Caller must hold the subject write lock
+func (s *subject) untally(msgs []msgPost) {
+	s.countersMutex.Lock()
+	defer s.countersMutex.Unlock()
+	if s.counters != nil {
+		for _, mesg := range msgs {
+			s.counters.add(mesg, -1)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Clients give a request a budget with X-Request-Timeout, a duration like 2s
+// or 1500ms or a plain number of seconds, and -max-request-timeout bounds it.
+// Requests without one get -request-timeout, 0 leaves them unbounded. Event
+// streams are meant to stay open and have no budget. The budget is the
+// deadline of the request context: the virus scanner gets what is left of it,
+// and a post whose budget ran out on the way is refused before it queues for
+// the channel lock rather than piling up behind a slow backend.
+//
+// Database writes are bounded by -db-timeout instead. They belong to the log
+// every request shares, a record given up halfway would leave the database
+// behind memory
+var requestTimeout time.Duration
+var maxRequestTimeout = 30 * time.Second
+var dbTimeout = 10 * time.Second
+
+// streams not ending in /events or /ws
+var streamPaths = map[string]bool{"/admin/firehose": true, "/admin/replication": true, "/cdc": true}
+
+// isStream tells whether r is for an event stream or WebSocket
+func isStream(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	path, _ := route.GetPathTemplate()
+	return streamPaths[path] || strings.HasSuffix(path, "/events") || strings.HasSuffix(path, "/ws")
+}
+
+func deadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeout := requestTimeout
+		if v := r.Header.Get("X-Request-Timeout"); v != "" {
+			var err error
+			if timeout, err = parseTimeout(v); err != nil || timeout <= 0 {
+				respondJSON(w, http.StatusBadRequest, "X-Request-Timeout should be a duration like 2s or a number of seconds")
+				return
+			}
+		}
+		if maxRequestTimeout > 0 && timeout > maxRequestTimeout {
+			timeout = maxRequestTimeout
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func parseTimeout(v string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(v)
+}
+
+// expired answers 504 when the budget of the request is spent
+func expired(w http.ResponseWriter, r *http.Request) bool {
+	if r.Context().Err() == nil {
+		return false
+	}
+	respondJSON(w, http.StatusGatewayTimeout, "Request timed out")
+	return true
+}
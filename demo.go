@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Caps on what the service holds, 0 means unlimited. Only the demo profile
+// sets them for now
+var maxChannels int
+var maxChannelMessages int
+
+// -demo turns the skeleton into a public playground: tiny caps, a strict per
+// client write limit and everything wiped every hour
+var demoMode bool
+
+const (
+	demoMaxChannels        = 20
+	demoMaxChannelMessages = 200
+	demoWritesPerWindow    = 10
+	demoWriteWindow        = time.Minute
+	demoWipeInterval       = time.Hour
+	demoBanner             = "Public demo: strict limits apply and all data is wiped every hour"
+)
+
+var demoMutex sync.Mutex
+var demoNextWipe time.Time
+
+// writes by client address in the current window
+var demoWrites = make(map[string]int)
+var demoWindowStart time.Time
+
+func enableDemo() {
+	maxChannels = demoMaxChannels
+	maxChannelMessages = demoMaxChannelMessages
+	demoNextWipe = time.Now().Add(demoWipeInterval)
+	demoWindowStart = time.Now()
+	go demoWiper()
+}
+
+func channelCount() int {
+	globalMapMutex.RLock()
+	defer globalMapMutex.RUnlock()
+	return len(liveMessages)
+}
+
+// demoMiddleware puts the banner on every response and rejects writes over
+// the per client budget with 429
+func demoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		demoMutex.Lock()
+		nextWipe := demoNextWipe
+		allowed, retry := true, time.Duration(0)
+		if r.Method != "GET" && r.Method != "HEAD" {
+			now := time.Now()
+			if now.Sub(demoWindowStart) >= demoWriteWindow {
+				demoWindowStart = now
+				demoWrites = make(map[string]int)
+			}
+			client := clientAddr(r)
+			if demoWrites[client] >= demoWritesPerWindow {
+				allowed = false
+				retry = demoWindowStart.Add(demoWriteWindow).Sub(now)
+			} else {
+				demoWrites[client]++
+			}
+		}
+		demoMutex.Unlock()
+
+		w.Header().Set("X-Demo", "true")
+		w.Header().Set("X-Demo-Banner", demoBanner)
+		w.Header().Set("X-Demo-Next-Wipe", nextWipe.UTC().Format(time.RFC3339))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			respondJSON(w, http.StatusTooManyRequests, "Demo write limit reached, try again later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// demoWiper wipes the demo each hour
+func demoWiper() {
+	for range time.Tick(demoWipeInterval) {
+		if err := demoWipe(); err != nil {
+			fmt.Println("Wiping the demo failed:", err)
+		}
+		demoMutex.Lock()
+		demoNextWipe = time.Now().Add(demoWipeInterval)
+		demoMutex.Unlock()
+	}
+}
+
+// demoWipe restores an empty state but for the channels on legal hold, live
+// or archived, the holds themselves and the features admins switched. All
+// that globalState covers goes, what is added to it later too
+func demoWipe() error {
+	b := backup{Version: backupVersion, Node: nodeID, Channels: []archivedChannel{}}
+	for _, subject := range allSubjects() {
+		subject.RLock()
+		channel, held := subject.title, channelOnHold(subject.title)
+		if held {
+			b.Channels = append(b.Channels, subject.snapshot())
+		}
+		subject.RUnlock()
+		if !held {
+			publish(channel, "demo_wipe", nil)
+		}
+	}
+	for _, a := range archivedSnapshots() {
+		if channelOnHold(a.Title) {
+			b.Channels = append(b.Channels, a)
+		}
+	}
+	g := takeGlobals()
+	b.globalState = globalState{ChannelHolds: g.ChannelHolds, UserHolds: g.UserHolds, Features: g.Features}
+	b.TakenAt = time.Now()
+	return restoreBackup(b)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Tools that already post to Discord webhooks, CI systems, monitoring, bots,
+// only need the host changed. A token integration (see webhooks.go) takes
+// Discord webhook calls at
+//
+//	POST /api/webhooks/{integration id}/{token}
+//
+// with JSON or multipart bodies, the JSON in payload_json then. content and
+// the embeds become the text of the message, username the name it is posted
+// under. avatar_url is taken but not kept, messages have no avatars here, and
+// files are not taken. Like Discord the call answers 204 No Content, or the
+// message with ?wait=true
+type discordPayload struct {
+	Content   string         `json:"content"`
+	Username  string         `json:"username"`
+	AvatarURL string         `json:"avatar_url"`
+	Embeds    []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	Author      struct {
+		Name string `json:"name"`
+	} `json:"author"`
+	Fields []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"fields"`
+	Footer struct {
+		Text string `json:"text"`
+	} `json:"footer"`
+}
+
+// text is the message a Discord payload makes: the content, then each embed
+// as its author, title and link, description, fields a line each and footer
+func (p discordPayload) text() string {
+	parts := []string{}
+	if strings.TrimSpace(p.Content) != "" {
+		parts = append(parts, p.Content)
+	}
+	for _, embed := range p.Embeds {
+		lines := []string{}
+		if embed.Author.Name != "" {
+			lines = append(lines, embed.Author.Name)
+		}
+		if heading := strings.TrimSpace(embed.Title + " " + embed.URL); heading != "" {
+			lines = append(lines, heading)
+		}
+		if embed.Description != "" {
+			lines = append(lines, embed.Description)
+		}
+		for _, field := range embed.Fields {
+			lines = append(lines, field.Name+": "+field.Value)
+		}
+		if embed.Footer.Text != "" {
+			lines = append(lines, embed.Footer.Text)
+		}
+		if len(lines) > 0 {
+			parts = append(parts, strings.Join(lines, "\n"))
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// curl -X POST http://localhost:8000/api/webhooks/<id>/<token> -H 'Content-Type: application/json' -d '{"content": "Build passed", "username": "ci"}'
+func postDiscordWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hook, ok := tokenIntegration(vars["id"], vars["token"])
+	if !ok {
+		respondJSON(w, http.StatusNotFound, "No such integration")
+		return
+	}
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, maxWebhookBody)
+	payload := discordPayload{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxWebhookBody); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if data := r.FormValue("payload_json"); data != "" {
+			if err := json.Unmarshal([]byte(data), &payload); err != nil {
+				respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		} else {
+			payload.Content, payload.Username = r.FormValue("content"), r.FormValue("username")
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	mesg, ok := postAsIntegration(w, r, hook, msgPost{Username: payload.Username, Message: payload.text()})
+	if !ok {
+		return
+	}
+	if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); !wait {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"id":         strconv.Itoa(mesg.Id),
+		"channel_id": hook.Channel,
+		"webhook_id": hook.Id,
+		"content":    mesg.Message,
+		"author":     map[string]string{"username": mesg.Username},
+		"timestamp":  mesg.Created,
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Drafts are half-written messages a user keeps on the server so another
+// device can pick them up, one per channel and thread. They are no part of
+// channel history: nobody else sees them, posting clears them and untouched
+// ones are forgotten after -draft-ttl. Drafts are private, so only registered
+// names and guests with their token have any
+type draft struct {
+	Username  string    `json:"username"`
+	Channel   string    `json:"channel"`
+	ThreadID  int       `json:"thread_id,omitempty"` // 0 is the channel itself
+	Message   string    `json:"message"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type draftKey struct {
+	channel  string
+	threadID int
+}
+
+var draftTTL = 7 * 24 * time.Hour
+
+const draftSweepInterval = time.Hour
+const maxDraftLength = 16 * 1024
+const maxDraftsPerUser = 100
+
+var draftsMutex sync.Mutex
+var drafts = make(map[string]map[draftKey]*draft) // username -> drafts
+
+// privateUser is the user the request keeps private state such as drafts
+// for, "" when it can not have any
+func privateUser(r *http.Request) string {
+	username := actingUser(r)
+	if isGuest(username) || isClaimed(username) {
+		return username
+	}
+	return ""
+}
+
+// draftThread reads the optional thread_id query parameter
+func draftThread(r *http.Request) (int, bool) {
+	key := r.URL.Query().Get("thread_id")
+	if key == "" {
+		return 0, true
+	}
+	id, err := strconv.Atoi(key)
+	return id, err == nil && id > 0
+}
+
+// clearDraft forgets the draft once it was posted
+func clearDraft(username, channel string, threadID int) {
+	draftsMutex.Lock()
+	_, found := drafts[username][draftKey{channel, threadID}]
+	if found {
+		delete(drafts[username], draftKey{channel, threadID})
+		if len(drafts[username]) == 0 {
+			delete(drafts, username)
+		}
+		logGlobal("draft_cleared", "drafts", draftEntry(username, channel, threadID), nil)
+	}
+	draftsMutex.Unlock()
+}
+
+func sweepDrafts(now time.Time) {
+	if isMirror() {
+		return
+	}
+	draftsMutex.Lock()
+	defer draftsMutex.Unlock()
+	for username, mine := range drafts {
+		for key, d := range mine {
+			if now.Sub(d.UpdatedAt) > draftTTL {
+				delete(mine, key)
+				logGlobal("draft_expired", "drafts", draftEntry(username, key.channel, key.threadID), nil)
+			}
+		}
+		if len(mine) == 0 {
+			delete(drafts, username)
+		}
+	}
+}
+
+// Lists the drafts of the user, newest first. channel= narrows them down
+// curl -X GET http://localhost:8000/drafts -H 'Authorization: Bearer <token>' -v
+func getDrafts(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Drafts need a registered username or a guest token")
+		return
+	}
+	channel := ""
+	if r.URL.Query().Get("channel") != "" {
+		channel = resolveChannel(r.URL.Query().Get("channel"))
+	}
+
+	list := []draft{}
+	draftsMutex.Lock()
+	for _, d := range drafts[username] {
+		if channel == "" || d.Channel == channel {
+			list = append(list, *d)
+		}
+	}
+	draftsMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+	respondJSON(w, http.StatusOK, map[string][]draft{"drafts": list})
+}
+
+// Saves the draft of the channel, or of a thread with thread_id=
+// curl -X PUT 'http://localhost:8000/gdgsas022/draft?thread_id=1' -H 'Authorization: Bearer <token>' -d '{"message": "I think we"}' -v
+func putDraft(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Drafts need a registered username or a guest token")
+		return
+	}
+	threadID, ok := draftThread(r)
+	if !ok {
+		respondJSON(w, http.StatusBadRequest, "thread_id should be a message id")
+		return
+	}
+	req := struct {
+		Message string `json:"message"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Message == "" {
+		respondJSON(w, http.StatusBadRequest, "Empty draft, delete it instead")
+		return
+	}
+	if len(req.Message) > maxDraftLength {
+		respondJSON(w, http.StatusRequestEntityTooLarge, "Draft is too long")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canAccess(username)
+	exists := threadID == 0 || subject.message(threadID) != nil
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	if !exists {
+		respondJSON(w, http.StatusBadRequest, "Provided messageId does not exist!")
+		return
+	}
+
+	d := &draft{Username: username, Channel: channel, ThreadID: threadID, Message: req.Message, UpdatedAt: time.Now()}
+	key := draftKey{channel, threadID}
+	draftsMutex.Lock()
+	mine := drafts[username]
+	if mine == nil {
+		mine = make(map[draftKey]*draft)
+		drafts[username] = mine
+	}
+	if _, found := mine[key]; !found && len(mine) >= maxDraftsPerUser {
+		draftsMutex.Unlock()
+		respondJSON(w, http.StatusForbidden, "Too many drafts")
+		return
+	}
+	mine[key] = d
+	logGlobal("draft_saved", "drafts", draftEntry(username, channel, threadID), d)
+	draftsMutex.Unlock()
+	respondJSON(w, http.StatusOK, d)
+}
+
+// curl -X DELETE 'http://localhost:8000/gdgsas022/draft?thread_id=1' -H 'Authorization: Bearer <token>' -v
+func deleteDraft(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Drafts need a registered username or a guest token")
+		return
+	}
+	threadID, ok := draftThread(r)
+	if !ok {
+		respondJSON(w, http.StatusBadRequest, "thread_id should be a message id")
+		return
+	}
+	draftsMutex.Lock()
+	_, found := drafts[username][draftKey{channel, threadID}]
+	draftsMutex.Unlock()
+	if !found {
+		respondJSON(w, http.StatusNotFound, "No such draft")
+		return
+	}
+	clearDraft(username, channel, threadID)
+	respondJSON(w, http.StatusOK, "Draft deleted")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Before a stream is closed by the server (shutdown, or its channel moving to
+// the archive) the client gets a last "drain" event:
+//
+//	{"type": "drain", "channel": "foo", "data": {"reason": "shutdown", "resume_last_id": 41, "reconnect": "http://10.0.0.2:8000"}}
+//
+// resume_last_id is the newest message this stream delivered, so fetching
+// messages?last_id=41 from reconnect (or this node once it is back) loses
+// nothing. reconnect is -drain-to and left out when not set
+var drainTo string
+
+const drainTimeout = 10 * time.Second
+
+type drain struct {
+	done   chan struct{}
+	reason string
+}
+
+var drainsMutex sync.Mutex
+var drains = make(map[string]*drain)
+
+// drainSignal is closed when the streams of channel have to go. The firehose
+// listens on allChannels, which only drains on shutdown
+func drainSignal(channel string) *drain {
+	drainsMutex.Lock()
+	defer drainsMutex.Unlock()
+	d, ok := drains[channel]
+	if !ok {
+		d = &drain{done: make(chan struct{})}
+		drains[channel] = d
+	}
+	return d
+}
+
+// drainChannel asks every stream of channel to drain. Streams opened later get
+// a fresh signal
+func drainChannel(channel, reason string) {
+	drainsMutex.Lock()
+	defer drainsMutex.Unlock()
+	if d, ok := drains[channel]; ok {
+		d.reason = reason
+		close(d.done)
+		delete(drains, channel)
+	}
+}
+
+func drainAll(reason string) {
+	drainsMutex.Lock()
+	channels := make([]string, 0, len(drains))
+	for channel := range drains {
+		channels = append(channels, channel)
+	}
+	drainsMutex.Unlock()
+	for _, channel := range channels {
+		drainChannel(channel, reason)
+	}
+}
+
+// drainEvent has no cursor for the firehose, it spans every channel, nor for
+// sync streams, which carry no messages
+func drainEvent(channel, reason string, cursor int) event {
+	data := map[string]interface{}{"reason": reason}
+	if channel != allChannels && !strings.HasPrefix(channel, userChannel("")) {
+		data["resume_last_id"] = cursor
+	}
+	if drainTo != "" {
+		data["reconnect"] = drainTo
+	}
+	return event{Type: "drain", Channel: channel, Data: data}
+}
+
+// serve runs the server until SIGINT or SIGTERM, then drains the streams and
+// waits up to drainTimeout for requests in flight
+func serve(server *http.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		fmt.Println("Draining streams and shutting down")
+		drainAll("shutdown")
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+		close(stopped)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Clients disagree on shortcodes, so :smile: style codes are expanded once at
+// ingest and posts carry both the raw text and the rendered one. Turned off
+// with -expand-emoji=false, rendered is then the raw text
+var expandEmoji = true
+
+var shortcodes = map[string]string{
+	"+1": "👍", "-1": "👎", "thumbsup": "👍", "thumbsdown": "👎",
+	"smile": "😄", "smiley": "😃", "grin": "😁", "joy": "😂", "laughing": "😆",
+	"wink": "😉", "blush": "😊", "slightly_smiling_face": "🙂", "upside_down_face": "🙃",
+	"heart_eyes": "😍", "kissing_heart": "😘", "thinking": "🤔", "neutral_face": "😐",
+	"expressionless": "😑", "unamused": "😒", "roll_eyes": "🙄", "grimacing": "😬",
+	"relieved": "😌", "pensive": "😔", "sleepy": "😪", "sleeping": "😴",
+	"sunglasses": "😎", "confused": "😕", "worried": "😟", "open_mouth": "😮",
+	"astonished": "😲", "flushed": "😳", "cry": "😢", "sob": "😭", "scream": "😱",
+	"angry": "😠", "rage": "😡", "skull": "💀", "poop": "💩", "clown_face": "🤡",
+	"ghost": "👻", "alien": "👽", "robot": "🤖", "see_no_evil": "🙈",
+	"wave": "👋", "ok_hand": "👌", "v": "✌️", "crossed_fingers": "🤞", "point_up": "☝️",
+	"clap": "👏", "raised_hands": "🙌", "pray": "🙏", "muscle": "💪", "eyes": "👀",
+	"heart": "❤️", "broken_heart": "💔", "sparkling_heart": "💖", "100": "💯",
+	"fire": "🔥", "sparkles": "✨", "star": "⭐", "zap": "⚡", "boom": "💥",
+	"tada": "🎉", "confetti_ball": "🎊", "gift": "🎁", "trophy": "🏆", "rocket": "🚀",
+	"white_check_mark": "✅", "heavy_check_mark": "✔️", "x": "❌", "warning": "⚠️",
+	"question": "❓", "exclamation": "❗", "no_entry": "⛔", "bulb": "💡",
+	"memo": "📝", "pushpin": "📌", "lock": "🔒", "unlock": "🔓", "key": "🔑",
+	"bell": "🔔", "mega": "📣", "calendar": "📆", "hourglass": "⌛", "coffee": "☕",
+	"beer": "🍺", "pizza": "🍕", "cake": "🍰", "bug": "🐛", "dog": "🐶", "cat": "🐱",
+	"sunny": "☀️", "cloud": "☁️", "umbrella": "☔", "snowflake": "❄️", "rainbow": "🌈",
+	"ship": "🚢", "construction": "🚧", "chart_with_upwards_trend": "📈",
+	"chart_with_downwards_trend": "📉",
+}
+
+// shortcodeOf finds a shortcode for an emoji, the shortest one when several map
+// to it, so listings can show both forms
+var shortcodeOf = func() map[string]string {
+	reverse := make(map[string]string)
+	for code, emoji := range shortcodes {
+		if cur, ok := reverse[emoji]; !ok || len(code) < len(cur) || len(code) == len(cur) && code < cur {
+			reverse[emoji] = code
+		}
+	}
+	return reverse
+}()
+
+var shortcodePattern = regexp.MustCompile(`:[a-z0-9_+\-]+:`)
+
+// renderEmoji expands the known shortcodes of text, unknown ones stay as typed
+func renderEmoji(text string) string {
+	if !expandEmoji || !strings.Contains(text, ":") {
+		return text
+	}
+	return shortcodePattern.ReplaceAllStringFunc(text, func(code string) string {
+		if emoji, ok := shortcodes[strings.Trim(code, ":")]; ok {
+			return emoji
+		}
+		return code
+	})
+}
+
+// reactionEmoji turns what a client sent as a reaction (":+1:", "+1" or the
+// emoji itself) into the emoji. ok is false when it is none of those
+func reactionEmoji(raw string) (string, bool) {
+	if emoji, ok := shortcodes[strings.Trim(raw, ":")]; ok {
+		return emoji, true
+	}
+	return raw, isEmoji(raw)
+}
+
+// isEmoji accepts a single emoji sequence: pictographs possibly joined with
+// ZWJ and decorated with skin tones, variation selectors or a keycap
+func isEmoji(s string) bool {
+	symbol := false
+	for _, r := range s {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		case unicode.Is(unicode.Sk, r), unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r), unicode.Is(unicode.Cf, r):
+		case r == '#' || r == '*' || r >= '0' && r <= '9':
+			// keycap bases
+		default:
+			return false
+		}
+	}
+	return symbol || strings.ContainsRune(s, '⃣')
+}
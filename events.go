@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// event is a notification fanned out to everybody listening on a channel.
+// Data carries whatever the event is about (a message, a thread reply, ...)
+type event struct {
+	Type    string      `json:"type"`
+	Channel string      `json:"channel"`
+	Data    interface{} `json:"data,omitempty"`
+	// when the broker published it, with -sla, see sla.go
+	PublishedUS int64 `json:"published_us,omitempty"`
+}
+
+// Listening on allChannels receives the events of every channel. The channel
+// route pattern does not allow '*' so it can not clash with a real channel
+const allChannels = "*"
+
+// userChannel is where the sync stream of username listens. Like allChannels
+// it can not clash with a real channel
+func userChannel(username string) string {
+	return "@" + username
+}
+
+// Streams channel events as newline delimited JSON until the client goes away.
+// Takes the filters of parseFilter
+// curl -N http://localhost:8000/gdgsas022/events
+// curl -N 'http://localhost:8000/gdgsas022/events?type=message&author=arthur,sally&q=deploy&min_priority=high'
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	if _, ok := w.(http.Flusher); !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	keep, err := parseFilter(r.URL.Query())
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rd := readerOf(r)
+	keep = rd.stream(keep)
+
+	newest := 0
+	if subject := lookupSubject(channel); subject != nil {
+		subject.RLock()
+		allowed := rd.mayRead(subject)
+		newest = subject.lastID
+		subject.RUnlock()
+		if !allowed {
+			respondJSON(w, http.StatusForbidden, "This channel is private")
+			return
+		}
+	}
+
+	release, ok := openStream(w, r, channel, actingUser(r))
+	if !ok {
+		return
+	}
+	defer release()
+	l := broker.Subscribe(channel, keep)
+	defer broker.Unsubscribe(channel, l)
+	if username := actingUser(r); username != "" {
+		streamOpened(channel, username)
+		defer streamClosed(channel, username)
+	}
+	streamListener(w, r, channel, l, newest)
+}
+
+// Streams the events of a single thread so an open thread view does not have
+// to follow the whole channel: its replies, reactions to the message and it
+// being locked, unlocked or deleted. Takes the filters of parseFilter too
+// curl -N http://localhost:8000/gdgsas022/thread/1/events
+func streamThread(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["message_id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "message_id should be an integer")
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	common, err := parseFilter(r.URL.Query())
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rd := readerOf(r)
+	common = rd.stream(common)
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Provided channel does not exist!")
+		return
+	}
+	subject.RLock()
+	allowed := rd.mayRead(subject)
+	_, exists := rd.message(subject.message(id))
+	newest := subject.lastID
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	if !exists {
+		respondJSON(w, http.StatusBadRequest, "Provided messageId does not exist!")
+		return
+	}
+	keep := func(ev event) bool {
+		if expired, ok := ev.Data.(map[string]int); ok && ev.Type == "messages_expired" {
+			// retention took the message with the older ones
+			return expired["oldest_id"] > id || expired["oldest_id"] == 0
+		}
+		about, ok := eventMessageID(ev)
+		return ok && about == id && (common == nil || common(ev))
+	}
+	release, ok := openStream(w, r, channel, actingUser(r))
+	if !ok {
+		return
+	}
+	defer release()
+	l := broker.Subscribe(channel, keep)
+	defer broker.Unsubscribe(channel, l)
+	if username := actingUser(r); username != "" {
+		streamOpened(channel, username)
+		defer streamClosed(channel, username)
+	}
+	streamListener(w, r, channel, l, newest)
+}
+
+// Streams the events meant for the user alone to every device of the user:
+// read markers moving and notifications
+// curl -N http://localhost:8000/sync/events -H 'Authorization: Bearer <token>'
+func streamSync(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "The sync stream needs a registered username or a guest token")
+		return
+	}
+
+	channel := userChannel(username)
+	release, ok := openStream(w, r, channel, username)
+	if !ok {
+		return
+	}
+	defer release()
+	l := broker.Subscribe(channel, nil)
+	defer broker.Unsubscribe(channel, l)
+	streamListener(w, r, channel, l, 0)
+}
+
+// streamListener writes the events of l as newline delimited JSON until the
+// client goes away or the channel drains. cursor is the newest message id of
+// the channel read before l subscribed, what a client resumes from when no
+// message came through the stream
+func streamListener(w http.ResponseWriter, r *http.Request, channel string, l listener, cursor int) {
+	drain := drainSignal(channel)
+	flusher := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	send := func(ev event) bool {
+		if mesg, ok := ev.Data.(msgPost); ok && ev.Type == "message" && mesg.Id > cursor {
+			cursor = mesg.Id
+		}
+		if err := encoder.Encode(ev); err != nil {
+			return false
+		}
+		flusher.Flush()
+		delivered(ev)
+		return true
+	}
+	for {
+		select {
+		case ev := <-l:
+			if !send(ev) {
+				return
+			}
+		case <-drain.done:
+			// hand over what is already buffered so the cursor is exact
+			for buffered := true; buffered; {
+				select {
+				case ev := <-l:
+					if !send(ev) {
+						return
+					}
+				default:
+					buffered = false
+				}
+			}
+			send(drainEvent(channel, drain.reason, cursor))
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Every event of every channel, for audit recorders and analytics taps.
+// Besides the filters of parseFilter: channel=a,b exact channels and prefix=
+// channel name prefix
+// curl -N 'http://localhost:8000/admin/firehose?type=message' -H 'X-Admin-Token: secret'
+func streamFirehose(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	query := r.URL.Query()
+	channels := make(map[string]bool)
+	for channel := range splitSet(query.Get("channel")) {
+		channels[resolveChannel(channel)] = true
+	}
+	prefix := canonicalChannel(query.Get("prefix"))
+	common, err := parseFilter(query)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	keep := func(ev event) bool {
+		if len(channels) > 0 && !channels[ev.Channel] {
+			return false
+		}
+		return strings.HasPrefix(ev.Channel, prefix) && (common == nil || common(ev))
+	}
+
+	release, ok := openStream(w, r, allChannels, "")
+	if !ok {
+		return
+	}
+	defer release()
+	l := broker.Subscribe(allChannels, keep)
+	defer broker.Unsubscribe(allChannels, l)
+	streamListener(w, r, allChannels, l, 0)
+}
+
+// splitSet turns "a,b" into a set, empty input into an empty set
+func splitSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
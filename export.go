@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The whole history of a channel with its threads, for compliance exports and
+// offline analysis. It is written out a block of history at a time and the
+// channel lock is only held while a block is copied, a slow download does not
+// hold up posting. Messages posted during the export may or may not be in it
+//
+//	json  {"channel": ..., "exported_at": ..., "messages": [...]}, the messages
+//	      in the form GET /{channel}/messages serves
+//	csv   a row a message and a row a reply, a reply names its message in
+//	      reply_to and its place in the thread in position
+//	slack       a Slack export ZIP, see slack.go
+//	mattermost  a Mattermost bulk export, see mattermost.go
+
+var exportExtensions = map[string]string{"json": "json", "csv": "csv", "slack": "zip", "mattermost": "jsonl"}
+
+// exportPage is the next messages after id, at most a block of them. Empty
+// once there are no more. Caller must hold the subject lock
+func (s *subject) exportPage(after int) []msgPost {
+	page := s.Messages
+	if i := sort.Search(len(s.cold), func(i int) bool { return s.cold[i].last > after }); i < len(s.cold) {
+		page = s.cold[i].messages()
+	}
+	page = page[sort.Search(len(page), func(j int) bool { return page[j].Id > after }):]
+	if coldBlockSize > 0 && len(page) > coldBlockSize {
+		page = page[:coldBlockSize]
+	}
+	// hot messages and thawed blocks change in place under the lock, the copy
+	// goes out without it
+	copied := make([]msgPost, len(page))
+	for k, mesg := range page {
+		copied[k] = mesg
+		copied[k].Threads = append([]Thread(nil), mesg.Threads...)
+	}
+	return copied
+}
+
+// curl -X GET 'http://localhost:8000/gdgsas022/export?format=csv' -o gdgsas022.csv
+func exportChannel(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	extension, ok := exportExtensions[format]
+	if !ok {
+		respondJSON(w, http.StatusBadRequest, "format should be json, csv, slack or mattermost")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	rd := readerOf(r)
+	allowed := rd.mayRead(subject)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Disposition", `attachment; filename="`+channel+"-"+now.Format("2006-01-02")+"."+extension+`"`)
+	next := func(after int) []msgPost {
+		subject.RLock()
+		defer subject.RUnlock()
+		return subject.exportPage(after)
+	}
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		exportCSV(w, next, rd)
+	case "slack":
+		w.Header().Set("Content-Type", "application/zip")
+		exportSlack(w, channel, now, next, rd)
+	case "mattermost":
+		team := r.URL.Query().Get("team")
+		if team == "" {
+			team = "messaging"
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		exportMattermost(w, channel, team, next, rd)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		exportJSON(w, channel, now, next, rd)
+	}
+}
+
+// pages walks the history with next until it runs dry, each gets what the
+// reader sees of the pages
+func pages(next func(after int) []msgPost, rd reader, each func(page []msgPost) error) error {
+	after := 0
+	for {
+		page := next(after)
+		if len(page) == 0 {
+			return nil
+		}
+		after = page[len(page)-1].Id
+		if err := each(rd.visible(page)); err != nil {
+			return err
+		}
+	}
+}
+
+func exportJSON(w http.ResponseWriter, channel string, now time.Time, next func(int) []msgPost, rd reader) {
+	header, _ := json.Marshal(map[string]interface{}{"channel": channel, "exported_at": now})
+	w.Write(header[:len(header)-1])
+	w.Write([]byte(`,"messages":[`))
+	first := true
+	pages(next, rd, func(page []msgPost) error {
+		for _, mesg := range page {
+			data, err := json.Marshal(mesg)
+			if err != nil {
+				return err
+			}
+			if !first {
+				w.Write([]byte(","))
+			}
+			first = false
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	w.Write([]byte("]}\n"))
+}
+
+func exportCSV(w http.ResponseWriter, next func(int) []msgPost, rd reader) {
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "reply_to", "position", "username", "created_at", "message", "verified", "priority", "reactions"})
+	pages(next, rd, func(page []msgPost) error {
+		for _, mesg := range page {
+			id := strconv.Itoa(mesg.Id)
+			out.Write([]string{id, "", "", mesg.Username, mesg.Created.UTC().Format(time.RFC3339Nano), mesg.Message,
+				strconv.FormatBool(mesg.Verified), mesg.Priority, strconv.Itoa(mesg.ReactionCount)})
+			for i, reply := range mesg.Threads {
+				out.Write([]string{"", id, strconv.Itoa(i + 1), reply.Username, "", reply.Message, strconv.FormatBool(reply.Verified), "", ""})
+			}
+		}
+		out.Flush()
+		return out.Error()
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Features admins switch on and off at runtime, e.g. voice notes while the
+// scanner is down. A feature that is off answers 403 on its endpoints and
+// posts using it are refused. Only the switches that differ from the defaults
+// are kept, they survive restarts with the rest of the global state. Clients
+// learn what is on from GET /capabilities
+var featureDefaults = map[string]bool{
+	"snippets":     true,
+	"voice_notes":  true,
+	"locations":    true,
+	"quotes":       true,
+	"reactions":    true,
+	"drafts":       true,
+	"guests":       true,
+	"invites":      true,
+	"integrations": true,
+	"promotion":    true,
+	"streams":      true,
+}
+
+var featuresMutex sync.RWMutex
+var featureOverrides = make(map[string]bool)
+
+func featureEnabled(name string) bool {
+	featuresMutex.RLock()
+	defer featuresMutex.RUnlock()
+	if enabled, ok := featureOverrides[name]; ok {
+		return enabled
+	}
+	return featureDefaults[name]
+}
+
+func allFeatures() map[string]bool {
+	features := make(map[string]bool, len(featureDefaults))
+	for name := range featureDefaults {
+		features[name] = featureEnabled(name)
+	}
+	return features
+}
+
+// withFeature refuses requests while the feature is off
+func withFeature(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureEnabled(name) {
+			respondJSON(w, http.StatusForbidden, "The "+name+" feature is turned off")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// postFeatures is the feature a post needs that is off, empty when none is
+func postFeatures(mesg msgPost) string {
+	switch {
+	case mesg.Snippet != nil && !featureEnabled("snippets"):
+		return "snippets"
+	case mesg.VoiceNote != nil && !featureEnabled("voice_notes"):
+		return "voice_notes"
+	case mesg.Location != nil && !featureEnabled("locations"):
+		return "locations"
+	case mesg.Quote != nil && !featureEnabled("quotes"):
+		return "quotes"
+	}
+	return ""
+}
+
+// curl -X GET http://localhost:8000/admin/features -H 'X-Admin-Token: secret'
+func getFeatures(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]map[string]bool{"features": allFeatures()})
+}
+
+// curl -X PUT http://localhost:8000/admin/features/voice_notes -H 'X-Admin-Token: secret' -d '{"enabled": false}'
+func putFeature(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if _, ok := featureDefaults[name]; !ok {
+		names := []string{}
+		for name := range featureDefaults {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{"error": "No such feature", "features": names})
+		return
+	}
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Enabled == nil {
+		respondJSON(w, http.StatusBadRequest, "enabled is required")
+		return
+	}
+	featuresMutex.Lock()
+	if *body.Enabled == featureDefaults[name] {
+		delete(featureOverrides, name)
+		logGlobal("feature_changed", "features", name, nil)
+	} else {
+		featureOverrides[name] = *body.Enabled
+		logGlobal("feature_changed", "features", name, *body.Enabled)
+	}
+	featuresMutex.Unlock()
+	audit(auditEntry{Actor: actor(r), Action: "feature_changed", Data: map[string]interface{}{"feature": name, "enabled": *body.Enabled}})
+	respondJSON(w, http.StatusOK, map[string]bool{name: *body.Enabled})
+}
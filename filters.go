@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Posts may carry a priority, no priority counts as normal
+var priorityRank = map[string]int{"low": 0, "normal": 1, "high": 2, "urgent": 3}
+
+// parseFilter builds the filter of a stream subscription, nil when the query
+// asks for nothing in particular. All given filters must match:
+//
+//	type=message,thread  event types
+//	author=a,b           who wrote the post, reply or reaction
+//	q=word               case insensitive keyword in the text
+//	regex=expr           regular expression on the text
+//	min_priority=high    posts of at least this priority
+//
+// The content filters (all but type) only let through events about a post
+func parseFilter(query url.Values) (filter, error) {
+	types := splitSet(query.Get("type"))
+	authors := splitSet(query.Get("author"))
+	keyword := strings.ToLower(query.Get("q"))
+	var re *regexp.Regexp
+	if expr := query.Get("regex"); expr != "" {
+		var err error
+		if re, err = regexp.Compile(expr); err != nil {
+			return nil, errors.New("regex does not compile: " + err.Error())
+		}
+	}
+	minRank := -1
+	if min := query.Get("min_priority"); min != "" {
+		rank, ok := priorityRank[min]
+		if !ok {
+			return nil, errors.New("min_priority should be low, normal, high or urgent")
+		}
+		minRank = rank
+	}
+	content := len(authors) > 0 || keyword != "" || re != nil || minRank >= 0
+	if len(types) == 0 && !content {
+		return nil, nil
+	}
+
+	return func(ev event) bool {
+		if len(types) > 0 && !types[ev.Type] {
+			return false
+		}
+		if !content {
+			return true
+		}
+		author, text, priority, ok := eventPost(ev)
+		if !ok {
+			return false
+		}
+		if len(authors) > 0 && !authors[author] {
+			return false
+		}
+		if keyword != "" && !strings.Contains(strings.ToLower(text), keyword) {
+			return false
+		}
+		if re != nil && !re.MatchString(text) {
+			return false
+		}
+		if priority == "" {
+			priority = "normal"
+		}
+		return priorityRank[priority] >= minRank
+	}, nil
+}
+
+// eventPost digs the author, text and priority out of the events about a
+// post, ok is false for the others
+func eventPost(ev event) (author, text, priority string, ok bool) {
+	switch data := ev.Data.(type) {
+	case msgPost:
+		return data.Username, data.Message, data.Priority, true
+	case pendingPost:
+		return data.Username, data.Message, data.Priority, true
+	case map[string]interface{}:
+		if reply, isReply := data["thread"].(Thread); isReply {
+			return reply.Username, reply.Message, "", true
+		}
+		if username, isReaction := data["username"].(string); isReaction {
+			emoji, _ := data["emoji"].(string)
+			return username, emoji, "", true
+		}
+	}
+	return "", "", "", false
+}
+
+// eventMessageID is the message an event is about: the parent of a reply, the
+// message reacted to, locked or deleted. ok is false for the others
+func eventMessageID(ev event) (id int, ok bool) {
+	switch data := ev.Data.(type) {
+	case msgPost:
+		return data.Id, true
+	case map[string]int:
+		id, ok = data["message_id"]
+	case map[string]interface{}:
+		id, ok = data["message_id"].(int)
+	}
+	return id, ok
+}
@@ -2,4 +2,11 @@ module github.com/axlesor/messaging-service
 
 go 1.13
 
-require github.com/gorilla/mux v1.7.3
+require (
+	github.com/gorilla/mux v1.7.3
+	github.com/jackc/pgx/v4 v4.18.1
+	github.com/mattn/go-sqlite3 v1.14.10
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.6.0
+	golang.org/x/text v0.7.0
+)
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC. With -grpc-port the node serves the Messaging service of
+// messaging.proto next to the REST API, over HTTP/2 with the TLS certificate
+// of -grpc-cert and -grpc-key:
+//
+//	Post       runs POST /{channel}/messages or /{channel}/thread/{reply_to}
+//	Get        runs GET /{channel}/messages?last_id=
+//	Subscribe  follows the channel like GET /{channel}/ws
+//
+// Post and Get go through the router like any other request, so they share
+// the storage, moderation, limits and pools of the REST API and answer with
+// its error messages. Metadata are HTTP/2 headers, authorization, x-username
+// and x-admin-token identify the caller as they do over REST, and
+// grpc-timeout is the budget of X-Request-Timeout. Messages are encoded by
+// hand, the handful of types here does not need a protobuf library
+var grpcPort string
+var grpcCert string
+var grpcKey string
+
+// the default limit of gRPC implementations
+const grpcMaxMessage = 4 << 20
+
+// status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK                = 0
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+var errCompressed = errors.New("Compressed messages are not supported")
+
+var grpcServer *http.Server
+
+// startGRPC serves the gRPC API until stopGRPC
+func startGRPC() {
+	grpcServer = &http.Server{Addr: grpcPort, Handler: http.HandlerFunc(handleGRPC)}
+	fmt.Println("Serving gRPC at port ", grpcPort)
+	go func() {
+		if err := grpcServer.ListenAndServeTLS(grpcCert, grpcKey); err != http.ErrServerClosed {
+			fmt.Println("Serving gRPC failed:", err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// stopGRPC lets the calls in flight finish once the streams were drained
+func stopGRPC() {
+	if grpcServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	grpcServer.Shutdown(ctx)
+}
+
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		respondJSON(w, http.StatusUnsupportedMediaType, "Expected a gRPC call over HTTP/2")
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		code, message := grpcInvalidArgument, err.Error()
+		switch err {
+		case errCompressed:
+			code = grpcUnimplemented
+		case errFrameTooBig:
+			code, message = grpcResourceExhausted, "The request message is larger than 4MiB"
+		}
+		finishGRPC(w, code, message)
+		return
+	}
+	switch r.URL.Path {
+	case "/messaging.Messaging/Post":
+		grpcPost(w, r, msg)
+	case "/messaging.Messaging/Get":
+		grpcGet(w, r, msg)
+	case "/messaging.Messaging/Subscribe":
+		grpcSubscribe(w, r, msg)
+	default:
+		w.WriteHeader(http.StatusOK)
+		finishGRPC(w, grpcUnimplemented, "Unknown method "+r.URL.Path)
+	}
+}
+
+// readGRPCMessage reads the single length prefixed message of a request
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(body, head); err != nil {
+		return nil, errors.New("Expected a request message")
+	}
+	if head[0] != 0 {
+		return nil, errCompressed
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > grpcMaxMessage {
+		return nil, errFrameTooBig
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, errors.New("Expected a request message")
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	head := make([]byte, 5)
+	binary.BigEndian.PutUint32(head[1:], uint32(len(msg)))
+	if _, err := w.Write(append(head, msg...)); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// finishGRPC ends the call with a status in the trailers
+func finishGRPC(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(message))
+	}
+}
+
+// grpcEscape percent-encodes what may not appear in grpc-message as is
+func grpcEscape(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < 0x20 || c > 0x7E || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcCode is the gRPC status of an HTTP one
+func grpcCode(status int) int {
+	switch {
+	case status < 300:
+		return grpcOK
+	case status == http.StatusBadRequest || status == http.StatusRequestEntityTooLarge:
+		return grpcInvalidArgument
+	case status == http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case status == http.StatusForbidden:
+		return grpcPermissionDenied
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return grpcNotFound
+	case status == http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case status == http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case status == http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case status == http.StatusInternalServerError:
+		return grpcInternal
+	}
+	return grpcUnknown
+}
+
+// errorText is the message of a REST error answer: a JSON string or the
+// error of a JSON object
+func errorText(body []byte) string {
+	var text string
+	if json.Unmarshal(body, &text) == nil {
+		return text
+	}
+	var answer struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &answer) == nil && answer.Error != "" {
+		return answer.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// dispatch runs a REST request on behalf of the call r, with its metadata as
+// headers
+func dispatch(r *http.Request, method, target string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusBadRequest, []byte(strconv.Quote(err.Error()))
+	}
+	req = req.WithContext(r.Context())
+	req.RemoteAddr = r.RemoteAddr
+	for name, values := range r.Header {
+		if !strings.HasPrefix(strings.ToLower(name), "grpc-") && name != "Content-Type" && name != "Te" {
+			req.Header[name] = values
+		}
+	}
+	if timeout, ok := grpcTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		req.Header.Set("X-Request-Timeout", timeout.String())
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return serveInternal(req)
+}
+
+// grpcTimeout reads grpc-timeout, a number and a unit like 500m or 10S
+func grpcTimeout(value string) (time.Duration, bool) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(value) < 2 {
+		return 0, false
+	}
+	unit, ok := units[value[len(value)-1]]
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// answer sends the response of a unary call, or the error of its REST answer
+func answer(w http.ResponseWriter, status int, body []byte, response func() []byte) {
+	w.WriteHeader(http.StatusOK)
+	if code := grpcCode(status); code != grpcOK {
+		finishGRPC(w, code, errorText(body))
+		return
+	}
+	writeGRPCMessage(w, response())
+	finishGRPC(w, grpcOK, "")
+}
+
+func grpcPost(w http.ResponseWriter, r *http.Request, msg []byte) {
+	var channel, priority string
+	var post Thread
+	var replyTo int64
+	err := decodeProto(msg, func(field int, n uint64, b []byte) {
+		switch field {
+		case 1:
+			channel = string(b)
+		case 2:
+			post.Username = string(b)
+		case 3:
+			post.Message = string(b)
+		case 4:
+			replyTo = int64(n)
+		case 5:
+			priority = string(b)
+		}
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		finishGRPC(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	target := "/" + url.PathEscape(channel) + "/messages"
+	body, _ := json.Marshal(map[string]string{"username": post.Username, "message": post.Message, "priority": priority})
+	if replyTo != 0 {
+		target = "/" + url.PathEscape(channel) + "/thread/" + strconv.FormatInt(replyTo, 10)
+		body, _ = json.Marshal(post)
+	}
+	status, answered := dispatch(r, http.MethodPost, target, body)
+	answer(w, status, answered, func() []byte {
+		var posted struct {
+			ID          int64 `json:"id"`
+			PendingID   int64 `json:"pending_id"`
+			Quarantined bool  `json:"quarantined"`
+		}
+		json.Unmarshal(answered, &posted)
+		b := protoInt(nil, 1, posted.ID)
+		b = protoInt(b, 2, posted.PendingID)
+		return protoBool(b, 3, posted.Quarantined)
+	})
+}
+
+// readChannelRequest decodes GetRequest and SubscribeRequest
+func readChannelRequest(msg []byte) (channel string, lastID int64, err error) {
+	err = decodeProto(msg, func(field int, n uint64, b []byte) {
+		switch field {
+		case 1:
+			channel = string(b)
+		case 2:
+			lastID = int64(n)
+		}
+	})
+	return channel, lastID, err
+}
+
+func grpcGet(w http.ResponseWriter, r *http.Request, msg []byte) {
+	channel, lastID, err := readChannelRequest(msg)
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		finishGRPC(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	status, answered := dispatch(r, http.MethodGet, "/"+url.PathEscape(channel)+"/messages?last_id="+strconv.FormatInt(lastID, 10), nil)
+	if status == http.StatusBadRequest && errorText(answered) == "No new message after last_id" {
+		// an empty list is no error here
+		status, answered = http.StatusOK, []byte("{}")
+	}
+	answer(w, status, answered, func() []byte {
+		var listing struct {
+			Messages []msgPost `json:"messages"`
+		}
+		json.Unmarshal(answered, &listing)
+		name := resolveChannel(channel)
+		newest := 0
+		if subject := lookupSubject(name); subject != nil {
+			subject.RLock()
+			newest = subject.lastID
+			subject.RUnlock()
+		}
+		b := protoMessage(nil, 1, protoInt(protoString(nil, 1, name), 2, int64(newest)))
+		for _, mesg := range listing.Messages {
+			b = protoMessage(b, 2, encodeMessage(mesg))
+		}
+		return b
+	})
+}
+
+func grpcSubscribe(w http.ResponseWriter, r *http.Request, msg []byte) {
+	channel, lastID, err := readChannelRequest(msg)
+	w.WriteHeader(http.StatusOK)
+	if err != nil {
+		finishGRPC(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	if !featureEnabled("streams") {
+		finishGRPC(w, grpcPermissionDenied, "The streams feature is turned off")
+		return
+	}
+	channel = resolveChannel(channel)
+	username := actingUser(r)
+	rd := readerOf(r)
+	subject := lookupSubject(channel)
+	newest := 0
+	if subject != nil {
+		subject.RLock()
+		allowed := rd.mayRead(subject)
+		newest = subject.lastID
+		subject.RUnlock()
+		if !allowed {
+			finishGRPC(w, grpcPermissionDenied, "This channel is private")
+			return
+		}
+	}
+	if p := pools["streams"]; p != nil {
+		if !p.acquire(r.Context(), poolWait) {
+			finishGRPC(w, grpcUnavailable, "Too many requests in progress, try again later")
+			return
+		}
+		defer p.release()
+	}
+	release, hit := acquireStream(channel, clientAddr(r), username)
+	if hit != nil {
+		finishGRPC(w, grpcResourceExhausted, fmt.Sprintf("Too many open streams, %s limit is %d", hit.Limit, hit.Max))
+		return
+	}
+	defer release()
+	keep, _ := parseFilter(url.Values{"type": {"message,thread"}})
+	keep = rd.stream(keep)
+	l := broker.Subscribe(channel, keep)
+	defer broker.Unsubscribe(channel, l)
+	if username != "" {
+		streamOpened(channel, username)
+		defer streamClosed(channel, username)
+	}
+	w.(http.Flusher).Flush()
+
+	// the client has what it asked the backlog after, or without a backlog
+	// what was there before it subscribed
+	cursor := newest
+	if lastID > 0 && int(lastID) < cursor {
+		cursor = int(lastID)
+	}
+	send := func(ev event) bool {
+		if mesg, ok := ev.Data.(msgPost); ok && ev.Type == "message" {
+			if mesg.Id <= cursor {
+				return true
+			}
+			cursor = mesg.Id
+		}
+		b, ok := encodeEvent(ev)
+		if !ok {
+			return true
+		}
+		if writeGRPCMessage(w, b) != nil {
+			return false
+		}
+		delivered(ev)
+		return true
+	}
+	if lastID > 0 && subject != nil {
+		subject.RLock()
+		backlog := rd.visible(subject.after(int(lastID)))
+		subject.RUnlock()
+		for _, mesg := range backlog {
+			if !send(event{Type: "message", Channel: channel, Data: mesg}) {
+				return
+			}
+		}
+	}
+	drain := drainSignal(channel)
+	for {
+		select {
+		case ev := <-l:
+			if !send(ev) {
+				return
+			}
+		case <-drain.done:
+			for buffered := true; buffered; {
+				select {
+				case ev := <-l:
+					if !send(ev) {
+						return
+					}
+				default:
+					buffered = false
+				}
+			}
+			finishGRPC(w, grpcUnavailable, "The node is draining ("+drain.reason+"), subscribe again with last_id "+strconv.Itoa(cursor))
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// encodeEvent is the Event of a message or thread event
+func encodeEvent(ev event) ([]byte, bool) {
+	b := protoString(protoString(nil, 1, ev.Type), 2, ev.Channel)
+	switch data := ev.Data.(type) {
+	case msgPost:
+		return protoMessage(b, 3, encodeMessage(data)), true
+	case map[string]interface{}:
+		id, _ := data["message_id"].(int)
+		reply, ok := data["thread"].(Thread)
+		if !ok {
+			return nil, false
+		}
+		return protoMessage(protoInt(b, 4, int64(id)), 5, encodeThread(reply)), true
+	}
+	return nil, false
+}
+
+func encodeMessage(mesg msgPost) []byte {
+	b := protoInt(nil, 1, int64(mesg.Id))
+	b = protoString(b, 2, mesg.Username)
+	b = protoString(b, 3, mesg.Message)
+	b = protoString(b, 4, mesg.Rendered)
+	for _, reply := range mesg.Threads {
+		b = protoMessage(b, 5, encodeThread(reply))
+	}
+	b = protoString(b, 6, mesg.Permalink)
+	b = protoString(b, 7, mesg.Created.Format(time.RFC3339Nano))
+	b = protoBool(b, 8, mesg.Locked)
+	b = protoBool(b, 9, mesg.Verified)
+	b = protoString(b, 10, mesg.Priority)
+	b = protoInt(b, 11, int64(mesg.ReactionCount))
+	b = protoBool(b, 12, mesg.Pinned)
+	b = protoString(b, 13, mesg.Type)
+	return protoString(b, 14, mesg.ULID)
+}
+
+func encodeThread(reply Thread) []byte {
+	b := protoString(nil, 1, reply.Username)
+	b = protoString(b, 2, reply.Message)
+	b = protoString(b, 3, reply.Rendered)
+	return protoBool(b, 4, reply.Verified)
+}
+
+// Protocol buffers wire format. Fields with the default value are left out
+// as proto3 does
+func protoKey(b []byte, field, wire int) []byte {
+	return protoVarint(b, uint64(field<<3|wire))
+}
+
+func protoVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func protoInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return protoVarint(protoKey(b, field, 0), uint64(v))
+}
+
+func protoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return protoInt(b, field, 1)
+}
+
+func protoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return append(protoVarint(protoKey(b, field, 2), uint64(len(s))), s...)
+}
+
+// protoMessage appends an embedded message, empty ones too
+func protoMessage(b []byte, field int, msg []byte) []byte {
+	return append(protoVarint(protoKey(b, field, 2), uint64(len(msg))), msg...)
+}
+
+// decodeProto calls found with every field of msg, the value of varints in n
+// and of length delimited fields in b. Fixed size fields are skipped
+func decodeProto(msg []byte, found func(field int, n uint64, b []byte)) error {
+	malformed := errors.New("Malformed request message")
+	for len(msg) > 0 {
+		key, size := binary.Uvarint(msg)
+		if size <= 0 {
+			return malformed
+		}
+		msg = msg[size:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			n, size := binary.Uvarint(msg)
+			if size <= 0 {
+				return malformed
+			}
+			msg = msg[size:]
+			found(field, n, nil)
+		case 1, 5:
+			skip := 8
+			if key&7 == 5 {
+				skip = 4
+			}
+			if len(msg) < skip {
+				return malformed
+			}
+			msg = msg[skip:]
+		case 2:
+			n, size := binary.Uvarint(msg)
+			if size <= 0 || uint64(len(msg)-size) < n {
+				return malformed
+			}
+			msg = msg[size:]
+			found(field, 0, msg[:n])
+			msg = msg[n:]
+		default:
+			return malformed
+		}
+	}
+	return nil
+}
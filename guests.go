@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Guests get a throw away guest-xxxx identity for public support style
+// channels. The name is reserved: posting or reading as guest-xxxx requires
+// the token handed out with it in the X-Guest-Token header
+const guestPrefix = "guest-"
+const guestTTL = 2 * time.Hour
+const guestSweepInterval = time.Minute
+
+type guest struct {
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var guestsMutex sync.Mutex
+var guests = make(map[string]*guest)
+
+func isGuest(username string) bool {
+	return strings.HasPrefix(username, guestPrefix)
+}
+
+// validGuest is true for regular usernames and for guests presenting the token
+// that was issued with their (unexpired) identity
+func validGuest(r *http.Request, username string) bool {
+	if !isGuest(username) {
+		return true
+	}
+	guestsMutex.Lock()
+	defer guestsMutex.Unlock()
+	g, ok := guests[username]
+	return ok && g.Token == r.Header.Get("X-Guest-Token") && time.Now().Before(g.ExpiresAt)
+}
+
+// curl -X POST http://localhost:8000/guests -v
+func postGuest(w http.ResponseWriter, r *http.Request) {
+	g := &guest{
+		Username:  guestPrefix + newToken()[:8],
+		Token:     newToken(),
+		ExpiresAt: time.Now().Add(guestTTL),
+	}
+	guestsMutex.Lock()
+	guests[g.Username] = g
+	logGlobal("guest_created", "guests", g.Username, g)
+	guestsMutex.Unlock()
+	respondJSON(w, http.StatusOK, g)
+}
+
+// curl -X PUT http://localhost:8000/gdgsas022/guests -H 'X-Username: arthur' -d '{"allow": true}' -v
+func putGuests(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	settings := struct {
+		Allow bool `json:"allow"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&settings); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can change guest access")
+		return
+	}
+	subject.allowGuests = settings.Allow
+	subject.logSettings("channel_updated")
+	publish(channel, "guests_changed", settings)
+	respondJSON(w, http.StatusOK, settings)
+}
+
+// sweepGuests forgets expired guests and everything they left behind in channels
+func sweepGuests(now time.Time) {
+	if isMirror() {
+		return
+	}
+	expired := []string{}
+	guestsMutex.Lock()
+	for name, g := range guests {
+		if now.After(g.ExpiresAt) {
+			delete(guests, name)
+			logGlobal("guest_expired", "guests", name, nil)
+			expired = append(expired, name)
+		}
+	}
+	guestsMutex.Unlock()
+	if len(expired) > 0 {
+		forgetGuests(expired)
+	}
+}
+
+func forgetGuests(usernames []string) {
+	globalMapMutex.RLock()
+	defer globalMapMutex.RUnlock()
+	for channel, subject := range liveMessages {
+		subject.Lock()
+		if subject.isArchived() {
+			subject.Unlock()
+			continue
+		}
+		forgot := false
+		for _, name := range usernames {
+			if subject.members[name] {
+				delete(subject.members, name)
+				forgot = true
+				publish(channel, "guest_expired", map[string]string{"username": name})
+			}
+		}
+		if forgot {
+			subject.logSettings("membership_changed")
+		}
+		subject.Unlock()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Message ids. Listings page with last_id, so whichever way ids are handed out
+// a new message gets one above the newest of its channel. -ids picks the way:
+//
+//	sequential  1, 2, 3... in each channel
+//	snowflake   a millisecond timestamp, the -id-node number and a sequence
+//	            in 63 bits, unique across a cluster, so messages fanned out
+//	            over NATS keep the id they were posted with. They go beyond
+//	            the 2^53 a JavaScript number holds exactly
+//	ulid        sequential, and each message carries a ULID as well, sortable
+//	            and unique anywhere, for systems keyed by strings
+//	client      sequential, unless the poster proposes an id above the newest,
+//	            by no more than clientIDWindow, for clients syncing what they
+//	            posted offline under the ids they showed meanwhile
+var idStrategy = "sequential"
+var idNode = -1
+
+type idGenerator interface {
+	// next is the id of a new message of s and its ULID, if it gets one.
+	// proposed is the id the message came with, 0 when none. Caller must hold
+	// the subject write lock
+	next(s *subject, proposed int) (int, string)
+}
+
+var ids idGenerator = sequentialIDs{}
+
+// startIDs checks -ids and -id-node
+func startIDs() error {
+	switch idStrategy {
+	case "sequential":
+		ids = sequentialIDs{}
+	case "client":
+		ids = clientIDs{}
+	case "ulid":
+		ids = &ulidIDs{}
+	case "snowflake":
+		if storageMode == "postgres" {
+			return errors.New("-ids snowflake needs 64 bit ids, the postgres schema keeps 32 bit ones")
+		}
+		if idNode < 0 {
+			h := fnv.New32a()
+			h.Write([]byte(nodeID))
+			idNode = int(h.Sum32() % snowflakeNodes)
+		}
+		if idNode >= snowflakeNodes {
+			return errors.New("-id-node should be below 1024")
+		}
+		ids = &snowflakeIDs{node: int64(idNode)}
+	default:
+		return errors.New("-ids should be sequential, snowflake, ulid or client")
+	}
+	return nil
+}
+
+type sequentialIDs struct{}
+
+func (sequentialIDs) next(s *subject, proposed int) (int, string) {
+	return s.lastID + 1, ""
+}
+
+type clientIDs struct{}
+
+// a proposed id may skip at most this far ahead of the newest of its channel,
+// so no single post uses up the ids after it
+const clientIDWindow = 1 << 20
+
+// proposalProblem is why the id a client proposed can not be had in s, ""
+// when it can. Caller must hold the subject lock
+func proposalProblem(s *subject, proposed int) string {
+	limit := s.lastID + clientIDWindow
+	if storageMode == "postgres" && limit > math.MaxInt32 {
+		// the postgres schema keeps 32 bit ids
+		limit = math.MaxInt32
+	}
+	if proposed > limit {
+		return "id should be at most " + strconv.Itoa(limit)
+	}
+	return ""
+}
+
+func (clientIDs) next(s *subject, proposed int) (int, string) {
+	if proposed > s.lastID {
+		return proposed, ""
+	}
+	return s.lastID + 1, ""
+}
+
+// 2020-01-01 UTC in milliseconds, snowflake timestamps count from there
+const snowflakeEpoch = 1577836800000
+const snowflakeNodes = 1 << 10
+const snowflakeSequence = 1 << 12
+
+type snowflakeIDs struct {
+	sync.Mutex
+	node int64
+	last int64 // millisecond of the newest id
+	seq  int64
+}
+
+func (g *snowflakeIDs) next(s *subject, proposed int) (int, string) {
+	// made by another node of the cluster, unique already
+	if proposed > s.lastID {
+		return proposed, ""
+	}
+	g.Lock()
+	defer g.Unlock()
+	if now := time.Now().UnixNano()/int64(time.Millisecond) - snowflakeEpoch; now > g.last {
+		g.last, g.seq = now, 0
+	} else if g.seq++; g.seq == snowflakeSequence {
+		// the sequence ran out, borrow the next millisecond
+		g.last, g.seq = g.last+1, 0
+	}
+	id := int(g.last<<22 | g.node<<12 | g.seq)
+	if id <= s.lastID {
+		id = s.lastID + 1
+	}
+	return id, ""
+}
+
+// Monotonic ULIDs: within a millisecond the random part counts up
+type ulidIDs struct {
+	sync.Mutex
+	last    int64
+	entropy [10]byte
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ulidIDs) next(s *subject, proposed int) (int, string) {
+	g.Lock()
+	defer g.Unlock()
+	if now := time.Now().UnixNano() / int64(time.Millisecond); now > g.last {
+		g.last = now
+		rand.Read(g.entropy[:])
+	} else {
+		for i := len(g.entropy) - 1; i >= 0; i-- {
+			if g.entropy[i]++; g.entropy[i] != 0 {
+				break
+			}
+		}
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(g.last)<<16)
+	copy(b[6:], g.entropy[:])
+	// 128 bits in 26 characters of 5 bits, the first one holds 3
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return s.lastID + 1, string(out)
+}
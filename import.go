@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Moderators bring history over from other systems with POST /{channel}/import,
+// either a JSON array of messages or one message a line. A message may carry
+// the time it was originally posted in created_at and its replies in thread:
+//
+//	{"username": "arthur", "message": "How are you", "created_at": "2019-03-01T10:00:00Z", "thread": [{"username": "sally", "message": "Fine"}]}
+//
+// The messages are appended in the order given, so their times may not go back
+// from one message to the next or before the newest message of the channel.
+// Either every message is imported or none is. Imported messages are never
+// verified, the names in another system prove nothing here. Slack and
+// Mattermost exports are taken as well, see slack.go and mattermost.go
+const maxImportBody = 64 << 20
+const maxImportMessages = 100000
+
+type importedPost struct {
+	Username  string     `json:"username"`
+	Message   string     `json:"message"`
+	CreatedAt *time.Time `json:"created_at"`
+	Priority  string     `json:"priority"`
+	Thread    []Thread   `json:"thread"`
+}
+
+// readImport decodes a JSON array or a stream of JSON objects
+func readImport(body *bufio.Reader) ([]importedPost, error) {
+	posts := []importedPost{}
+	decoder := json.NewDecoder(body)
+	// skip to the first byte that says which of the two it is
+	for {
+		b, err := body.Peek(1)
+		if err != nil {
+			return posts, nil
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		body.ReadByte()
+	}
+	array := false
+	if b, _ := body.Peek(1); b[0] == '[' {
+		decoder.Token()
+		array = true
+	}
+	for decoder.More() {
+		if len(posts) == maxImportMessages {
+			return nil, fmt.Errorf("at most %d messages can be imported at once", maxImportMessages)
+		}
+		post := importedPost{}
+		if err := decoder.Decode(&post); err != nil {
+			return nil, fmt.Errorf("message %d: %v", len(posts)+1, err)
+		}
+		posts = append(posts, post)
+	}
+	if array {
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return posts, nil
+}
+
+// check prepares an imported message, the error is safe to show the caller
+func (post *importedPost) check(previous, now time.Time) error {
+	post.Username = normalizeUsername(post.Username)
+	if post.Username == "" || post.Message == "" {
+		return fmt.Errorf("empty username or message")
+	}
+	if _, ok := priorityRank[post.Priority]; post.Priority != "" && !ok {
+		return fmt.Errorf("priority should be low, normal, high or urgent")
+	}
+	for i := range post.Thread {
+		reply := &post.Thread[i]
+		reply.Username = normalizeUsername(reply.Username)
+		if reply.Username == "" || reply.Message == "" {
+			return fmt.Errorf("reply %d: empty username or message", i+1)
+		}
+		reply.Rendered, reply.Verified = renderEmoji(reply.Message), false
+	}
+	if post.CreatedAt == nil {
+		return nil
+	}
+	if post.CreatedAt.After(now) {
+		return fmt.Errorf("created_at is in the future")
+	}
+	if post.CreatedAt.Before(previous) {
+		return fmt.Errorf("created_at is before the message ahead of it")
+	}
+	return nil
+}
+
+// checkImport prepares the imported messages, in order after previous. The
+// error is safe to show the caller
+func checkImport(posts []importedPost, previous time.Time) error {
+	now := time.Now()
+	for i := range posts {
+		if err := posts[i].check(previous, now); err != nil {
+			return fmt.Errorf("message %d: %v", i+1, err)
+		}
+		// a message without created_at is posted now
+		previous = now
+		if posts[i].CreatedAt != nil {
+			previous = *posts[i].CreatedAt
+		}
+	}
+	return nil
+}
+
+// Only moderators import, a channel that does not exist yet is created for the
+// importer once the messages checked out
+// curl -X POST http://localhost:8000/gdgsas022/import -H 'X-Username: arthur' --data-binary @history.ndjson -v
+func importMessages(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if shed(w) {
+		return
+	}
+
+	defer r.Body.Close()
+	body := http.MaxBytesReader(w, r.Body, maxImportBody)
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = channel
+	}
+	var posts []importedPost
+	var err error
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		posts, err = readImport(bufio.NewReader(body))
+	case "slack":
+		posts, err = readSlackImport(body, from)
+	case "mattermost":
+		posts, err = readMattermostImport(bufio.NewReader(body), from)
+	default:
+		respondJSON(w, http.StatusBadRequest, "format should be json, slack or mattermost")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(posts) == 0 {
+		respondJSON(w, http.StatusBadRequest, "Nothing to import")
+		return
+	}
+	// on their own first, a failed import must not leave a channel behind
+	if err := checkImport(posts, time.Time{}); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if maxChannelMessages > 0 && len(posts) > maxChannelMessages {
+		respondJSON(w, http.StatusForbidden, "Channel is full")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		username := actingUser(r)
+		if username == "" || isGuest(username) {
+			respondJSON(w, http.StatusForbidden, "Only moderators can import messages")
+			return
+		}
+		if subject = loadOrCreateSubject(channel, username); subject == nil {
+			respondJSON(w, http.StatusForbidden, "Channel limit reached")
+			return
+		}
+	}
+	// Critical region
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can import messages")
+		return
+	}
+	if subject.frozen {
+		respondJSON(w, http.StatusForbidden, "Channel is frozen")
+		return
+	}
+	if maxChannelMessages > 0 && subject.count()+len(posts) > maxChannelMessages {
+		respondJSON(w, http.StatusForbidden, "Channel is full")
+		return
+	}
+	// then after what the channel holds
+	if err := checkImport(posts, subject.lastActivity()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	first := 0
+	for _, post := range posts {
+		mesg := subject.add(msgPost{Username: post.Username, Message: post.Message, Priority: post.Priority, Threads: post.Thread})
+		if post.CreatedAt != nil {
+			subject.tally(mesg, -1)
+			mesg.Created = *post.CreatedAt
+			subject.Messages[len(subject.Messages)-1].Created = mesg.Created
+			subject.tally(mesg, 1)
+		}
+		if first == 0 {
+			first = mesg.Id
+		}
+		subject.logMessage(mesg.Id, "message_created")
+	}
+	// one event instead of a message event each, which would flood the streams
+	publish(channel, "messages_imported", map[string]int{"first_id": first, "last_id": subject.lastID, "count": len(posts)})
+	respondJSON(w, http.StatusOK, map[string]int{"imported": len(posts), "first_id": first, "last_id": subject.lastID})
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// An incident gets a channel of its own, incident-{id}, made from the template
+// named by -incident-template when there is one. Its status goes from
+// investigating to mitigated to resolved, every change is posted to the channel
+// with when and by whom. Closing a resolved incident writes its timeline, the
+// status changes and the messages in order, next to the closed channel log in
+// -closed-dir and closes the channel. Incidents are kept with the global state
+var incidentTemplate = "incident"
+
+var incidentStatuses = map[string]bool{"investigating": true, "mitigated": true, "resolved": true}
+
+type statusChange struct {
+	Status    string    `json:"status"`
+	At        time.Time `json:"at"`
+	By        string    `json:"by"`
+	Note      string    `json:"note,omitempty"`
+	MessageID int       `json:"message_id"` // the post announcing it
+}
+
+type incident struct {
+	Id       int            `json:"id"`
+	Title    string         `json:"title"`
+	Channel  string         `json:"channel"`
+	Status   string         `json:"status"`
+	Private  bool           `json:"private,omitempty"`
+	OpenedBy string         `json:"opened_by"`
+	OpenedAt time.Time      `json:"opened_at"`
+	Changes  []statusChange `json:"status_changes"`
+	ClosedAt *time.Time     `json:"closed_at,omitempty"`
+	Timeline string         `json:"timeline,omitempty"` // file written on close
+}
+
+type timelineEntry struct {
+	At       time.Time `json:"at"`
+	Type     string    `json:"type"` // status or message
+	Username string    `json:"username"`
+	Text     string    `json:"text,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	Replies  []Thread  `json:"replies,omitempty"`
+}
+
+var incidentsMutex sync.Mutex
+var incidents = make(map[int]*incident)
+var lastIncidentID int
+
+// visibleTo tells whether the incident may be seen at all by whoever made r
+func (inc incident) visibleTo(r *http.Request) bool {
+	return !inc.Private || isAdmin(r) || (actingUser(r) != "" && actingUser(r) == inc.OpenedBy)
+}
+
+// timeline merges the status changes with the messages, the posts announcing
+// the changes are left out
+func (inc incident) timeline(messages []msgPost) []timelineEntry {
+	entries := []timelineEntry{}
+	announced := make(map[int]bool)
+	for _, change := range inc.Changes {
+		announced[change.MessageID] = true
+		entries = append(entries, timelineEntry{At: change.At, Type: "status", Username: change.By, Text: change.Note, Status: change.Status})
+	}
+	for _, mesg := range messages {
+		if !announced[mesg.Id] {
+			entries = append(entries, timelineEntry{At: mesg.Created, Type: "message", Username: mesg.Username, Text: mesg.Message, Replies: mesg.Threads})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.Before(entries[j].At) })
+	return entries
+}
+
+// copied is the incident to use once incidentsMutex is let go. Caller must hold
+// incidentsMutex
+func (inc *incident) copied() incident {
+	c := *inc
+	c.Changes = append([]statusChange(nil), inc.Changes...)
+	return c
+}
+
+// findIncident answers the request itself when the incident can not be seen
+func findIncident(w http.ResponseWriter, r *http.Request) (incident, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return incident{}, false
+	}
+	incidentsMutex.Lock()
+	inc, ok := incidents[id]
+	found := incident{}
+	if ok {
+		found = inc.copied()
+	}
+	incidentsMutex.Unlock()
+	if !ok || !found.visibleTo(r) {
+		respondJSON(w, http.StatusNotFound, "No such incident")
+		return incident{}, false
+	}
+	return found, true
+}
+
+// updateIncident changes an incident and records the change, returns the
+// incident as changed
+func updateIncident(id int, change func(inc *incident)) incident {
+	incidentsMutex.Lock()
+	inc := incidents[id]
+	change(inc)
+	updated := inc.copied()
+	logGlobal("incident_updated", "incidents", strconv.Itoa(id), updated)
+	incidentsMutex.Unlock()
+	return updated
+}
+
+// announce posts a status change to the incident channel as a system message
+// and returns its id, 0 when the channel is gone
+func announce(channel, username, text string) int {
+	subject := lookupSubject(channel).lockLive()
+	if subject == nil {
+		return 0
+	}
+	defer subject.Unlock()
+	return subject.postSystem(systemEvent{Event: "incident_status", Username: username}, text).Id
+}
+
+// moderates tells whether r comes from a moderator of the incident channel,
+// answering the request itself when not
+func moderates(w http.ResponseWriter, r *http.Request, inc incident) (*subject, bool) {
+	subject := lookupSubject(inc.Channel)
+	if subject == nil {
+		respondJSON(w, http.StatusConflict, "The incident channel is gone")
+		return nil, false
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only moderators of the incident channel can do this")
+		return nil, false
+	}
+	return subject, true
+}
+
+// curl -X POST http://localhost:8000/incidents -H 'X-Username: arthur' -d '{"title": "Checkout is failing"}' -v
+func postIncident(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Title string `json:"title"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		respondJSON(w, http.StatusBadRequest, "Empty title!")
+		return
+	}
+	username := actingUser(r)
+	if username == "" || isGuest(username) {
+		respondJSON(w, http.StatusUnauthorized, "Opening an incident needs a registered username")
+		return
+	}
+	templatesMutex.RLock()
+	t := templates[incidentTemplate]
+	templatesMutex.RUnlock()
+	if !featureEnabled("integrations") {
+		t.Webhooks = nil
+	}
+
+	// a channel somebody made by hand may have taken the name already
+	var id int
+	var channel string
+	for {
+		incidentsMutex.Lock()
+		lastIncidentID++
+		id = lastIncidentID
+		incidentsMutex.Unlock()
+		channel = "incident-" + strconv.Itoa(id)
+		if resolveChannel(channel) != channel || lookupSubject(channel) != nil {
+			continue
+		}
+		status, problem := createChannel(channel, username, t)
+		if status == http.StatusConflict {
+			continue
+		}
+		if problem != "" {
+			respondJSON(w, status, problem)
+			return
+		}
+		break
+	}
+	hooks := createIntegrations(channel, username, t.Webhooks)
+
+	now := time.Now()
+	inc := &incident{Id: id, Title: req.Title, Channel: channel, Status: "investigating", Private: t.Private, OpenedBy: username, OpenedAt: now}
+	messageID := announce(channel, username, "Incident opened: "+req.Title+". Status: investigating")
+	inc.Changes = append(inc.Changes, statusChange{Status: inc.Status, At: now, By: username, MessageID: messageID})
+	incidentsMutex.Lock()
+	incidents[id] = inc
+	opened := inc.copied()
+	logGlobal("incident_opened", "incidents", strconv.Itoa(id), opened)
+	incidentsMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string]interface{}{"incident": opened, "integrations": hooks})
+}
+
+// Closed incidents are listed too, newest first
+// curl -X GET http://localhost:8000/incidents -H 'X-Username: arthur'
+func getIncidents(w http.ResponseWriter, r *http.Request) {
+	list := []incident{}
+	incidentsMutex.Lock()
+	for _, inc := range incidents {
+		list = append(list, inc.copied())
+	}
+	incidentsMutex.Unlock()
+	visible := []incident{}
+	for _, inc := range list {
+		if inc.visibleTo(r) {
+			visible = append(visible, inc)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool { return visible[i].Id > visible[j].Id })
+	respondJSON(w, http.StatusOK, map[string][]incident{"incidents": visible})
+}
+
+// curl -X GET http://localhost:8000/incidents/1 -H 'X-Username: arthur'
+func getIncident(w http.ResponseWriter, r *http.Request) {
+	if inc, ok := findIncident(w, r); ok {
+		respondJSON(w, http.StatusOK, inc)
+	}
+}
+
+// Channel moderators change the status, with an optional note
+// curl -X POST http://localhost:8000/incidents/1/status -H 'X-Username: arthur' -d '{"status": "mitigated", "note": "Rolled back to v41"}' -v
+func postIncidentStatus(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !incidentStatuses[req.Status] {
+		respondJSON(w, http.StatusBadRequest, "status should be investigating, mitigated or resolved")
+		return
+	}
+
+	inc, ok := findIncident(w, r)
+	if !ok {
+		return
+	}
+	if inc.ClosedAt != nil {
+		respondJSON(w, http.StatusConflict, "Incident is closed")
+		return
+	}
+	if req.Status == inc.Status {
+		respondJSON(w, http.StatusConflict, "Incident is "+inc.Status+" already")
+		return
+	}
+	if _, ok := moderates(w, r, inc); !ok {
+		return
+	}
+	text := "Status changed from " + inc.Status + " to " + req.Status
+	if req.Note != "" {
+		text += ": " + req.Note
+	}
+	change := statusChange{Status: req.Status, At: time.Now(), By: actor(r), Note: req.Note}
+	change.MessageID = announce(inc.Channel, actor(r), text)
+	inc = updateIncident(inc.Id, func(inc *incident) {
+		inc.Status = req.Status
+		inc.Changes = append(inc.Changes, change)
+	})
+	publish(inc.Channel, "incident_status", change)
+	respondJSON(w, http.StatusOK, inc)
+}
+
+// The timeline of an open incident is put together from its channel, that of a
+// closed one read back from the file written on close
+// curl -X GET http://localhost:8000/incidents/1/timeline -H 'X-Username: arthur'
+func getIncidentTimeline(w http.ResponseWriter, r *http.Request) {
+	inc, ok := findIncident(w, r)
+	if !ok {
+		return
+	}
+	if inc.ClosedAt != nil {
+		data, err := ioutil.ReadFile(inc.Timeline)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Reading the timeline failed: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	subject := lookupSubject(inc.Channel)
+	if subject == nil {
+		respondJSON(w, http.StatusConflict, "The incident channel is gone")
+		return
+	}
+	subject.RLock()
+	rd := readerOf(r)
+	allowed := rd.mayRead(subject)
+	messages := rd.visible(subject.all())
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"incident": inc, "timeline": inc.timeline(messages)})
+}
+
+// Only resolved incidents close, by a moderator of the incident channel
+// curl -X POST http://localhost:8000/incidents/1/close -H 'X-Username: arthur'
+func closeIncident(w http.ResponseWriter, r *http.Request) {
+	inc, ok := findIncident(w, r)
+	if !ok {
+		return
+	}
+	if inc.ClosedAt != nil {
+		respondJSON(w, http.StatusConflict, "Incident is closed")
+		return
+	}
+	if inc.Status != "resolved" {
+		respondJSON(w, http.StatusConflict, "Only resolved incidents can be closed")
+		return
+	}
+	if channelOnHold(inc.Channel) {
+		respondJSON(w, http.StatusConflict, "Channel is on legal hold")
+		return
+	}
+	subject, ok := moderates(w, r, inc)
+	if !ok {
+		return
+	}
+	path, stored, err := closeSubject(inc.Channel, subject, actor(r))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Writing the channel log failed: "+err.Error())
+		return
+	}
+	audit(auditEntry{Actor: actor(r), Action: "channel_closed", Channel: inc.Channel, Data: map[string]interface{}{"path": path, "messages": len(stored), "incident": inc.Id}})
+	messages := make([]msgPost, 0, len(stored))
+	for _, sp := range stored {
+		messages = append(messages, sp.message())
+	}
+	now := time.Now()
+	inc.ClosedAt = &now
+	inc.Timeline = strings.TrimSuffix(path, ".log") + ".timeline.json"
+	timeline, _ := json.Marshal(map[string]interface{}{"incident": inc, "timeline": inc.timeline(messages)})
+	if err := writeTimeline(inc.Timeline, timeline); err != nil {
+		// the channel is closed either way, its log has every message
+		inc.Timeline = ""
+		fmt.Println("Writing the timeline of incident", inc.Id, "failed:", err)
+	} else {
+		toS3(inc.Timeline, "closed/"+filepath.Base(inc.Timeline))
+	}
+	inc = updateIncident(inc.Id, func(closed *incident) {
+		closed.ClosedAt, closed.Timeline = inc.ClosedAt, inc.Timeline
+	})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"incident": inc, "path": path})
+}
+
+func writeTimeline(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
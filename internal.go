@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// The gRPC API and the MQTT bridge hand what they are asked to do to the
+// router as REST requests, so every protocol shares the same handlers,
+// storage, limits and pools
+var internalRouter http.Handler
+
+// recorder keeps what a REST handler answers
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header { return rec.header }
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+// serveInternal runs req through the router, returns the status and body it
+// was answered with
+func serveInternal(req *http.Request) (int, []byte) {
+	rec := &recorder{header: make(http.Header)}
+	internalRouter.ServeHTTP(rec, req)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.status, rec.body.Bytes()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// invite lets up to MaxUses people join a private channel until it expires
+type invite struct {
+	Token     string    `json:"token"`
+	Channel   string    `json:"channel"`
+	CreatedBy string    `json:"created_by"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+	URL       string    `json:"url"`
+}
+
+const defaultInviteTTL = 24 * time.Hour
+
+// Invites are looked up by token on redemption, so they live in their own map
+// instead of under the subject
+var invitesMutex sync.Mutex
+var invites = make(map[string]*invite)
+
+// canAccess reports whether username may read or post. Public channels are open
+// to everybody, private ones only to members. Guests need the channel to allow
+// them or an invite. Caller must hold the subject lock
+func (s *subject) canAccess(username string) bool {
+	if isGuest(username) {
+		return s.allowGuests || s.members[username]
+	}
+	return !s.private || s.isModerator(username) || s.members[username]
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// curl -X PUT http://localhost:8000/gdgsas022/visibility -H 'X-Username: arthur' -d '{"private": true}' -v
+func putVisibility(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	settings := struct {
+		Private bool `json:"private"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&settings); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can change channel visibility")
+		return
+	}
+	subject.private = settings.Private
+	subject.logSettings("channel_updated")
+	publish(channel, "visibility_changed", settings)
+	respondJSON(w, http.StatusOK, settings)
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/invites -H 'X-Username: arthur' -d '{"max_uses": 5, "expires_in": "2h"}' -v
+func postInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	req := struct {
+		MaxUses   int    `json:"max_uses"`
+		ExpiresIn string `json:"expires_in"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ttl := defaultInviteTTL
+	if req.ExpiresIn != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			respondJSON(w, http.StatusBadRequest, "expires_in should be a positive duration like 24h")
+			return
+		}
+	}
+	if req.MaxUses < 0 {
+		respondJSON(w, http.StatusBadRequest, "max_uses can not be negative")
+		return
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only moderators can create invites")
+		return
+	}
+
+	token := newToken()
+	inv := &invite{
+		Token:     token,
+		Channel:   channel,
+		CreatedBy: actingUser(r),
+		MaxUses:   req.MaxUses,
+		ExpiresAt: time.Now().Add(ttl),
+		URL:       "/invites/" + token,
+	}
+	invitesMutex.Lock()
+	invites[token] = inv
+	logGlobal("invite_created", "invites", token, inv)
+	invitesMutex.Unlock()
+	respondJSON(w, http.StatusOK, inv)
+}
+
+func getInvites(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only moderators can list invites")
+		return
+	}
+
+	list := []invite{}
+	now := time.Now()
+	invitesMutex.Lock()
+	defer invitesMutex.Unlock()
+	for token, inv := range invites {
+		if now.After(inv.ExpiresAt) {
+			// lazily drop expired invites, nothing else sweeps them
+			delete(invites, token)
+			continue
+		}
+		if inv.Channel == channel {
+			list = append(list, *inv)
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string][]invite{"invites": list})
+}
+
+func deleteInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only moderators can revoke invites")
+		return
+	}
+
+	invitesMutex.Lock()
+	inv, ok := invites[vars["token"]]
+	if !ok || inv.Channel != channel {
+		invitesMutex.Unlock()
+		respondJSON(w, http.StatusBadRequest, "Provided invite does not exist!")
+		return
+	}
+	delete(invites, inv.Token)
+	logGlobal("invite_revoked", "invites", inv.Token, nil)
+	invitesMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string]string{"revoked": inv.Token})
+}
+
+// curl -X POST http://localhost:8000/invites/<token> -H 'X-Username: sally' -v
+func redeemInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	username := actingUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusBadRequest, "Empty username!")
+		return
+	}
+
+	invitesMutex.Lock()
+	inv, ok := invites[vars["token"]]
+	expired := ok && time.Now().After(inv.ExpiresAt)
+	if expired {
+		delete(invites, inv.Token)
+		logGlobal("invite_expired", "invites", inv.Token, nil)
+		ok = false
+	}
+	if !ok {
+		invitesMutex.Unlock()
+		respondJSON(w, http.StatusGone, "Invite is expired or does not exist")
+		return
+	}
+	inv.Uses++
+	if inv.Uses >= inv.MaxUses {
+		delete(invites, inv.Token)
+		logGlobal("invite_redeemed", "invites", inv.Token, nil)
+	} else {
+		logGlobal("invite_redeemed", "invites", inv.Token, inv)
+	}
+	channel := inv.Channel
+	invitesMutex.Unlock()
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.members[username] {
+		subject.members[username] = true
+		subject.logSettings("membership_changed")
+		publish(channel, "member_joined", map[string]string{"username": username})
+		subject.postSystem(systemEvent{Event: "member_joined", Username: username}, username+" joined")
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"channel": channel, "username": username})
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Firehose to Kafka, for analytics, search indexing and audit pipelines:
+//
+//	-kafka kafka-1.internal:9092,kafka-2.internal:9092 -kafka-topic messaging
+//
+// Every message and thread reply posted on this node is produced to the topic
+// as the JSON /admin/firehose carries, {"type": "message", "channel": ...,
+// "data": ...}. The key is the channel, so the partition is the one the Java
+// client picks for it and a channel stays in order on a single partition.
+// Messages fanned out from other nodes over NATS are left to the node they
+// were posted to.
+//
+// Records wait in a buffer while Kafka can not be reached and the batch that
+// failed is produced again, backing off up to a minute, so a consumer may see
+// a record twice. A full buffer drops new records and says how many. Brokers
+// are spoken to in plaintext and without SASL
+const kafkaBuffer = 10000
+const kafkaBatchSize = 500
+const kafkaMaxBackoff = time.Minute
+const kafkaTimeout = 10 * time.Second
+
+var kafkaBrokers string
+var kafkaTopic = "messaging"
+var kafkaQueue chan event
+var kafkaDropped int64
+
+// Kafka API keys. Produce v3 and Metadata v1 are used, which Kafka speaks from
+// 0.11 to 4
+const (
+	kafkaProduce  = 0
+	kafkaMetadata = 3
+)
+
+// startKafka checks -kafka and starts producing
+func startKafka() error {
+	if kafkaBrokers == "" {
+		return nil
+	}
+	if kafkaTopic == "" {
+		return errors.New("-kafka-topic can not be empty")
+	}
+	bootstrap := []string{}
+	for addr := range splitSet(kafkaBrokers) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.New("-kafka should be comma separated host:port addresses of brokers")
+		}
+		bootstrap = append(bootstrap, addr)
+	}
+	kafkaQueue = make(chan event, kafkaBuffer)
+	broker.Handle(allChannels, toKafka)
+	go produceKafka(&kafkaSink{bootstrap: bootstrap, conns: make(map[string]*kafkaConn)})
+	return nil
+}
+
+// toKafka queues new messages and replies without ever blocking the publisher
+func toKafka(ev event) {
+	switch data := ev.Data.(type) {
+	case msgPost:
+		if ev.Type != "message" || relayedFrom(ev.Channel, data.Id) {
+			return
+		}
+	default:
+		if ev.Type != "thread" {
+			return
+		}
+	}
+	select {
+	case kafkaQueue <- ev:
+	default:
+		if atomic.AddInt64(&kafkaDropped, 1)%1000 == 1 {
+			fmt.Println("Kafka buffer is full, dropped", atomic.LoadInt64(&kafkaDropped), "records so far")
+		}
+	}
+}
+
+func produceKafka(k *kafkaSink) {
+	backoff := time.Second
+	for ev := range kafkaQueue {
+		batch := []event{ev}
+	fill:
+		for len(batch) < kafkaBatchSize {
+			select {
+			case ev := <-kafkaQueue:
+				batch = append(batch, ev)
+			default:
+				break fill
+			}
+		}
+		for {
+			err := k.send(batch)
+			if err == nil {
+				backoff = time.Second
+				break
+			}
+			k.reset()
+			fmt.Println("Producing to Kafka failed, retrying in", backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > kafkaMaxBackoff {
+				backoff = kafkaMaxBackoff
+			}
+		}
+	}
+}
+
+// kafkaSink keeps its connections and the partition leaders between batches,
+// both are looked up again after a failure
+type kafkaSink struct {
+	bootstrap   []string
+	conns       map[string]*kafkaConn
+	leaders     []string // address of the leader of each partition
+	correlation int32
+}
+
+type kafkaConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+type kafkaRecord struct {
+	key, value []byte
+}
+
+func (k *kafkaSink) send(batch []event) error {
+	if k.leaders == nil {
+		if err := k.refresh(); err != nil {
+			return err
+		}
+	}
+	partitions := make(map[int][]kafkaRecord)
+	for _, ev := range batch {
+		value, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		p := int(murmur2([]byte(ev.Channel))&0x7fffffff) % len(k.leaders)
+		partitions[p] = append(partitions[p], kafkaRecord{[]byte(ev.Channel), value})
+	}
+	for p, records := range partitions {
+		if err := k.produce(p, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *kafkaSink) reset() {
+	for addr, conn := range k.conns {
+		conn.Close()
+		delete(k.conns, addr)
+	}
+	k.leaders = nil
+}
+
+// refresh asks the bootstrap brokers, in turn, who leads each partition
+func (k *kafkaSink) refresh() error {
+	var err error
+	for _, addr := range k.bootstrap {
+		var leaders []string
+		if leaders, err = k.metadata(addr); err == nil {
+			k.leaders = leaders
+			return nil
+		}
+	}
+	return err
+}
+
+func (k *kafkaSink) metadata(addr string) ([]string, error) {
+	// Metadata v1: the topic asked about
+	body := kafkaString(kafkaInt32(nil, 1), kafkaTopic)
+	resp, err := k.request(addr, kafkaMetadata, 1, body)
+	if err != nil {
+		return nil, err
+	}
+	r := &kafkaReader{b: resp}
+	brokers := make(map[int32]string)
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // controller
+	var leaders []string
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		code, name := r.int16(), r.string()
+		r.int8() // internal
+		if name != kafkaTopic {
+			return nil, errors.New("metadata of another topic")
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("topic %s: Kafka error %d", kafkaTopic, code)
+		}
+		for m := r.int32(); m > 0 && r.err == nil; m-- {
+			r.int16() // error of the partition
+			index, leader := r.int32(), r.int32()
+			// replicas, then the in sync ones
+			for i := 0; i < 2; i++ {
+				for n := r.int32(); n > 0 && r.err == nil; n-- {
+					r.int32()
+				}
+			}
+			if r.err != nil || index < 0 || index > 1<<16 {
+				return nil, errors.New("malformed Kafka metadata")
+			}
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, "")
+			}
+			leaders[index] = brokers[leader]
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	for p, addr := range leaders {
+		if addr == "" {
+			return nil, fmt.Errorf("partition %d of %s has no leader", p, kafkaTopic)
+		}
+	}
+	if len(leaders) == 0 {
+		return nil, errors.New("topic " + kafkaTopic + " has no partitions")
+	}
+	return leaders, nil
+}
+
+// produce sends records to partition p and waits for all in sync replicas to
+// have them
+func (k *kafkaSink) produce(p int, records []kafkaRecord) error {
+	// Produce v3: no transaction, acks all, timeout, one topic and partition
+	body := kafkaInt16(nil, -1)
+	body = kafkaInt16(body, -1)
+	body = kafkaInt32(body, int32(kafkaTimeout/time.Millisecond))
+	body = kafkaString(kafkaInt32(body, 1), kafkaTopic)
+	body = kafkaInt32(kafkaInt32(body, 1), int32(p))
+	batch := kafkaRecordBatch(records, time.Now())
+	body = append(kafkaInt32(body, int32(len(batch))), batch...)
+	resp, err := k.request(k.leaders[p], kafkaProduce, 3, body)
+	if err != nil {
+		return err
+	}
+	r := &kafkaReader{b: resp}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.string()
+		for m := r.int32(); m > 0 && r.err == nil; m-- {
+			r.int32()
+			if code := r.int16(); code != 0 && r.err == nil {
+				return fmt.Errorf("partition %d of %s: Kafka error %d", p, kafkaTopic, code)
+			}
+			r.int64() // base offset
+			r.int64() // log append time
+		}
+	}
+	return r.err
+}
+
+// request sends a request to the broker at addr and returns the body of its
+// response
+func (k *kafkaSink) request(addr string, api, version int16, body []byte) ([]byte, error) {
+	conn := k.conns[addr]
+	if conn == nil {
+		c, err := net.DialTimeout("tcp", addr, kafkaTimeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = &kafkaConn{c, bufio.NewReader(c)}
+		k.conns[addr] = conn
+	}
+	k.correlation++
+	header := kafkaInt16(kafkaInt16(nil, api), version)
+	header = kafkaString(kafkaInt32(header, k.correlation), "messaging-"+nodeID)
+	frame := kafkaInt32(nil, int32(len(header)+len(body)))
+	conn.SetDeadline(time.Now().Add(2 * kafkaTimeout))
+	if _, err := conn.Write(append(append(frame, header...), body...)); err != nil {
+		return nil, err
+	}
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(conn.r, size); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size)
+	if n < 4 || n > 64<<20 {
+		return nil, fmt.Errorf("a Kafka response of %d bytes", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn.r, resp); err != nil {
+		return nil, err
+	}
+	if int32(binary.BigEndian.Uint32(resp)) != k.correlation {
+		return nil, errors.New("a Kafka response to another request")
+	}
+	return resp[4:], nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaRecordBatch is records in the v2 format Kafka keeps them in
+func kafkaRecordBatch(records []kafkaRecord, now time.Time) []byte {
+	at := now.UnixNano() / int64(time.Millisecond)
+	var recs []byte
+	for i, rec := range records {
+		// attributes, timestamp and offset deltas, key, value, no headers
+		b := []byte{0}
+		b = kafkaVarint(b, 0)
+		b = kafkaVarint(b, int64(i))
+		b = append(kafkaVarint(b, int64(len(rec.key))), rec.key...)
+		b = append(kafkaVarint(b, int64(len(rec.value))), rec.value...)
+		b = kafkaVarint(b, 0)
+		recs = append(kafkaVarint(recs, int64(len(b))), b...)
+	}
+	// attributes, last offset delta, first and max timestamp, no producer id,
+	// epoch or sequence, then the records
+	tail := kafkaInt16(nil, 0)
+	tail = kafkaInt32(tail, int32(len(records)-1))
+	tail = kafkaInt64(kafkaInt64(tail, at), at)
+	tail = kafkaInt64(tail, -1)
+	tail = kafkaInt16(tail, -1)
+	tail = kafkaInt32(tail, -1)
+	tail = append(kafkaInt32(tail, int32(len(records))), recs...)
+
+	// base offset, length, leader epoch, magic, crc of the tail
+	head := kafkaInt64(nil, 0)
+	head = kafkaInt32(head, int32(4+1+4+len(tail)))
+	head = append(kafkaInt32(head, -1), 2)
+	head = kafkaInt32(head, int32(crc32.Checksum(tail, castagnoli)))
+	return append(head, tail...)
+}
+
+// murmur2 is the hash the Java client picks the partition of a key with
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) % 4 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+func kafkaInt16(b []byte, v int16) []byte {
+	return append(b, byte(uint16(v)>>8), byte(v))
+}
+
+func kafkaInt32(b []byte, v int32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(v))
+	return append(b, buf[:]...)
+}
+
+func kafkaInt64(b []byte, v int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	return append(b, buf[:]...)
+}
+
+func kafkaString(b []byte, s string) []byte {
+	return append(kafkaInt16(b, int16(len(s))), s...)
+}
+
+// kafkaVarint is the zigzag varint of records
+func kafkaVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// kafkaReader reads a response, the first error sticks and the rest reads
+// zeros
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err == nil && len(r.b) < n {
+		r.err = errors.New("a short Kafka response")
+	}
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	return int8(r.next(1)[0])
+}
+
+func (r *kafkaReader) int16() int16 {
+	return int16(binary.BigEndian.Uint16(r.next(2)))
+}
+
+func (r *kafkaReader) int32() int32 {
+	return int32(binary.BigEndian.Uint32(r.next(4)))
+}
+
+func (r *kafkaReader) int64() int64 {
+	return int64(binary.BigEndian.Uint64(r.next(8)))
+}
+
+// string reads a string, a null one as empty
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A legal hold keeps content that may be needed as evidence. Admins place it
+// on a channel, which then keeps every message, or on a user, whose messages
+// stay wherever they were posted. Held content is exempt from retention and
+// message TTLs, and a held channel survives the demo wipe. The content comes
+// due again once the hold is lifted. Every placed and lifted hold goes to the
+// audit log
+type legalHold struct {
+	Reason string    `json:"reason"`
+	By     string    `json:"placed_by"`
+	Since  time.Time `json:"since"`
+}
+
+var holdsMutex sync.RWMutex
+var channelHolds = make(map[string]legalHold)
+var userHolds = make(map[string]legalHold)
+
+func channelOnHold(channel string) bool {
+	holdsMutex.RLock()
+	defer holdsMutex.RUnlock()
+	_, held := channelHolds[channel]
+	return held
+}
+
+// heldUsers is the set of users on hold, nil when there are none
+func heldUsers() map[string]bool {
+	holdsMutex.RLock()
+	defer holdsMutex.RUnlock()
+	if len(userHolds) == 0 {
+		return nil
+	}
+	held := make(map[string]bool, len(userHolds))
+	for username := range userHolds {
+		held[username] = true
+	}
+	return held
+}
+
+// expireAround is expire for a channel with messages of held users: those
+// stay and the oldest of the others go one by one. Returns the ids removed.
+// Caller must hold the subject write lock
+func (s *subject) expireAround(policy retentionPolicy, now time.Time, held map[string]bool) []int {
+	excess := 0
+	if policy.MaxMessages > 0 && s.count() > policy.MaxMessages {
+		excess = s.count() - policy.MaxMessages
+	}
+	cutoff := now.Add(-policy.MaxAge)
+	if excess == 0 && (policy.MaxAge <= 0 || s.olderThan(cutoff) == 0) {
+		return nil
+	}
+	gone := []int{}
+	for _, mesg := range s.all() {
+		if held[mesg.Username] {
+			continue
+		}
+		if len(gone) >= excess && (policy.MaxAge <= 0 || !mesg.Created.Before(cutoff)) {
+			break
+		}
+		gone = append(gone, mesg.Id)
+	}
+	for _, id := range gone {
+		s.remove(id)
+		delete(s.expiring, id)
+	}
+	return gone
+}
+
+// curl -X GET http://localhost:8000/admin/legal-holds -H 'X-Admin-Token: secret'
+func getLegalHolds(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	holdsMutex.RLock()
+	defer holdsMutex.RUnlock()
+	respondJSON(w, http.StatusOK, map[string]map[string]legalHold{"channels": channelHolds, "users": userHolds})
+}
+
+// curl -X PUT http://localhost:8000/admin/legal-holds/channels/gdgsas022 -H 'X-Admin-Token: secret' -d '{"reason": "case 2026-114"}'
+func putChannelHold(w http.ResponseWriter, r *http.Request) {
+	setHold(w, r, "channel", true)
+}
+
+func deleteChannelHold(w http.ResponseWriter, r *http.Request) {
+	setHold(w, r, "channel", false)
+}
+
+// curl -X PUT http://localhost:8000/admin/legal-holds/users/sally -H 'X-Admin-Token: secret' -d '{"reason": "case 2026-114"}'
+func putUserHold(w http.ResponseWriter, r *http.Request) {
+	setHold(w, r, "user", true)
+}
+
+func deleteUserHold(w http.ResponseWriter, r *http.Request) {
+	setHold(w, r, "user", false)
+}
+
+func setHold(w http.ResponseWriter, r *http.Request, kind string, place bool) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	vars := mux.Vars(r)
+	hold := legalHold{}
+	if place {
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		if err := decoder.Decode(&hold); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if hold.Reason == "" {
+			respondJSON(w, http.StatusBadRequest, "A hold needs a reason")
+			return
+		}
+		hold.By, hold.Since = actor(r), time.Now()
+	}
+	entry := auditEntry{Actor: actor(r), Action: "legal_hold_lifted"}
+	holds := userHolds
+	if kind == "channel" {
+		// held channels need not exist, a hold may come before the content
+		entry.Channel = resolveChannel(vars["channel"])
+		holds = channelHolds
+	} else {
+		entry.Username = normalizeUsername(vars["username"])
+	}
+	name := entry.Channel + entry.Username
+
+	holdsMutex.Lock()
+	previous, held := holds[name]
+	if place {
+		holds[name] = hold
+		logGlobal("legal_hold_placed", kind+"_holds", name, hold)
+	} else if held {
+		delete(holds, name)
+		logGlobal("legal_hold_released", kind+"_holds", name, nil)
+	}
+	holdsMutex.Unlock()
+	if !place && !held {
+		respondJSON(w, http.StatusNotFound, "No hold on this "+kind)
+		return
+	}
+	if place {
+		entry.Action = "legal_hold_placed"
+		entry.Data = hold
+	} else {
+		entry.Data = previous
+	}
+	audit(entry)
+	if !place {
+		respondJSON(w, http.StatusOK, map[string]bool{"held": false})
+		return
+	}
+	respondJSON(w, http.StatusOK, hold)
+}
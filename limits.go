@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Caps on open event streams, 0 means unlimited. Every stream holds a file
+// descriptor and a share of the fan-out work of its channel
+var maxStreams int
+var maxStreamsPerClient int
+var maxStreamsPerUser int
+var maxChannelSubscribers int
+
+var streamsMutex sync.Mutex
+var openStreams int
+var streamsByClient = make(map[string]int)
+var streamsByUser = make(map[string]int)
+var subscribersByChannel = make(map[string]int)
+
+// streamLimit names the cap a stream ran into
+type streamLimit struct {
+	Limit string `json:"limit"`
+	Max   int    `json:"max"`
+}
+
+// acquireStream books a stream of client (and username when known) on channel.
+// On success release has to be called when the stream ends, otherwise the
+// limit that was hit is returned
+func acquireStream(channel, client, username string) (release func(), hit *streamLimit) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	switch {
+	case maxStreams > 0 && openStreams >= maxStreams:
+		return nil, &streamLimit{"total", maxStreams}
+	case maxStreamsPerClient > 0 && streamsByClient[client] >= maxStreamsPerClient:
+		return nil, &streamLimit{"per_client", maxStreamsPerClient}
+	case maxStreamsPerUser > 0 && username != "" && streamsByUser[username] >= maxStreamsPerUser:
+		return nil, &streamLimit{"per_user", maxStreamsPerUser}
+	case maxChannelSubscribers > 0 && channel != allChannels && subscribersByChannel[channel] >= maxChannelSubscribers:
+		return nil, &streamLimit{"per_channel", maxChannelSubscribers}
+	}
+	openStreams++
+	streamsByClient[client]++
+	if username != "" {
+		streamsByUser[username]++
+	}
+	subscribersByChannel[channel]++
+	return func() {
+		streamsMutex.Lock()
+		defer streamsMutex.Unlock()
+		openStreams--
+		decrement(streamsByClient, client)
+		if username != "" {
+			decrement(streamsByUser, username)
+		}
+		decrement(subscribersByChannel, channel)
+	}, nil
+}
+
+func decrement(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// openStream books the stream or answers 429 telling which limit was hit
+func openStream(w http.ResponseWriter, r *http.Request, channel, username string) (func(), bool) {
+	release, hit := acquireStream(channel, clientAddr(r), username)
+	if hit != nil {
+		respondJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"error": "Too many open streams",
+			"limit": hit.Limit,
+			"max":   hit.Max,
+		})
+		return nil, false
+	}
+	return release, true
+}
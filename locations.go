@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// A message may carry a place, for field teams telling each other where they
+// are or what they found:
+//
+//	{"username": "arthur", "message": "pump is down", "location": {"lat": 52.52, "lon": 13.405, "label": "Station 4"}}
+//
+// /{channel}/nearby finds the messages with a location within a radius
+type location struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Label string  `json:"label,omitempty"`
+}
+
+const maxLocationLabel = 100
+const maxNearbyRadius = 1000 * 1000 // meters
+const earthRadius = 6371000         // meters
+
+func (l *location) validate() error {
+	if math.IsNaN(l.Lat) || l.Lat < -90 || l.Lat > 90 {
+		return errors.New("lat should be between -90 and 90")
+	}
+	if math.IsNaN(l.Lon) || l.Lon < -180 || l.Lon > 180 {
+		return errors.New("lon should be between -180 and 180")
+	}
+	if utf8.RuneCountInString(l.Label) > maxLocationLabel {
+		return errors.New("label should be at most " + strconv.Itoa(maxLocationLabel) + " characters")
+	}
+	return nil
+}
+
+// distance is the great circle distance in meters
+func (l location) distance(to location) float64 {
+	rad := math.Pi / 180
+	dLat := (to.Lat - l.Lat) * rad
+	dLon := (to.Lon - l.Lon) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(l.Lat*rad)*math.Cos(to.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+type nearbyPost struct {
+	msgPost
+	Distance float64 `json:"distance_m"`
+}
+
+// Messages with a location within radius_m meters of lat,lon, nearest first
+// curl -X GET 'http://localhost:8000/gdgsas022/nearby?lat=52.52&lon=13.405&radius_m=2000' -v
+func getNearby(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	query := r.URL.Query()
+	center := location{}
+	var err error
+	if center.Lat, err = strconv.ParseFloat(query.Get("lat"), 64); err != nil {
+		respondJSON(w, http.StatusBadRequest, "lat should be a number")
+		return
+	}
+	if center.Lon, err = strconv.ParseFloat(query.Get("lon"), 64); err != nil {
+		respondJSON(w, http.StatusBadRequest, "lon should be a number")
+		return
+	}
+	if err := center.validate(); err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	radius, err := strconv.ParseFloat(query.Get("radius_m"), 64)
+	if err != nil || !(radius > 0 && radius <= maxNearbyRadius) {
+		respondJSON(w, http.StatusBadRequest, "radius_m should be a distance in meters up to "+strconv.Itoa(maxNearbyRadius))
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	rd := readerOf(r)
+	if !rd.mayRead(subject) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	found := []nearbyPost{}
+	for _, mesg := range rd.visible(subject.all()) {
+		if mesg.Location == nil {
+			continue
+		}
+		if d := center.distance(*mesg.Location); d <= radius {
+			found = append(found, nearbyPost{msgPost: mesg, Distance: math.Round(d)})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Distance < found[j].Distance })
+	respondJSON(w, http.StatusOK, map[string][]nearbyPost{"messages": found})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Long polling. GET /messages?last_id=5&wait=30s holds on to the request until
+// a message after last_id arrives, instead of the client asking again and
+// again. Every channel has a condition its waiters sleep on, broadcast by
+// closing a Go channel so that a waiter can also give up when the wait is
+// over, the client goes away or the node drains. A wait that runs out is
+// answered like a poll that found nothing
+const maxWait = time.Minute
+
+// parseWait reads the wait parameter, 0 when there is none
+func parseWait(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, true
+	}
+	wait, err := time.ParseDuration(value)
+	return wait, err == nil && wait >= 0 && wait <= maxWait
+}
+
+// wake lets everybody waiting for a message go. Caller must hold the subject
+// write lock
+func (s *subject) wake() {
+	s.waitMutex.Lock()
+	defer s.waitMutex.Unlock()
+	if s.arrived != nil {
+		close(s.arrived)
+		s.arrived = nil
+	}
+}
+
+// arrival is closed by the next wake. Caller must hold the subject lock, so no
+// message can arrive between looking and waiting
+func (s *subject) arrival() <-chan struct{} {
+	s.waitMutex.Lock()
+	defer s.waitMutex.Unlock()
+	if s.arrived == nil {
+		s.arrived = make(chan struct{})
+	}
+	return s.arrived
+}
+
+// listing is what GET /messages answers r with after lastID. Caller must hold
+// the subject lock
+func (s *subject) listing(r *http.Request, lastID int) []msgPost {
+	newer := readerOf(r).visible(s.after(lastID))
+	if r.URL.Query().Get("system") == "false" {
+		newer = withoutSystem(newer)
+	}
+	return newer
+}
+
+// awaitListing waits up to wait for listing to have something. Like the Wait
+// of a sync.Cond it is called with the read lock held and lets go of it while
+// waiting
+func (s *subject) awaitListing(r *http.Request, lastID int, wait time.Duration) []msgPost {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	drain := drainSignal(s.title)
+	for {
+		if newer := s.listing(r, lastID); len(newer) > 0 {
+			return newer
+		}
+		arrived := s.arrival()
+		s.RUnlock()
+		woken := false
+		select {
+		case <-arrived:
+			woken = true
+		case <-timer.C:
+		case <-drain.done:
+		case <-r.Context().Done():
+		}
+		s.RLock()
+		if !woken {
+			return s.listing(r, lastID)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mattermost bulk exports, a JSON object a line: a version line, then teams,
+// channels, users and posts. Importing with format=mattermost takes the posts
+// of the channel named in from, the channel imported into by default, with
+// their replies as the thread:
+//
+//	curl -X POST 'http://localhost:8000/gdgsas022/import?format=mattermost&from=town-square' -H 'X-Username: arthur' --data-binary @export.jsonl
+//
+// Exporting with format=mattermost writes the channel and its posts in the
+// form mattermost import bulk takes, in the team named in team, messaging by
+// default. The users have to be in Mattermost already
+type mattermostLine struct {
+	Type    string             `json:"type"`
+	Version int                `json:"version,omitempty"`
+	Channel *mattermostChannel `json:"channel,omitempty"`
+	Post    *mattermostPost    `json:"post,omitempty"`
+}
+
+type mattermostChannel struct {
+	Team        string `json:"team"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Type        string `json:"type"`
+}
+
+type mattermostPost struct {
+	Team     string           `json:"team,omitempty"`
+	Channel  string           `json:"channel,omitempty"`
+	User     string           `json:"user"`
+	Message  string           `json:"message"`
+	CreateAt int64            `json:"create_at"` // milliseconds
+	Replies  []mattermostPost `json:"replies,omitempty"`
+}
+
+// readMattermostImport converts the posts of the channel from of a bulk export
+func readMattermostImport(body *bufio.Reader, from string) ([]importedPost, error) {
+	found := []mattermostPost{}
+	decoder := json.NewDecoder(body)
+	for line := 1; decoder.More(); line++ {
+		entry := mattermostLine{}
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if entry.Type != "post" || entry.Post == nil || entry.Post.Channel != from {
+			continue
+		}
+		if len(found) == maxImportMessages {
+			return nil, fmt.Errorf("at most %d messages can be imported at once", maxImportMessages)
+		}
+		found = append(found, *entry.Post)
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("the export has no posts in %s, name the channel to import with from", from)
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].CreateAt < found[j].CreateAt })
+
+	posts := []importedPost{}
+	for _, post := range found {
+		if strings.TrimSpace(post.Message) == "" {
+			continue
+		}
+		created := time.Unix(0, post.CreateAt*int64(time.Millisecond)).UTC()
+		imported := importedPost{Username: post.User, Message: post.Message, CreatedAt: &created}
+		for _, reply := range post.Replies {
+			if strings.TrimSpace(reply.Message) != "" {
+				imported.Thread = append(imported.Thread, Thread{Username: reply.User, Message: reply.Message})
+			}
+		}
+		posts = append(posts, imported)
+	}
+	return posts, nil
+}
+
+// exportMattermost writes the history as a bulk export, the replies a
+// millisecond apart after their post since they carry no time here
+func exportMattermost(w http.ResponseWriter, channel, team string, next func(int) []msgPost, rd reader) {
+	encoder := json.NewEncoder(w)
+	encoder.Encode(mattermostLine{Type: "version", Version: 1})
+	encoder.Encode(mattermostLine{Type: "channel", Channel: &mattermostChannel{Team: team, Name: channel, DisplayName: channel, Type: "O"}})
+	pages(next, rd, func(page []msgPost) error {
+		for _, mesg := range page {
+			created := mesg.Created.UnixNano() / int64(time.Millisecond)
+			post := mattermostPost{Team: team, Channel: channel, User: mesg.Username, Message: mesg.Message, CreateAt: created}
+			for i, reply := range mesg.Threads {
+				post.Replies = append(post.Replies, mattermostPost{User: reply.Username, Message: reply.Message, CreateAt: created + int64(i+1)})
+			}
+			if err := encoder.Encode(mattermostLine{Type: "post", Post: &post}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
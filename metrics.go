@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -metrics serves request latency histograms for the post and list paths at
+// GET /metrics in the OpenMetrics text format. -tracing makes the node take
+// part in W3C trace context: the trace of an incoming traceparent header is
+// kept, a request without one starts a new trace, and the response carries the
+// traceparent either way. With both on, every histogram bucket carries the
+// trace of the newest sampled request that fell in it as an exemplar, so a
+// spike in the p99 leads straight to a trace that caused it
+var metricsEnabled bool
+var tracingEnabled bool
+
+// upper bounds of the latency buckets, in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+type histogram struct {
+	counts    []uint64 // one a bucket, +Inf last, not cumulative
+	exemplars []*exemplar
+	sum       float64
+	count     uint64
+}
+
+var metricsMutex sync.Mutex
+var latencies = make(map[string]*histogram) // by route
+
+func observe(route string, seconds float64, traceID string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	h := latencies[route]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1), exemplars: make([]*exemplar, len(latencyBuckets)+1)}
+		latencies[route] = h
+	}
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+	if traceID != "" {
+		h.exemplars[i] = &exemplar{traceID: traceID, value: seconds, at: time.Now()}
+	}
+}
+
+// traceContext is the trace a request belongs to, from its traceparent header
+// or a new one. sampled is the flag of the caller, new traces are sampled
+func traceContext(r *http.Request) (traceID string, sampled bool) {
+	// version-traceid-parentid-flags
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) == 4 && len(parts[0]) == 2 && parts[0] != "ff" && isLowerHex(parts[1], 32) && isLowerHex(parts[2], 16) && isLowerHex(parts[3], 2) &&
+		parts[1] != strings.Repeat("0", 32) && parts[2] != strings.Repeat("0", 16) {
+		flags, _ := strconv.ParseUint(parts[3], 16, 8)
+		return parts[1], flags&1 == 1
+	}
+	return randomHex(16), true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// timed records the latency of handler under route. Streams are not worth
+// timing, they last as long as the client stays
+func timed(route string, handler http.HandlerFunc) http.HandlerFunc {
+	if !metricsEnabled && !tracingEnabled {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		traceID, sampled := "", false
+		if tracingEnabled {
+			traceID, sampled = traceContext(r)
+			flags := "00"
+			if sampled {
+				flags = "01"
+			}
+			// this node is the parent of whatever the caller does next
+			w.Header().Set("traceparent", "00-"+traceID+"-"+randomHex(8)+"-"+flags)
+		}
+		start := time.Now()
+		handler(w, r)
+		if !metricsEnabled {
+			return
+		}
+		if !sampled {
+			traceID = ""
+		}
+		observe(route, time.Since(start).Seconds(), traceID)
+	}
+}
+
+// curl -X GET http://localhost:8000/metrics
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMutex.Lock()
+	routes := make([]string, 0, len(latencies))
+	for route := range latencies {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	var b strings.Builder
+	b.WriteString("# TYPE messaging_request_duration_seconds histogram\n")
+	b.WriteString("# UNIT messaging_request_duration_seconds seconds\n")
+	b.WriteString("# HELP messaging_request_duration_seconds Time taken to answer posts and listings.\n")
+	for _, route := range routes {
+		h := latencies[route]
+		var cumulative uint64
+		for i, n := range h.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = fmt.Sprint(latencyBuckets[i])
+			}
+			fmt.Fprintf(&b, "messaging_request_duration_seconds_bucket{route=%q,le=%q} %d", route, le, cumulative)
+			if e := h.exemplars[i]; e != nil {
+				fmt.Fprintf(&b, " # {trace_id=%q} %g %.3f", e.traceID, e.value, float64(e.at.UnixNano())/1e9)
+			}
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "messaging_request_duration_seconds_sum{route=%q} %g\n", route, h.sum)
+		fmt.Fprintf(&b, "messaging_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+	metricsMutex.Unlock()
+	b.WriteString("# TYPE messaging_events_published counter\n")
+	b.WriteString("# HELP messaging_events_published Events published to the broker.\n")
+	fmt.Fprintf(&b, "messaging_events_published_total %d\n", atomic.LoadInt64(&broker.published))
+	b.WriteString("# TYPE messaging_events_dropped counter\n")
+	b.WriteString("# HELP messaging_events_dropped Events a subscriber missed because its buffer was full.\n")
+	fmt.Fprintf(&b, "messaging_events_dropped_total %d\n", atomic.LoadInt64(&broker.dropped))
+	b.WriteString("# TYPE messaging_reads_coalesced counter\n")
+	b.WriteString("# HELP messaging_reads_coalesced Listings answered with the bytes of an identical one running at the same time.\n")
+	fmt.Fprintf(&b, "messaging_reads_coalesced_total %d\n", atomic.LoadInt64(&coalescedReads))
+	if s3Bucket != "" {
+		b.WriteString("# TYPE messaging_object_uploads counter\n")
+		b.WriteString("# HELP messaging_object_uploads Files copied to object storage, or given up on.\n")
+		fmt.Fprintf(&b, "messaging_object_uploads_total{result=\"uploaded\"} %d\n", atomic.LoadInt64(&s3Uploaded))
+		fmt.Fprintf(&b, "messaging_object_uploads_total{result=\"failed\"} %d\n", atomic.LoadInt64(&s3Failed))
+	}
+	if shedHighWater > 0 {
+		writeShedMetrics(&b)
+	}
+	if len(pools) > 0 {
+		writePoolMetrics(&b)
+	}
+	if pageCacheMB > 0 {
+		writePageCacheMetrics(&b)
+	}
+	if slaTarget > 0 {
+		writeLatencyMetrics(&b)
+	}
+	b.WriteString("# EOF\n")
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A mirror is a standby node started with -mirror pointing at a primary. It
+// follows GET /admin/replication there, a backup first and then every change
+// record as it is made (see wal.go), and keeps a warm copy of all channels.
+// Mirrors serve reads and refuse writes until they are promoted for a manual
+// failover:
+//
+//	messaging-service -port :8001 -admin-token secret -mirror http://10.0.0.1:8000
+//	messaging-service promote -server http://localhost:8001 -admin-token secret
+//
+// Both nodes need the same -admin-token. A mirror that loses the primary or
+// falls too far behind starts over with a fresh backup. Streams opened on a
+// mirror see no events, the copy changes underneath them. Jobs and handlers
+// acting on the data, sweeping, reaping, archiving, emptying the trash,
+// running reminders, mailing digests, welcoming, pushing and calling webhooks,
+// leave it to the primary and start once the mirror is promoted
+var mirrorOf string
+
+const heartbeatInterval = 10 * time.Second
+const mirrorRetry = 5 * time.Second
+
+// mirroring is 1 until the mirror is promoted, read on every request
+var mirroring int32
+
+// mirrorMutex guards mirrorStatus and keeps a promotion from landing in the
+// middle of applying a record
+var mirrorMutex sync.Mutex
+var mirrorStatus struct {
+	Primary    string     `json:"primary"`
+	Connected  bool       `json:"connected"`
+	Syncs      int        `json:"syncs"`
+	Applied    int        `json:"applied"`
+	LastRecord time.Time  `json:"last_record"`
+	LastError  string     `json:"last_error,omitempty"`
+	PromotedAt *time.Time `json:"promoted_at,omitempty"`
+}
+var stopMirror = make(chan struct{})
+
+var errPromoted = errors.New("promoted")
+
+func isMirror() bool {
+	return atomic.LoadInt32(&mirroring) == 1
+}
+
+// mirrorMiddleware refuses writes on a mirror, admin and internal calls aside
+func mirrorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMirror() && r.Method != "GET" && !strings.HasPrefix(r.URL.Path, "/admin/") && !strings.HasPrefix(r.URL.Path, "/internal/") {
+			respondJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "This node is a read only mirror", "primary": mirrorOf})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Streams a backup followed by every change record, with a heartbeat when
+// nothing happens. A mirror that does not keep up is cut off
+// curl -N http://localhost:8000/admin/replication -H 'X-Admin-Token: secret'
+func streamReplication(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	// subscribe before the backup is taken: records made meanwhile are both
+	// in the backup and in the feed, which does no harm
+	feed := make(chan walRecord, feedBuffer)
+	subscribe(feed, true, math.MaxInt64)
+	defer unsubscribe(feed)
+
+	drain := drainSignal(allChannels)
+	flusher := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(takeBackup()); err != nil {
+		return
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case rec, ok := <-feed:
+			if !ok || encoder.Encode(rec) != nil {
+				return
+			}
+		case now := <-heartbeat.C:
+			if encoder.Encode(walRecord{At: now, Kind: "heartbeat"}) != nil {
+				return
+			}
+		case <-drain.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// followPrimary keeps the mirror in sync until it is promoted
+func followPrimary() {
+	for {
+		err := syncFromPrimary()
+		mirrorMutex.Lock()
+		mirrorStatus.Connected = false
+		if err != nil && err != errPromoted {
+			mirrorStatus.LastError = err.Error()
+		}
+		mirrorMutex.Unlock()
+		select {
+		case <-stopMirror:
+			return
+		case <-time.After(mirrorRetry):
+		}
+	}
+}
+
+func syncFromPrimary() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopMirror:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, "GET", mirrorOf+"/admin/replication", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Admin-Token", adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(resp.Status + ": " + string(msg))
+	}
+	// a primary that goes quiet, heartbeats included, is given up on
+	watchdog := time.AfterFunc(3*heartbeatInterval, cancel)
+	defer watchdog.Stop()
+
+	decoder := json.NewDecoder(resp.Body)
+	b := backup{}
+	if err := decoder.Decode(&b); err != nil {
+		return err
+	}
+	err = whileMirroring(func() error {
+		if err := restoreBackup(b); err != nil {
+			return err
+		}
+		mirrorStatus.Connected = true
+		mirrorStatus.Syncs++
+		mirrorStatus.LastRecord = b.TakenAt
+		mirrorStatus.LastError = ""
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		rec := walRecord{}
+		if err := decoder.Decode(&rec); err != nil {
+			return err
+		}
+		watchdog.Reset(3 * heartbeatInterval)
+		if rec.Kind == "restored" {
+			return errors.New("the primary was restored from a backup")
+		}
+		err := whileMirroring(func() error {
+			if rec.Kind != "heartbeat" {
+				if err := applyRecord(rec); err != nil {
+					return err
+				}
+				mirrorStatus.Applied++
+			}
+			mirrorStatus.LastRecord = rec.At
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// whileMirroring runs apply under mirrorMutex unless the node got promoted
+func whileMirroring(apply func() error) error {
+	mirrorMutex.Lock()
+	defer mirrorMutex.Unlock()
+	if !isMirror() {
+		return errPromoted
+	}
+	return apply()
+}
+
+// applyRecord makes a change of the primary here and records it in turn, for
+// the log on disk and for mirrors of this mirror
+func applyRecord(rec walRecord) error {
+	switch rec.Kind {
+	case "global":
+		g := takeGlobals()
+		if err := g.apply(*rec.Global); err != nil {
+			return err
+		}
+		restoreGlobals(g)
+	case "globals":
+		restoreGlobals(*rec.Globals)
+	case "dropped":
+		replaceSubject(rec.Channel, nil)
+	case "channel":
+		replaceSubject(rec.Channel, restoreSnapshot(*rec.Settings))
+	case "settings":
+		if s := lookupSubject(rec.Channel); s != nil {
+			s.Lock()
+			s.applySettings(*rec.Settings)
+			if s.private {
+				forgetChannelPages(rec.Channel)
+			}
+			s.Unlock()
+		} else {
+			replaceSubject(rec.Channel, restoreSettings(*rec.Settings))
+		}
+	case "message":
+		if s := lookupSubject(rec.Channel); s != nil {
+			s.Lock()
+			s.upsert(rec.Message.message())
+			forgetPages(rec.Channel, rec.Message.Id, rec.Message.Id)
+			s.Unlock()
+		}
+	case "removed":
+		if s := lookupSubject(rec.Channel); s != nil {
+			s.Lock()
+			for _, id := range rec.Removed {
+				delete(s.expiring, id)
+				s.remove(id)
+			}
+			if n := s.below(rec.Before); n > 0 {
+				s.dropOldest(n)
+			}
+			s.forgetRemoved(rec.Removed, rec.Before)
+			s.Unlock()
+		}
+	}
+	appendWAL(rec)
+	return nil
+}
+
+// replaceSubject puts s in place of the channel, nil drops it
+func replaceSubject(channel string, s *subject) {
+	globalMapMutex.Lock()
+	old := liveMessages[channel]
+	if s == nil {
+		delete(liveMessages, channel)
+	} else {
+		liveMessages[channel] = s
+	}
+	globalMapMutex.Unlock()
+	forgetChannelPages(channel)
+	if old != nil {
+		old.Lock()
+		for _, b := range old.cold {
+			b.discard()
+		}
+		old.Unlock()
+	}
+}
+
+// upsert puts a message made on another node in place as it is. A message
+// that is not here although its id was handed out is gone already. Caller
+// must hold the subject write lock
+func (s *subject) upsert(mesg msgPost) {
+	if existing := s.mutableMessage(mesg.Id); existing != nil {
+		s.tally(*existing, -1)
+		*existing = mesg
+		s.tally(mesg, 1)
+		return
+	}
+	if mesg.Id <= s.lastID {
+		return
+	}
+	s.lastID = mesg.Id
+	if mesg.ExpiresAt != nil {
+		s.expiring[mesg.Id] = *mesg.ExpiresAt
+	}
+	i := sort.Search(len(s.Messages), func(i int) bool { return s.Messages[i].Id >= mesg.Id })
+	s.Messages = append(s.Messages, msgPost{})
+	copy(s.Messages[i+1:], s.Messages[i:])
+	s.Messages[i] = mesg
+	s.tally(mesg, 1)
+	s.wake()
+}
+
+// curl -X GET http://localhost:8001/admin/mirror -H 'X-Admin-Token: secret'
+func getMirror(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	if mirrorOf == "" {
+		respondJSON(w, http.StatusBadRequest, "This node is not a mirror")
+		return
+	}
+	mirrorMutex.Lock()
+	defer mirrorMutex.Unlock()
+	status := map[string]interface{}{"mirroring": isMirror(), "status": mirrorStatus}
+	if !mirrorStatus.LastRecord.IsZero() {
+		status["lag"] = time.Since(mirrorStatus.LastRecord).String()
+	}
+	respondJSON(w, http.StatusOK, status)
+}
+
+// Promotes the mirror to a primary: it stops following and accepts writes.
+// Whatever the primary wrote after the last record that arrived is not here
+// curl -X POST http://localhost:8001/admin/promote -H 'X-Admin-Token: secret'
+func postPromote(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	mirrorMutex.Lock()
+	defer mirrorMutex.Unlock()
+	if !isMirror() {
+		respondJSON(w, http.StatusConflict, "This node is not a mirror")
+		return
+	}
+	atomic.StoreInt32(&mirroring, 0)
+	close(stopMirror)
+	now := time.Now()
+	mirrorStatus.PromotedAt = &now
+	respondJSON(w, http.StatusOK, map[string]interface{}{"promoted_at": now, "last_record": mirrorStatus.LastRecord, "applied": mirrorStatus.Applied})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// A post from an untrusted user waiting for a moderator while the channel is
+// pre-moderated. It gets a real message id only once approved
+type pendingPost struct {
+	PendingId int    `json:"pending_id"`
+	Username  string `json:"username"`
+	Message   string `json:"message"`
+	Verified  bool   `json:"verified"`
+	Priority  string `json:"priority,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
+	Quote     *quote `json:"quoted_message,omitempty"`
+	// moderators review the whole snippet
+	Snippet       *snippet   `json:"snippet,omitempty"`
+	SnippetBody   string     `json:"snippet_body,omitempty"`
+	Location      *location  `json:"location,omitempty"`
+	VoiceNote     *voiceNote `json:"voice_note,omitempty"`
+	VoiceNoteData []byte     `json:"voice_note_data,omitempty"`
+	// why the scanner held the post back, see scanning.go
+	Quarantine *scanVerdict `json:"quarantine,omitempty"`
+}
+
+// actingUser is whoever the X-Username header claims to be, the same level of
+// trust the service already gives to the username field of a post. Registered
+// and guest names are only honoured together with their token, and a bearer
+// token alone identifies its registered owner
+func actingUser(r *http.Request) string {
+	username := normalizeUsername(r.Header.Get("X-Username"))
+	if username == "" {
+		return tokenOwner(r)
+	}
+	if !mayActAs(r, username) {
+		return ""
+	}
+	return username
+}
+
+// Callers of the role helpers below must hold the subject lock
+func (s *subject) isModerator(username string) bool {
+	return username != "" && (username == s.owner || s.moderators[username])
+}
+
+func (s *subject) isTrusted(username string) bool {
+	return s.isModerator(username) || s.trusted[username]
+}
+
+func (s *subject) enqueue(mesg msgPost) int {
+	s.nextPendingID++
+	p := pendingPost{PendingId: s.nextPendingID, Username: mesg.Username, Message: mesg.Message, Verified: mesg.Verified, Priority: mesg.Priority, TTL: mesg.TTL, Quote: mesg.Quote, Snippet: mesg.Snippet, Location: mesg.Location, VoiceNote: mesg.VoiceNote}
+	if mesg.Snippet != nil {
+		p.SnippetBody = mesg.Snippet.body
+	}
+	if mesg.VoiceNote != nil {
+		p.VoiceNoteData = mesg.VoiceNote.data
+	}
+	s.pending = append(s.pending, p)
+	return s.nextPendingID
+}
+
+// dequeue removes and returns the pending post, ok is false if there is none
+func (s *subject) dequeue(pendingID int) (pendingPost, bool) {
+	for i, p := range s.pending {
+		if p.PendingId == pendingID {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return p, true
+		}
+	}
+	return pendingPost{}, false
+}
+
+// publishPending tells the channel that a pending post changed by its
+// pending_id only, a held back post is nobody's business but the moderators'.
+// They get the whole post on their sync streams. Caller must hold the subject
+// lock
+func (s *subject) publishPending(channel, kind string, p pendingPost) {
+	publish(channel, kind, map[string]int{"pending_id": p.PendingId})
+	if s.owner != "" && !s.moderators[s.owner] {
+		notifyUser(s.owner, channel, kind, p)
+	}
+	for username := range s.moderators {
+		notifyUser(username, channel, kind, p)
+	}
+}
+
+// curl -X PUT http://localhost:8000/gdgsas022/moderation -H 'X-Username: arthur' -d '{"premoderate": true}' -v
+func putModeration(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	settings := struct {
+		Premoderate bool `json:"premoderate"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&settings); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can change moderation settings")
+		return
+	}
+	subject.premoderate = settings.Premoderate
+	subject.logSettings("channel_updated")
+	publish(channel, "moderation_changed", settings)
+	respondJSON(w, http.StatusOK, settings)
+}
+
+// Only the channel owner hands out moderator rights
+func putModerator(w http.ResponseWriter, r *http.Request) {
+	setRole(w, r, true, true)
+}
+
+func deleteModerator(w http.ResponseWriter, r *http.Request) {
+	setRole(w, r, true, false)
+}
+
+// Moderators decide whose posts skip the queue
+func putTrusted(w http.ResponseWriter, r *http.Request) {
+	setRole(w, r, false, true)
+}
+
+func deleteTrusted(w http.ResponseWriter, r *http.Request) {
+	setRole(w, r, false, false)
+}
+
+func setRole(w http.ResponseWriter, r *http.Request, moderator bool, grant bool) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	username := normalizeUsername(vars["username"])
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if isGuest(username) {
+		respondJSON(w, http.StatusBadRequest, "Guests can not be given channel roles")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	roles := subject.trusted
+	if moderator {
+		if actingUser(r) != subject.owner {
+			respondJSON(w, http.StatusForbidden, "Only the channel owner can change moderators")
+			return
+		}
+		roles = subject.moderators
+	} else if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can change trusted users")
+		return
+	}
+	if grant {
+		roles[username] = true
+	} else {
+		delete(roles, username)
+	}
+	subject.logSettings("roles_changed")
+	respondJSON(w, http.StatusOK, map[string]bool{username: grant})
+}
+
+// curl -X GET http://localhost:8000/gdgsas022/queue -H 'X-Username: arthur' -v
+func getQueue(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can see the queue")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string][]pendingPost{"pending": subject.pending})
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/queue/1/approve -H 'X-Username: arthur' -v
+func approvePending(w http.ResponseWriter, r *http.Request) {
+	resolvePending(w, r, true)
+}
+
+func rejectPending(w http.ResponseWriter, r *http.Request) {
+	resolvePending(w, r, false)
+}
+
+func resolvePending(w http.ResponseWriter, r *http.Request, approve bool) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	pendingID, err := strconv.Atoi(vars["pending_id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "pending_id should be an integer")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	// the backlink of a quote is recorded once the channel is unlocked
+	var quoting *msgPost
+	defer func() {
+		if quoting != nil {
+			recordQuote(channel, *quoting)
+		}
+	}()
+	// Critical region
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can resolve the queue")
+		return
+	}
+	if approve && subject.frozen {
+		respondJSON(w, http.StatusForbidden, "Channel is frozen")
+		return
+	}
+	if approve && maxChannelMessages > 0 && subject.count() >= maxChannelMessages {
+		respondJSON(w, http.StatusForbidden, "Channel is full")
+		return
+	}
+	pending, ok := subject.dequeue(pendingID)
+	if !ok {
+		respondJSON(w, http.StatusBadRequest, "Provided pending_id does not exist!")
+		return
+	}
+	if !approve {
+		subject.logSettings("message_rejected")
+		subject.publishPending(channel, "message_rejected", pending)
+		respondJSON(w, http.StatusOK, map[string]int{"pending_id": pendingID})
+		return
+	}
+	mesg := msgPost{Username: pending.Username, Message: pending.Message, Verified: pending.Verified, Priority: pending.Priority, TTL: pending.TTL, Quote: pending.Quote, Location: pending.Location}
+	if pending.Snippet != nil {
+		sn := *pending.Snippet
+		sn.body = pending.SnippetBody
+		mesg.Snippet = &sn
+	}
+	if pending.VoiceNote != nil {
+		vn := *pending.VoiceNote
+		vn.data = pending.VoiceNoteData
+		mesg.VoiceNote = &vn
+	}
+	// the clock of the TTL starts once the message is visible
+	if err := subject.setTTL(&mesg); err != nil {
+		mesg.TTL = ""
+	}
+	mesg = subject.add(mesg)
+	subject.logMessage(mesg.Id, "message_created")
+	quoting = &mesg
+	subject.logSettings("message_approved")
+	// the message itself goes out as the message event
+	publish(channel, "message_approved", map[string]int{"pending_id": pendingID, "message_id": mesg.Id})
+	publish(channel, "message", mesg)
+	subject.notifyPost(notice{MessageID: mesg.Id, Username: mesg.Username, Message: mesg.Message, Priority: mesg.Priority})
+	respondJSON(w, http.StatusOK, map[string]int{"id": mesg.Id})
+	// End of Critical region
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/messages/1/lock -H 'X-Username: arthur' -v
+func lockThread(w http.ResponseWriter, r *http.Request) {
+	setThreadLock(w, r, true)
+}
+
+func unlockThread(w http.ResponseWriter, r *http.Request) {
+	setThreadLock(w, r, false)
+}
+
+func setThreadLock(w http.ResponseWriter, r *http.Request, locked bool) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can lock threads")
+		return
+	}
+	mesg := subject.mutableMessage(id)
+	if mesg == nil {
+		respondJSON(w, http.StatusBadRequest, "Provided messageId does not exist!")
+		return
+	}
+	mesg.Locked = locked
+	subject.logMessage(id, "message_updated")
+	kind := "thread_unlocked"
+	if locked {
+		kind = "thread_locked"
+	}
+	publish(channel, kind, map[string]int{"message_id": id})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"id": id, "locked": locked})
+}
+
+// Frozen channels stay readable but refuse new posts and pins, e.g. during an
+// incident or before archiving
+// curl -X PUT http://localhost:8000/gdgsas022/freeze -H 'X-Username: arthur' -d '{"frozen": true}' -v
+func putFreeze(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	settings := struct {
+		Frozen bool `json:"frozen"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&settings); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can freeze the channel")
+		return
+	}
+	if subject.frozen != settings.Frozen {
+		subject.frozen = settings.Frozen
+		subject.logSettings("channel_updated")
+		kind, text := "channel_unfrozen", actor(r)+" unfroze the channel"
+		if settings.Frozen {
+			kind, text = "channel_frozen", actor(r)+" froze the channel"
+		}
+		publish(channel, kind, map[string]string{"by": actingUser(r)})
+		subject.postSystem(systemEvent{Event: kind, Username: actor(r)}, text)
+	}
+	respondJSON(w, http.StatusOK, settings)
+}
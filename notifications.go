@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Users following a channel, that is with a read marker in it, and users
+// mentioned as @name get a "notification" event on their sync stream for new
+// messages and replies:
+//
+//	{"type": "notification", "channel": "foo", "data": {"reason": "mention", "message_id": 41, "username": "sally", ...}}
+//
+// Before anything is delivered the preferences of the recipient are asked:
+// muted channels stay silent, mentions_only drops everything but mentions and
+// nothing short of an urgent message gets through do-not-disturb hours, which
+// are in the timezone of the user. Every notifier has to go through
+// wantsNotification, push.go sends the same to phones
+type notificationPrefs struct {
+	Muted        []string     `json:"muted"`
+	MentionsOnly bool         `json:"mentions_only"`
+	Timezone     string       `json:"timezone"` // IANA name, empty is UTC
+	DoNotDisturb []quietHours `json:"do_not_disturb"`
+	// email digests of unread messages, hourly, daily or weekly, see digests.go
+	Email  string `json:"email,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// quietHours is a daily window such as 22:00 to 07:00, on Days only when given.
+// A window past midnight belongs to the day it starts on
+type quietHours struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Days []string `json:"days,omitempty"` // mon, tue, ...
+}
+
+type notice struct {
+	Reason    string `json:"reason"` // mention or message
+	MessageID int    `json:"message_id"`
+	Reply     bool   `json:"reply,omitempty"`
+	Username  string `json:"username"`
+	Message   string `json:"message"`
+	Priority  string `json:"priority,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+var prefsMutex sync.Mutex
+var preferences = make(map[string]notificationPrefs)
+
+// clockMinutes parses "15:04" into minutes after midnight
+func clockMinutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.New("Times should look like 22:00, not " + clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (p *notificationPrefs) validate() error {
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return errors.New("Unknown timezone " + p.Timezone)
+	}
+	for _, window := range p.DoNotDisturb {
+		for _, clock := range []string{window.From, window.To} {
+			if _, err := clockMinutes(clock); err != nil {
+				return err
+			}
+		}
+		for _, day := range window.Days {
+			if _, ok := weekdays[day]; !ok {
+				return errors.New("Days should be mon, tue, wed, thu, fri, sat or sun")
+			}
+		}
+	}
+	for i, channel := range p.Muted {
+		p.Muted[i] = resolveChannel(channel)
+	}
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil {
+			return errors.New("Not an email address: " + p.Email)
+		}
+		p.Email = addr.Address
+	}
+	if p.Digest == "off" {
+		p.Digest = ""
+	}
+	if _, ok := digestPeriods[p.Digest]; p.Digest != "" && !ok {
+		return errors.New("digest should be hourly, daily, weekly or off")
+	}
+	if p.Digest != "" && p.Email == "" {
+		return errors.New("A digest needs an email address")
+	}
+	return nil
+}
+
+// quiet reports whether now falls into do-not-disturb hours
+func (p notificationPrefs) quiet(now time.Time) bool {
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return false
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	for _, window := range p.DoNotDisturb {
+		from, _ := clockMinutes(window.From)
+		to, _ := clockMinutes(window.To)
+		day := local.Weekday()
+		inside := from <= minute && minute < to
+		if from > to {
+			inside = minute >= from || minute < to
+			if minute < to {
+				day = local.AddDate(0, 0, -1).Weekday()
+			}
+		}
+		if inside && onDay(window.Days, day) {
+			return true
+		}
+	}
+	return false
+}
+
+func onDay(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, name := range days {
+		if weekdays[name] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsNotification is where every notifier asks whether username is to be
+// told about a post on channel
+func wantsNotification(username, channel string, n notice, now time.Time) bool {
+	prefsMutex.Lock()
+	p, ok := preferences[username]
+	prefsMutex.Unlock()
+	if !ok {
+		return true
+	}
+	for _, muted := range p.Muted {
+		if muted == channel {
+			return false
+		}
+	}
+	if p.MentionsOnly && n.Reason != "mention" {
+		return false
+	}
+	return n.Priority == "urgent" || !p.quiet(now)
+}
+
+// mentioned lists the @names in text
+func mentioned(text string) map[string]bool {
+	names := make(map[string]bool)
+	for _, word := range strings.Fields(text) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimRightFunc(word[1:], func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if name = normalizeUsername(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// notifyPost tells mentioned users and followers of the channel about a new
+// message or reply. Caller must hold the subject lock
+func (s *subject) notifyPost(n notice) {
+	recipients := make(map[string]string)
+	markersMutex.Lock()
+	for username, markers := range readMarkers {
+		if _, following := markers[s.title]; following {
+			recipients[username] = "message"
+		}
+	}
+	markersMutex.Unlock()
+	for username := range mentioned(n.Message) {
+		recipients[username] = "mention"
+	}
+	delete(recipients, n.Username)
+
+	now := time.Now()
+	for username, reason := range recipients {
+		n.Reason = reason
+		if s.canAccess(username) && !hasBlocked(username, n.Username) && wantsNotification(username, s.title, n, now) {
+			notifyUser(username, s.title, "notification", n)
+			pushNotice(username, s.title, n)
+		}
+	}
+}
+
+// curl -X GET http://localhost:8000/notification-preferences -H 'Authorization: Bearer <token>' -v
+func getNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Notification preferences need a registered username or a guest token")
+		return
+	}
+	prefsMutex.Lock()
+	p := preferences[username]
+	prefsMutex.Unlock()
+	respondJSON(w, http.StatusOK, p)
+}
+
+// Replaces the preferences of the user
+// curl -X PUT http://localhost:8000/notification-preferences -H 'Authorization: Bearer <token>' -d '{"muted": ["random"], "timezone": "Europe/Berlin", "do_not_disturb": [{"from": "22:00", "to": "07:00"}]}' -v
+func putNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Notification preferences need a registered username or a guest token")
+		return
+	}
+	p := notificationPrefs{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&p); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := p.validate(); err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefsMutex.Lock()
+	preferences[username] = p
+	logGlobal("preferences_changed", "notification_preferences", username, p)
+	prefsMutex.Unlock()
+	respondJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With -s3-bucket everything written for keeping is copied to S3 or any
+// compatible object storage (MinIO, Ceph, R2...) as well: archived channels
+// with their history blocks, snapshots, closed channel logs and incident
+// timelines, and the backups of POST /admin/backup.
+//
+//	-s3-endpoint https://s3.eu-west-1.amazonaws.com -s3-region eu-west-1 -s3-bucket chat-archive -s3-prefix node-a/
+//
+// Objects are addressed path style, endpoint/bucket/prefix + key, with keys
+// like snapshots/20261015T150405.000000000Z.json.gz. The credentials come
+// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, never
+// from flags that show up in ps. Uploads run in the background and are tried
+// again a few times, the local copy is written first either way
+const s3Buffer = 1000
+const s3Attempts = 5
+
+var s3Endpoint = "https://s3.amazonaws.com"
+var s3Region = "us-east-1"
+var s3Bucket string
+var s3Prefix string
+var s3Queue chan s3Upload
+var s3Uploaded, s3Failed int64
+
+type s3Upload struct {
+	path, key string
+}
+
+type s3Credentials struct {
+	accessKey, secretKey, sessionToken string
+}
+
+var s3Creds s3Credentials
+
+// startS3 checks the object storage settings and starts uploading
+func startS3() error {
+	if s3Bucket == "" {
+		return nil
+	}
+	u, err := url.Parse(s3Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("-s3-endpoint should be an http(s) URL")
+	}
+	s3Creds = s3Credentials{os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}
+	if s3Creds.accessKey == "" || s3Creds.secretKey == "" {
+		return errors.New("-s3-bucket needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	s3Queue = make(chan s3Upload, s3Buffer)
+	go uploadS3()
+	return nil
+}
+
+// toS3 copies the file at path to key in the bucket, later
+func toS3(path, key string) {
+	if s3Queue == nil {
+		return
+	}
+	select {
+	case s3Queue <- s3Upload{path, filepath.ToSlash(key)}:
+	default:
+		atomic.AddInt64(&s3Failed, 1)
+		fmt.Println("Object storage upload queue is full, not uploading", path)
+	}
+}
+
+// dataToS3 copies a file kept in dataDir, its key is where it is in there
+func dataToS3(path string) {
+	if rel, err := filepath.Rel(dataDir, path); err == nil {
+		toS3(path, rel)
+	}
+}
+
+func uploadS3() {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	for up := range s3Queue {
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := putObject(client, up, time.Now())
+			if err == nil {
+				atomic.AddInt64(&s3Uploaded, 1)
+				break
+			}
+			if os.IsNotExist(err) || attempt == s3Attempts {
+				// pruned or rehydrated since, or the storage keeps failing
+				atomic.AddInt64(&s3Failed, 1)
+				fmt.Println("Uploading", up.path, "to object storage failed:", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func putObject(client *http.Client, up s3Upload, now time.Time) error {
+	f, err := os.Open(up.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the payload is signed, so it is read twice
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	endpoint, _ := url.Parse(s3Endpoint)
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s3Bucket + "/" + s3Prefix + up.key
+	endpoint.RawPath = s3EscapePath(endpoint.Path)
+	req, err := http.NewRequest("PUT", endpoint.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	signS3(req, hex.EncodeToString(hash.Sum(nil)), now)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New(resp.Status + ": " + string(msg))
+	}
+	return nil
+}
+
+// signS3 adds an AWS Signature Version 4 to req
+func signS3(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	headers := "host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n"
+	if s3Creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s3Creds.sessionToken)
+		signed += ";x-amz-security-token"
+		headers += "x-amz-security-token:" + s3Creds.sessionToken + "\n"
+	}
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers, signed, payloadHash}, "\n")
+	scope := date + "/" + s3Region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := []byte("AWS4" + s3Creds.secretKey)
+	for _, part := range []string{date, s3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s3Creds.accessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes everything but the unreserved characters and the
+// slashes, the way SigV4 wants the path
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,918 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Outgoing webhooks POST channel events as JSON to the URLs subscribed to them,
+//
+//	{"webhook_id": ..., "delivery_id": ..., "channel": ..., "type": "message", "message": {...}}
+//
+// with data in place of message for events other than messages, signed with
+// the webhook secret the way incoming webhooks are:
+//
+//	X-Timestamp: unix seconds, of the attempt
+//	X-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// Moderators subscribe their channel with POST /{channel}/webhooks, admins
+// manage subscriptions across channels under /admin/webhooks. A subscription
+// names the events it wants, new messages by default or * for all of them
+// but typing, the channels it listens to, all of them when admins name none,
+// and may be switched off with "active": false, events meanwhile are not kept
+// for it.
+//
+// Chat tools and incident systems take their own payloads. A webhook with a
+// template posts what the Go template renders instead, from webhookPayload,
+// and one with a preset posts what Slack, Discord, Teams or PagerDuty take:
+//
+//	{"url": "https://hooks.slack.com/services/...", "preset": "slack"}
+//	{"url": "https://events.pagerduty.com/v2/enqueue", "preset": "pagerduty", "vars": {"routing_key": "..."}}
+//	{"url": "https://example.com/hook", "template": "{\"text\": {{json .Text}}, \"by\": {{json .Message.Username}}}"}
+//
+// json quotes a value for JSON and truncate cuts a string to a number of
+// characters. A template failing on an event fails its delivery.
+//
+// A webhook gets its events in order, one at a time. A delivery answered
+// with anything but 2xx is tried again, backing off up to a minute, until it
+// has been tried webhookAttempts times. A 4xx other than 429 fails it at once.
+// Retries carry the same delivery_id, as do deliveries sent again with
+// POST .../deliveries/{delivery}/retry. Events wait in a buffer a webhook
+// while it is behind, a full buffer drops new ones and counts them. The last
+// deliveries of each webhook are listed with GET .../deliveries, they and the
+// buffer are lost on restart, the subscriptions are not.
+//
+// Deliveries only go to public addresses: loopback, private, link-local and
+// unspecified addresses are refused when connecting, redirects included, so a
+// moderator can not point a webhook at the services next to the node. Admins
+// let webhooks reach such networks with -webhook-allow 10.1.0.0/16,...
+const webhookBuffer = 1000
+const webhookAttempts = 8
+const webhookMaxBackoff = time.Minute
+const webhookRecent = 100
+const maxChannelWebhooks = 10
+const minWebhookSecret = 16
+const maxWebhookTemplate = 16 << 10
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// -webhook-allow, networks webhooks may reach though they are not public
+var webhookAllow string
+var webhookAllowed []*net.IPNet
+
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookDial refuses connections to addresses that are not public, it sees
+// the address the host resolved to so a name can not lead around it
+func webhookDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%s is not an IP address", host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if (inNetworks(ip, nonPublicNetworks) || ip.IsMulticast()) && !inNetworks(ip, webhookAllowed) {
+		return fmt.Errorf("%s is not a public address", ip)
+	}
+	return nil
+}
+
+var webhookEvent = regexp.MustCompile(`^([a-z_]+|\*)$`)
+
+// webhookPayload is what templates render
+type webhookPayload struct {
+	WebhookID  string
+	DeliveryID string
+	Channel    string
+	Type       string
+	Title      string // "New message in #ops", "message_deleted in #ops"
+	Text       string // "arthur: the message" for messages, the title otherwise
+	Message    *msgPost
+	Data       interface{} // of events other than messages
+	Vars       map[string]string
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"truncate": func(n int, s string) string {
+		if runes := []rune(s); len(runes) > n {
+			return string(runes[:n])
+		}
+		return s
+	},
+}
+
+var webhookPresets = map[string]string{
+	"slack":   `{"text": {{json .Text}}}`,
+	"discord": `{"content": {{json (truncate 2000 .Text)}}}`,
+	"teams":   `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "summary": {{json .Title}}, "title": {{json .Title}}, "text": {{json .Text}}}`,
+	"pagerduty": `{"routing_key": {{json .Vars.routing_key}}, "event_action": "trigger", "dedup_key": {{json .DeliveryID}}, "payload": {` +
+		`"summary": {{json (truncate 1024 .Text)}}, "source": "messaging-service", "component": {{json .Channel}}, "class": {{json .Type}}, ` +
+		`"severity": {{with .Message}}{{if eq .Priority "urgent"}}"critical"{{else if eq .Priority "high"}}"error"{{else}}"info"{{end}}{{else}}"info"{{end}}}}`,
+}
+
+type outgoingHook struct {
+	Id        string            `json:"id"`
+	Channel   string            `json:"channel,omitempty"` // of the moderators who added it, empty for admins
+	URL       string            `json:"url"`
+	Events    []string          `json:"events"`
+	Channels  []string          `json:"channels,omitempty"` // filter of admin webhooks, empty for all
+	Active    bool              `json:"active"`
+	Preset    string            `json:"preset,omitempty"`
+	Template  string            `json:"template,omitempty"`
+	Vars      map[string]string `json:"vars,omitempty"`
+	CreatedBy string            `json:"created_by"`
+	CreatedAt time.Time         `json:"created_at"`
+	secret    string
+	render    *template.Template // of the preset or template, nil for the plain payload
+
+	queue     chan *webhookDelivery
+	stop      chan struct{}
+	recent    []*webhookDelivery // oldest first
+	pending   int
+	delivered int
+	failed    int
+	dropped   int
+}
+
+type webhookDelivery struct {
+	Id           string     `json:"id"`
+	Type         string     `json:"type"`
+	Channel      string     `json:"channel"`
+	MessageID    int        `json:"message_id,omitempty"`
+	Status       string     `json:"status"` // pending, delivered or failed
+	Attempts     int        `json:"attempts"`
+	ResponseCode int        `json:"response_code,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	QueuedAt     time.Time  `json:"queued_at"`
+	LastAttempt  *time.Time `json:"last_attempt,omitempty"`
+	body         []byte
+}
+
+// webhookSpec is what callers set on a webhook, fields left out stay as they
+// are
+type webhookSpec struct {
+	URL      *string           `json:"url"`
+	Secret   *string           `json:"secret"`
+	Events   []string          `json:"events"`
+	Channels []string          `json:"channels"`
+	Active   *bool             `json:"active"`
+	Preset   *string           `json:"preset"`
+	Template *string           `json:"template"`
+	Vars     map[string]string `json:"vars"`
+}
+
+// outgoingMutex guards the webhooks and their deliveries. It is taken while
+// an event is published, never take a subject lock under it
+var outgoingMutex sync.Mutex
+var outgoingHooks = make(map[string]*outgoingHook)
+
+// startWebhooks hands the channel events to the webhooks
+func startWebhooks() error {
+	for cidr := range splitSet(webhookAllow) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("-webhook-allow should be comma separated networks, e.g. 10.1.0.0/16: %v", err)
+		}
+		webhookAllowed = append(webhookAllowed, network)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, Control: webhookDial}).DialContext
+	webhookClient.Transport = transport
+	broker.Handle(allChannels, toWebhooks)
+	return nil
+}
+
+// wants tells whether the webhook subscribes to the event. Caller must hold
+// outgoingMutex
+func (hook *outgoingHook) wants(ev event) bool {
+	if !hook.Active || hook.queue == nil {
+		return false
+	}
+	if hook.Channel != "" && hook.Channel != ev.Channel {
+		return false
+	}
+	if len(hook.Channels) > 0 && !contains(hook.Channels, ev.Channel) {
+		return false
+	}
+	return contains(hook.Events, ev.Type) || (contains(hook.Events, "*") && !ephemeralEvents[ev.Type])
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// toWebhooks queues an event for each webhook subscribed to it without ever
+// blocking the publisher
+func toWebhooks(ev event) {
+	// the sync streams of users are not channels
+	if ev.Channel == "" || ev.Channel[0] == '@' || !featureEnabled("integrations") || isMirror() {
+		return
+	}
+	mesg, isMessage := ev.Data.(msgPost)
+	if isMessage && relayedFrom(ev.Channel, mesg.Id) {
+		return
+	}
+	now := time.Now()
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	for _, hook := range outgoingHooks {
+		if !hook.wants(ev) {
+			continue
+		}
+		d := &webhookDelivery{Id: newToken(), Type: ev.Type, Channel: ev.Channel, Status: "pending", QueuedAt: now}
+		if isMessage {
+			d.MessageID = mesg.Id
+		}
+		body, err := hook.payload(d, ev)
+		if err != nil {
+			d.Status, d.Error = "failed", err.Error()
+			hook.failed++
+			hook.remember(d)
+			continue
+		}
+		d.body = body
+		select {
+		case hook.queue <- d:
+			hook.pending++
+			hook.remember(d)
+		default:
+			hook.dropped++
+		}
+	}
+}
+
+// payload is the body of the delivery d of ev. Caller must hold outgoingMutex
+func (hook *outgoingHook) payload(d *webhookDelivery, ev event) ([]byte, error) {
+	mesg, isMessage := ev.Data.(msgPost)
+	if hook.render == nil {
+		payload := map[string]interface{}{"webhook_id": hook.Id, "delivery_id": d.Id, "channel": ev.Channel, "type": ev.Type}
+		if isMessage {
+			payload["message"] = mesg
+		} else if ev.Data != nil {
+			payload["data"] = ev.Data
+		}
+		return json.Marshal(payload)
+	}
+	p := webhookPayload{WebhookID: hook.Id, DeliveryID: d.Id, Channel: ev.Channel, Type: ev.Type, Vars: hook.Vars}
+	p.Title = ev.Type + " in #" + ev.Channel
+	p.Text = p.Title
+	if isMessage {
+		p.Message = &mesg
+		p.Title = "New message in #" + ev.Channel
+		p.Text = mesg.Username + ": " + mesg.Message
+	} else {
+		p.Data = ev.Data
+	}
+	var body bytes.Buffer
+	if err := hook.render.Execute(&body, p); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// remember keeps d among the last deliveries. Caller must hold outgoingMutex
+func (hook *outgoingHook) remember(d *webhookDelivery) {
+	if len(hook.recent) == webhookRecent {
+		hook.recent = append(hook.recent[:0], hook.recent[1:]...)
+	}
+	hook.recent = append(hook.recent, d)
+}
+
+// start runs the deliveries of the webhook until it is removed. Caller must
+// hold outgoingMutex
+func (hook *outgoingHook) start() {
+	hook.queue = make(chan *webhookDelivery, webhookBuffer)
+	hook.stop = make(chan struct{})
+	go hook.run(hook.queue, hook.stop)
+}
+
+func (hook *outgoingHook) run(queue chan *webhookDelivery, stop chan struct{}) {
+	for {
+		select {
+		case d := <-queue:
+			if !hook.deliver(d, stop) {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// deliver tries d until it goes through, fails for good or the webhook is
+// removed, which is when it returns false
+func (hook *outgoingHook) deliver(d *webhookDelivery, stop chan struct{}) bool {
+	backoff := time.Second
+	for {
+		// the URL and secret may change in between
+		outgoingMutex.Lock()
+		target, secret := hook.URL, hook.secret
+		outgoingMutex.Unlock()
+		code, err := postWebhookEvent(target, secret, hook.Id, d.body)
+		now := time.Now()
+		outgoingMutex.Lock()
+		d.Attempts++
+		d.LastAttempt, d.ResponseCode, d.Error = &now, code, ""
+		switch {
+		case err == nil:
+			d.Status = "delivered"
+			hook.delivered++
+		case code >= 400 && code < 500 && code != http.StatusTooManyRequests, d.Attempts >= webhookAttempts:
+			d.Status, d.Error = "failed", err.Error()
+			hook.failed++
+		default:
+			d.Error = err.Error()
+		}
+		done := d.Status != "pending"
+		if done {
+			hook.pending--
+		}
+		outgoingMutex.Unlock()
+		if done {
+			return true
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return false
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// postWebhookEvent makes one attempt, signed with a fresh timestamp
+func postWebhookEvent(target, secret, id string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "messaging-service/"+serviceVersion)
+	req.Header.Set("X-Webhook-Id", id)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", webhookSignature(secret, timestamp, body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// apply checks spec and sets it on the webhook, which is not shared yet or
+// guarded by outgoingMutex. The error is safe to show the caller
+func (hook *outgoingHook) apply(spec webhookSpec) error {
+	if spec.URL != nil {
+		if u, err := url.Parse(*spec.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("url should be an http:// or https:// URL")
+		}
+	}
+	if spec.Secret != nil && len(*spec.Secret) < minWebhookSecret {
+		return fmt.Errorf("secret should be at least %d characters", minWebhookSecret)
+	}
+	if spec.Events != nil {
+		if len(spec.Events) == 0 {
+			return errors.New("events should name at least one event, or *")
+		}
+		for _, name := range spec.Events {
+			if !webhookEvent.MatchString(name) {
+				return fmt.Errorf("%q is not an event name", name)
+			}
+		}
+	}
+	if spec.Channels != nil {
+		if hook.Channel != "" {
+			return errors.New("a channel webhook only gets the events of its channel")
+		}
+		for _, channel := range spec.Channels {
+			if !natsChannel.MatchString(channel) {
+				return fmt.Errorf("%q is not a channel name", channel)
+			}
+		}
+	}
+	preset, text := hook.Preset, hook.Template
+	if spec.Preset != nil {
+		preset = *spec.Preset
+	}
+	if spec.Template != nil {
+		text = *spec.Template
+	}
+	render, err := webhookTemplate(preset, text)
+	if err != nil {
+		return err
+	}
+	if spec.URL != nil {
+		hook.URL = *spec.URL
+	}
+	hook.Preset, hook.Template, hook.render = preset, text, render
+	if spec.Vars != nil {
+		hook.Vars = spec.Vars
+	}
+	if spec.Secret != nil {
+		hook.secret = *spec.Secret
+	}
+	if spec.Events != nil {
+		hook.Events = append([]string(nil), spec.Events...)
+	}
+	if spec.Channels != nil {
+		hook.Channels = append([]string(nil), spec.Channels...)
+	}
+	if spec.Active != nil {
+		hook.Active = *spec.Active
+	}
+	return nil
+}
+
+// webhookTemplate parses the template of a webhook, nil when it has neither
+// a preset nor a template. The error is safe to show the caller
+func webhookTemplate(preset, text string) (*template.Template, error) {
+	if preset != "" && text != "" {
+		return nil, errors.New("a webhook takes a preset or a template, not both")
+	}
+	if preset != "" {
+		if text = webhookPresets[preset]; text == "" {
+			return nil, errors.New("preset should be slack, discord, teams or pagerduty")
+		}
+	}
+	if text == "" {
+		return nil, nil
+	}
+	if len(text) > maxWebhookTemplate {
+		return nil, fmt.Errorf("template should be at most %d bytes", maxWebhookTemplate)
+	}
+	render, err := template.New("webhook").Funcs(webhookFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return render, nil
+}
+
+// addWebhook makes a webhook of spec for channel, empty for an admin one, and
+// answers the caller with it and its secret
+func addWebhook(w http.ResponseWriter, r *http.Request, channel string) {
+	spec := webhookSpec{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&spec); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if spec.URL == nil {
+		respondJSON(w, http.StatusBadRequest, "url should be an http:// or https:// URL")
+		return
+	}
+	hook := &outgoingHook{
+		Id:        newToken(),
+		Channel:   channel,
+		Events:    []string{"message"},
+		Active:    true,
+		CreatedBy: actor(r),
+		CreatedAt: time.Now(),
+		secret:    newToken(),
+	}
+	if err := hook.apply(spec); err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	outgoingMutex.Lock()
+	if channel != "" {
+		n := 0
+		for _, other := range outgoingHooks {
+			if other.Channel == channel {
+				n++
+			}
+		}
+		if n >= maxChannelWebhooks {
+			outgoingMutex.Unlock()
+			respondJSON(w, http.StatusForbidden, fmt.Sprintf("A channel has at most %d webhooks", maxChannelWebhooks))
+			return
+		}
+	}
+	outgoingHooks[hook.Id] = hook
+	hook.start()
+	logGlobal("webhook_added", "webhooks", hook.Id, hook.stored())
+	outgoingMutex.Unlock()
+	audit(auditEntry{Actor: actor(r), Action: "webhook_added", Channel: channel, Data: map[string]interface{}{"id": hook.Id, "url": hook.URL, "events": hook.Events}})
+	// the secret is only ever shown here
+	respondJSON(w, http.StatusOK, map[string]interface{}{"webhook": hook, "secret": hook.secret})
+}
+
+type webhookStatus struct {
+	outgoingHook
+	Pending   int `json:"pending"`
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+	Dropped   int `json:"dropped"`
+}
+
+// statusOf is the webhook with its delivery counts since the node started.
+// Caller must hold outgoingMutex
+func statusOf(hook *outgoingHook) webhookStatus {
+	return webhookStatus{*hook, hook.pending, hook.delivered, hook.failed, hook.dropped}
+}
+
+// findWebhook looks up the webhook of the request, of the channel unless it is
+// an admin call, and answers the caller when there is none. Caller must hold
+// outgoingMutex
+func findWebhook(w http.ResponseWriter, r *http.Request, channel string) *outgoingHook {
+	hook, ok := outgoingHooks[mux.Vars(r)["id"]]
+	if !ok || (channel != "" && hook.Channel != channel) {
+		respondJSON(w, http.StatusNotFound, "Provided webhook does not exist!")
+		return nil
+	}
+	return hook
+}
+
+func updateWebhook(w http.ResponseWriter, r *http.Request, channel string) {
+	spec := webhookSpec{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&spec); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	outgoingMutex.Lock()
+	hook := findWebhook(w, r, channel)
+	if hook == nil {
+		outgoingMutex.Unlock()
+		return
+	}
+	if err := hook.apply(spec); err != nil {
+		outgoingMutex.Unlock()
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	status := statusOf(hook)
+	logGlobal("webhook_changed", "webhooks", hook.Id, hook.stored())
+	outgoingMutex.Unlock()
+	audit(auditEntry{Actor: actor(r), Action: "webhook_changed", Channel: channel, Data: map[string]interface{}{"id": status.Id, "url": status.URL, "events": status.Events, "active": status.Active}})
+	respondJSON(w, http.StatusOK, status)
+}
+
+func removeWebhook(w http.ResponseWriter, r *http.Request, channel string) {
+	outgoingMutex.Lock()
+	hook := findWebhook(w, r, channel)
+	if hook == nil {
+		outgoingMutex.Unlock()
+		return
+	}
+	delete(outgoingHooks, hook.Id)
+	close(hook.stop)
+	logGlobal("webhook_removed", "webhooks", hook.Id, nil)
+	outgoingMutex.Unlock()
+	audit(auditEntry{Actor: actor(r), Action: "webhook_removed", Channel: channel, Data: map[string]string{"id": hook.Id}})
+	respondJSON(w, http.StatusOK, map[string]string{"removed": hook.Id})
+}
+
+// forgetWebhooks stops and removes the webhooks moderators added to a channel
+// that is gone, those of admins stay
+func forgetWebhooks(channel string) {
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	for id, hook := range outgoingHooks {
+		if hook.Channel == channel {
+			delete(outgoingHooks, id)
+			close(hook.stop)
+			logGlobal("webhook_removed", "webhooks", id, nil)
+		}
+	}
+}
+
+// listDeliveries answers with the last deliveries of the webhook, newest
+// first, those with ?status= only
+func listDeliveries(w http.ResponseWriter, r *http.Request, channel string) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "pending" && status != "delivered" && status != "failed" {
+		respondJSON(w, http.StatusBadRequest, "status should be pending, delivered or failed")
+		return
+	}
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	hook := findWebhook(w, r, channel)
+	if hook == nil {
+		return
+	}
+	list := []webhookDelivery{}
+	for i := len(hook.recent) - 1; i >= 0; i-- {
+		if status == "" || hook.recent[i].Status == status {
+			list = append(list, *hook.recent[i])
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string][]webhookDelivery{"deliveries": list})
+}
+
+// retryDelivery sends a delivery that is done again, with all its attempts
+func retryDelivery(w http.ResponseWriter, r *http.Request, channel string) {
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	hook := findWebhook(w, r, channel)
+	if hook == nil {
+		return
+	}
+	var d *webhookDelivery
+	for _, recent := range hook.recent {
+		if recent.Id == mux.Vars(r)["delivery"] {
+			d = recent
+		}
+	}
+	if d == nil {
+		respondJSON(w, http.StatusNotFound, "No such delivery among the last ones")
+		return
+	}
+	if d.Status == "pending" {
+		respondJSON(w, http.StatusConflict, "The delivery is still pending")
+		return
+	}
+	if d.body == nil {
+		respondJSON(w, http.StatusConflict, "The template failed on the event, there is nothing to send")
+		return
+	}
+	if d.Status == "failed" {
+		hook.failed--
+	} else {
+		hook.delivered--
+	}
+	d.Status, d.Attempts, d.Error = "pending", 0, ""
+	select {
+	case hook.queue <- d:
+		hook.pending++
+	default:
+		hook.dropped++
+		d.Status, d.Error = "failed", "the webhook buffer was full"
+		hook.failed++
+		respondJSON(w, http.StatusServiceUnavailable, "The webhook buffer is full")
+		return
+	}
+	respondJSON(w, http.StatusOK, *d)
+}
+
+// moderatesChannel answers for the handlers below, false once it has
+func moderatesChannel(w http.ResponseWriter, r *http.Request, channel, refusal string) bool {
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return false
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, refusal)
+	}
+	return allowed
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/webhooks -H 'X-Username: arthur' -d '{"url": "https://ci.example.com/hook", "events": ["message", "thread"]}' -v
+func postOutgoingHook(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if moderatesChannel(w, r, channel, "Only moderators can add webhooks") {
+		addWebhook(w, r, channel)
+	}
+}
+
+// The webhooks of the channel with their delivery counts since the node started
+// curl -X GET http://localhost:8000/gdgsas022/webhooks -H 'X-Username: arthur'
+func getOutgoingHooks(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if !moderatesChannel(w, r, channel, "Only moderators can list webhooks") {
+		return
+	}
+	list := []webhookStatus{}
+	outgoingMutex.Lock()
+	for _, hook := range outgoingHooks {
+		if hook.Channel == channel {
+			list = append(list, statusOf(hook))
+		}
+	}
+	outgoingMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string][]webhookStatus{"webhooks": list})
+}
+
+// curl -X PUT http://localhost:8000/gdgsas022/webhooks/<id> -H 'X-Username: arthur' -d '{"active": false}'
+func putOutgoingHook(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if moderatesChannel(w, r, channel, "Only moderators can change webhooks") {
+		updateWebhook(w, r, channel)
+	}
+}
+
+// curl -X DELETE http://localhost:8000/gdgsas022/webhooks/<id> -H 'X-Username: arthur'
+func deleteOutgoingHook(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if moderatesChannel(w, r, channel, "Only moderators can remove webhooks") {
+		removeWebhook(w, r, channel)
+	}
+}
+
+// The last deliveries of a webhook, newest first
+// curl -X GET 'http://localhost:8000/gdgsas022/webhooks/<id>/deliveries?status=failed' -H 'X-Username: arthur'
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if moderatesChannel(w, r, channel, "Only moderators can list webhook deliveries") {
+		listDeliveries(w, r, channel)
+	}
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/webhooks/<id>/deliveries/<delivery>/retry -H 'X-Username: arthur'
+func postDeliveryRetry(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if moderatesChannel(w, r, channel, "Only moderators can retry webhook deliveries") {
+		retryDelivery(w, r, channel)
+	}
+}
+
+// Webhooks of any channels, set up by admins
+// curl -X POST http://localhost:8000/admin/webhooks -H 'X-Admin-Token: secret' -d '{"url": "https://audit.example.com/hook", "events": ["*"], "channels": ["ops", "security"]}'
+func postAdminWebhook(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	addWebhook(w, r, "")
+}
+
+// Every webhook, the ones moderators added to their channels as well
+// curl -X GET http://localhost:8000/admin/webhooks -H 'X-Admin-Token: secret'
+func getAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	list := []webhookStatus{}
+	outgoingMutex.Lock()
+	for _, hook := range outgoingHooks {
+		list = append(list, statusOf(hook))
+	}
+	outgoingMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string][]webhookStatus{"webhooks": list})
+}
+
+// curl -X GET http://localhost:8000/admin/webhooks/<id> -H 'X-Admin-Token: secret'
+func getAdminWebhook(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	if hook := findWebhook(w, r, ""); hook != nil {
+		respondJSON(w, http.StatusOK, statusOf(hook))
+	}
+}
+
+// curl -X PUT http://localhost:8000/admin/webhooks/<id> -H 'X-Admin-Token: secret' -d '{"events": ["message", "message_deleted"], "secret": "a-new-secret-of-16-chars"}'
+func putAdminWebhook(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	updateWebhook(w, r, "")
+}
+
+// curl -X DELETE http://localhost:8000/admin/webhooks/<id> -H 'X-Admin-Token: secret'
+func deleteAdminWebhook(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	removeWebhook(w, r, "")
+}
+
+// curl -X GET http://localhost:8000/admin/webhooks/<id>/deliveries -H 'X-Admin-Token: secret'
+func getAdminDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	listDeliveries(w, r, "")
+}
+
+// curl -X POST http://localhost:8000/admin/webhooks/<id>/deliveries/<delivery>/retry -H 'X-Admin-Token: secret'
+func postAdminRetry(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	retryDelivery(w, r, "")
+}
+
+// storedWebhook keeps the secret, which the API never shows again
+type storedWebhook struct {
+	Id        string            `json:"id"`
+	Channel   string            `json:"channel"`
+	URL       string            `json:"url"`
+	Events    []string          `json:"events,omitempty"` // new messages when missing
+	Channels  []string          `json:"channels,omitempty"`
+	Active    *bool             `json:"active,omitempty"` // true when missing
+	Preset    string            `json:"preset,omitempty"`
+	Template  string            `json:"template,omitempty"`
+	Vars      map[string]string `json:"vars,omitempty"`
+	CreatedBy string            `json:"created_by"`
+	CreatedAt time.Time         `json:"created_at"`
+	Secret    string            `json:"secret"`
+}
+
+func takeWebhooks() []storedWebhook {
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	stored := []storedWebhook{}
+	for _, hook := range outgoingHooks {
+		stored = append(stored, hook.stored())
+	}
+	return stored
+}
+
+// stored is the webhook as backups keep it. Caller must hold outgoingMutex
+func (hook *outgoingHook) stored() storedWebhook {
+	active := hook.Active
+	return storedWebhook{hook.Id, hook.Channel, hook.URL, hook.Events, hook.Channels, &active, hook.Preset, hook.Template, hook.Vars, hook.CreatedBy, hook.CreatedAt, hook.secret}
+}
+
+// restoreWebhooks puts back the webhooks, those still here go on with their
+// deliveries
+func restoreWebhooks(stored []storedWebhook) {
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	old := outgoingHooks
+	outgoingHooks = make(map[string]*outgoingHook)
+	for _, s := range stored {
+		hook, ok := old[s.Id]
+		if ok {
+			delete(old, s.Id)
+		} else {
+			hook = &outgoingHook{Id: s.Id}
+			hook.start()
+		}
+		hook.Channel, hook.URL, hook.Channels, hook.CreatedBy, hook.CreatedAt, hook.secret = s.Channel, s.URL, s.Channels, s.CreatedBy, s.CreatedAt, s.Secret
+		hook.Events, hook.Active = s.Events, s.Active == nil || *s.Active
+		if len(hook.Events) == 0 {
+			hook.Events = []string{"message"}
+		}
+		// checked when it was set
+		hook.Preset, hook.Template, hook.Vars = s.Preset, s.Template, s.Vars
+		hook.render, _ = webhookTemplate(s.Preset, s.Template)
+		outgoingHooks[s.Id] = hook
+	}
+	for _, hook := range old {
+		close(hook.stop)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Page cache for history scrolls. A page of GET /{channel}/messages?limit=
+// that came back full holds the same messages whatever is posted after it, new
+// messages only ever get higher ids. Such pages of public channels are kept
+// encoded, keyed like coalesced listings, and served again without taking the
+// lock of the channel, with "pages": [{"source": "cache", ...}] spanning them.
+// Edits and deletes drop the pages holding the ids they touch, a channel
+// turning private, replaced or dropped loses all of its pages. The least
+// recently used pages go once the cache grows beyond -page-cache-mb
+var pageCacheMB = 64
+
+type cachedPage struct {
+	key     string
+	channel string
+	subject *subject
+	first   int // ids the page spans, last_id excluded
+	last    int
+	body    []byte
+}
+
+var pageCacheMutex sync.Mutex
+var pageLRU = list.New()
+var pagesByChannel = make(map[string]map[string]*list.Element)
+var pageCacheSize int64
+var pageHits, pageMisses int64
+
+// pageFromCache is the page kept for key, nil when there is none
+func pageFromCache(s *subject, key string) []byte {
+	if pageCacheMB == 0 {
+		return nil
+	}
+	pageCacheMutex.Lock()
+	defer pageCacheMutex.Unlock()
+	e := pagesByChannel[s.title][key]
+	if e == nil || e.Value.(*cachedPage).subject != s {
+		atomic.AddInt64(&pageMisses, 1)
+		return nil
+	}
+	pageLRU.MoveToFront(e)
+	atomic.AddInt64(&pageHits, 1)
+	return e.Value.(*cachedPage).body
+}
+
+// keepPage caches a full page of the messages after lastID. Caller must hold
+// the subject lock, so no change can come between reading the page and keeping
+// it
+func (s *subject) keepPage(key string, lastID int, page []msgPost) {
+	if pageCacheMB == 0 || len(page) == 0 || s.private {
+		return
+	}
+	p := &cachedPage{key: key, channel: s.title, subject: s, first: lastID + 1, last: page[len(page)-1].Id}
+	body, err := json.Marshal(map[string]interface{}{"messages": page, "pages": []pageSource{{"cache", p.first, p.last}}})
+	budget := int64(pageCacheMB) << 20
+	if err != nil || int64(len(body)) > budget {
+		return
+	}
+	p.body = body
+
+	pageCacheMutex.Lock()
+	defer pageCacheMutex.Unlock()
+	if old := pagesByChannel[s.title][key]; old != nil {
+		dropPage(old)
+	}
+	if pagesByChannel[s.title] == nil {
+		pagesByChannel[s.title] = make(map[string]*list.Element)
+	}
+	pagesByChannel[s.title][key] = pageLRU.PushFront(p)
+	pageCacheSize += int64(len(body))
+	for pageCacheSize > budget {
+		dropPage(pageLRU.Back())
+	}
+}
+
+// forgetPages drops the cached pages of the channel holding any id from first
+// to last
+func forgetPages(channel string, first, last int) {
+	if pageCacheMB == 0 {
+		return
+	}
+	pageCacheMutex.Lock()
+	defer pageCacheMutex.Unlock()
+	for _, e := range pagesByChannel[channel] {
+		if p := e.Value.(*cachedPage); p.first <= last && first <= p.last {
+			dropPage(e)
+		}
+	}
+}
+
+// forgetChannelPages drops every cached page of the channel
+func forgetChannelPages(channel string) {
+	if pageCacheMB == 0 {
+		return
+	}
+	pageCacheMutex.Lock()
+	defer pageCacheMutex.Unlock()
+	for _, e := range pagesByChannel[channel] {
+		dropPage(e)
+	}
+}
+
+// Caller must hold pageCacheMutex
+func dropPage(e *list.Element) {
+	p := pageLRU.Remove(e).(*cachedPage)
+	pageCacheSize -= int64(len(p.body))
+	delete(pagesByChannel[p.channel], p.key)
+	if len(pagesByChannel[p.channel]) == 0 {
+		delete(pagesByChannel, p.channel)
+	}
+}
+
+func writePageCacheMetrics(b *strings.Builder) {
+	pageCacheMutex.Lock()
+	size, count := pageCacheSize, pageLRU.Len()
+	pageCacheMutex.Unlock()
+	b.WriteString("# TYPE messaging_page_cache_lookups counter\n")
+	b.WriteString("# HELP messaging_page_cache_lookups History pages looked up in the page cache.\n")
+	fmt.Fprintf(b, "messaging_page_cache_lookups_total{result=\"hit\"} %d\n", atomic.LoadInt64(&pageHits))
+	fmt.Fprintf(b, "messaging_page_cache_lookups_total{result=\"miss\"} %d\n", atomic.LoadInt64(&pageMisses))
+	b.WriteString("# TYPE messaging_page_cache_pages gauge\n")
+	b.WriteString("# HELP messaging_page_cache_pages History pages kept in the page cache.\n")
+	fmt.Fprintf(b, "messaging_page_cache_pages %d\n", count)
+	b.WriteString("# TYPE messaging_page_cache_bytes gauge\n")
+	b.WriteString("# UNIT messaging_page_cache_bytes bytes\n")
+	b.WriteString("# HELP messaging_page_cache_bytes Size of the encoded pages in the page cache.\n")
+	fmt.Fprintf(b, "messaging_page_cache_bytes %d\n", size)
+}
+
+// firstPage is the first limit messages of newer, all of them when limit is 0
+func firstPage(newer []msgPost, limit int) []msgPost {
+	if limit > 0 && len(newer) > limit {
+		return newer[:limit]
+	}
+	return newer
+}
+
+// forgetRemoved drops the pages holding deleted ids, or ids below before
+func (s *subject) forgetRemoved(ids []int, before int) {
+	for _, id := range ids {
+		forgetPages(s.title, id, id)
+	}
+	if before > 0 {
+		forgetPages(s.title, 0, before-1)
+	}
+}
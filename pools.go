@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrency pools. Requests are let in through one of three pools, each with
+// slots of its own, so a flood of expensive history fetches can not take the
+// goroutines, locks and memory that posting needs, and neither can thousands
+// of clients opening streams:
+//
+//	reads    GET requests
+//	writes   every other method
+//	streams  event streams, WebSockets and long polls, holding their slot for
+//	         as long as they stay open
+//
+// -pool-reads, -pool-writes and -pool-streams size them, 0 leaves a pool
+// unlimited. A request finding its pool full waits for a slot in line, up to
+// -pool-wait or its own deadline, and is answered 503 with Retry-After after
+// that. How many slots are taken, how many requests wait and how many were
+// turned away are on /metrics
+var poolReads, poolWrites, poolStreams int
+var poolWait = 2 * time.Second
+
+type pool struct {
+	slots    chan struct{}
+	waiting  int64
+	rejected int64
+}
+
+var pools = make(map[string]*pool)
+
+// startPools makes the pools that have a size
+func startPools() {
+	for name, size := range map[string]int{"reads": poolReads, "writes": poolWrites, "streams": poolStreams} {
+		if size > 0 {
+			pools[name] = &pool{slots: make(chan struct{}, size)}
+		}
+	}
+}
+
+// acquire takes a slot, waiting in line up to wait. False when the wait or ctx
+// ran out first
+func (p *pool) acquire(ctx context.Context, wait time.Duration) bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+	}
+	atomic.AddInt64(&p.waiting, 1)
+	defer atomic.AddInt64(&p.waiting, -1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	atomic.AddInt64(&p.rejected, 1)
+	return false
+}
+
+func (p *pool) release() {
+	<-p.slots
+}
+
+// poolOf names the pool r goes through
+func poolOf(r *http.Request) string {
+	switch {
+	case isStream(r) || r.Method == http.MethodGet && r.URL.Query().Get("wait") != "":
+		return "streams"
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return "reads"
+	}
+	return "writes"
+}
+
+func poolMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := poolOf(r)
+		p := pools[name]
+		if p == nil || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !p.acquire(r.Context(), poolWait) {
+			w.Header().Set("Retry-After", "1")
+			respondJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+				"error": "Too many requests in progress, try again later",
+				"pool":  name,
+			})
+			return
+		}
+		defer p.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writePoolMetrics adds the slots taken, the requests waiting and those turned
+// away to /metrics
+func writePoolMetrics(b *strings.Builder) {
+	names := []string{"reads", "streams", "writes"}
+	b.WriteString("# TYPE messaging_pool_in_use gauge\n")
+	b.WriteString("# HELP messaging_pool_in_use Requests holding a slot of a concurrency pool.\n")
+	for _, name := range names {
+		if p := pools[name]; p != nil {
+			fmt.Fprintf(b, "messaging_pool_in_use{pool=%q} %d\n", name, len(p.slots))
+		}
+	}
+	b.WriteString("# TYPE messaging_pool_limit gauge\n")
+	b.WriteString("# HELP messaging_pool_limit Slots of a concurrency pool.\n")
+	for _, name := range names {
+		if p := pools[name]; p != nil {
+			fmt.Fprintf(b, "messaging_pool_limit{pool=%q} %d\n", name, cap(p.slots))
+		}
+	}
+	b.WriteString("# TYPE messaging_pool_waiting gauge\n")
+	b.WriteString("# HELP messaging_pool_waiting Requests waiting in line for a slot.\n")
+	for _, name := range names {
+		if p := pools[name]; p != nil {
+			fmt.Fprintf(b, "messaging_pool_waiting{pool=%q} %d\n", name, atomic.LoadInt64(&p.waiting))
+		}
+	}
+	b.WriteString("# TYPE messaging_pool_rejected counter\n")
+	b.WriteString("# HELP messaging_pool_rejected Requests turned away with 503 after waiting for a slot.\n")
+	for _, name := range names {
+		if p := pools[name]; p != nil {
+			fmt.Fprintf(b, "messaging_pool_rejected_total{pool=%q} %d\n", name, atomic.LoadInt64(&p.rejected))
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Presence is who currently has an event stream open on a channel. Every node
+// owns the entries for the streams it terminates and gossips its whole view to
+// its peers, so each (channel, username, node) entry is a last-write-wins
+// register: the newest Updated stamp wins. A user is online when any node says
+// so, hence leaving one node never hides a stream still open on another.
+// Changes reach the channel streams as presence_joined and presence_left
+// events, {"username": ...}, ephemeral like typing
+type presenceEntry struct {
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+	Node     string `json:"node"`
+	Online   bool   `json:"online"`
+	Updated  int64  `json:"updated"` // unix nanoseconds
+}
+
+type presenceKey struct {
+	channel, username, node string
+}
+
+const gossipInterval = 2 * time.Second
+
+// A node that has not gossiped for this long is considered gone together with
+// its streams
+const nodeTimeout = 3 * gossipInterval
+
+// nodeID and peers are set from -node-id and -peers, no peers means single node
+var nodeID string
+var peers []string
+
+var presenceMutex sync.Mutex
+var presence = make(map[presenceKey]*presenceEntry)
+
+// open streams per channel and user on this node
+var localStreams = make(map[presenceKey]int)
+
+// last time each node was heard of, either directly or through gossip
+var nodeSeen = make(map[string]time.Time)
+
+// the newest Updated stamp of each node. Nodes restamp their own entries every
+// round, so only a stamp newer than this says the node is still alive, an old
+// entry relayed by a peer does not. Kept after the node is forgotten so its
+// last entries can not bring it back
+var nodeStamps = make(map[string]int64)
+
+// who the channel streams were last told is online, by channel
+var announced = make(map[string]map[string]bool)
+
+// streamOpened and streamClosed keep the local entries up to date as clients
+// come and go, a user with several streams stays online until the last closes
+func streamOpened(channel, username string) {
+	key := presenceKey{channel, username, nodeID}
+	presenceMutex.Lock()
+	localStreams[key]++
+	if localStreams[key] == 1 {
+		setLocalPresence(key, true)
+	}
+	presenceMutex.Unlock()
+	announcePresence(channel)
+}
+
+func streamClosed(channel, username string) {
+	key := presenceKey{channel, username, nodeID}
+	presenceMutex.Lock()
+	localStreams[key]--
+	if localStreams[key] <= 0 {
+		delete(localStreams, key)
+		setLocalPresence(key, false)
+	}
+	presenceMutex.Unlock()
+	announcePresence(channel)
+}
+
+// Caller must hold presenceMutex
+func setLocalPresence(key presenceKey, online bool) {
+	presence[key] = &presenceEntry{
+		Channel:  key.channel,
+		Username: key.username,
+		Node:     key.node,
+		Online:   online,
+		Updated:  time.Now().UnixNano(),
+	}
+}
+
+// mergePresence applies entries received from a peer, keeping the newest
+// write for every register. Entries about this node are ignored, nobody knows
+// better than us which streams we have. A node counts as seen when one of its
+// entries carries a stamp newer than any heard of before
+func mergePresence(entries []presenceEntry) {
+	presenceMutex.Lock()
+	now := time.Now()
+	changed := []string{}
+	for _, e := range entries {
+		if e.Node == nodeID {
+			continue
+		}
+		if e.Updated > nodeStamps[e.Node] {
+			nodeStamps[e.Node] = e.Updated
+			nodeSeen[e.Node] = now
+		}
+		key := presenceKey{e.Channel, e.Username, e.Node}
+		if cur, ok := presence[key]; !ok || e.Updated > cur.Updated {
+			entry := e
+			presence[key] = &entry
+			if e.Channel != "" && (!ok || cur.Online != e.Online) {
+				changed = append(changed, e.Channel)
+			}
+		}
+	}
+	presenceMutex.Unlock()
+	announcePresence(changed...)
+}
+
+// onlineUsers lists who has a stream open on the channel on any live node
+func onlineUsers(channel string) []string {
+	presenceMutex.Lock()
+	defer presenceMutex.Unlock()
+	return onlineLocked(channel, time.Now())
+}
+
+// Caller must hold presenceMutex
+func onlineLocked(channel string, now time.Time) []string {
+	seen := make(map[string]bool)
+	users := []string{}
+	for key, e := range presence {
+		if key.channel != channel || !e.Online || seen[key.username] {
+			continue
+		}
+		if key.node != nodeID && now.Sub(nodeSeen[key.node]) > nodeTimeout {
+			continue
+		}
+		seen[key.username] = true
+		users = append(users, key.username)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// announcePresence tells the streams of the channels who came online and who
+// left since they were last told. The events go out after presenceMutex is
+// released since broker handlers may ask for presence themselves
+func announcePresence(channels ...string) {
+	type change struct {
+		channel, username string
+		online            bool
+	}
+	changes := []change{}
+	presenceMutex.Lock()
+	now := time.Now()
+	for _, channel := range channels {
+		was := announced[channel]
+		is := make(map[string]bool)
+		for _, username := range onlineLocked(channel, now) {
+			is[username] = true
+			if !was[username] {
+				changes = append(changes, change{channel, username, true})
+			}
+		}
+		left := []string{}
+		for username := range was {
+			if !is[username] {
+				left = append(left, username)
+			}
+		}
+		sort.Strings(left)
+		for _, username := range left {
+			changes = append(changes, change{channel, username, false})
+		}
+		if len(is) == 0 {
+			delete(announced, channel)
+		} else {
+			announced[channel] = is
+		}
+	}
+	presenceMutex.Unlock()
+	for _, c := range changes {
+		kind := "presence_left"
+		if c.online {
+			kind = "presence_joined"
+		}
+		publish(c.channel, kind, map[string]interface{}{"username": c.username})
+	}
+}
+
+// prunePresence forgets the registers of nodes that went silent and the
+// offline ones nobody needs to hear about anymore
+func prunePresence(now time.Time) {
+	presenceMutex.Lock()
+	for key, e := range presence {
+		if key.node != nodeID && now.Sub(nodeSeen[key.node]) > nodeTimeout {
+			delete(presence, key)
+		} else if !e.Online && now.Sub(time.Unix(0, e.Updated)) > nodeTimeout {
+			delete(presence, key)
+		}
+	}
+	for node, seen := range nodeSeen {
+		if now.Sub(seen) > nodeTimeout {
+			delete(nodeSeen, node)
+		}
+	}
+	// users whose only streams were on a silent node have left
+	channels := []string{}
+	for channel := range announced {
+		channels = append(channels, channel)
+	}
+	presenceMutex.Unlock()
+	announcePresence(channels...)
+}
+
+// curl -X GET http://localhost:8000/gdgsas022/presence -v
+func getPresence(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canAccess(actingUser(r))
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string][]string{"online": onlineUsers(channel)})
+}
+
+// Peers push their full presence view here every gossipInterval
+func postGossipPresence(w http.ResponseWriter, r *http.Request) {
+	if adminToken != "" && !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	entries := []presenceEntry{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&entries); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	mergePresence(entries)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gossipPresence sends everything this node knows to every peer. Relaying the
+// entries of other nodes too lets presence spread even without a full mesh
+func gossipPresence() {
+	client := &http.Client{Timeout: gossipInterval}
+	for range time.Tick(gossipInterval) {
+		presenceMutex.Lock()
+		entries := make([]presenceEntry, 0, len(presence)+1)
+		for key, e := range presence {
+			if key.node == nodeID {
+				// refresh our own registers so peers know we are alive
+				e.Updated = time.Now().UnixNano()
+			} else if time.Since(nodeSeen[key.node]) > nodeTimeout {
+				delete(presence, key)
+				continue
+			}
+			entries = append(entries, *e)
+		}
+		presenceMutex.Unlock()
+		// a heartbeat entry so peers learn about us before any stream opens
+		entries = append(entries, presenceEntry{Node: nodeID, Updated: time.Now().UnixNano()})
+
+		body, err := json.Marshal(entries)
+		if err != nil {
+			continue
+		}
+		toPeers(client, "/internal/gossip/presence", body)
+	}
+}
+
+// toPeers posts body to path on every peer, whoever does not answer misses it
+func toPeers(client *http.Client, path string, body []byte) {
+	for _, peer := range peers {
+		req, err := http.NewRequest("POST", peer+path, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if adminToken != "" {
+			req.Header.Set("X-Admin-Token", adminToken)
+		}
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
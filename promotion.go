@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// A thread that outgrew its message is promoted to a channel of its own: the
+// message and its replies become the first messages of the new channel, each
+// with the permalink it came from as origin. The thread is locked and points
+// to the new channel, which keeps the visibility, the owner and the
+// moderators of the old one. Frozen channels promote nothing
+var channelName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// Only moderators and whoever wrote the message may promote its thread
+// curl -X POST http://localhost:8000/gdgsas022/messages/1/promote -H 'X-Username: arthur' -d '{"channel": "deploy-talk"}' -v
+func promoteThread(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return
+	}
+
+	req := struct {
+		Channel string `json:"channel"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	target := canonicalChannel(req.Channel)
+	if !channelName.MatchString(target) {
+		respondJSON(w, http.StatusBadRequest, "channel should be made of letters, digits and dashes")
+		return
+	}
+	if resolveChannel(target) != target || lookupSubject(target) != nil {
+		respondJSON(w, http.StatusConflict, "A channel with this name exists")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	// The thread is copied and locked under one lock of the old channel, so
+	// no reply slips in between. That lock has to be let go before
+	// globalMapMutex is taken, the thread is unlocked again when the new
+	// channel can not be put in after all
+	username := actingUser(r)
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	mesg := subject.mutableMessage(id)
+	if mesg == nil {
+		subject.Unlock()
+		respondJSON(w, http.StatusBadRequest, "Provided messageId does not exist!")
+		return
+	}
+	if !subject.canModerate(r) && (username == "" || username != mesg.Username) {
+		subject.Unlock()
+		respondJSON(w, http.StatusForbidden, "Only moderators and the author can promote a thread")
+		return
+	}
+	if subject.frozen {
+		subject.Unlock()
+		respondJSON(w, http.StatusForbidden, "Channel is frozen")
+		return
+	}
+	if promoted := mesg.PromotedTo; promoted != "" {
+		subject.Unlock()
+		respondJSON(w, http.StatusConflict, map[string]string{"error": "Thread was promoted already", "channel": promoted})
+		return
+	}
+	promoted := newSubject(target, subject.owner)
+	promoted.private, promoted.allowGuests = subject.private, subject.allowGuests
+	promoted.moderators = copySet(subject.moderators)
+	promoted.members = copySet(subject.members)
+	origin := permalink(channel, id)
+	promoted.add(msgPost{Username: mesg.Username, Message: mesg.Message, Verified: mesg.Verified, Priority: mesg.Priority, Origin: origin})
+	for _, reply := range mesg.Threads {
+		promoted.add(msgPost{Username: reply.Username, Message: reply.Message, Verified: reply.Verified, Origin: origin})
+	}
+	wasLocked := mesg.Locked
+	mesg.PromotedTo, mesg.Locked = target, true
+	subject.Unlock()
+
+	status, problem := http.StatusOK, ""
+	globalMapMutex.Lock()
+	if liveMessages[target] != nil {
+		status, problem = http.StatusConflict, "A channel with this name exists"
+	} else if maxChannels > 0 && len(liveMessages) >= maxChannels {
+		status, problem = http.StatusForbidden, "Channel limit reached"
+	} else {
+		liveMessages[target] = promoted
+		// nobody else can see the new subject yet
+		promoted.logSettings("channel_created")
+		for _, copied := range promoted.Messages {
+			promoted.logMessage(copied.Id, "message_created")
+		}
+	}
+	globalMapMutex.Unlock()
+
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	parent := subject.mutableMessage(id)
+	if problem != "" {
+		if parent != nil && parent.PromotedTo == target {
+			parent.PromotedTo, parent.Locked = "", wasLocked
+			subject.logMessage(id, "message_updated")
+		}
+		respondJSON(w, status, problem)
+		return
+	}
+	if parent != nil {
+		subject.logMessage(id, "message_updated")
+	}
+	publish(channel, "thread_promoted", map[string]interface{}{"message_id": id, "channel": target, "by": username})
+	publish(channel, "thread_locked", map[string]int{"message_id": id})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"channel": target, "messages": len(promoted.Messages)})
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Push notifications to phones through Firebase Cloud Messaging and the Apple
+// Push Notification service:
+//
+//	-fcm-credentials service-account.json
+//	-apns-key AuthKey_ABC123.p8 -apns-key-id ABC123 -apns-team-id DEF456 -apns-topic com.example.chat
+//
+// Users register the tokens of their devices and every notification their
+// sync stream gets (see notifications.go) is pushed to them as well, to the
+// devices with notify "all" for every message of the channels they follow and
+// to those with "mentions", the default, when they are mentioned:
+//
+//	curl -X POST http://localhost:8000/devices -H 'Authorization: Bearer <token>' -d '{"platform": "apns", "token": "<device token>"}'
+//
+// Pushes wait in a buffer for a few workers, a full buffer drops them. Failed
+// pushes are tried again twice, devices FCM or APNs no longer know are
+// unregistered
+type device struct {
+	Id        string    `json:"id"`
+	Platform  string    `json:"platform"` // fcm or apns
+	Token     string    `json:"token"`
+	Notify    string    `json:"notify"` // mentions or all
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type pushJob struct {
+	username string
+	device   device
+	channel  string
+	notice   notice
+}
+
+// a push service, send tells apart devices that are gone for good
+type pushSender interface {
+	send(job pushJob) (gone bool, err error)
+}
+
+const pushBuffer = 10000
+const pushWorkers = 4
+const pushAttempts = 3
+const pushTimeout = 10 * time.Second
+const maxDevices = 20
+const maxPushBody = 180
+
+var fcmCredentials string
+var apnsKey, apnsKeyID, apnsTeamID, apnsTopic string
+var apnsSandbox bool
+
+// where the services are reached, tests point them elsewhere
+var fcmEndpoint = "https://fcm.googleapis.com"
+var apnsProduction = "https://api.push.apple.com"
+var apnsDevelopment = "https://api.sandbox.push.apple.com"
+
+var pushSenders = make(map[string]pushSender)
+var pushQueue chan pushJob
+var pushDropped int64
+
+var devicesMutex sync.Mutex
+var devices = make(map[string][]*device) // username -> devices
+
+// startPush checks the push flags and starts the workers when a service is set up
+func startPush() error {
+	if fcmCredentials != "" {
+		sender, err := newFCMSender(fcmCredentials)
+		if err != nil {
+			return errors.New("-fcm-credentials: " + err.Error())
+		}
+		pushSenders["fcm"] = sender
+	}
+	if apnsKey != "" {
+		if apnsKeyID == "" || apnsTeamID == "" || apnsTopic == "" {
+			return errors.New("-apns-key needs -apns-key-id, -apns-team-id and -apns-topic")
+		}
+		sender, err := newAPNsSender(apnsKey)
+		if err != nil {
+			return errors.New("-apns-key: " + err.Error())
+		}
+		pushSenders["apns"] = sender
+	}
+	if len(pushSenders) == 0 {
+		return nil
+	}
+	pushQueue = make(chan pushJob, pushBuffer)
+	for i := 0; i < pushWorkers; i++ {
+		go sendPushes()
+	}
+	return nil
+}
+
+func pushPlatforms() []string {
+	platforms := []string{}
+	for platform := range pushSenders {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// pushNotice queues n for the devices of username without ever blocking the
+// poster
+func pushNotice(username, channel string, n notice) {
+	if pushQueue == nil || isMirror() {
+		return
+	}
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+	for _, d := range devices[username] {
+		if d.Notify != "all" && n.Reason != "mention" {
+			continue
+		}
+		select {
+		case pushQueue <- pushJob{username: username, device: *d, channel: channel, notice: n}:
+		default:
+			if atomic.AddInt64(&pushDropped, 1)%1000 == 1 {
+				fmt.Println("Push buffer is full, dropped", atomic.LoadInt64(&pushDropped), "notifications so far")
+			}
+		}
+	}
+}
+
+func sendPushes() {
+	for job := range pushQueue {
+		sender, ok := pushSenders[job.device.Platform]
+		if !ok {
+			continue
+		}
+		for attempt := 1; attempt <= pushAttempts; attempt++ {
+			gone, err := sender.send(job)
+			if gone {
+				removeDevice(job.username, job.device.Id)
+				break
+			}
+			if err == nil {
+				break
+			}
+			if attempt == pushAttempts {
+				fmt.Println("Push to", job.device.Platform, "failed:", err)
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+func removeDevice(username, id string) bool {
+	devicesMutex.Lock()
+	removed := false
+	for i, d := range devices[username] {
+		if d.Id == id {
+			dropDevice(username, i)
+			removed = true
+			break
+		}
+	}
+	devicesMutex.Unlock()
+	return removed
+}
+
+// Caller must hold devicesMutex
+func dropDevice(username string, i int) {
+	list := devices[username]
+	devices[username] = append(list[:i:i], list[i+1:]...)
+	if len(devices[username]) == 0 {
+		delete(devices, username)
+	}
+	logDevices(username)
+}
+
+// logDevices records the devices username has now. Caller must hold
+// devicesMutex
+func logDevices(username string) {
+	if len(devices[username]) == 0 {
+		logGlobal("devices_changed", "devices", username, nil)
+		return
+	}
+	list := []device{}
+	for _, d := range devices[username] {
+		list = append(list, *d)
+	}
+	logGlobal("devices_changed", "devices", username, list)
+}
+
+// pushTitle and pushBody are what the lock screen shows
+func pushTitle(channel string, n notice) string {
+	switch {
+	case n.Reason == "mention":
+		return n.Username + " mentioned you in #" + channel
+	case n.Reply:
+		return n.Username + " replied in #" + channel
+	}
+	return n.Username + " in #" + channel
+}
+
+func pushBody(n notice) string {
+	if utf8.RuneCountInString(n.Message) <= maxPushBody {
+		return n.Message
+	}
+	return string([]rune(n.Message)[:maxPushBody-1]) + "…"
+}
+
+// signedJWT joins header and claims and signs them with sign
+func signedJWT(header, claims map[string]interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+	parts := []string{}
+	for _, part := range []map[string]interface{}{header, claims} {
+		data, err := json.Marshal(part)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+	digest := sha256.Sum256([]byte(strings.Join(parts, ".")))
+	signature, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(parts, ".") + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func readPEMKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM key found")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// fcmSender speaks the HTTP v1 API of FCM with the OAuth token of a service
+// account, fetched again shortly before it expires
+type fcmSender struct {
+	project  string
+	email    string
+	tokenURI string
+	key      *rsa.PrivateKey
+	client   *http.Client
+
+	mu      sync.Mutex
+	access  string
+	expires time.Time
+}
+
+func newFCMSender(path string) (*fcmSender, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	account := struct {
+		ProjectID   string `json:"project_id"`
+		PrivateKey  string `json:"private_key"`
+		ClientEmail string `json:"client_email"`
+		TokenURI    string `json:"token_uri"`
+	}{}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, errors.New("not the key file of a service account")
+	}
+	key, err := readPEMKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key is not an RSA key")
+	}
+	return &fcmSender{project: account.ProjectID, email: account.ClientEmail, tokenURI: account.TokenURI, key: rsaKey, client: &http.Client{Timeout: pushTimeout}}, nil
+}
+
+func (f *fcmSender) accessToken() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.access != "" && now.Before(f.expires) {
+		return f.access, nil
+	}
+	assertion, err := signedJWT(
+		map[string]interface{}{"alg": "RS256", "typ": "JWT"},
+		map[string]interface{}{
+			"iss":   f.email,
+			"scope": "https://www.googleapis.com/auth/firebase.messaging",
+			"aud":   f.tokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		},
+		func(digest []byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest)
+		})
+	if err != nil {
+		return "", err
+	}
+	resp, err := f.client.PostForm(f.tokenURI, url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("no access token from %s: %s", f.tokenURI, resp.Status)
+	}
+	f.access = token.AccessToken
+	f.expires = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return f.access, nil
+}
+
+func (f *fcmSender) send(job pushJob) (bool, error) {
+	access, err := f.accessToken()
+	if err != nil {
+		return false, err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        job.device.Token,
+			"notification": map[string]string{"title": pushTitle(job.channel, job.notice), "body": pushBody(job.notice)},
+			"data":         map[string]string{"channel": job.channel, "message_id": strconv.Itoa(job.notice.MessageID), "reason": job.notice.Reason},
+			"android":      map[string]interface{}{"priority": "high", "notification": map[string]string{"tag": job.channel}},
+		},
+	})
+	req, err := http.NewRequest("POST", fcmEndpoint+"/v1/projects/"+f.project+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+access)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return false, nil
+	case resp.StatusCode == http.StatusNotFound || bytes.Contains(reply, []byte("UNREGISTERED")):
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		f.mu.Lock()
+		f.access = ""
+		f.mu.Unlock()
+	}
+	return false, fmt.Errorf("%s %s", resp.Status, bytes.TrimSpace(reply))
+}
+
+// apnsSender speaks HTTP/2 to APNs with a provider token signed by the .p8
+// key, made again every 50 minutes as Apple refuses those older than an hour
+type apnsSender struct {
+	host   string
+	key    *ecdsa.PrivateKey
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+func newAPNsSender(path string) (*apnsSender, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readPEMKey(data)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an APNs auth key")
+	}
+	host := apnsProduction
+	if apnsSandbox {
+		host = apnsDevelopment
+	}
+	return &apnsSender{host: host, key: ecKey, client: &http.Client{Timeout: pushTimeout}}, nil
+}
+
+func (a *apnsSender) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.token != "" && now.Sub(a.issued) < 50*time.Minute {
+		return a.token, nil
+	}
+	token, err := signedJWT(
+		map[string]interface{}{"alg": "ES256", "kid": apnsKeyID},
+		map[string]interface{}{"iss": apnsTeamID, "iat": now.Unix()},
+		func(digest []byte) ([]byte, error) {
+			r, s, err := ecdsa.Sign(rand.Reader, a.key, digest)
+			if err != nil {
+				return nil, err
+			}
+			// JWS wants r and s as two 32 byte big-endian numbers
+			signature := make([]byte, 64)
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(signature[32-len(rb):32], rb)
+			copy(signature[64-len(sb):], sb)
+			return signature, nil
+		})
+	if err != nil {
+		return "", err
+	}
+	a.token, a.issued = token, now
+	return token, nil
+}
+
+func (a *apnsSender) send(job pushJob) (bool, error) {
+	token, err := a.providerToken()
+	if err != nil {
+		return false, err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert":     map[string]string{"title": pushTitle(job.channel, job.notice), "body": pushBody(job.notice)},
+			"sound":     "default",
+			"thread-id": job.channel,
+		},
+		"channel":    job.channel,
+		"message_id": job.notice.MessageID,
+		"reason":     job.notice.Reason,
+	})
+	req, err := http.NewRequest("POST", a.host+"/3/device/"+job.device.Token, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", apnsTopic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	reason := struct {
+		Reason string `json:"reason"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&reason)
+	switch {
+	case resp.StatusCode == http.StatusGone || reason.Reason == "BadDeviceToken" || reason.Reason == "DeviceTokenNotForTopic":
+		return true, nil
+	case reason.Reason == "ExpiredProviderToken":
+		a.mu.Lock()
+		a.token = ""
+		a.mu.Unlock()
+	}
+	return false, fmt.Errorf("%s %s", resp.Status, reason.Reason)
+}
+
+// curl -X GET http://localhost:8000/devices -H 'Authorization: Bearer <token>' -v
+func getDevices(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Devices need a registered username or a guest token")
+		return
+	}
+	list := []device{}
+	devicesMutex.Lock()
+	for _, d := range devices[username] {
+		list = append(list, *d)
+	}
+	devicesMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string]interface{}{"devices": list, "platforms": pushPlatforms()})
+}
+
+// Registers a device of the user. A token registered before, by this user or
+// another one signed in on the same phone earlier, moves to this registration
+// curl -X POST http://localhost:8000/devices -H 'Authorization: Bearer <token>' -d '{"platform": "fcm", "token": "<registration token>", "notify": "all"}' -v
+func postDevice(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Devices need a registered username or a guest token")
+		return
+	}
+	d := device{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&d); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if d.Platform != "fcm" && d.Platform != "apns" {
+		respondJSON(w, http.StatusBadRequest, "platform should be fcm or apns")
+		return
+	}
+	if _, ok := pushSenders[d.Platform]; !ok {
+		respondJSON(w, http.StatusBadRequest, "Push notifications through "+d.Platform+" are not set up")
+		return
+	}
+	if d.Notify == "" {
+		d.Notify = "mentions"
+	}
+	if d.Notify != "mentions" && d.Notify != "all" {
+		respondJSON(w, http.StatusBadRequest, "notify should be mentions or all")
+		return
+	}
+	d.Token = strings.TrimSpace(d.Token)
+	if d.Token == "" || len(d.Token) > 4096 {
+		respondJSON(w, http.StatusBadRequest, "token should be the push token of the device")
+		return
+	}
+	d.Id, d.CreatedAt = newToken(), time.Now()
+
+	devicesMutex.Lock()
+	for owner, list := range devices {
+		for i, old := range list {
+			if old.Platform == d.Platform && old.Token == d.Token {
+				dropDevice(owner, i)
+				break
+			}
+		}
+	}
+	if len(devices[username]) >= maxDevices {
+		devicesMutex.Unlock()
+		respondJSON(w, http.StatusForbidden, "at most "+strconv.Itoa(maxDevices)+" devices")
+		return
+	}
+	devices[username] = append(devices[username], &d)
+	logDevices(username)
+	devicesMutex.Unlock()
+	respondJSON(w, http.StatusOK, d)
+}
+
+// curl -X DELETE http://localhost:8000/devices/<id> -H 'Authorization: Bearer <token>' -v
+func deleteDevice(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Devices need a registered username or a guest token")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if !removeDevice(username, id) {
+		respondJSON(w, http.StatusNotFound, "No such device")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"removed": id})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A post may quote another message, of its own channel or any other the poster
+// can read, by sending "quoted_message": {"channel": "foo", "id": 41}. The
+// server fills in who wrote the quoted message and a snapshot of its text, so
+// the quote reads the same after the original changes or is gone. Every
+// message knows which messages quote it
+const maxQuoteLength = 280
+
+type quote struct {
+	Channel  string    `json:"channel"`
+	Id       int       `json:"id"`
+	Username string    `json:"username"`
+	Message  string    `json:"message"`
+	Created  time.Time `json:"created_at"`
+}
+
+type messageRef struct {
+	Channel string `json:"channel"`
+	Id      int    `json:"id"`
+}
+
+// backlink is how backups keep quotedBy, JSON has no struct keys
+type backlink struct {
+	Quoted  messageRef `json:"quoted"`
+	Quoting messageRef `json:"quoting"`
+}
+
+var quotesMutex sync.Mutex
+var quotedBy = make(map[messageRef][]messageRef) // quoted -> quoting
+
+// resolveQuote checks that username can read the quoted message and takes the
+// snapshot. Returns the status to answer with when it can not be quoted. The
+// quoted channel is locked here, callers must not hold a subject lock
+func resolveQuote(q *quote, username string) (*quote, int, string) {
+	channel := resolveChannel(q.Channel)
+	subject := lookupSubject(channel)
+	if subject == nil {
+		return nil, http.StatusBadRequest, "Quoted channel does not exist"
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canAccess(username) {
+		return nil, http.StatusForbidden, "Quoted channel is private"
+	}
+	mesg := subject.message(q.Id)
+	if mesg == nil {
+		return nil, http.StatusBadRequest, "Quoted message does not exist"
+	}
+	text := []rune(mesg.Message)
+	if len(text) > maxQuoteLength {
+		text = append(text[:maxQuoteLength-1], '…')
+	}
+	return &quote{Channel: channel, Id: mesg.Id, Username: mesg.Username, Message: string(text), Created: mesg.Created}, http.StatusOK, ""
+}
+
+// recordQuote adds the backlink of a posted message quoting another one.
+// Callers must not hold a subject lock
+func recordQuote(channel string, mesg msgPost) {
+	if mesg.Quote == nil {
+		return
+	}
+	link := backlink{Quoted: messageRef{mesg.Quote.Channel, mesg.Quote.Id}, Quoting: messageRef{channel, mesg.Id}}
+	quotesMutex.Lock()
+	quotedBy[link.Quoted] = append(quotedBy[link.Quoted], link.Quoting)
+	logGlobal("quote_recorded", "quoted_by", link.entryKey(), link)
+	quotesMutex.Unlock()
+}
+
+// Lists the messages quoting this one that the caller can read. Backlinks of
+// messages deleted since are dropped on the way
+// curl -X GET http://localhost:8000/gdgsas022/messages/1/quoted-by -v
+func getQuotedBy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	rd := readerOf(r)
+	subject.RLock()
+	allowed := rd.mayRead(subject)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+
+	quoted := messageRef{channel, id}
+	quotesMutex.Lock()
+	refs := append([]messageRef(nil), quotedBy[quoted]...)
+	quotesMutex.Unlock()
+
+	list := []msgPost{}
+	dead := make(map[messageRef]bool)
+	for _, ref := range refs {
+		quoting := lookupSubject(ref.Channel)
+		if quoting == nil {
+			dead[ref] = true
+			continue
+		}
+		quoting.RLock()
+		mesg := quoting.message(ref.Id)
+		if mesg == nil || mesg.Quote == nil || mesg.Quote.Channel != channel || mesg.Quote.Id != id {
+			dead[ref] = true
+		} else if visible, ok := rd.message(mesg); ok && rd.mayRead(quoting) {
+			list = append(list, visible)
+		}
+		quoting.RUnlock()
+	}
+	if len(dead) > 0 {
+		quotesMutex.Lock()
+		live := []messageRef{}
+		for _, ref := range quotedBy[quoted] {
+			if !dead[ref] {
+				live = append(live, ref)
+			} else {
+				logGlobal("quote_dropped", "quoted_by", backlinkEntry(quoted, ref), nil)
+			}
+		}
+		if len(live) == 0 {
+			delete(quotedBy, quoted)
+		} else {
+			quotedBy[quoted] = live
+		}
+		quotesMutex.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	respondJSON(w, http.StatusOK, map[string]interface{}{"channel": channel, "id": id, "quoted_by": list})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const maxEmojiLength = 32
+const defaultReactorsPage = 50
+const maxReactorsPage = 500
+
+type reaction struct {
+	Username string `json:"username"`
+	Emoji    string `json:"emoji"`
+}
+
+type reactionSummary struct {
+	Emoji     string   `json:"emoji"`
+	Shortcode string   `json:"shortcode,omitempty"`
+	Count     int      `json:"count"`
+	Users     []string `json:"users"`
+}
+
+// react adds or removes username from the emoji reactors. Caller must hold the
+// subject lock. Returns false if nothing changed
+func (m *msgPost) react(emoji, username string, add bool) bool {
+	users := m.reactions[emoji]
+	for i, u := range users {
+		if u == username {
+			if add {
+				return false
+			}
+			m.reactions[emoji] = append(users[:i], users[i+1:]...)
+			if len(m.reactions[emoji]) == 0 {
+				delete(m.reactions, emoji)
+			}
+			m.ReactionCount--
+			return true
+		}
+	}
+	if !add {
+		return false
+	}
+	if m.reactions == nil {
+		m.reactions = make(map[string][]string)
+	}
+	m.reactions[emoji] = append(users, username)
+	m.ReactionCount++
+	return true
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/messages/1/reactions -d '{"username": "sally", "emoji": "+1"}' -v
+func postReaction(w http.ResponseWriter, r *http.Request) {
+	changeReaction(w, r, true)
+}
+
+// curl -X DELETE http://localhost:8000/gdgsas022/messages/1/reactions -d '{"username": "sally", "emoji": "+1"}' -v
+func deleteReaction(w http.ResponseWriter, r *http.Request) {
+	changeReaction(w, r, false)
+}
+
+func changeReaction(w http.ResponseWriter, r *http.Request, add bool) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return
+	}
+
+	react := reaction{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&react); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	react.Username = normalizeUsername(react.Username)
+	if react.Username == "" || react.Emoji == "" {
+		respondJSON(w, http.StatusBadRequest, "Empty username or emoji!")
+		return
+	}
+	if utf8.RuneCountInString(react.Emoji) > maxEmojiLength {
+		respondJSON(w, http.StatusBadRequest, "emoji is too long")
+		return
+	}
+	// reactions are stored as the emoji whichever form the client sent
+	emoji, ok := reactionEmoji(react.Emoji)
+	if !ok {
+		respondJSON(w, http.StatusBadRequest, "emoji should be an emoji or a known shortcode")
+		return
+	}
+	react.Emoji = emoji
+	if !mayActAs(r, react.Username) {
+		respondJSON(w, http.StatusForbidden, "Not allowed to react as this username")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	// Critical region
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canAccess(react.Username) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	if subject.frozen {
+		respondJSON(w, http.StatusForbidden, "Channel is frozen")
+		return
+	}
+	mesg := subject.mutableMessage(id)
+	if mesg == nil {
+		respondJSON(w, http.StatusBadRequest, "Provided messageId does not exist!")
+		return
+	}
+	if mesg.react(react.Emoji, react.Username, add) {
+		subject.logMessage(id, "message_updated")
+		kind := "reaction_removed"
+		if add {
+			kind = "reaction_added"
+		}
+		publish(channel, kind, map[string]interface{}{"message_id": id, "username": react.Username, "emoji": react.Emoji, "shortcode": shortcodeOf[react.Emoji]})
+	}
+	respondJSON(w, http.StatusOK, map[string]int{"id": id, "reaction_count": mesg.ReactionCount})
+	// End of Critical region
+}
+
+// Lists per emoji counts and who reacted. offset/limit page through the users
+// of each emoji, emoji= narrows the answer down to a single emoji
+// curl -X GET 'http://localhost:8000/gdgsas022/messages/1/reactions?emoji=%2B1&offset=0&limit=20' -v
+func getReactions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return
+	}
+	query := r.URL.Query()
+	offset, limit := 0, defaultReactorsPage
+	if key := query.Get("offset"); key != "" {
+		if offset, err = strconv.Atoi(key); err != nil || offset < 0 {
+			respondJSON(w, http.StatusBadRequest, "offset should be a positive integer")
+			return
+		}
+	}
+	if key := query.Get("limit"); key != "" {
+		if limit, err = strconv.Atoi(key); err != nil || limit <= 0 || limit > maxReactorsPage {
+			respondJSON(w, http.StatusBadRequest, "limit should be between 1 and "+strconv.Itoa(maxReactorsPage))
+			return
+		}
+	}
+	only := query.Get("emoji")
+	if only != "" {
+		only, _ = reactionEmoji(only)
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	rd := readerOf(r)
+	if !rd.mayRead(subject) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	mesg := subject.message(id)
+	if _, ok := rd.message(mesg); !ok {
+		respondJSON(w, http.StatusBadRequest, "No message for the provided id")
+		return
+	}
+
+	summaries := []reactionSummary{}
+	total := 0
+	for emoji, users := range mesg.reactions {
+		users = rd.reactors(users)
+		total += len(users)
+		if (only != "" && emoji != only) || len(users) == 0 {
+			continue
+		}
+		page := []string{}
+		if offset < len(users) {
+			end := offset + limit
+			if end > len(users) {
+				end = len(users)
+			}
+			page = append(page, users[offset:end]...)
+		}
+		summaries = append(summaries, reactionSummary{Emoji: emoji, Shortcode: shortcodeOf[emoji], Count: len(users), Users: page})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Count != summaries[j].Count {
+			return summaries[i].Count > summaries[j].Count
+		}
+		return summaries[i].Emoji < summaries[j].Emoji
+	})
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message_id": id,
+		"total":      total,
+		"offset":     offset,
+		"limit":      limit,
+		"reactions":  summaries,
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Every path serving messages asks a reader what its caller may see instead
+// of deciding for itself: the listings, single messages, threads and
+// reactions, exports and closed channels, the streams and their backlogs. The
+// rules are
+//
+//   - private channels are for their members, moderators and invited guests,
+//     admins read every channel as they could export it anyway
+//   - a message past its TTL is gone, even before the reaper drops it
+//   - the messages, replies and reactions of users the caller blocked are
+//     left out
+//
+// A new rule about who reads what goes here so that no read path misses it
+type reader struct {
+	username string
+	admin    bool
+	blocked  map[string]bool
+}
+
+// readerOf is the caller of a request
+func readerOf(r *http.Request) reader {
+	username := actingUser(r)
+	return reader{username: username, admin: isAdmin(r), blocked: blockedBy(username)}
+}
+
+// readerFor reads on behalf of username when nobody asked, for digests
+func readerFor(username string) reader {
+	return reader{username: username, blocked: blockedBy(username)}
+}
+
+// mayRead tells whether the channel is open to the reader. Caller must hold
+// the subject lock
+func (rd reader) mayRead(s *subject) bool {
+	return rd.admin || s.canAccess(rd.username)
+}
+
+func (rd reader) sees(mesg *msgPost, now time.Time) bool {
+	return !rd.blocked[mesg.Username] && (mesg.ExpiresAt == nil || now.Before(*mesg.ExpiresAt))
+}
+
+// visible is what the reader sees of msgs. The messages are copied when their
+// thread changes, the channel keeps them whole
+func (rd reader) visible(msgs []msgPost) []msgPost {
+	now := time.Now()
+	hidden := false
+	for i := range msgs {
+		if !rd.sees(&msgs[i], now) {
+			hidden = true
+			break
+		}
+	}
+	if !hidden && len(rd.blocked) == 0 {
+		return msgs
+	}
+	visible := []msgPost{}
+	for _, mesg := range msgs {
+		if !rd.sees(&mesg, now) {
+			continue
+		}
+		mesg.Threads = rd.replies(mesg.Threads)
+		visible = append(visible, mesg)
+	}
+	return visible
+}
+
+// message is what the reader sees of a single message, false for nothing
+func (rd reader) message(mesg *msgPost) (msgPost, bool) {
+	if mesg == nil || !rd.sees(mesg, time.Now()) {
+		return msgPost{}, false
+	}
+	visible := *mesg
+	visible.Threads = rd.replies(mesg.Threads)
+	return visible, true
+}
+
+func (rd reader) replies(replies []Thread) []Thread {
+	if len(rd.blocked) == 0 {
+		return replies
+	}
+	visible := []Thread{}
+	for _, reply := range replies {
+		if !rd.blocked[reply.Username] {
+			visible = append(visible, reply)
+		}
+	}
+	return visible
+}
+
+// reactors leaves the blocked users out of those who reacted
+func (rd reader) reactors(users []string) []string {
+	if len(rd.blocked) == 0 {
+		return users
+	}
+	visible := []string{}
+	for _, username := range users {
+		if !rd.blocked[username] {
+			visible = append(visible, username)
+		}
+	}
+	return visible
+}
+
+// stream wraps the filter of a stream so events by users the reader blocked
+// are dropped. Blocks are looked up as events go out, so blocking takes
+// effect on open streams right away
+func (rd reader) stream(keep filter) filter {
+	if rd.username == "" {
+		return keep
+	}
+	username := rd.username
+	return func(ev event) bool {
+		if author, _, _, ok := eventPost(ev); ok && hasBlocked(username, author) {
+			return false
+		}
+		return keep == nil || keep(ev)
+	}
+}
+
+// key tells readers apart for caches, those with the same key see the same
+func (rd reader) key() string {
+	blocked := []string{}
+	for name := range rd.blocked {
+		blocked = append(blocked, name)
+	}
+	sort.Strings(blocked)
+	return strings.Join(blocked, ",")
+}
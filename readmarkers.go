@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// A read marker is the newest message id a user has read in a channel, kept
+// on the server so every device of the user agrees on what is unread. Changes
+// go out as "read" events on the sync stream of the user:
+//
+//	{"type": "read", "channel": "foo", "data": {"last_read": 41}}
+var markersMutex sync.Mutex
+var readMarkers = make(map[string]map[string]int) // username -> channel -> last read id
+
+type readMarker struct {
+	Channel  string `json:"channel"`
+	LastRead int    `json:"last_read"`
+	Unread   int    `json:"unread"`
+}
+
+// checkedMarker resolves last_read for username on channel, 0 and anything
+// past the newest message mean all of it. Returns the status to answer with
+// when the marker can not be set
+func checkedMarker(username, channel string, lastRead int) (int, int, string) {
+	subject := lookupSubject(channel)
+	if subject == nil {
+		return 0, http.StatusBadRequest, "Sorry No such channel exist!"
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canAccess(username) {
+		return 0, http.StatusForbidden, "This channel is private"
+	}
+	if lastRead <= 0 || lastRead > subject.lastID {
+		lastRead = subject.lastID
+	}
+	return lastRead, http.StatusOK, ""
+}
+
+// setMarkers stores the markers and tells the other devices of the user
+func setMarkers(username string, markers map[string]int) {
+	markersMutex.Lock()
+	if readMarkers[username] == nil {
+		readMarkers[username] = make(map[string]int)
+	}
+	for channel, lastRead := range markers {
+		readMarkers[username][channel] = lastRead
+		logGlobal("marker_set", "read_markers", markerEntry(username, channel), lastRead)
+	}
+	markersMutex.Unlock()
+	for channel, lastRead := range markers {
+		notifyUser(username, channel, "read", map[string]int{"last_read": lastRead})
+	}
+}
+
+// Lists the read markers of the user with the unread messages of each channel
+// curl -X GET http://localhost:8000/read-markers -H 'Authorization: Bearer <token>' -v
+func getReadMarkers(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Read markers need a registered username or a guest token")
+		return
+	}
+	markersMutex.Lock()
+	list := []readMarker{}
+	for channel, lastRead := range readMarkers[username] {
+		list = append(list, readMarker{Channel: channel, LastRead: lastRead})
+	}
+	markersMutex.Unlock()
+
+	// archived channels are not brought back for a count
+	for i := range list {
+		if subject := lookupLive(list[i].Channel); subject != nil {
+			subject.RLock()
+			list[i].Unread = subject.countersOf().newerThan(list[i].LastRead)
+			subject.RUnlock()
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Channel < list[j].Channel })
+	respondJSON(w, http.StatusOK, map[string][]readMarker{"markers": list})
+}
+
+// Sets the markers of many channels at once, 0 marks a channel read up to its
+// newest message. Either all of them are set or none. all marks every channel
+// the user has a marker in as read, skipping those gone meanwhile
+// curl -X PUT http://localhost:8000/read-markers -H 'Authorization: Bearer <token>' -d '{"markers": {"gdgsas022": 41, "general": 0}}' -v
+// curl -X PUT http://localhost:8000/read-markers -H 'Authorization: Bearer <token>' -d '{"all": true}' -v
+func putReadMarkers(w http.ResponseWriter, r *http.Request) {
+	username := privateUser(r)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Read markers need a registered username or a guest token")
+		return
+	}
+	req := struct {
+		Markers map[string]int `json:"markers"`
+		All     bool           `json:"all"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Markers) == 0 && !req.All {
+		respondJSON(w, http.StatusBadRequest, "No markers given")
+		return
+	}
+
+	markers := make(map[string]int, len(req.Markers))
+	if req.All {
+		markersMutex.Lock()
+		tracked := []string{}
+		for channel := range readMarkers[username] {
+			tracked = append(tracked, channel)
+		}
+		markersMutex.Unlock()
+		for _, channel := range tracked {
+			if lastRead, status, _ := checkedMarker(username, channel, 0); status == http.StatusOK {
+				markers[channel] = lastRead
+			}
+		}
+	}
+	for name, lastRead := range req.Markers {
+		channel := resolveChannel(name)
+		lastRead, status, msg := checkedMarker(username, channel, lastRead)
+		if status != http.StatusOK {
+			respondJSON(w, status, map[string]string{"error": msg, "channel": name})
+			return
+		}
+		markers[channel] = lastRead
+	}
+	setMarkers(username, markers)
+	respondJSON(w, http.StatusOK, map[string]map[string]int{"markers": markers})
+}
+
+// markerUser is whose markers a call is about, username when it names one
+// and the caller otherwise. Markers are kept for registered and guest names
+// only and only their holders may read or move them
+func markerUser(r *http.Request, username string) string {
+	if username == "" {
+		return privateUser(r)
+	}
+	username = normalizeUsername(username)
+	if (isGuest(username) || isClaimed(username)) && mayActAs(r, username) {
+		return username
+	}
+	return ""
+}
+
+// Moves the marker of the user in the channel to last_read, everything is
+// read without one
+// curl -X POST http://localhost:8000/gdgsas022/read -H 'Authorization: Bearer <token>' -v
+// curl -X POST http://localhost:8000/gdgsas022/read -H 'Authorization: Bearer <token>' -d '{"username": "arthur", "last_read": 41}' -v
+func postRead(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	req := struct {
+		Username string `json:"username"`
+		LastRead int    `json:"last_read"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	username := markerUser(r, req.Username)
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Read markers need a registered username or a guest token")
+		return
+	}
+	lastRead, status, msg := checkedMarker(username, channel, req.LastRead)
+	if status != http.StatusOK {
+		respondJSON(w, status, msg)
+		return
+	}
+	setMarkers(username, map[string]int{channel: lastRead})
+	marker := readMarker{Channel: channel, LastRead: lastRead}
+	if subject := lookupSubject(channel); subject != nil {
+		subject.RLock()
+		marker.Unread = subject.countersOf().newerThan(lastRead)
+		subject.RUnlock()
+	}
+	respondJSON(w, http.StatusOK, marker)
+}
+
+// The unread messages of the user in the channel, all of them before the
+// first marker is set
+// curl -X GET 'http://localhost:8000/gdgsas022/unread?username=arthur' -H 'Authorization: Bearer <token>' -v
+func getUnread(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	username := markerUser(r, r.URL.Query().Get("username"))
+	if username == "" {
+		respondJSON(w, http.StatusUnauthorized, "Read markers need a registered username or a guest token")
+		return
+	}
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	markersMutex.Lock()
+	lastRead := readMarkers[username][channel]
+	markersMutex.Unlock()
+
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canAccess(username) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	respondJSON(w, http.StatusOK, readMarker{Channel: channel, LastRead: lastRead, Unread: subject.countersOf().newerThan(lastRead)})
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis storage, for deployments that run Redis already:
+//
+//	messaging-service -storage redis -db redis://:secret@localhost:6379/0
+//
+// The settings of every channel are in the hash messaging:channels, the
+// messages of a channel in the hash messaging:messages:{channel} and the
+// replies of their threads in messaging:threads:{channel}, both by message
+// id. Messages change after they are posted, a hash updates one in place
+// where a list would need its position. The state kept outside channels is
+// messaging:globals, the entries changed since it was written are in the hash
+// messaging:global_entries by set/entry. Each record is applied in one
+// MULTI/EXEC, so the keys never show half a change.
+//
+// Every instance still serves from its own memory and hands out ids there.
+// Redis keeps the state across restarts and lets a standby take over from a
+// primary that is gone, instances writing the same channels at once would
+// overwrite each other
+const redisPrefix = "messaging:"
+const redisTimeout = 10 * time.Second
+
+type redisStore struct {
+	addr     string
+	username string
+	password string
+	database int
+	conn     net.Conn
+	r        *bufio.Reader
+	deadline time.Time // of the record being applied, zero for none
+}
+
+// redisError is an error reply, the connection is fine after one
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func openRedis(rawURL string) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, errors.New("-db should be a redis:// URL")
+	}
+	rs := &redisStore{addr: u.Host}
+	if u.Port() == "" {
+		rs.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		rs.username = u.User.Username()
+		rs.password, _ = u.User.Password()
+	}
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		if rs.database, err = strconv.Atoi(path); err != nil {
+			return nil, errors.New("the path of a redis:// URL is the database number")
+		}
+	}
+	if _, err := rs.do("PING"); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *redisStore) dial() error {
+	conn, err := net.DialTimeout("tcp", rs.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	rs.conn, rs.r = conn, bufio.NewReader(conn)
+	var setup [][]string
+	if rs.password != "" {
+		if rs.username != "" {
+			setup = append(setup, []string{"AUTH", rs.username, rs.password})
+		} else {
+			setup = append(setup, []string{"AUTH", rs.password})
+		}
+	}
+	if rs.database != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(rs.database)})
+	}
+	for _, cmd := range setup {
+		if _, err := rs.roundTrip([][]string{cmd}); err != nil {
+			rs.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *redisStore) close() error {
+	if rs.conn == nil {
+		return nil
+	}
+	err := rs.conn.Close()
+	rs.conn = nil
+	return err
+}
+
+func (rs *redisStore) do(args ...string) (interface{}, error) {
+	replies, err := rs.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends the commands at once and reads their replies, the first
+// error reply is returned as the error. A connection that failed is dialed
+// again for the next commands
+func (rs *redisStore) pipeline(cmds [][]string) ([]interface{}, error) {
+	if rs.conn == nil {
+		if err := rs.dial(); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := rs.roundTrip(cmds)
+	if _, ok := err.(redisError); err != nil && !ok {
+		rs.close()
+	}
+	return replies, err
+}
+
+func (rs *redisStore) roundTrip(cmds [][]string) ([]interface{}, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if !rs.deadline.IsZero() && rs.deadline.Before(deadline) {
+		deadline = rs.deadline
+	}
+	rs.conn.SetDeadline(deadline)
+	w := bufio.NewWriter(rs.conn)
+	for _, args := range cmds {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var failed error
+	for i := range cmds {
+		reply, err := readRedisReply(rs.r)
+		if _, ok := err.(redisError); err != nil && !ok {
+			return nil, err
+		}
+		if err != nil && failed == nil {
+			failed = err
+		}
+		replies[i] = reply
+	}
+	return replies, failed
+}
+
+// readRedisReply reads one RESP reply: a string, an int64, nil or a slice of
+// those
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		var failed error
+		for i := range items {
+			item, err := readRedisReply(r)
+			if _, ok := err.(redisError); err != nil && !ok {
+				return nil, err
+			}
+			if err != nil && failed == nil {
+				failed = err
+			}
+			items[i] = item
+		}
+		return items, failed
+	}
+	return nil, errors.New("redis: unknown reply type " + string(kind))
+}
+
+// strings of an array reply, HGETALL and HKEYS
+func redisStrings(reply interface{}) []string {
+	items, _ := reply.([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		s, _ := item.(string)
+		list = append(list, s)
+	}
+	return list
+}
+
+func messagesKey(channel string) string {
+	return redisPrefix + "messages:" + channel
+}
+
+func threadsKey(channel string) string {
+	return redisPrefix + "threads:" + channel
+}
+
+func (rs *redisStore) load() (backup, error) {
+	b := backup{Version: backupVersion, TakenAt: time.Now(), Node: nodeID, Channels: []archivedChannel{}}
+	reply, err := rs.do("HGETALL", redisPrefix+"channels")
+	if err != nil {
+		return b, err
+	}
+	fields := redisStrings(reply)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name := fields[i]
+		a := archivedChannel{}
+		if err := json.Unmarshal([]byte(fields[i+1]), &a); err != nil {
+			return b, fmt.Errorf("channel %s: %v", name, err)
+		}
+		replies, err := rs.pipeline([][]string{{"HGETALL", messagesKey(name)}, {"HGETALL", threadsKey(name)}})
+		if err != nil {
+			return b, err
+		}
+		threads := make(map[string][]Thread)
+		fields := redisStrings(replies[1])
+		for j := 0; j+1 < len(fields); j += 2 {
+			var thread []Thread
+			if err := json.Unmarshal([]byte(fields[j+1]), &thread); err != nil {
+				return b, fmt.Errorf("thread %s/%s: %v", name, fields[j], err)
+			}
+			threads[fields[j]] = thread
+		}
+		fields = redisStrings(replies[0])
+		for j := 0; j+1 < len(fields); j += 2 {
+			sp := storedPost{}
+			if err := json.Unmarshal([]byte(fields[j+1]), &sp); err != nil {
+				return b, fmt.Errorf("message %s/%s: %v", name, fields[j], err)
+			}
+			sp.Threads = threads[fields[j]]
+			a.upsert(sp)
+		}
+		b.Channels = append(b.Channels, a)
+	}
+	sort.Slice(b.Channels, func(i, j int) bool { return b.Channels[i].Title < b.Channels[j].Title })
+
+	reply, err = rs.do("GET", redisPrefix+"globals")
+	if err != nil {
+		return b, err
+	}
+	if state, ok := reply.(string); ok {
+		if err := json.Unmarshal([]byte(state), &b.globalState); err != nil {
+			return b, err
+		}
+	}
+	reply, err = rs.do("HGETALL", redisPrefix+"global_entries")
+	if err != nil {
+		return b, err
+	}
+	entries := []globalEntry{}
+	fields = redisStrings(reply)
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := strings.SplitN(fields[i], "/", 2)
+		entries = append(entries, globalEntry{Set: key[0], Key: key[1], Value: storedValue(fields[i+1])})
+	}
+	return b, b.globalState.applyEntries(entries)
+}
+
+// A transaction a record, the commands of a record may read what the one
+// before wrote
+func (rs *redisStore) apply(ctx context.Context, records []walRecord) error {
+	rs.deadline, _ = ctx.Deadline()
+	defer func() { rs.deadline = time.Time{} }()
+	for _, rec := range records {
+		cmds, err := rs.commands(rec)
+		if err != nil {
+			return err
+		}
+		if len(cmds) == 0 {
+			continue
+		}
+		cmds = append([][]string{{"MULTI"}}, cmds...)
+		cmds = append(cmds, []string{"EXEC"})
+		if _, err = rs.pipeline(cmds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commands are what applies the record, the reads it needs are made here
+func (rs *redisStore) commands(rec walRecord) ([][]string, error) {
+	channel := rec.Channel
+	switch rec.Kind {
+	case "message":
+		return messageCommands(channel, *rec.Message)
+	case "removed":
+		ids := make([]string, 0, len(rec.Removed))
+		for _, id := range rec.Removed {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		if rec.Before > 0 {
+			reply, err := rs.do("HKEYS", messagesKey(channel))
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range redisStrings(reply) {
+				if id, err := strconv.Atoi(key); err == nil && id < rec.Before {
+					ids = append(ids, key)
+				}
+			}
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		return [][]string{
+			append([]string{"HDEL", messagesKey(channel)}, ids...),
+			append([]string{"HDEL", threadsKey(channel)}, ids...),
+		}, nil
+	case "settings":
+		a := *rec.Settings
+		a.Messages = nil
+		settings, err := json.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{{"HSET", redisPrefix + "channels", channel, string(settings)}}, nil
+	case "channel":
+		a := *rec.Settings
+		a.Messages = nil
+		settings, err := json.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		cmds := [][]string{
+			{"DEL", messagesKey(channel), threadsKey(channel)},
+			{"HSET", redisPrefix + "channels", channel, string(settings)},
+		}
+		for _, sp := range rec.Settings.Messages {
+			more, err := messageCommands(channel, sp)
+			if err != nil {
+				return nil, err
+			}
+			cmds = append(cmds, more...)
+		}
+		return cmds, nil
+	case "dropped":
+		return [][]string{
+			{"DEL", messagesKey(channel), threadsKey(channel)},
+			{"HDEL", redisPrefix + "channels", channel},
+		}, nil
+	case "global":
+		entries, prefix := redisPrefix+"global_entries", rec.Global.Set+"/"
+		cmds := [][]string{}
+		if rec.Global.Key == "" {
+			reply, err := rs.do("HKEYS", entries)
+			if err != nil {
+				return nil, err
+			}
+			del := []string{"HDEL", entries}
+			for _, key := range redisStrings(reply) {
+				if strings.HasPrefix(key, prefix) {
+					del = append(del, key)
+				}
+			}
+			if len(del) > 2 {
+				cmds = append(cmds, del)
+			}
+		}
+		return append(cmds, []string{"HSET", entries, prefix + rec.Global.Key, string(rec.Global.Value)}), nil
+	case "globals":
+		state, err := json.Marshal(rec.Globals)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{{"DEL", redisPrefix + "global_entries"}, {"SET", redisPrefix + "globals", string(state)}}, nil
+	case "restored":
+		// restoreBackup writes the new state right after
+		reply, err := rs.do("HKEYS", redisPrefix+"channels")
+		if err != nil {
+			return nil, err
+		}
+		del := []string{"DEL", redisPrefix + "channels", redisPrefix + "globals", redisPrefix + "global_entries"}
+		for _, name := range redisStrings(reply) {
+			del = append(del, messagesKey(name), threadsKey(name))
+		}
+		return [][]string{del}, nil
+	}
+	return nil, errors.New("unknown record kind " + rec.Kind)
+}
+
+func messageCommands(channel string, sp storedPost) ([][]string, error) {
+	replies := sp.Threads
+	sp.Threads = nil
+	body, err := json.Marshal(sp)
+	if err != nil {
+		return nil, err
+	}
+	id := strconv.Itoa(sp.Id)
+	cmds := [][]string{{"HSET", messagesKey(channel), id, string(body)}}
+	if len(replies) == 0 {
+		return append(cmds, []string{"HDEL", threadsKey(channel), id}), nil
+	}
+	thread, err := json.Marshal(replies)
+	if err != nil {
+		return nil, err
+	}
+	return append(cmds, []string{"HSET", threadsKey(channel), id, string(thread)}), nil
+}
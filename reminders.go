@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Reminders post a message into a channel on a schedule, a cron expression
+// in the timezone of the reminder or a fixed interval:
+//
+//	curl -X POST http://localhost:8000/standup/reminders -H 'X-Username: arthur' -d '{"message": "Standup in 5 minutes", "cron": "55 9 * * mon-fri", "timezone": "Europe/Berlin"}'
+//	curl -X POST http://localhost:8000/ops/reminders -H 'X-Username: arthur' -d '{"message": "Check the {{.Channel}} backlog, run {{.Run}}", "every": "4h"}'
+//
+// The message is a Go template with .Channel, .Now and .Run, the number of
+// the post. Reminders post as whoever created them unless they name someone
+// the creator may act as, skip the pre-moderation queue and survive restarts.
+// A reminder missed while the node was down posts once when it comes back.
+// Their creator and the moderators of the channel can pause, change and
+// remove them
+type reminder struct {
+	Id        string     `json:"id"`
+	Channel   string     `json:"channel"`
+	Username  string     `json:"username"`
+	Message   string     `json:"message"`
+	Cron      string     `json:"cron,omitempty"`
+	Every     string     `json:"every,omitempty"`
+	Timezone  string     `json:"timezone,omitempty"`
+	Paused    bool       `json:"paused"`
+	NextRun   time.Time  `json:"next_run"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	Runs      int        `json:"runs"`
+	LastError string     `json:"last_error,omitempty"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// reminderSpec is the body of POST and PUT, PUT leaves out what stays
+type reminderSpec struct {
+	Username *string `json:"username"`
+	Message  *string `json:"message"`
+	Cron     *string `json:"cron"`
+	Every    *string `json:"every"`
+	Timezone *string `json:"timezone"`
+	Paused   *bool   `json:"paused"`
+}
+
+type reminderData struct {
+	Channel string
+	Now     time.Time
+	Run     int
+}
+
+const reminderInterval = 15 * time.Second
+const minReminderEvery = time.Minute
+const maxChannelReminders = 50
+
+var remindersMutex sync.Mutex
+var reminders = make(map[string]*reminder)
+
+// cronSchedule is a parsed cron expression, a bit per allowed value
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+var cronNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCron reads the five fields minute, hour, day of month, month and day
+// of week with *, lists, ranges, steps and the names of months and days
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron should have five fields: minute, hour, day of month, month and day of week")
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	bits := [5]uint64{}
+	for i, field := range fields {
+		for _, part := range strings.Split(field, ",") {
+			step := 1
+			if j := strings.IndexByte(part, '/'); j >= 0 {
+				n, err := strconv.Atoi(part[j+1:])
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("bad step in %q", field)
+				}
+				step, part = n, part[:j]
+			}
+			lo, hi := bounds[i][0], bounds[i][1]
+			if part != "*" {
+				ends := strings.SplitN(part, "-", 2)
+				var err error
+				if lo, err = cronValue(ends[0]); err != nil {
+					return nil, fmt.Errorf("bad value in %q", field)
+				}
+				hi = lo
+				if len(ends) == 2 {
+					if hi, err = cronValue(ends[1]); err != nil {
+						return nil, fmt.Errorf("bad value in %q", field)
+					}
+				} else if step > 1 {
+					hi = bounds[i][1]
+				}
+			}
+			if lo < bounds[i][0] || hi > bounds[i][1] || lo > hi {
+				return nil, fmt.Errorf("%q is out of range %d-%d", field, bounds[i][0], bounds[i][1])
+			}
+			for v := lo; v <= hi; v += step {
+				bits[i] |= 1 << uint(v)
+			}
+		}
+	}
+	// 7 is Sunday too
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronSchedule{minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4], anyDom: fields[2] == "*", anyDow: fields[4] == "*"}, nil
+}
+
+func cronValue(s string) (int, error) {
+	if v, ok := cronNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// dayMatches follows cron: with both day fields restricted either may match
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// next is the first minute after t the schedule fires at, zero when it never
+// does, e.g. on February 30
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// nextRun is when the reminder posts after now, zero for never
+func (rem *reminder) nextRun(now time.Time) time.Time {
+	if rem.Every != "" {
+		every, _ := time.ParseDuration(rem.Every)
+		return now.Add(every)
+	}
+	schedule, err := parseCron(rem.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	loc, err := time.LoadLocation(rem.Timezone)
+	if err != nil {
+		return time.Time{}
+	}
+	return schedule.next(now.In(loc)).UTC()
+}
+
+// apply validates spec and sets it on rem, which is only changed when all of
+// it is valid
+func (rem *reminder) apply(r *http.Request, spec reminderSpec) error {
+	next := *rem
+	if spec.Username != nil {
+		next.Username = normalizeUsername(*spec.Username)
+	}
+	if spec.Message != nil {
+		next.Message = *spec.Message
+	}
+	if spec.Cron != nil || spec.Every != nil {
+		next.Cron, next.Every = "", ""
+		if spec.Cron != nil {
+			next.Cron = strings.TrimSpace(*spec.Cron)
+		}
+		if spec.Every != nil {
+			next.Every = strings.TrimSpace(*spec.Every)
+		}
+	}
+	if spec.Timezone != nil {
+		next.Timezone = *spec.Timezone
+	}
+	if spec.Paused != nil {
+		next.Paused = *spec.Paused
+	}
+
+	if next.Username == "" {
+		return errors.New("Empty username!")
+	}
+	if next.Username != rem.Username && !mayActAs(r, next.Username) {
+		return errors.New("Not allowed to post as this username")
+	}
+	if strings.TrimSpace(next.Message) == "" {
+		return errors.New("Empty message!")
+	}
+	if _, err := template.New("reminder").Option("missingkey=error").Parse(next.Message); err != nil {
+		return errors.New("message is not a valid template: " + err.Error())
+	}
+	if (next.Cron == "") == (next.Every == "") {
+		return errors.New("A reminder needs either cron or every")
+	}
+	if next.Every != "" {
+		every, err := time.ParseDuration(next.Every)
+		if err != nil || every < minReminderEvery {
+			return errors.New("every should be a duration of at least " + minReminderEvery.String())
+		}
+	}
+	if _, err := time.LoadLocation(next.Timezone); err != nil {
+		return errors.New("Unknown timezone " + next.Timezone)
+	}
+	if next.Cron != "" {
+		schedule, err := parseCron(next.Cron)
+		if err != nil {
+			return err
+		}
+		if schedule.next(time.Now()).IsZero() {
+			return errors.New("cron never fires")
+		}
+	}
+	// a new schedule starts from now
+	if next.Cron != rem.Cron || next.Every != rem.Every || next.Timezone != rem.Timezone || next.NextRun.IsZero() {
+		next.NextRun = next.nextRun(time.Now())
+	}
+	*rem = next
+	return nil
+}
+
+// text fills in the template of the reminder
+func (rem *reminder) text(now time.Time) (string, error) {
+	t, err := template.New("reminder").Option("missingkey=error").Parse(rem.Message)
+	if err != nil {
+		return "", err
+	}
+	loc, err := time.LoadLocation(rem.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, reminderData{Channel: rem.Channel, Now: now.In(loc), Run: rem.Runs + 1}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// runReminders posts the reminders that are due. A mirror posts nothing, its
+// reminders run once it is promoted
+func runReminders(now time.Time) {
+	if isMirror() {
+		return
+	}
+	remindersMutex.Lock()
+	due := []reminder{}
+	for _, rem := range reminders {
+		if !rem.Paused && !rem.NextRun.IsZero() && !now.Before(rem.NextRun) {
+			due = append(due, *rem)
+		}
+	}
+	remindersMutex.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRun.Before(due[j].NextRun) })
+
+	for _, rem := range due {
+		problem := ""
+		text, err := rem.text(now)
+		if err != nil {
+			problem = err.Error()
+		} else {
+			problem = rem.post(text)
+		}
+		remindersMutex.Lock()
+		// it may have been removed or changed meanwhile
+		if current, ok := reminders[rem.Id]; ok && current.NextRun.Equal(rem.NextRun) {
+			ran := now
+			current.LastRun, current.LastError = &ran, problem
+			if problem == "" {
+				current.Runs++
+			}
+			current.NextRun = current.nextRun(now)
+			logGlobal("reminder_ran", "reminders", current.Id, current)
+		}
+		remindersMutex.Unlock()
+	}
+}
+
+// post adds text to the channel of the reminder, the problem when it can not
+func (rem reminder) post(text string) string {
+	subject := lookupSubject(rem.Channel).lockLive()
+	if subject == nil {
+		return "Sorry No such channel exist!"
+	}
+	defer subject.Unlock()
+	if !subject.canAccess(rem.Username) {
+		return "This channel is private"
+	}
+	if subject.frozen {
+		return "Channel is frozen"
+	}
+	if maxChannelMessages > 0 && subject.count() >= maxChannelMessages {
+		return "Channel is full"
+	}
+	mesg := subject.add(msgPost{Username: rem.Username, Message: text, Verified: isClaimed(rem.Username)})
+	subject.logMessage(mesg.Id, "message_created")
+	publish(rem.Channel, "message", mesg)
+	subject.notifyPost(notice{MessageID: mesg.Id, Username: mesg.Username, Message: mesg.Message})
+	return ""
+}
+
+// reminderFor finds the id of a reminder of the channel the caller may change
+func reminderFor(w http.ResponseWriter, r *http.Request) (string, bool) {
+	vars := mux.Vars(r)
+	subject := lookupSubject(vars["channel"])
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return "", false
+	}
+	remindersMutex.Lock()
+	rem, ok := reminders[vars["id"]]
+	createdBy := ""
+	if ok {
+		createdBy = rem.CreatedBy
+	}
+	ok = ok && rem.Channel == vars["channel"]
+	remindersMutex.Unlock()
+	if !ok {
+		respondJSON(w, http.StatusNotFound, "No such reminder")
+		return "", false
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r) || (createdBy != "" && actingUser(r) == createdBy && mayActAs(r, createdBy))
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only its creator and moderators can change a reminder")
+		return "", false
+	}
+	return vars["id"], true
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/reminders -H 'X-Username: arthur' -d '{"message": "Weekly report due", "cron": "0 16 * * fri"}' -v
+func postReminder(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	spec := reminderSpec{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&spec); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	creator := actingUser(r)
+	if creator == "" || !mayActAs(r, creator) {
+		respondJSON(w, http.StatusUnauthorized, "Creating a reminder needs a username")
+		return
+	}
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canAccess(creator)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+
+	rem := &reminder{Id: newToken(), Channel: channel, Username: creator, CreatedBy: creator, CreatedAt: time.Now()}
+	if err := rem.apply(r, spec); err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	remindersMutex.Lock()
+	count := 0
+	for _, other := range reminders {
+		if other.Channel == channel {
+			count++
+		}
+	}
+	if count >= maxChannelReminders {
+		remindersMutex.Unlock()
+		respondJSON(w, http.StatusForbidden, "at most "+strconv.Itoa(maxChannelReminders)+" reminders a channel")
+		return
+	}
+	reminders[rem.Id] = rem
+	shown := *rem
+	logGlobal("reminder_created", "reminders", rem.Id, shown)
+	remindersMutex.Unlock()
+	respondJSON(w, http.StatusOK, shown)
+}
+
+// curl -X GET http://localhost:8000/gdgsas022/reminders -v
+func getReminders(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canAccess(actingUser(r))
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	list := []reminder{}
+	remindersMutex.Lock()
+	for _, rem := range reminders {
+		if rem.Channel == channel {
+			list = append(list, *rem)
+		}
+	}
+	remindersMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	respondJSON(w, http.StatusOK, map[string][]reminder{"reminders": list})
+}
+
+// Changes a reminder, {"paused": true} pauses it
+// curl -X PUT http://localhost:8000/gdgsas022/reminders/<id> -H 'X-Username: arthur' -d '{"paused": true}' -v
+func putReminder(w http.ResponseWriter, r *http.Request) {
+	spec := reminderSpec{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&spec); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, ok := reminderFor(w, r)
+	if !ok {
+		return
+	}
+	remindersMutex.Lock()
+	rem, ok := reminders[id]
+	if !ok {
+		remindersMutex.Unlock()
+		respondJSON(w, http.StatusNotFound, "No such reminder")
+		return
+	}
+	if err := rem.apply(r, spec); err != nil {
+		remindersMutex.Unlock()
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	shown := *rem
+	logGlobal("reminder_changed", "reminders", rem.Id, shown)
+	remindersMutex.Unlock()
+	respondJSON(w, http.StatusOK, shown)
+}
+
+// curl -X DELETE http://localhost:8000/gdgsas022/reminders/<id> -H 'X-Username: arthur' -v
+func deleteReminder(w http.ResponseWriter, r *http.Request) {
+	id, ok := reminderFor(w, r)
+	if !ok {
+		return
+	}
+	remindersMutex.Lock()
+	delete(reminders, id)
+	logGlobal("reminder_removed", "reminders", id, nil)
+	remindersMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string]string{"removed": id})
+}
+
+// forgetReminders removes the reminders of a channel that is gone, so they do
+// not post into whatever channel takes its name next
+func forgetReminders(channel string) {
+	remindersMutex.Lock()
+	defer remindersMutex.Unlock()
+	for id, rem := range reminders {
+		if rem.Channel == channel {
+			delete(reminders, id)
+			logGlobal("reminder_removed", "reminders", id, nil)
+		}
+	}
+}
+
+func takeReminders() []reminder {
+	remindersMutex.Lock()
+	defer remindersMutex.Unlock()
+	list := []reminder{}
+	for _, rem := range reminders {
+		list = append(list, *rem)
+	}
+	return list
+}
+
+func restoreReminders(list []reminder) {
+	remindersMutex.Lock()
+	defer remindersMutex.Unlock()
+	reminders = make(map[string]*reminder)
+	for i := range list {
+		reminders[list[i].Id] = &list[i]
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// GitHub and GitLab post their webhooks to an integration (see webhooks.go):
+//
+//	GitHub: Payload URL  https://chat.example.com/api/github/<integration id>
+//	        Content type application/json, Secret the integration secret
+//	GitLab: URL          https://chat.example.com/api/gitlab/<integration id>
+//	        Secret token the integration secret
+//
+// GitHub calls are checked against X-Hub-Signature-256, GitLab ones against
+// X-Gitlab-Token. Pushes, pull and merge requests being opened, closed, merged
+// or reopened and issues being opened, closed or reopened become messages
+// under the integration name, in the channel the repository routes of the
+// integration pick. Anything else is acknowledged and dropped
+type repoEvent struct {
+	Repository string
+	Text       string
+}
+
+// GitHub caps payloads at 25MB, pushes that big lose their commits here
+const maxRepoEventBody = 1 << 20
+
+// the commits of a push listed in the message
+const maxPushCommits = 5
+
+type repoCommit struct {
+	ID      string
+	Message string
+	Author  string
+}
+
+// pushText describes a push of commits to branch, the first line of each
+func pushText(who, repository, branch string, total int, commits []repoCommit, link string) string {
+	noun := "commits"
+	if total == 1 {
+		noun = "commit"
+	}
+	lines := []string{fmt.Sprintf("%s pushed %d %s to %s:%s", who, total, noun, repository, branch)}
+	for i, c := range commits {
+		if i == maxPushCommits {
+			lines = append(lines, fmt.Sprintf("and %d more", total-maxPushCommits))
+			break
+		}
+		id := c.ID
+		if len(id) > 7 {
+			id = id[:7]
+		}
+		subject := strings.SplitN(c.Message, "\n", 2)[0]
+		lines = append(lines, fmt.Sprintf("- %s %s (%s)", id, subject, c.Author))
+	}
+	if link != "" {
+		lines = append(lines, link)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// changeText describes a pull request, merge request or issue changing state
+func changeText(who, action, kind, repository string, number int, title, link string) string {
+	return fmt.Sprintf("%s %s %s #%d in %s: %s\n%s", who, action, kind, number, repository, title, link)
+}
+
+type githubPayload struct {
+	Action     string `json:"action"`
+	Ref        string `json:"ref"`
+	Created    bool   `json:"created"`
+	Deleted    bool   `json:"deleted"`
+	Compare    string `json:"compare"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	Pusher struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		Author  struct {
+			Name     string `json:"name"`
+			Username string `json:"username"`
+		} `json:"author"`
+	} `json:"commits"`
+	PullRequest *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+	} `json:"pull_request"`
+	Issue *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+	} `json:"issue"`
+}
+
+// githubEvent translates a GitHub webhook, false for the ones not posted
+func githubEvent(kind string, body []byte) (repoEvent, bool, error) {
+	p := githubPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return repoEvent{}, false, err
+	}
+	ev := repoEvent{Repository: p.Repository.FullName}
+	switch {
+	case kind == "push":
+		branch := strings.TrimPrefix(p.Ref, "refs/heads/")
+		switch {
+		case p.Deleted:
+			ev.Text = fmt.Sprintf("%s deleted %s:%s", p.Pusher.Name, ev.Repository, branch)
+		case len(p.Commits) == 0 && p.Created:
+			ev.Text = fmt.Sprintf("%s created %s:%s\n%s", p.Pusher.Name, ev.Repository, branch, p.Compare)
+		case len(p.Commits) == 0:
+			return ev, false, nil
+		default:
+			commits := []repoCommit{}
+			for _, c := range p.Commits {
+				author := c.Author.Username
+				if author == "" {
+					author = c.Author.Name
+				}
+				commits = append(commits, repoCommit{ID: c.ID, Message: c.Message, Author: author})
+			}
+			ev.Text = pushText(p.Pusher.Name, ev.Repository, branch, len(commits), commits, p.Compare)
+		}
+	case kind == "pull_request" && p.PullRequest != nil:
+		action := p.Action
+		switch {
+		case action == "closed" && p.PullRequest.Merged:
+			action = "merged"
+		case action == "ready_for_review":
+			action = "marked ready for review"
+		case action != "opened" && action != "closed" && action != "reopened":
+			return ev, false, nil
+		}
+		ev.Text = changeText(p.Sender.Login, action, "pull request", ev.Repository, p.PullRequest.Number, p.PullRequest.Title, p.PullRequest.HTMLURL)
+	case kind == "issues" && p.Issue != nil:
+		if p.Action != "opened" && p.Action != "closed" && p.Action != "reopened" {
+			return ev, false, nil
+		}
+		ev.Text = changeText(p.Sender.Login, p.Action, "issue", ev.Repository, p.Issue.Number, p.Issue.Title, p.Issue.HTMLURL)
+	default:
+		return ev, false, nil
+	}
+	return ev, true, nil
+}
+
+type gitlabPayload struct {
+	ObjectKind string `json:"object_kind"`
+	Ref        string `json:"ref"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	User       struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	UserUsername string `json:"user_username"`
+	Project      struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	TotalCommitsCount int `json:"total_commits_count"`
+	Commits           []struct {
+		ID     string `json:"id"`
+		Title  string `json:"title"`
+		Author struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	ObjectAttributes struct {
+		IID    int    `json:"iid"`
+		Title  string `json:"title"`
+		URL    string `json:"url"`
+		Action string `json:"action"`
+	} `json:"object_attributes"`
+}
+
+// GitLab sends an all zero sha as before of a new branch and after of a
+// deleted one
+const gitlabNoCommit = "0000000000000000000000000000000000000000"
+
+// gitlabEvent translates a GitLab webhook, false for the ones not posted
+func gitlabEvent(body []byte) (repoEvent, bool, error) {
+	p := gitlabPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return repoEvent{}, false, err
+	}
+	ev := repoEvent{Repository: p.Project.PathWithNamespace}
+	actions := map[string]string{"open": "opened", "close": "closed", "reopen": "reopened", "merge": "merged"}
+	switch p.ObjectKind {
+	case "push":
+		branch := strings.TrimPrefix(p.Ref, "refs/heads/")
+		switch {
+		case p.After == gitlabNoCommit:
+			ev.Text = fmt.Sprintf("%s deleted %s:%s", p.UserUsername, ev.Repository, branch)
+		case p.TotalCommitsCount == 0:
+			return ev, false, nil
+		default:
+			commits := []repoCommit{}
+			for _, c := range p.Commits {
+				commits = append(commits, repoCommit{ID: c.ID, Message: c.Title, Author: c.Author.Name})
+			}
+			link := p.Project.WebURL + "/-/commits/" + branch
+			if p.Before != gitlabNoCommit {
+				link = p.Project.WebURL + "/-/compare/" + p.Before + "..." + p.After
+			}
+			ev.Text = pushText(p.UserUsername, ev.Repository, branch, p.TotalCommitsCount, commits, link)
+		}
+	case "merge_request", "issue":
+		action, ok := actions[p.ObjectAttributes.Action]
+		if !ok || (p.ObjectKind == "issue" && action == "merged") {
+			return ev, false, nil
+		}
+		kind := "merge request"
+		if p.ObjectKind == "issue" {
+			kind = "issue"
+		}
+		ev.Text = changeText(p.User.Username, action, kind, ev.Repository, p.ObjectAttributes.IID, p.ObjectAttributes.Title, p.ObjectAttributes.URL)
+	default:
+		return ev, false, nil
+	}
+	return ev, true, nil
+}
+
+// curl -X POST http://localhost:8000/api/github/<id> -H 'X-GitHub-Event: push' -H "X-Hub-Signature-256: sha256=$sig" -d @push.json
+// curl -X POST http://localhost:8000/api/gitlab/<id> -H 'X-Gitlab-Token: <secret>' -d @push.json
+func postRepoEvent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	integrationsMutex.Lock()
+	hook, ok := integrations[vars["id"]]
+	integrationsMutex.Unlock()
+	if !ok {
+		respondJSON(w, http.StatusNotFound, "No such integration")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRepoEventBody))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var ev repoEvent
+	var posted bool
+	if vars["forge"] == "github" {
+		mac := hmac.New(sha256.New, []byte(hook.secret))
+		mac.Write(body)
+		if !hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+			respondJSON(w, http.StatusUnauthorized, "Bad signature")
+			return
+		}
+		if r.Header.Get("X-GitHub-Event") == "ping" {
+			respondJSON(w, http.StatusOK, map[string]bool{"pong": true})
+			return
+		}
+		ev, posted, err = githubEvent(r.Header.Get("X-GitHub-Event"), body)
+	} else {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(hook.secret)) != 1 {
+			respondJSON(w, http.StatusUnauthorized, "Bad token")
+			return
+		}
+		ev, posted, err = gitlabEvent(body)
+	}
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !posted {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// the route is followed as if the integration belonged there
+	routed := *hook
+	routed.Channel = hook.channelFor(ev.Repository)
+	if mesg, ok := postAsIntegration(w, r, &routed, msgPost{Message: ev.Text}); ok {
+		respondJSON(w, http.StatusOK, map[string]interface{}{"id": mesg.Id, "channel": routed.Channel})
+	}
+}
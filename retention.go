@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// retentionPolicy bounds how much history a channel keeps. Zero values mean no
+// limit for that dimension
+type retentionPolicy struct {
+	MaxAge      time.Duration
+	MaxMessages int
+}
+
+func (p retentionPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"max_age":      p.MaxAge.String(),
+		"max_messages": p.MaxMessages,
+	})
+}
+
+// globalRetention comes from -retention-max-age and -retention-max-messages. It
+// applies to every channel and is also the bound for channel overrides, which
+// may only be stricter. Admins are not bound by it
+var globalRetention retentionPolicy
+
+// Often enough for message TTLs of a few tens of seconds
+const reaperInterval = 10 * time.Second
+
+// effectiveRetention merges the channel override over the global policy. Caller
+// must hold the subject lock
+func (s *subject) effectiveRetention() retentionPolicy {
+	policy := globalRetention
+	if s.retention != nil {
+		if s.retention.MaxAge > 0 {
+			policy.MaxAge = s.retention.MaxAge
+		}
+		if s.retention.MaxMessages > 0 {
+			policy.MaxMessages = s.retention.MaxMessages
+		}
+	}
+	return policy
+}
+
+// expire drops the messages the policy no longer allows, oldest first, and
+// returns how many went. Caller must hold the subject write lock
+func (s *subject) expire(policy retentionPolicy, now time.Time) int {
+	drop := 0
+	if policy.MaxMessages > 0 && s.count() > policy.MaxMessages {
+		drop = s.count() - policy.MaxMessages
+	}
+	if policy.MaxAge > 0 {
+		if old := s.olderThan(now.Add(-policy.MaxAge)); old > drop {
+			drop = old
+		}
+	}
+	if drop == 0 {
+		return 0
+	}
+	s.dropOldest(drop)
+	return drop
+}
+
+// olderThan counts the messages created before cutoff. Caller must hold the
+// subject lock
+func (s *subject) olderThan(cutoff time.Time) int {
+	old := 0
+	for _, b := range s.cold {
+		if b.newest.Before(cutoff) {
+			old += b.count
+			continue
+		}
+		for _, mesg := range b.messages() {
+			if !mesg.Created.Before(cutoff) {
+				return old
+			}
+			old++
+		}
+	}
+	for _, mesg := range s.Messages {
+		if !mesg.Created.Before(cutoff) {
+			break
+		}
+		old++
+	}
+	return old
+}
+
+// below counts the messages with an id lower than id. Caller must hold the
+// subject lock
+func (s *subject) below(id int) int {
+	n := 0
+	for _, b := range s.cold {
+		if b.last < id {
+			n += b.count
+			continue
+		}
+		for _, mesg := range b.messages() {
+			if mesg.Id < id {
+				n++
+			}
+		}
+		return n
+	}
+	for _, mesg := range s.Messages {
+		if mesg.Id >= id {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// dropOldest forgets the n oldest messages, whole cold blocks first. Caller
+// must hold the subject write lock
+func (s *subject) dropOldest(n int) {
+	for n > 0 && len(s.cold) > 0 {
+		b := s.cold[0]
+		if b.count <= n {
+			n -= b.count
+			// no readers build the counters under the write lock
+			if s.counters != nil {
+				s.untally(b.messages())
+			}
+			b.discard()
+			s.cold = s.cold[1:]
+			continue
+		}
+		b.thaw()
+		s.untally(b.msgs[:n])
+		b.set(append([]msgPost(nil), b.msgs[n:]...))
+		return
+	}
+	if n > len(s.Messages) {
+		n = len(s.Messages)
+	}
+	s.untally(s.Messages[:n])
+	// copy so the dropped messages can actually be garbage collected
+	s.Messages = append([]msgPost(nil), s.Messages[n:]...)
+}
+
+// setTTL validates the ttl of a new message and sets when it expires. A TTL
+// has to be shorter than the max age the channel keeps messages for. Caller
+// must hold the subject lock
+func (s *subject) setTTL(mesg *msgPost) error {
+	mesg.ExpiresAt = nil
+	if mesg.TTL == "" {
+		return nil
+	}
+	ttl, err := time.ParseDuration(mesg.TTL)
+	if err != nil || ttl <= 0 {
+		return errors.New("ttl should be a positive duration like 30s")
+	}
+	if maxAge := s.effectiveRetention().MaxAge; maxAge > 0 && ttl >= maxAge {
+		return errors.New("ttl should be shorter than the channel retention of " + maxAge.String())
+	}
+	expires := time.Now().Add(ttl)
+	mesg.ExpiresAt = &expires
+	return nil
+}
+
+// expireMessages deletes the messages whose own TTL ran out and returns their
+// ids. Messages of held users wait for the hold to be lifted. Caller must hold
+// the subject write lock
+func (s *subject) expireMessages(now time.Time, held map[string]bool) []int {
+	gone := []int{}
+	for id, at := range s.expiring {
+		if now.Before(at) {
+			continue
+		}
+		if mesg := s.message(id); mesg != nil && held[mesg.Username] {
+			continue
+		}
+		delete(s.expiring, id)
+		if s.remove(id) {
+			gone = append(gone, id)
+		}
+	}
+	sort.Ints(gone)
+	return gone
+}
+
+// remove deletes a single message wherever it is kept, false if it is gone
+// already. Caller must hold the subject write lock
+func (s *subject) remove(id int) bool {
+	if id >= s.firstHotID() {
+		i := sort.Search(len(s.Messages), func(i int) bool { return s.Messages[i].Id >= id })
+		if i == len(s.Messages) || s.Messages[i].Id != id {
+			return false
+		}
+		s.tally(s.Messages[i], -1)
+		s.Messages = append(s.Messages[:i], s.Messages[i+1:]...)
+		return true
+	}
+	i := sort.Search(len(s.cold), func(i int) bool { return s.cold[i].last >= id })
+	if i == len(s.cold) || id < s.cold[i].first {
+		return false
+	}
+	b := s.cold[i]
+	b.thaw()
+	j := sort.Search(len(b.msgs), func(j int) bool { return b.msgs[j].Id >= id })
+	if j == len(b.msgs) || b.msgs[j].Id != id {
+		return false
+	}
+	s.tally(b.msgs[j], -1)
+	msgs := append(b.msgs[:j], b.msgs[j+1:]...)
+	if len(msgs) == 0 {
+		b.discard()
+		s.cold = append(s.cold[:i], s.cold[i+1:]...)
+	} else {
+		b.set(msgs)
+	}
+	return true
+}
+
+// reap enforces retention and message TTLs on every channel not on legal hold
+func reap(now time.Time) {
+	// the primary reaps, its removals reach mirrors as records
+	if isMirror() {
+		return
+	}
+	held := heldUsers()
+	for channel, subject := range allSubjects() {
+		if channelOnHold(channel) {
+			continue
+		}
+		subject.Lock()
+		if held != nil {
+			trimmed := subject.expireAround(subject.effectiveRetention(), now, held)
+			for _, id := range trimmed {
+				publish(channel, "message_deleted", map[string]interface{}{"message_id": id, "reason": "retention"})
+			}
+			if len(trimmed) > 0 {
+				subject.logRemoved(trimmed, 0)
+			}
+		} else if count := subject.expire(subject.effectiveRetention(), now); count > 0 {
+			before := subject.oldestID()
+			if before == 0 {
+				before = subject.lastID + 1
+			}
+			subject.logRemoved(nil, before)
+			publish(channel, "messages_expired", map[string]int{"count": count, "oldest_id": subject.oldestID()})
+		}
+		gone := subject.expireMessages(now, held)
+		for _, id := range gone {
+			publish(channel, "message_deleted", map[string]interface{}{"message_id": id, "reason": "ttl"})
+		}
+		if len(gone) > 0 {
+			subject.logRemoved(gone, 0)
+		}
+		subject.Unlock()
+	}
+}
+
+// curl -X GET http://localhost:8000/gdgsas022/retention -v
+func getRetention(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canAccess(actingUser(r)) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"global":    globalRetention,
+		"override":  subject.retention,
+		"effective": subject.effectiveRetention(),
+	})
+}
+
+// Channel owners narrow the retention of their channel, within the global bounds
+// curl -X PUT http://localhost:8000/gdgsas022/retention -H 'X-Username: arthur' -d '{"max_age": "72h", "max_messages": 5000}' -v
+func putRetention(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	req := struct {
+		MaxAge      string `json:"max_age"`
+		MaxMessages int    `json:"max_messages"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	policy := retentionPolicy{MaxMessages: req.MaxMessages}
+	if req.MaxAge != "" {
+		var err error
+		if policy.MaxAge, err = time.ParseDuration(req.MaxAge); err != nil || policy.MaxAge < 0 {
+			respondJSON(w, http.StatusBadRequest, "max_age should be a positive duration like 72h")
+			return
+		}
+	}
+	if policy.MaxMessages < 0 {
+		respondJSON(w, http.StatusBadRequest, "max_messages can not be negative")
+		return
+	}
+	if !isAdmin(r) {
+		if globalRetention.MaxAge > 0 && (policy.MaxAge == 0 || policy.MaxAge > globalRetention.MaxAge) {
+			respondJSON(w, http.StatusBadRequest, "max_age can not exceed "+globalRetention.MaxAge.String())
+			return
+		}
+		if globalRetention.MaxMessages > 0 && (policy.MaxMessages == 0 || policy.MaxMessages > globalRetention.MaxMessages) {
+			respondJSON(w, http.StatusBadRequest, "max_messages exceeds the global limit")
+			return
+		}
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !isAdmin(r) && actingUser(r) != subject.owner {
+		respondJSON(w, http.StatusForbidden, "Only the channel owner can change retention")
+		return
+	}
+	subject.retention = &policy
+	subject.logSettings("channel_updated")
+	publish(channel, "retention_changed", subject.effectiveRetention())
+	respondJSON(w, http.StatusOK, map[string]interface{}{"override": policy, "effective": subject.effectiveRetention()})
+}
+
+func deleteRetention(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !isAdmin(r) && actingUser(r) != subject.owner {
+		respondJSON(w, http.StatusForbidden, "Only the channel owner can change retention")
+		return
+	}
+	subject.retention = nil
+	subject.logSettings("channel_updated")
+	publish(channel, "retention_changed", subject.effectiveRetention())
+	respondJSON(w, http.StatusOK, map[string]interface{}{"effective": subject.effectiveRetention()})
+}
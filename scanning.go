@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Attachments, the audio of voice notes and the body of snippets, can be run
+// through a virus scanner before anybody gets them:
+//
+//	-scanner clamd://localhost:3310             clamd, with its INSTREAM command
+//	-scanner https://scanner.internal/scan      POST of the bytes, answered with
+//	                                            {"infected": true, "signature": "Eicar-Test-Signature"}
+//
+// A flagged post is quarantined: it waits in the moderation queue of its
+// channel with the verdict, premoderated or not, and goes out only once a
+// moderator approves it. Posts the scanner could not check are quarantined
+// too, nothing unscanned goes out
+var scannerURL string
+
+const scanTimeout = 30 * time.Second
+const clamdChunk = 64 << 10
+
+type scanVerdict struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// scanPost scans the attachments of a post, nil when there is no scanner or
+// they are clean. It talks to the scanner, callers must not hold a subject lock.
+// The scan gives up when ctx is done
+func scanPost(ctx context.Context, mesg *msgPost) *scanVerdict {
+	if scannerURL == "" {
+		return nil
+	}
+	var attachments [][]byte
+	if mesg.Snippet != nil {
+		attachments = append(attachments, []byte(mesg.Snippet.body))
+	}
+	if mesg.VoiceNote != nil {
+		attachments = append(attachments, mesg.VoiceNote.data)
+	}
+	for _, data := range attachments {
+		verdict, err := scan(ctx, data)
+		if err != nil {
+			fmt.Println("Scanning an attachment failed:", err)
+			return &scanVerdict{Error: err.Error()}
+		}
+		if verdict.Infected {
+			return &verdict
+		}
+	}
+	return nil
+}
+
+func scan(ctx context.Context, data []byte) (scanVerdict, error) {
+	u, err := url.Parse(scannerURL)
+	if err != nil {
+		return scanVerdict{}, err
+	}
+	if u.Scheme == "clamd" {
+		return scanClamd(ctx, u.Host, data)
+	}
+	return scanHTTP(ctx, data)
+}
+
+func scanClamd(ctx context.Context, addr string, data []byte) (scanVerdict, error) {
+	dialer := net.Dialer{Timeout: scanTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return scanVerdict{}, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(scanTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		n := len(data)
+		if n > clamdChunk {
+			n = clamdChunk
+		}
+		binary.BigEndian.PutUint32(size, uint32(n))
+		w.Write(size)
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	if err := w.Flush(); err != nil {
+		return scanVerdict{}, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return scanVerdict{}, err
+	}
+	// stream: OK, stream: Eicar-Test-Signature FOUND or ... ERROR
+	reply = strings.TrimPrefix(strings.TrimRight(reply, "\x00\n"), "stream: ")
+	switch {
+	case reply == "OK":
+		return scanVerdict{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return scanVerdict{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return scanVerdict{}, errors.New("clamd: " + reply)
+}
+
+var scanClient = &http.Client{Timeout: scanTimeout}
+
+func scanHTTP(ctx context.Context, data []byte) (scanVerdict, error) {
+	verdict := scanVerdict{}
+	req, err := http.NewRequestWithContext(ctx, "POST", scannerURL, bytes.NewReader(data))
+	if err != nil {
+		return verdict, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := scanClient.Do(req)
+	if err != nil {
+		return verdict, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return verdict, fmt.Errorf("scanner answered %s", resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&verdict)
+	verdict.Error = ""
+	return verdict, err
+}
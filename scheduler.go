@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Housekeeping runs as jobs of a small scheduler instead of one ticker per
+// sweeper. Every job runs every Interval plus a random delay of up to Jitter,
+// so nodes started together do not sweep in lockstep. -jobs overrides the
+// defaults, e.g. -jobs "reap=30s,compact=5m+1m,archive=off". Admins can list
+// the jobs with their metrics and run one on demand
+type job struct {
+	Name     string
+	Interval time.Duration
+	Jitter   time.Duration
+	Enabled  bool
+	run      func(now time.Time)
+
+	// metrics, guarded by mu which also keeps runs from overlapping
+	mu            sync.Mutex
+	Runs          int
+	LastRun       time.Time
+	LastDuration  time.Duration
+	TotalDuration time.Duration
+}
+
+var jobs = make(map[string]*job)
+
+func registerJob(name string, interval, jitter time.Duration, run func(now time.Time)) {
+	jobs[name] = &job{Name: name, Interval: interval, Jitter: jitter, Enabled: true, run: run}
+}
+
+func (j *job) execute() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	start := time.Now()
+	j.run(start)
+	j.LastRun = start
+	j.LastDuration = time.Since(start)
+	j.TotalDuration += j.LastDuration
+	j.Runs++
+}
+
+func (j *job) loop() {
+	for {
+		delay := j.Interval
+		if j.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(j.Jitter)))
+		}
+		time.Sleep(delay)
+		j.execute()
+	}
+}
+
+// configureJobs applies a -jobs value: comma separated name=interval,
+// name=interval+jitter or name=off
+func configureJobs(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		j, ok := jobs[parts[0]]
+		if !ok || len(parts) != 2 {
+			return errors.New("unknown job or missing value in " + item)
+		}
+		if parts[1] == "off" {
+			j.Enabled = false
+			continue
+		}
+		timing := strings.SplitN(parts[1], "+", 2)
+		interval, err := time.ParseDuration(timing[0])
+		if err != nil || interval <= 0 {
+			return errors.New("bad interval in " + item)
+		}
+		j.Interval, j.Enabled = interval, true
+		if len(timing) == 2 {
+			if j.Jitter, err = time.ParseDuration(timing[1]); err != nil || j.Jitter < 0 {
+				return errors.New("bad jitter in " + item)
+			}
+		}
+	}
+	return nil
+}
+
+func startJobs() {
+	for _, j := range jobs {
+		if j.Enabled {
+			go j.loop()
+		}
+	}
+}
+
+// curl -X GET http://localhost:8000/admin/jobs -H 'X-Admin-Token: secret'
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	list := []map[string]interface{}{}
+	for _, j := range jobs {
+		j.mu.Lock()
+		list = append(list, map[string]interface{}{
+			"name":              j.Name,
+			"enabled":           j.Enabled,
+			"interval":          j.Interval.String(),
+			"jitter":            j.Jitter.String(),
+			"runs":              j.Runs,
+			"last_run":          j.LastRun,
+			"last_duration_ns":  j.LastDuration,
+			"total_duration_ns": j.TotalDuration,
+		})
+		j.mu.Unlock()
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a]["name"].(string) < list[b]["name"].(string) })
+	respondJSON(w, http.StatusOK, map[string]interface{}{"jobs": list})
+}
+
+// Runs a job right away, disabled ones included, and answers once it is done
+// curl -X POST http://localhost:8000/admin/jobs/reap/run -H 'X-Admin-Token: secret'
+func runJob(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	vars := mux.Vars(r)
+	j, ok := jobs[vars["name"]]
+	if !ok {
+		respondJSON(w, http.StatusNotFound, "No such job")
+		return
+	}
+	j.execute()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	respondJSON(w, http.StatusOK, map[string]interface{}{"name": j.Name, "duration_ns": j.LastDuration})
+}
+
+// describeJobs is the startup line listing what runs how often
+func describeJobs() string {
+	names := make([]string, 0, len(jobs))
+	for name, j := range jobs {
+		if j.Enabled {
+			names = append(names, fmt.Sprintf("%s every %s", name, j.Interval))
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Regulated deployments forward the audit log and moderation events to their
+// SIEM, as syslog or over HTTP:
+//
+//	-siem udp://siem.internal:514            RFC 5424 syslog, one record a datagram
+//	-siem tcp://siem.internal:601            RFC 5424 syslog, octet counted
+//	-siem https://siem.internal/ingest       POST of a batch, a JSON array or CEF lines
+//
+// -siem-format picks JSON or CEF for the records. They wait in a buffer while
+// the SIEM can not be reached and the batch that failed is sent again, backing
+// off up to a minute. A full buffer drops new records and says how many
+const siemBuffer = 10000
+const siemBatch = 100
+const siemMaxBackoff = time.Minute
+
+var siemURL string
+var siemFormat = "json"
+var siemQueue chan siemRecord
+var siemDropped int64
+
+type siemRecord struct {
+	At       time.Time   `json:"at"`
+	Source   string      `json:"source"` // audit or moderation
+	Type     string      `json:"type"`
+	Actor    string      `json:"actor,omitempty"`
+	Channel  string      `json:"channel,omitempty"`
+	Username string      `json:"username,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// the channel events moderators cause
+var moderationEvents = map[string]bool{
+	"message_pending":     true,
+	"message_quarantined": true,
+	"message_approved":    true,
+	"message_rejected":    true,
+	"moderation_changed":  true,
+	"thread_locked":       true,
+	"thread_unlocked":     true,
+	"thread_promoted":     true,
+	"channel_frozen":      true,
+	"channel_unfrozen":    true,
+	"slow_mode_changed":   true,
+	"retention_changed":   true,
+	"visibility_changed":  true,
+}
+
+// startSIEM checks -siem and starts forwarding
+func startSIEM() error {
+	if siemURL == "" {
+		return nil
+	}
+	if siemFormat != "json" && siemFormat != "cef" {
+		return errors.New("-siem-format should be json or cef")
+	}
+	u, err := url.Parse(siemURL)
+	if err != nil {
+		return err
+	}
+	var send func([]siemRecord) error
+	switch u.Scheme {
+	case "udp", "tcp":
+		send = (&syslogSink{network: u.Scheme, addr: u.Host}).send
+	case "http", "https":
+		send = sendSIEMHTTP
+	default:
+		return errors.New("-siem should be a udp://, tcp://, http:// or https:// URL")
+	}
+	siemQueue = make(chan siemRecord, siemBuffer)
+	broker.Handle(allChannels, moderationToSIEM)
+	go forwardSIEM(send)
+	return nil
+}
+
+// toSIEM queues a record without ever blocking the caller
+func toSIEM(rec siemRecord) {
+	if siemQueue == nil {
+		return
+	}
+	select {
+	case siemQueue <- rec:
+	default:
+		if atomic.AddInt64(&siemDropped, 1)%1000 == 1 {
+			fmt.Println("SIEM buffer is full, dropped", atomic.LoadInt64(&siemDropped), "records so far")
+		}
+	}
+}
+
+// moderationToSIEM forwards a channel event when moderators caused it
+func moderationToSIEM(ev event) {
+	if !moderationEvents[ev.Type] {
+		return
+	}
+	rec := siemRecord{At: time.Now(), Source: "moderation", Type: ev.Type, Channel: ev.Channel, Data: ev.Data}
+	switch d := ev.Data.(type) {
+	case map[string]string:
+		rec.Actor = d["by"]
+	case map[string]interface{}:
+		rec.Actor, _ = d["by"].(string)
+	case pendingPost:
+		rec.Username = d.Username
+	}
+	toSIEM(rec)
+}
+
+func forwardSIEM(send func([]siemRecord) error) {
+	backoff := time.Second
+	for rec := range siemQueue {
+		batch := []siemRecord{rec}
+	fill:
+		for len(batch) < siemBatch {
+			select {
+			case rec := <-siemQueue:
+				batch = append(batch, rec)
+			default:
+				break fill
+			}
+		}
+		for {
+			err := send(batch)
+			if err == nil {
+				backoff = time.Second
+				break
+			}
+			fmt.Println("Forwarding to the SIEM failed, retrying in", backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > siemMaxBackoff {
+				backoff = siemMaxBackoff
+			}
+		}
+	}
+}
+
+func (rec siemRecord) format() string {
+	if siemFormat == "cef" {
+		return rec.cef()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		line, _ = json.Marshal(siemRecord{At: rec.At, Source: rec.Source, Type: rec.Type, Data: err.Error()})
+	}
+	return string(line)
+}
+
+var cefHeader = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+var cefValue = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// cef is the record in ArcSight Common Event Format, the data goes in msg as
+// JSON
+func (rec siemRecord) cef() string {
+	severity := 3
+	if rec.Source == "audit" || rec.Type == "message_quarantined" {
+		severity = 7
+	}
+	ext := []string{"rt=" + strconv.FormatInt(rec.At.UnixNano()/int64(time.Millisecond), 10)}
+	if rec.Actor != "" {
+		ext = append(ext, "suser="+cefValue.Replace(rec.Actor))
+	}
+	if rec.Username != "" {
+		ext = append(ext, "duser="+cefValue.Replace(rec.Username))
+	}
+	if rec.Channel != "" {
+		ext = append(ext, "cs1Label=channel", "cs1="+cefValue.Replace(rec.Channel))
+	}
+	if rec.Data != nil {
+		if data, err := json.Marshal(rec.Data); err == nil {
+			ext = append(ext, "msg="+cefValue.Replace(string(data)))
+		}
+	}
+	return fmt.Sprintf("CEF:0|axlesor|messaging-service|%s|%s|%s|%d|%s", serviceVersion,
+		cefHeader.Replace(rec.Source+":"+rec.Type), cefHeader.Replace(strings.Replace(rec.Type, "_", " ", -1)), severity, strings.Join(ext, " "))
+}
+
+// syslogSink keeps its connection between batches, a failed one is dialed again
+type syslogSink struct {
+	network, addr string
+	conn          net.Conn
+}
+
+func (s *syslogSink) send(batch []siemRecord) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	var buf bytes.Buffer
+	for _, rec := range batch {
+		// facility log audit, severity notice
+		msg := fmt.Sprintf("<109>1 %s %s messaging-service - %s - %s",
+			rec.At.UTC().Format(time.RFC3339Nano), nodeID, rec.Type, rec.format())
+		if s.network == "udp" {
+			if _, err := s.conn.Write([]byte(msg)); err != nil {
+				s.conn.Close()
+				s.conn = nil
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(&buf, "%d %s", len(msg), msg)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	// a batch cut off halfway is sent again whole, the SIEM may see a few
+	// records twice
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+var siemClient = &http.Client{Timeout: 30 * time.Second}
+
+func sendSIEMHTTP(batch []siemRecord) error {
+	var body bytes.Buffer
+	contentType := "text/plain; charset=utf-8"
+	if siemFormat == "json" {
+		contentType = "application/json"
+		body.WriteString("[")
+	}
+	for i, rec := range batch {
+		if i > 0 && siemFormat == "json" {
+			body.WriteString(",")
+		}
+		body.WriteString(rec.format())
+		if siemFormat == "cef" {
+			body.WriteString("\n")
+		}
+	}
+	if siemFormat == "json" {
+		body.WriteString("]")
+	}
+	resp, err := siemClient.Post(siemURL, contentType, &body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("SIEM answered " + resp.Status)
+	}
+	return nil
+}
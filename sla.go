@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// -sla 250ms is for products that need events delivered within a bound. The
+// broker stamps every event with published_us, unix microseconds of when it
+// was published, and the node measures per channel how long events take
+//
+//	delivered  from publish until a stream wrote the event to its client
+//	acked      from publish until the client echoed published_us back
+//
+// WebSocket clients ack with a text frame, clients of the other streams post
+// the stamps they got:
+//
+//	{"ack": 1760500000123456}
+//	curl -X POST http://localhost:8000/gdgsas022/acks -d '{"published_us": [1760500000123456]}'
+//
+// The newest slaWindow samples of each channel and stage make the percentiles
+// served by GET /admin/latency and, with -metrics, /metrics. Every sample over
+// the bound counts as a violation, which is logged at most once every
+// slaLogEvery per channel. Backlogs replayed to a new stream carry no stamp
+// and are not measured. Only stamps this node sent to a stream of the channel
+// are taken as acks, each once per delivery
+var slaTarget time.Duration
+
+const slaWindow = 1024
+const slaLogEvery = 10 * time.Second
+
+// acks of stamps older than this or from the future are ignored
+const slaMaxAckAge = time.Minute
+const maxAcks = 1000
+
+// stamps sent to stream clients kept per channel for their acks, once full
+// the ones too old to be acked are dropped and if that is not enough further
+// deliveries can not be acked
+const maxSentStamps = 64 * slaWindow
+
+var slaStages = []string{"delivered", "acked"}
+var slaQuantiles = []float64{0.5, 0.9, 0.99}
+
+// latencyWindow keeps the newest samples of a stage, in microseconds
+type latencyWindow struct {
+	samples    []int64
+	next       int
+	count      int64
+	violations int64
+}
+
+type channelLatency struct {
+	stages     map[string]*latencyWindow
+	sent       map[int64]int // stamp -> deliveries not acked yet
+	lastLogged time.Time
+	unlogged   int64
+}
+
+type latencyStats struct {
+	Count      int64              `json:"count"`
+	Violations int64              `json:"violations"`
+	Quantiles  map[string]float64 `json:"quantiles_ms"`
+	Max        float64            `json:"max_ms"`
+}
+
+var slaMutex sync.Mutex
+var slaChannels = make(map[string]*channelLatency)
+
+func nowMicros() int64 {
+	return time.Now().UnixNano() / int64(time.Microsecond)
+}
+
+// latencyOfChannel is the measurements of the channel. Caller must hold
+// slaMutex
+func latencyOfChannel(channel string) *channelLatency {
+	c := slaChannels[channel]
+	if c == nil {
+		c = &channelLatency{stages: make(map[string]*latencyWindow), sent: make(map[int64]int)}
+		slaChannels[channel] = c
+	}
+	return c
+}
+
+// delivered records the delivery of a stamped event to a stream client
+func delivered(ev event) {
+	if slaTarget <= 0 || ev.PublishedUS <= 0 {
+		return
+	}
+	now := nowMicros()
+	slaMutex.Lock()
+	c := latencyOfChannel(ev.Channel)
+	if len(c.sent) >= maxSentStamps {
+		for stamp := range c.sent {
+			if now-stamp > slaMaxAckAge.Microseconds() {
+				delete(c.sent, stamp)
+			}
+		}
+	}
+	if len(c.sent) < maxSentStamps {
+		c.sent[ev.PublishedUS]++
+	}
+	slaMutex.Unlock()
+	recordLatency(ev.Channel, "delivered", now-ev.PublishedUS)
+}
+
+// acked records the ack of a client, false for a stamp that can not be one:
+// every delivery of a stamp on the channel by this node is acked once at most
+func acked(channel string, publishedUS int64) bool {
+	if slaTarget <= 0 {
+		return false
+	}
+	took := nowMicros() - publishedUS
+	if took < 0 || took > slaMaxAckAge.Microseconds() {
+		return false
+	}
+	slaMutex.Lock()
+	c := slaChannels[channel]
+	if c == nil || c.sent[publishedUS] == 0 {
+		slaMutex.Unlock()
+		return false
+	}
+	if c.sent[publishedUS]--; c.sent[publishedUS] == 0 {
+		delete(c.sent, publishedUS)
+	}
+	slaMutex.Unlock()
+	recordLatency(channel, "acked", took)
+	return true
+}
+
+// ackFrame takes the ack of a WebSocket client on channel
+func ackFrame(channel string, payload []byte) {
+	ack := struct {
+		Ack int64 `json:"ack"`
+	}{}
+	if json.Unmarshal(payload, &ack) == nil && ack.Ack > 0 {
+		acked(channel, ack.Ack)
+	}
+}
+
+func recordLatency(channel, stage string, micros int64) {
+	slaMutex.Lock()
+	c := latencyOfChannel(channel)
+	window := c.stages[stage]
+	if window == nil {
+		window = &latencyWindow{}
+		c.stages[stage] = window
+	}
+	if len(window.samples) < slaWindow {
+		window.samples = append(window.samples, micros)
+	} else {
+		window.samples[window.next] = micros
+		window.next = (window.next + 1) % slaWindow
+	}
+	window.count++
+	took := time.Duration(micros) * time.Microsecond
+	if took <= slaTarget {
+		slaMutex.Unlock()
+		return
+	}
+	window.violations++
+	now := time.Now()
+	if now.Sub(c.lastLogged) < slaLogEvery {
+		c.unlogged++
+		slaMutex.Unlock()
+		return
+	}
+	unlogged := c.unlogged
+	c.lastLogged, c.unlogged = now, 0
+	slaMutex.Unlock()
+
+	line := fmt.Sprintf("SLA violation in %s: %s after %v, over %v", channel, stage, took, slaTarget)
+	if unlogged > 0 {
+		line += fmt.Sprintf(", %d more since the last one logged", unlogged)
+	}
+	fmt.Println(line)
+}
+
+// stats summarizes the window. Caller must hold slaMutex
+func (window *latencyWindow) stats() latencyStats {
+	s := latencyStats{Count: window.count, Violations: window.violations, Quantiles: make(map[string]float64)}
+	if len(window.samples) == 0 {
+		return s
+	}
+	sorted := append([]int64(nil), window.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, q := range slaQuantiles {
+		i := int(math.Ceil(q*float64(len(sorted)))) - 1
+		s.Quantiles[fmt.Sprint(q)] = float64(sorted[i]) / 1000
+	}
+	s.Max = float64(sorted[len(sorted)-1]) / 1000
+	return s
+}
+
+// latencyOf summarizes the channels, all of them for none
+func latencyOf(only []string) map[string]map[string]latencyStats {
+	slaMutex.Lock()
+	defer slaMutex.Unlock()
+	out := make(map[string]map[string]latencyStats)
+	for channel, c := range slaChannels {
+		if len(only) > 0 && !contains(only, channel) {
+			continue
+		}
+		out[channel] = make(map[string]latencyStats)
+		for stage, window := range c.stages {
+			out[channel][stage] = window.stats()
+		}
+	}
+	return out
+}
+
+// Percentiles of the channels named by channel=a,b, or of all of them
+// curl -X GET 'http://localhost:8000/admin/latency?channel=gdgsas022' -H 'X-Admin-Token: secret'
+func getLatency(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	if slaTarget <= 0 {
+		respondJSON(w, http.StatusNotFound, "Latency is only measured with -sla")
+		return
+	}
+	var only []string
+	if list := r.URL.Query().Get("channel"); list != "" {
+		only = strings.Split(list, ",")
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"target":   slaTarget.String(),
+		"window":   slaWindow,
+		"channels": latencyOf(only),
+	})
+}
+
+// Acks the events a client of /events or the gRPC stream received
+// curl -X POST http://localhost:8000/gdgsas022/acks -d '{"published_us": [1760500000123456]}' -v
+func postAcks(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if slaTarget <= 0 {
+		respondJSON(w, http.StatusNotFound, "Latency is only measured with -sla")
+		return
+	}
+	req := struct {
+		PublishedUS []int64 `json:"published_us"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.PublishedUS) > maxAcks {
+		respondJSON(w, http.StatusBadRequest, fmt.Sprintf("at most %d acks at a time", maxAcks))
+		return
+	}
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := readerOf(r).mayRead(subject)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	recorded := 0
+	for _, stamp := range req.PublishedUS {
+		if acked(channel, stamp) {
+			recorded++
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]int{"recorded": recorded})
+}
+
+func writeLatencyMetrics(b *strings.Builder) {
+	stats := latencyOf(nil)
+	channels := make([]string, 0, len(stats))
+	for channel := range stats {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	b.WriteString("# TYPE messaging_delivery_latency_seconds summary\n")
+	b.WriteString("# UNIT messaging_delivery_latency_seconds seconds\n")
+	b.WriteString("# HELP messaging_delivery_latency_seconds Time from publishing an event to delivering it to, or having it acked by, stream clients, over the newest samples.\n")
+	for _, channel := range channels {
+		for _, stage := range slaStages {
+			s, ok := stats[channel][stage]
+			if !ok {
+				continue
+			}
+			for _, q := range slaQuantiles {
+				fmt.Fprintf(b, "messaging_delivery_latency_seconds{channel=%q,stage=%q,quantile=\"%g\"} %g\n", channel, stage, q, s.Quantiles[fmt.Sprint(q)]/1000)
+			}
+			fmt.Fprintf(b, "messaging_delivery_latency_seconds_count{channel=%q,stage=%q} %d\n", channel, stage, s.Count)
+		}
+	}
+	b.WriteString("# TYPE messaging_sla_violations counter\n")
+	b.WriteString("# HELP messaging_sla_violations Deliveries and acks slower than -sla.\n")
+	for _, channel := range channels {
+		for _, stage := range slaStages {
+			if s, ok := stats[channel][stage]; ok {
+				fmt.Fprintf(b, "messaging_sla_violations_total{channel=%q,stage=%q} %d\n", channel, stage, s.Violations)
+			}
+		}
+	}
+}
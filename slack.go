@@ -0,0 +1,319 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slack exports, the ZIP a workspace admin downloads: users.json, channels.json
+// and a folder a channel with a JSON file a day. Importing with format=slack
+// takes the folder named in from, the channel imported into by default:
+//
+//	curl -X POST 'http://localhost:8000/gdgsas022/import?format=slack&from=general' -H 'X-Username: arthur' --data-binary @export.zip
+//
+// Users are mapped to their Slack handle, replies are put in the thread of the
+// message they answer and mentions become @name. Joins, leaves, topic changes
+// and other notices are left out, so are files. Exporting with format=slack
+// writes a ZIP of the same layout, with a made up Slack id for each username
+
+// the message subtypes that are something someone said
+var slackSaid = map[string]bool{"": true, "thread_broadcast": true, "bot_message": true, "me_message": true, "file_share": true}
+
+var slackMarkup = regexp.MustCompile(`<([^<>]*)>`)
+
+// Slack escapes these three in text, anything else in <> is markup
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+type slackUser struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Deleted bool   `json:"deleted"`
+	Profile struct {
+		DisplayName string `json:"display_name,omitempty"`
+		RealName    string `json:"real_name,omitempty"`
+	} `json:"profile"`
+}
+
+type slackMessage struct {
+	Type         string       `json:"type"`
+	Subtype      string       `json:"subtype,omitempty"`
+	User         string       `json:"user,omitempty"`
+	Username     string       `json:"username,omitempty"` // of bots
+	Text         string       `json:"text"`
+	Ts           string       `json:"ts"`
+	ThreadTs     string       `json:"thread_ts,omitempty"`
+	ParentUserID string       `json:"parent_user_id,omitempty"`
+	ReplyCount   int          `json:"reply_count,omitempty"`
+	Replies      []slackReply `json:"replies,omitempty"`
+}
+
+type slackReply struct {
+	User string `json:"user"`
+	Ts   string `json:"ts"`
+}
+
+type slackChannel struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Created    int64    `json:"created"`
+	Creator    string   `json:"creator"`
+	IsArchived bool     `json:"is_archived"`
+	IsGeneral  bool     `json:"is_general"`
+	Members    []string `json:"members"`
+	Topic      struct {
+		Value string `json:"value"`
+	} `json:"topic"`
+	Purpose struct {
+		Value string `json:"value"`
+	} `json:"purpose"`
+}
+
+// readSlackImport converts the messages of the channel from of a Slack export
+func readSlackImport(body io.Reader, from string) ([]importedPost, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.New("not a ZIP file: " + err.Error())
+	}
+	names := make(map[string]string)
+	days := []*zip.File{}
+	for _, f := range archive.File {
+		switch {
+		case f.Name == "users.json":
+			users := []slackUser{}
+			if err := readZipJSON(f, &users); err != nil {
+				return nil, err
+			}
+			for _, user := range users {
+				names[user.ID] = user.Name
+			}
+		case path.Dir(f.Name) == from && path.Ext(f.Name) == ".json":
+			days = append(days, f)
+		}
+	}
+	if len(days) == 0 {
+		return nil, fmt.Errorf("the export has no channel %s, name the one to import with from", from)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Name < days[j].Name })
+	msgs := []slackMessage{}
+	for _, f := range days {
+		day := []slackMessage{}
+		if err := readZipJSON(f, &day); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, day...)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return slackTime(msgs[i].Ts).Before(slackTime(msgs[j].Ts)) })
+
+	posts := []importedPost{}
+	threads := make(map[string]int) // ts of a message to its place in posts
+	for _, m := range msgs {
+		if m.Type != "message" || !slackSaid[m.Subtype] {
+			continue
+		}
+		username := names[m.User]
+		if username == "" {
+			username = m.Username
+		}
+		text := slackText(m.Text, names)
+		if username == "" || text == "" {
+			continue
+		}
+		if i, ok := threads[m.ThreadTs]; ok && m.ThreadTs != m.Ts {
+			posts[i].Thread = append(posts[i].Thread, Thread{Username: username, Message: text})
+			continue
+		}
+		if len(posts) == maxImportMessages {
+			return nil, fmt.Errorf("at most %d messages can be imported at once", maxImportMessages)
+		}
+		created := slackTime(m.Ts)
+		threads[m.Ts] = len(posts)
+		posts = append(posts, importedPost{Username: username, Message: text, CreatedAt: &created})
+	}
+	return posts, nil
+}
+
+func readZipJSON(f *zip.File, v interface{}) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", f.Name, err)
+	}
+	return nil
+}
+
+// slackTime reads a Slack ts, seconds and microseconds "1551434400.000100"
+func slackTime(ts string) time.Time {
+	i := strings.IndexByte(ts+".", '.')
+	sec, _ := strconv.ParseInt(ts[:i], 10, 64)
+	usec := int64(0)
+	if i < len(ts) {
+		usec, _ = strconv.ParseInt((ts[i+1:] + "000000")[:6], 10, 64)
+	}
+	return time.Unix(sec, usec*1000).UTC()
+}
+
+func slackTs(t time.Time) string {
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+}
+
+// slackText turns Slack markup into plain text: <@U123> into @name,
+// <#C123|general> into #general, <!here> into @here and <https://x|x> into
+// the link
+func slackText(text string, names map[string]string) string {
+	text = slackMarkup.ReplaceAllStringFunc(text, func(m string) string {
+		inner := m[1 : len(m)-1]
+		label := ""
+		if i := strings.IndexByte(inner, '|'); i >= 0 {
+			inner, label = inner[:i], inner[i+1:]
+		}
+		switch {
+		case strings.HasPrefix(inner, "@"):
+			if name := names[inner[1:]]; name != "" {
+				return "@" + name
+			}
+			if label != "" {
+				return "@" + label
+			}
+			return m
+		case strings.HasPrefix(inner, "#"):
+			if label != "" {
+				return "#" + label
+			}
+			return m
+		case strings.HasPrefix(inner, "!"):
+			if label != "" {
+				return label
+			}
+			return "@" + strings.TrimPrefix(inner, "!")
+		}
+		return inner
+	})
+	return strings.TrimSpace(html.UnescapeString(text))
+}
+
+// slackUserID makes up the Slack id of a username, the same in every export
+func slackUserID(username string) string {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return fmt.Sprintf("U%08X", h.Sum32())
+}
+
+// exportSlack writes the history as a Slack export ZIP, a file a UTC day
+func exportSlack(w http.ResponseWriter, channel string, now time.Time, next func(int) []msgPost, rd reader) {
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+	users := make(map[string]bool)
+	var day string
+	var file io.Writer
+	first := true
+	created := now
+	err := pages(next, rd, func(page []msgPost) error {
+		for _, mesg := range page {
+			// a message older than the one ahead of it stays in the same file
+			if d := mesg.Created.UTC().Format("2006-01-02"); d > day || file == nil {
+				if file != nil {
+					file.Write([]byte("\n]\n"))
+				} else {
+					created = mesg.Created
+				}
+				f, err := archive.Create(channel + "/" + d + ".json")
+				if err != nil {
+					return err
+				}
+				file, day, first = f, d, true
+				file.Write([]byte("["))
+			}
+			for _, m := range slackMessages(mesg, mesg.Threads) {
+				data, err := json.Marshal(m)
+				if err != nil {
+					return err
+				}
+				if !first {
+					file.Write([]byte(","))
+				}
+				first = false
+				file.Write([]byte("\n"))
+				if _, err := file.Write(data); err != nil {
+					return err
+				}
+			}
+			users[mesg.Username] = true
+			for _, reply := range mesg.Threads {
+				users[reply.Username] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if file != nil {
+		file.Write([]byte("\n]\n"))
+	}
+
+	members := []string{}
+	for username := range users {
+		members = append(members, username)
+	}
+	sort.Strings(members)
+	list := []slackUser{}
+	for i, username := range members {
+		user := slackUser{ID: slackUserID(username), Name: username}
+		user.Profile.DisplayName = username
+		list = append(list, user)
+		members[i] = user.ID
+	}
+	info := slackChannel{ID: "C" + strings.TrimPrefix(slackUserID(channel), "U"), Name: channel, Created: created.Unix(), Members: members}
+	if len(members) > 0 {
+		info.Creator = members[0]
+	}
+	writeZipJSON(archive, "users.json", list)
+	writeZipJSON(archive, "channels.json", []slackChannel{info})
+}
+
+// slackMessages is a message and its replies as Slack has them, the replies a
+// microsecond apart after the message since they carry no time here
+func slackMessages(mesg msgPost, thread []Thread) []slackMessage {
+	ts := slackTs(mesg.Created)
+	parent := slackMessage{Type: "message", User: slackUserID(mesg.Username), Text: slackEscape.Replace(mesg.Message), Ts: ts}
+	out := []slackMessage{parent}
+	for i, reply := range thread {
+		r := slackMessage{Type: "message", User: slackUserID(reply.Username), Text: slackEscape.Replace(reply.Message),
+			Ts: slackTs(mesg.Created.Add(time.Duration(i+1) * time.Microsecond)), ThreadTs: ts, ParentUserID: parent.User}
+		out[0].Replies = append(out[0].Replies, slackReply{User: r.User, Ts: r.Ts})
+		out = append(out, r)
+	}
+	if len(thread) > 0 {
+		out[0].ThreadTs, out[0].ReplyCount = ts, len(thread)
+	}
+	return out
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(f).Encode(v)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Slow mode makes everybody but moderators wait a moderator chosen interval
+// between two posts, messages and replies alike, in a busy channel. When each
+// user posted last is only kept in memory
+const maxSlowMode = 6 * time.Hour
+
+// cooldown is how long username still has to wait before posting. Caller must
+// hold the subject lock
+func (s *subject) cooldown(username string, now time.Time) time.Duration {
+	if s.slowMode <= 0 || s.isModerator(username) {
+		return 0
+	}
+	if wait := s.lastPosted[username].Add(s.slowMode).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// posted starts the cooldown of username. Caller must hold the subject write
+// lock
+func (s *subject) posted(username string, now time.Time) {
+	if s.slowMode <= 0 {
+		return
+	}
+	if len(s.lastPosted) >= 1024 {
+		for name, at := range s.lastPosted {
+			if now.Sub(at) >= s.slowMode {
+				delete(s.lastPosted, name)
+			}
+		}
+	}
+	s.lastPosted[username] = now
+}
+
+// slowedDown answers 429 with the remaining cooldown when username has to wait.
+// Caller must hold the subject lock
+func (s *subject) slowedDown(w http.ResponseWriter, username string) bool {
+	wait := s.cooldown(username, time.Now())
+	if wait == 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"error":          "Slow mode is on, wait before posting again",
+		"slow_mode":      s.slowMode.String(),
+		"retry_after_ms": wait.Milliseconds(),
+	})
+	return true
+}
+
+// Tells the interval and how long the caller still has to wait
+// curl -X GET http://localhost:8000/gdgsas022/slow-mode -H 'X-Username: sally' -v
+func getSlowMode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	username := actingUser(r)
+	if !subject.canAccess(username) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"interval":       subject.slowMode.String(),
+		"retry_after_ms": subject.cooldown(username, time.Now()).Milliseconds(),
+	})
+}
+
+// An empty or zero interval turns slow mode off
+// curl -X PUT http://localhost:8000/gdgsas022/slow-mode -H 'X-Username: arthur' -d '{"interval": "30s"}' -v
+func putSlowMode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	req := struct {
+		Interval string `json:"interval"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var interval time.Duration
+	if req.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(req.Interval); err != nil || interval < 0 || interval > maxSlowMode {
+			respondJSON(w, http.StatusBadRequest, "interval should be a duration like 30s, up to "+maxSlowMode.String())
+			return
+		}
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can change slow mode")
+		return
+	}
+	if subject.slowMode != interval {
+		subject.slowMode = interval
+		subject.lastPosted = make(map[string]time.Time)
+		subject.logSettings("channel_updated")
+		publish(channel, "slow_mode_changed", map[string]string{"interval": interval.String(), "by": actingUser(r)})
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"interval": interval.String()})
+}
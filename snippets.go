@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// A snippet is code or a log excerpt posted as a message:
+//
+//	{"username": "arthur", "message": "this panics", "snippet": {"language": "go", "filename": "main.go", "body": "..."}}
+//
+// The body is kept byte for byte, no emoji or anything else is rendered in it.
+// Listings and events only carry a preview of the first lines, the whole body
+// is downloaded from /{channel}/messages/{id}/raw
+const maxSnippetSize = 256 << 10
+const previewLines = 10
+const previewBytes = 1024
+
+var snippetLanguage = regexp.MustCompile(`^[A-Za-z0-9+#._-]{0,32}$`)
+
+type snippet struct {
+	Language  string `json:"language,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Lines     int    `json:"lines"`
+	Size      int    `json:"size"`
+	Preview   string `json:"preview"`
+	Truncated bool   `json:"truncated"`
+	body      string
+}
+
+// UnmarshalJSON takes the body from posts, it never goes out with the API form
+func (sn *snippet) UnmarshalJSON(data []byte) error {
+	type plain snippet
+	in := struct {
+		*plain
+		Body string `json:"body"`
+	}{plain: (*plain)(sn)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	sn.body = in.Body
+	return nil
+}
+
+// prepare checks a posted snippet and works out what listings show of it
+func (sn *snippet) prepare() error {
+	if sn.body == "" {
+		return errors.New("Empty snippet body")
+	}
+	if len(sn.body) > maxSnippetSize {
+		return errors.New("Snippet is larger than " + strconv.Itoa(maxSnippetSize>>10) + "KB")
+	}
+	if !utf8.ValidString(sn.body) {
+		return errors.New("Snippet body should be UTF-8 text")
+	}
+	if !snippetLanguage.MatchString(sn.Language) {
+		return errors.New("Snippet language should be a short name like go or c++")
+	}
+	if len(sn.Filename) > 255 || strings.ContainsAny(sn.Filename, "/\\\"\x00") {
+		return errors.New("Snippet filename should be a plain file name")
+	}
+	sn.Size = len(sn.body)
+	sn.Lines = strings.Count(sn.body, "\n")
+	if !strings.HasSuffix(sn.body, "\n") {
+		sn.Lines++
+	}
+	preview := sn.body
+	if i := nthIndex(preview, "\n", previewLines); i >= 0 {
+		preview = preview[:i]
+	}
+	if len(preview) > previewBytes {
+		cut := previewBytes
+		for !utf8.RuneStart(preview[cut]) {
+			cut--
+		}
+		preview = preview[:cut]
+	}
+	sn.Preview = preview
+	sn.Truncated = len(preview) < len(strings.TrimSuffix(sn.body, "\n"))
+	return nil
+}
+
+// nthIndex is the index of the nth occurrence of sep in s, -1 when there are
+// fewer
+func nthIndex(s, sep string, n int) int {
+	at := -1
+	for ; n > 0; n-- {
+		i := strings.Index(s[at+1:], sep)
+		if i < 0 {
+			return -1
+		}
+		at += i + 1
+	}
+	return at
+}
+
+// The whole snippet as a text file
+// curl -X GET http://localhost:8000/gdgsas022/messages/1/raw -v
+func getSnippetRaw(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	rd := readerOf(r)
+	if !rd.mayRead(subject) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	mesg, ok := rd.message(subject.message(id))
+	if !ok {
+		respondJSON(w, http.StatusNotFound, "No message for the provided id")
+		return
+	}
+	if mesg.Snippet == nil {
+		respondJSON(w, http.StatusNotFound, "This message has no snippet")
+		return
+	}
+	filename := mesg.Snippet.Filename
+	if filename == "" {
+		filename = "snippet-" + strconv.Itoa(id) + ".txt"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(mesg.Snippet.body))
+}
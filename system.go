@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Besides what users post, the server posts system messages into a channel
+// when something happens to it: somebody joined, the channel was frozen or
+// thawed, a message was pinned, an incident changed status. They have type
+// "system" and nobody's username, what happened is in system and a readable
+// line in message for clients that know no better:
+//
+//	{"id": 7, "type": "system", "message": "sally joined", "system": {"event": "member_joined", "username": "sally"}}
+//
+// User messages have no type. GET /messages?system=false leaves system
+// messages out, and they take no replies
+const systemMessage = "system"
+
+type systemEvent struct {
+	Event     string `json:"event"`
+	Username  string `json:"username,omitempty"`   // who did it
+	MessageID int    `json:"message_id,omitempty"` // the message it is about
+}
+
+// postSystem adds a system message about event to the channel. Caller must
+// hold the subject lock
+func (s *subject) postSystem(event systemEvent, text string) msgPost {
+	mesg := s.add(msgPost{Type: systemMessage, Message: text, System: &event})
+	s.logMessage(mesg.Id, "message_created")
+	publish(s.title, "message", mesg)
+	return mesg
+}
+
+func withoutSystem(msgs []msgPost) []msgPost {
+	visible := []msgPost{}
+	for _, mesg := range msgs {
+		if mesg.Type != systemMessage {
+			visible = append(visible, mesg)
+		}
+	}
+	return visible
+}
+
+// curl -X PUT http://localhost:8000/gdgsas022/messages/3/pin -H 'X-Username: arthur'
+func pinMessage(w http.ResponseWriter, r *http.Request) {
+	setPinned(w, r, true)
+}
+
+// curl -X DELETE http://localhost:8000/gdgsas022/messages/3/pin -H 'X-Username: arthur'
+func unpinMessage(w http.ResponseWriter, r *http.Request) {
+	setPinned(w, r, false)
+}
+
+func setPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can pin messages")
+		return
+	}
+	if subject.frozen {
+		respondJSON(w, http.StatusForbidden, "Channel is frozen")
+		return
+	}
+	mesg := subject.mutableMessage(id)
+	if mesg == nil {
+		respondJSON(w, http.StatusBadRequest, "Provided messageId does not exist!")
+		return
+	}
+	if mesg.Type == systemMessage {
+		respondJSON(w, http.StatusBadRequest, "System messages can not be pinned")
+		return
+	}
+	if mesg.Pinned != pinned {
+		mesg.Pinned = pinned
+		subject.logMessage(id, "message_updated")
+		event := systemEvent{Event: "message_unpinned", Username: actor(r), MessageID: id}
+		text := fmt.Sprintf("%s unpinned message %d", event.Username, id)
+		if pinned {
+			event.Event = "message_pinned"
+			text = fmt.Sprintf("%s pinned message %d", event.Username, id)
+		}
+		subject.postSystem(event, text)
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"id": id, "pinned": pinned})
+}
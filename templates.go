@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Channel templates provision recurring kinds of channels the same way every
+// time, e.g. one per incident. Admins keep them under /admin/templates and
+// anybody names one when creating a channel with POST /channels?template=.
+// The creator owns the channel, the template brings the rest: visibility,
+// pre-moderation, slow mode, a retention override, moderators and trusted
+// users, a welcome message pinned as the first message and integrations,
+// whose secrets are shown once in the response. Templates are kept with the
+// rest of the global state
+type channelTemplate struct {
+	Name        string   `json:"name"`
+	Private     bool     `json:"private,omitempty"`
+	AllowGuests bool     `json:"allow_guests,omitempty"`
+	Premoderate bool     `json:"premoderate,omitempty"`
+	SlowMode    string   `json:"slow_mode,omitempty"`
+	MaxAge      string   `json:"max_age,omitempty"`
+	MaxMessages int      `json:"max_messages,omitempty"`
+	Moderators  []string `json:"moderators,omitempty"`
+	Trusted     []string `json:"trusted,omitempty"`
+	Welcome     string   `json:"welcome,omitempty"`
+	Webhooks    []string `json:"webhooks,omitempty"` // names of the integrations
+}
+
+var templatesMutex sync.RWMutex
+var templates = make(map[string]channelTemplate)
+
+// check normalizes the usernames of the template, the returned message is safe
+// to show the caller
+func (t *channelTemplate) check() string {
+	if t.SlowMode != "" {
+		if interval, err := time.ParseDuration(t.SlowMode); err != nil || interval < 0 || interval > maxSlowMode {
+			return "slow_mode should be a duration like 30s, up to " + maxSlowMode.String()
+		}
+	}
+	if t.MaxAge != "" {
+		if age, err := time.ParseDuration(t.MaxAge); err != nil || age < 0 {
+			return "max_age should be a positive duration like 72h"
+		}
+	}
+	if t.MaxMessages < 0 {
+		return "max_messages can not be negative"
+	}
+	for _, names := range [][]string{t.Moderators, t.Trusted, t.Webhooks} {
+		for i, name := range names {
+			if names[i] = normalizeUsername(name); names[i] == "" {
+				return "Empty username!"
+			}
+		}
+	}
+	if len(t.Webhooks) > 0 && !featureEnabled("integrations") {
+		return "The integrations feature is turned off"
+	}
+	return ""
+}
+
+// apply provisions a channel nobody else can see yet with the template
+func (t channelTemplate) apply(s *subject) {
+	s.private, s.allowGuests, s.premoderate = t.Private, t.AllowGuests, t.Premoderate
+	s.slowMode, _ = time.ParseDuration(t.SlowMode)
+	if t.MaxAge != "" || t.MaxMessages > 0 {
+		s.retention = &retentionPolicy{MaxMessages: t.MaxMessages}
+		s.retention.MaxAge, _ = time.ParseDuration(t.MaxAge)
+	}
+	for _, name := range t.Moderators {
+		s.moderators[name] = true
+	}
+	for _, name := range t.Trusted {
+		s.trusted[name] = true
+	}
+	if t.Welcome != "" {
+		s.add(msgPost{Username: s.owner, Message: t.Welcome, Pinned: true})
+	}
+}
+
+// The creator owns the new channel, the template is optional
+// curl -X POST 'http://localhost:8000/channels?template=incident' -H 'X-Username: arthur' -d '{"channel": "inc-42"}' -v
+func postChannel(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Channel string `json:"channel"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	channel := canonicalChannel(req.Channel)
+	if !channelName.MatchString(channel) {
+		respondJSON(w, http.StatusBadRequest, "channel should be made of letters, digits and dashes")
+		return
+	}
+	owner := actingUser(r)
+	if owner == "" {
+		respondJSON(w, http.StatusUnauthorized, "Creating a channel needs a username")
+		return
+	}
+	t := channelTemplate{}
+	if name := r.URL.Query().Get("template"); name != "" {
+		templatesMutex.RLock()
+		found, ok := templates[name]
+		templatesMutex.RUnlock()
+		if !ok {
+			respondJSON(w, http.StatusNotFound, "No such template")
+			return
+		}
+		t = found
+	}
+	if len(t.Webhooks) > 0 && !featureEnabled("integrations") {
+		respondJSON(w, http.StatusForbidden, "The integrations feature is turned off")
+		return
+	}
+	if resolveChannel(channel) != channel || lookupSubject(channel) != nil {
+		respondJSON(w, http.StatusConflict, "A channel with this name exists")
+		return
+	}
+	if status, problem := createChannel(channel, owner, t); problem != "" {
+		respondJSON(w, status, problem)
+		return
+	}
+	hooks := createIntegrations(channel, owner, t.Webhooks)
+	respondJSON(w, http.StatusOK, map[string]interface{}{"channel": channel, "owner": owner, "template": t.Name, "integrations": hooks})
+}
+
+// createChannel makes a new channel of owner from the template. The status and
+// message say why not
+func createChannel(channel, owner string, t channelTemplate) (int, string) {
+	created := newSubject(channel, owner)
+	t.apply(created)
+	globalMapMutex.Lock()
+	defer globalMapMutex.Unlock()
+	if liveMessages[channel] != nil {
+		return http.StatusConflict, "A channel with this name exists"
+	}
+	if maxChannels > 0 && len(liveMessages) >= maxChannels {
+		return http.StatusForbidden, "Channel limit reached"
+	}
+	liveMessages[channel] = created
+	// nobody else can see the new subject yet
+	created.logSettings("channel_created")
+	for _, mesg := range created.Messages {
+		created.logMessage(mesg.Id, "message_created")
+	}
+	return http.StatusOK, ""
+}
+
+// createIntegrations adds the integrations a template names to a new channel.
+// The secrets are only ever shown in what it returns
+func createIntegrations(channel, owner string, names []string) []map[string]interface{} {
+	hooks := []map[string]interface{}{}
+	if len(names) == 0 {
+		return hooks
+	}
+	integrationsMutex.Lock()
+	for _, name := range names {
+		id := newToken()
+		hook := &integration{Id: id, Channel: channel, Name: name, CreatedBy: owner, CreatedAt: time.Now(), URL: "/hooks/" + id, secret: newToken()}
+		integrations[id] = hook
+		logIntegration(hook)
+		hooks = append(hooks, map[string]interface{}{"integration": hook, "secret": hook.secret})
+	}
+	integrationsMutex.Unlock()
+	return hooks
+}
+
+// curl -X GET http://localhost:8000/admin/templates -H 'X-Admin-Token: secret'
+func getTemplates(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	list := []channelTemplate{}
+	templatesMutex.RLock()
+	for _, t := range templates {
+		list = append(list, t)
+	}
+	templatesMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	respondJSON(w, http.StatusOK, map[string][]channelTemplate{"templates": list})
+}
+
+// curl -X PUT http://localhost:8000/admin/templates/incident -H 'X-Admin-Token: secret' -d '{"premoderate": false, "max_age": "2160h", "moderators": ["oncall"], "welcome": "Post status updates here", "webhooks": ["pager"]}'
+func putTemplate(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	name := mux.Vars(r)["name"]
+	t := channelTemplate{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&t); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t.Name = name
+	if problem := t.check(); problem != "" {
+		respondJSON(w, http.StatusBadRequest, problem)
+		return
+	}
+	templatesMutex.Lock()
+	templates[name] = t
+	logGlobal("template_changed", "templates", name, t)
+	templatesMutex.Unlock()
+	audit(auditEntry{Actor: actor(r), Action: "template_changed", Data: t})
+	respondJSON(w, http.StatusOK, t)
+}
+
+// curl -X DELETE http://localhost:8000/admin/templates/incident -H 'X-Admin-Token: secret'
+func deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	name := mux.Vars(r)["name"]
+	templatesMutex.Lock()
+	_, ok := templates[name]
+	if ok {
+		delete(templates, name)
+		logGlobal("template_deleted", "templates", name, nil)
+	}
+	templatesMutex.Unlock()
+	if !ok {
+		respondJSON(w, http.StatusNotFound, "No such template")
+		return
+	}
+	audit(auditEntry{Actor: actor(r), Action: "template_deleted", Data: map[string]string{"template": name}})
+	respondJSON(w, http.StatusOK, map[string]string{"removed": name})
+}
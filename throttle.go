@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Per channel ingest throttle, a token bucket refilled at channelRate posts per
+// second holding up to channelBurst. It is checked before the subject lock is
+// taken, so a bot flooding one channel is turned away without queueing on the
+// lock everybody else in the channel needs. 0 rate turns it off
+var channelRate float64
+var channelBurst = 20
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var throttleMutex sync.Mutex
+var buckets = make(map[string]*bucket)
+var bucketsSwept time.Time
+
+// takeChannelToken spends a token of the channel, or tells how long until the
+// next one
+func takeChannelToken(channel string, now time.Time) (bool, time.Duration) {
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+	if now.Sub(bucketsSwept) > time.Minute {
+		// full buckets hold nothing worth remembering
+		for name, b := range buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*channelRate >= float64(channelBurst) {
+				delete(buckets, name)
+			}
+		}
+		bucketsSwept = now
+	}
+	b, ok := buckets[channel]
+	if !ok {
+		b = &bucket{tokens: float64(channelBurst), last: now}
+		buckets[channel] = b
+	}
+	b.tokens = math.Min(float64(channelBurst), b.tokens+now.Sub(b.last).Seconds()*channelRate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / channelRate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// throttled answers 429 with the retry hints of the channel when it is over
+// its rate
+func throttled(w http.ResponseWriter, channel string) bool {
+	if channelRate <= 0 {
+		return false
+	}
+	allowed, retry := takeChannelToken(channel, time.Now())
+	if allowed {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	respondJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"error":          "Channel is receiving too many messages, try again later",
+		"channel":        channel,
+		"rate":           channelRate,
+		"burst":          channelBurst,
+		"retry_after_ms": retry.Milliseconds(),
+	})
+	return true
+}
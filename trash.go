@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deleting a channel moves it to -trash-dir instead of throwing it away, in
+// the format of closed channels, e.g. trash/2026-10-15_150405.123456789_gdgsas022.log.
+// Until -trash-retention has passed the owner or an admin can undelete it,
+// the trash job purges it after that. The name is free in the meantime, an
+// undelete is refused while another channel uses it. The webhooks,
+// integrations and reminders of the channel go at once, see forgetChannel,
+// so they never fire for a channel that reuses the name and an undelete does
+// not bring them back
+var trashDir = "trash"
+var trashRetention = 7 * 24 * time.Hour
+
+const trashInterval = time.Hour
+
+// trashed is a deleted channel as GET /admin/trash lists it
+type trashed struct {
+	Channel   string    `json:"channel"`
+	Owner     string    `json:"owner"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by"`
+	PurgeAt   time.Time `json:"purge_at"`
+	path      string
+}
+
+func trashPath(channel string, now time.Time) string {
+	return filepath.Join(trashDir, now.UTC().Format("2006-01-02_150405.000000000")+"_"+channel+".log")
+}
+
+// trashedChannels are the deleted channels still in the trash, oldest first.
+// Every one when channel is empty
+func trashedChannels(channel string) []trashed {
+	files, _ := ioutil.ReadDir(trashDir)
+	list := []trashed{}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".log") || (channel != "" && !strings.HasSuffix(name, "_"+channel+".log")) {
+			continue
+		}
+		header, err := readTrashHeader(filepath.Join(trashDir, name))
+		if err != nil {
+			continue
+		}
+		list = append(list, trashed{
+			Channel:   header.Channel,
+			Owner:     header.Settings.Owner,
+			DeletedAt: header.ClosedAt,
+			DeletedBy: header.ClosedBy,
+			PurgeAt:   header.ClosedAt.Add(trashRetention),
+			path:      filepath.Join(trashDir, name),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.Before(list[j].DeletedAt) })
+	return list
+}
+
+// readTrashHeader reads the first line only, listing the trash does not need
+// the messages
+func readTrashHeader(path string) (closedHeader, error) {
+	header := closedHeader{}
+	f, err := os.Open(path)
+	if err != nil {
+		return header, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&header)
+	return header, err
+}
+
+// purgeTrash removes what has been in the trash longer than trashRetention
+func purgeTrash(now time.Time) {
+	if isMirror() {
+		return
+	}
+	for _, t := range trashedChannels("") {
+		if now.Before(t.PurgeAt) {
+			continue
+		}
+		if err := os.Remove(t.path); err != nil {
+			fmt.Println("Purging", t.path, "failed:", err)
+			continue
+		}
+		fmt.Println("Purged", t.Channel, "deleted", t.DeletedAt.Format(time.RFC3339), "by", t.DeletedBy)
+	}
+}
+
+// Only the channel owner or an admin deletes a channel
+// curl -X DELETE http://localhost:8000/gdgsas022 -H 'X-Username: arthur'
+func deleteChannel(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if channelOnHold(channel) {
+		respondJSON(w, http.StatusConflict, "Channel is on legal hold")
+		return
+	}
+	// Critical region
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if !isAdmin(r) && (actingUser(r) == "" || actingUser(r) != subject.owner) {
+		subject.Unlock()
+		respondJSON(w, http.StatusForbidden, "Only the channel owner can delete it")
+		return
+	}
+	now := time.Now()
+	a := subject.snapshot()
+	messages := a.Messages
+	a.Messages = nil
+	path := trashPath(channel, now)
+	err := writeClosedLog(path, closedHeader{Type: "channel", Channel: channel, ClosedAt: now, ClosedBy: actor(r), Settings: a}, messages)
+	if err != nil {
+		subject.Unlock()
+		respondError(w, http.StatusInternalServerError, "Moving the channel to the trash failed: "+err.Error())
+		return
+	}
+	subject.frozen = true
+	cold := subject.cold
+	subject.Unlock()
+	forgetChannel(channel, subject, cold)
+
+	audit(auditEntry{Actor: actor(r), Action: "channel_deleted", Channel: channel, Data: map[string]interface{}{"messages": len(messages)}})
+	publish(channel, "channel_deleted", nil)
+	drainChannel(channel, "deleted")
+	respondJSON(w, http.StatusOK, map[string]interface{}{"deleted_at": now, "restore_until": now.Add(trashRetention)})
+}
+
+// Brings back the channel deleted last under this name, of those the user owned
+// curl -X POST http://localhost:8000/gdgsas022/undelete -H 'X-Username: arthur'
+func undeleteChannel(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+
+	list := trashedChannels(channel)
+	if len(list) == 0 {
+		respondJSON(w, http.StatusNotFound, "No deleted channel with this name")
+		return
+	}
+	// the name may have been deleted by several owners, each gets their own back
+	var t *trashed
+	for i := range list {
+		if isAdmin(r) || (actingUser(r) != "" && actingUser(r) == list[i].Owner) {
+			t = &list[i]
+		}
+	}
+	if t == nil {
+		respondJSON(w, http.StatusForbidden, "Only the channel owner can undelete it")
+		return
+	}
+	header, stored, err := readClosedLog(t.path)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Reading the deleted channel failed: "+err.Error())
+		return
+	}
+	header.Settings.Messages = stored
+	restored := restoreSnapshot(header.Settings)
+
+	if lookupSubject(channel) != nil {
+		respondJSON(w, http.StatusConflict, "A channel with this name exists")
+		return
+	}
+	globalMapMutex.Lock()
+	if liveMessages[channel] != nil {
+		globalMapMutex.Unlock()
+		respondJSON(w, http.StatusConflict, "A channel with this name exists")
+		return
+	}
+	if maxChannels > 0 && len(liveMessages) >= maxChannels {
+		globalMapMutex.Unlock()
+		respondJSON(w, http.StatusForbidden, "Channel limit reached")
+		return
+	}
+	liveMessages[channel] = restored
+	// nobody else can see the restored subject yet
+	restored.logChannel()
+	globalMapMutex.Unlock()
+	os.Remove(t.path)
+
+	audit(auditEntry{Actor: actor(r), Action: "channel_restored", Channel: channel, Data: map[string]interface{}{"deleted_at": t.DeletedAt, "messages": len(stored)}})
+	publish(channel, "channel_restored", nil)
+	respondJSON(w, http.StatusOK, map[string]interface{}{"channel": channel, "messages": len(stored)})
+}
+
+// curl -X GET http://localhost:8000/admin/trash -H 'X-Admin-Token: secret'
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string][]trashed{"channels": trashedChannels("")})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Typing indicators. Clients call POST /{channel}/typing every few seconds
+// while someone types and the streams of the channel, /events, /ws and the
+// firehose, get
+//
+//	{"type": "typing", "channel": ..., "data": {"username": "arthur", "typing": true, "expires_in": 6}}
+//
+// to show "arthur is typing…" for expires_in seconds unless another comes.
+// {"typing": false} says the user stopped or posted. Typing events are
+// ephemeral: they are not stored, logged, mirrored or replayed, they only
+// reach the streams open at the time. With -peers they go to the peers as
+// well, over the internal gossip endpoint presence uses, so readers on other
+// nodes see them too; peers do not pass them on. Calls within typingRefresh
+// of the last broadcast for the same user and channel are taken without
+// broadcasting again
+const typingTTL = 6 * time.Second
+const typingRefresh = 3 * time.Second
+
+// what a node sends its peers for every typing broadcast
+type typingRelay struct {
+	Node     string `json:"node"`
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+	Typing   bool   `json:"typing"`
+}
+
+var typingClient = &http.Client{Timeout: gossipInterval}
+
+// the events that are never kept and that webhooks only get when they name
+// them
+var ephemeralEvents = map[string]bool{"typing": true, "presence_joined": true, "presence_left": true}
+
+var typingMutex sync.Mutex
+
+// when a typing event last went out, by channel and username
+var typingSent = make(map[string]time.Time)
+var typingSwept time.Time
+
+// shouldBroadcast tells whether a typing call goes out to the streams
+func shouldBroadcast(channel, username string, typing bool, now time.Time) bool {
+	key := channel + "\x00" + username
+	typingMutex.Lock()
+	defer typingMutex.Unlock()
+	if now.Sub(typingSwept) > typingTTL {
+		for k, sent := range typingSent {
+			if now.Sub(sent) > typingTTL {
+				delete(typingSent, k)
+			}
+		}
+		typingSwept = now
+	}
+	sent, ok := typingSent[key]
+	if !typing {
+		delete(typingSent, key)
+		return ok
+	}
+	if ok && now.Sub(sent) < typingRefresh {
+		return false
+	}
+	typingSent[key] = now
+	return true
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/typing -d '{"username": "arthur"}'
+// curl -X POST http://localhost:8000/gdgsas022/typing -d '{"username": "arthur", "typing": false}'
+func postTyping(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	req := struct {
+		Username string `json:"username"`
+		Typing   *bool  `json:"typing"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Username == "" {
+		req.Username = actingUser(r)
+	}
+	req.Username = normalizeUsername(req.Username)
+	if req.Username == "" {
+		respondJSON(w, http.StatusBadRequest, "Empty username!")
+		return
+	}
+	if !mayActAs(r, req.Username) {
+		respondJSON(w, http.StatusForbidden, "Not allowed to type as this username")
+		return
+	}
+	typing := req.Typing == nil || *req.Typing
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canAccess(req.Username) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	if subject.frozen {
+		respondJSON(w, http.StatusForbidden, "Channel is frozen")
+		return
+	}
+	if shouldBroadcast(channel, req.Username, typing, time.Now()) {
+		publishTyping(channel, req.Username, typing)
+		if len(peers) > 0 {
+			go relayTyping(typingRelay{Node: nodeID, Channel: channel, Username: req.Username, Typing: typing})
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"typing": typing})
+}
+
+func publishTyping(channel, username string, typing bool) {
+	data := map[string]interface{}{"username": username, "typing": typing}
+	if typing {
+		data["expires_in"] = int(typingTTL / time.Second)
+	}
+	publish(channel, "typing", data)
+}
+
+func relayTyping(t typingRelay) {
+	body, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	toPeers(typingClient, "/internal/gossip/typing", body)
+}
+
+// Peers relay the typing broadcasts of their streams here. Channels this node
+// does not have in memory have no streams to tell
+func postGossipTyping(w http.ResponseWriter, r *http.Request) {
+	if adminToken != "" && !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	t := typingRelay{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&t); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if t.Node != nodeID && t.Username != "" && lookupLive(t.Channel) != nil {
+		publishTyping(t.Channel, t.Username, t.Typing)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
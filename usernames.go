@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Anybody could post under any username before names could be claimed. Once a
+// name is registered every post, read or moderation action under it has to
+// present the claim token, or a session of users.go, as
+// "Authorization: Bearer <token>"
+var claimsMutex sync.RWMutex
+var claims = make(map[string]string) // username -> token
+var claimTokens = make(map[string]string)
+var claimSkeletons = make(map[string]string) // skeleton -> username
+
+// Usernames are kept in NFC so a name typed on different keyboards is one name.
+// Names that only look alike, "arthur" spelled with a Cyrillic "а", share a
+// skeleton and only the registered holder may use any of them
+func normalizeUsername(username string) string {
+	return norm.NFC.String(strings.TrimSpace(username))
+}
+
+// confusables maps look-alike letters to the Latin letter they imitate. Not
+// the full Unicode table, the usual suspects in impersonation attempts
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k', 'ӏ': 'l',
+	'м': 'm', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'г': 'r', 'ѕ': 's', 'т': 't',
+	'ѵ': 'v', 'ԝ': 'w', 'х': 'x', 'у': 'y', 'ԁ': 'd',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y', 'ω': 'w',
+	// Latin and digits
+	'ı': 'i', 'ȷ': 'j', '0': 'o', '1': 'l', '|': 'l', '5': 's',
+}
+
+// skeleton folds case, compatibility forms, accents and confusables so that
+// names which render alike compare equal
+func skeleton(username string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(norm.NFKD.String(username)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// usernamePolicy is the hook deciding whether a (normalized) name may be used
+// at all. The default one only rejects mixed script names when
+// -reject-mixed-script is set
+var usernamePolicy = defaultUsernamePolicy
+var rejectMixedScript bool
+
+func defaultUsernamePolicy(username string) error {
+	if rejectMixedScript && len(scripts(username)) > 1 {
+		return errors.New("Username mixes scripts")
+	}
+	return nil
+}
+
+// scripts lists the writing systems of the letters of username
+func scripts(username string) map[string]bool {
+	found := make(map[string]bool)
+	for _, r := range username {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for name, table := range unicode.Scripts {
+			if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+				found[name] = true
+				break
+			}
+		}
+	}
+	return found
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+func isClaimed(username string) bool {
+	claimsMutex.RLock()
+	defer claimsMutex.RUnlock()
+	_, ok := claims[username]
+	return ok
+}
+
+// tokenOwner returns the registered username the request authenticates as,
+// by the claim token or a session of users.go
+func tokenOwner(r *http.Request) string {
+	token := bearerToken(r)
+	if token == "" {
+		return ""
+	}
+	claimsMutex.RLock()
+	owner := claimTokens[token]
+	claimsMutex.RUnlock()
+	if owner == "" {
+		owner = sessionOwner(token)
+	}
+	return owner
+}
+
+// mayActAs reports whether the request is allowed to use username: unclaimed
+// names are free for all, claimed ones and their look-alikes need the token of
+// the claim and guest names need the guest token. Names the policy rejects are
+// nobody's
+func mayActAs(r *http.Request, username string) bool {
+	if isGuest(username) {
+		return validGuest(r, username)
+	}
+	if usernamePolicy(username) != nil {
+		return false
+	}
+	claimsMutex.RLock()
+	holder, claimed := claimSkeletons[skeleton(username)]
+	claimsMutex.RUnlock()
+	if !claimed {
+		return true
+	}
+	return holder == username && tokenOwner(r) == username
+}
+
+// curl -X POST http://localhost:8000/usernames -d '{"username": "arthur"}' -v
+func postUsername(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Username string `json:"username"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Username = normalizeUsername(req.Username)
+	token, status, problem := claimUsername(req.Username)
+	if problem != "" {
+		respondJSON(w, status, problem)
+		return
+	}
+
+	// Migration: whatever was posted under the name before the claim stays in
+	// history but is not verified, since anyone could have written it
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"username":        req.Username,
+		"token":           token,
+		"legacy_messages": countUnverified(req.Username),
+	})
+}
+
+// claimUsername registers the normalized username and returns its token, or
+// the status and problem when it can not be had
+func claimUsername(username string) (string, int, string) {
+	if username == "" {
+		return "", http.StatusBadRequest, "Empty username!"
+	}
+	if err := usernamePolicy(username); err != nil {
+		return "", http.StatusBadRequest, err.Error()
+	}
+	if isGuest(username) {
+		return "", http.StatusBadRequest, "Guest names can not be registered"
+	}
+
+	token := newToken()
+	claimsMutex.Lock()
+	defer claimsMutex.Unlock()
+	if _, taken := claims[username]; taken {
+		return "", http.StatusConflict, "Username is already registered"
+	}
+	if holder, taken := claimSkeletons[skeleton(username)]; taken {
+		return "", http.StatusConflict, "Username is too similar to the registered " + holder
+	}
+	claims[username] = token
+	claimTokens[token] = username
+	claimSkeletons[skeleton(username)] = username
+	logGlobal("username_claimed", "claims", username, token)
+	return token, http.StatusOK, ""
+}
+
+func countUnverified(username string) int {
+	count := 0
+	globalMapMutex.RLock()
+	defer globalMapMutex.RUnlock()
+	for _, subject := range liveMessages {
+		subject.RLock()
+		count += subject.countersOf().unverified[username]
+		subject.RUnlock()
+	}
+	return count
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users register a name with a password and sign in for a session instead of
+// keeping the claim token of the name around:
+//
+//	curl -X POST http://localhost:8000/users -d '{"username": "arthur", "password": "correct horse battery"}'
+//	curl -X POST http://localhost:8000/login -d '{"username": "arthur", "password": "correct horse battery"}'
+//
+// Registering claims the name as POST /usernames does, the password is kept
+// as a bcrypt hash. The session token of a login goes where the claim token
+// would, "Authorization: Bearer <token>", for sessionLifetime. Messages and
+// replies posted with a session are attributed to its user, a body naming
+// anybody else is refused. POST /logout ends the session
+const sessionLifetime = 30 * 24 * time.Hour
+const minPasswordLength = 8
+
+// bcrypt looks at no more than 72 bytes
+const maxPasswordLength = 72
+
+type session struct {
+	Token     string    `json:"token"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+var usersMutex sync.Mutex
+var passwords = make(map[string][]byte) // username -> bcrypt hash
+var sessions = make(map[string]*session)
+
+// compared against when the username is unknown, so a login takes as long
+// whether the name exists or not
+var unknownUserHash []byte
+var unknownUserOnce sync.Once
+
+// sessionOwner is the user of a live session token
+func sessionOwner(token string) string {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	s, ok := sessions[token]
+	if !ok || !time.Now().Before(s.ExpiresAt) {
+		return ""
+	}
+	return s.Username
+}
+
+// postingAs is who a post of the request is attributed to: the user of the
+// session whatever the body names, or else the username named. false when
+// that is not allowed
+func postingAs(r *http.Request, named string) (string, bool) {
+	named = normalizeUsername(named)
+	if username := sessionOwner(bearerToken(r)); username != "" {
+		return username, named == "" || named == username
+	}
+	return named, mayActAs(r, named)
+}
+
+// curl -X POST http://localhost:8000/users -d '{"username": "arthur", "password": "correct horse battery"}' -v
+func postUser(w http.ResponseWriter, r *http.Request) {
+	req := credentials{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if utf8.RuneCountInString(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+		respondJSON(w, http.StatusBadRequest, "password should be 8 characters to 72 bytes long")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	username := normalizeUsername(req.Username)
+	if _, status, problem := claimUsername(username); problem != "" {
+		respondJSON(w, status, problem)
+		return
+	}
+	usersMutex.Lock()
+	passwords[username] = hash
+	logGlobal("user_registered", "passwords", username, string(hash))
+	usersMutex.Unlock()
+	audit(auditEntry{Actor: username, Action: "user_registered", Username: username})
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"username":        username,
+		"legacy_messages": countUnverified(username),
+	})
+}
+
+// curl -X POST http://localhost:8000/login -d '{"username": "arthur", "password": "correct horse battery"}' -v
+func postLogin(w http.ResponseWriter, r *http.Request) {
+	req := credentials{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	username := normalizeUsername(req.Username)
+	usersMutex.Lock()
+	hash, ok := passwords[username]
+	usersMutex.Unlock()
+	if !ok {
+		unknownUserOnce.Do(func() {
+			unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+		})
+		hash = unknownUserHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || !ok {
+		respondJSON(w, http.StatusUnauthorized, "Wrong username or password")
+		return
+	}
+
+	now := time.Now()
+	s := &session{Token: newToken(), Username: username, CreatedAt: now, ExpiresAt: now.Add(sessionLifetime)}
+	usersMutex.Lock()
+	for token, old := range sessions {
+		if !now.Before(old.ExpiresAt) {
+			delete(sessions, token)
+			logGlobal("session_expired", "sessions", token, nil)
+		}
+	}
+	sessions[s.Token] = s
+	logGlobal("session_started", "sessions", s.Token, s)
+	usersMutex.Unlock()
+	respondJSON(w, http.StatusOK, s)
+}
+
+// curl -X POST http://localhost:8000/logout -H 'Authorization: Bearer <session token>' -v
+func postLogout(w http.ResponseWriter, r *http.Request) {
+	token := bearerToken(r)
+	usersMutex.Lock()
+	_, ok := sessions[token]
+	if ok {
+		delete(sessions, token)
+		logGlobal("session_ended", "sessions", token, nil)
+	}
+	usersMutex.Unlock()
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, "No such session")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]bool{"logged_out": true})
+}
+
+func takeUsers() (map[string]string, []session) {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	hashes := make(map[string]string, len(passwords))
+	for username, hash := range passwords {
+		hashes[username] = string(hash)
+	}
+	list := []session{}
+	for _, s := range sessions {
+		list = append(list, *s)
+	}
+	return hashes, list
+}
+
+func restoreUsers(hashes map[string]string, list []session) {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	passwords = make(map[string][]byte, len(hashes))
+	for username, hash := range hashes {
+		passwords[username] = []byte(hash)
+	}
+	sessions = make(map[string]*session, len(list))
+	for i := range list {
+		sessions[list[i].Token] = &list[i]
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Message ids are the sequence numbers of a channel: handed out one after the
+// other from 1 and never reused, so a consumer that wants every message can
+// tell what it did not get. GET /{channel}/verify?from=&to= answers which ids
+// of the range the node still has, as ranges of consecutive ids:
+//
+//	{"from": 1, "to": 250, "last_id": 250, "count": 240, "present": [[1, 100], [111, 250]], "missing": [[101, 110]]}
+//
+// Missing ids were taken out by retention, TTLs or moderators, or lost, and
+// have to come from an archive if at all. from defaults to 1 and to to the
+// last id handed out, ids after that are not missing yet
+type idRange [2]int
+
+// appendID adds the ids first to last to ranges of ascending ids
+func appendID(ranges []idRange, first, last int) []idRange {
+	if n := len(ranges); n > 0 && ranges[n-1][1]+1 >= first {
+		if last > ranges[n-1][1] {
+			ranges[n-1][1] = last
+		}
+		return ranges
+	}
+	return append(ranges, idRange{first, last})
+}
+
+// present returns the ids held between from and to. Blocks without a gap are
+// taken from their bookkeeping, the others decompressed. Caller must hold the
+// subject lock
+func (s *subject) present(from, to int) []idRange {
+	ranges := []idRange{}
+	for _, b := range s.cold {
+		if b.last < from || b.first > to {
+			continue
+		}
+		if b.count == b.last-b.first+1 {
+			ranges = appendID(ranges, maxInt(b.first, from), minInt(b.last, to))
+			continue
+		}
+		for _, mesg := range b.messages() {
+			if mesg.Id >= from && mesg.Id <= to {
+				ranges = appendID(ranges, mesg.Id, mesg.Id)
+			}
+		}
+	}
+	i := sort.Search(len(s.Messages), func(i int) bool { return s.Messages[i].Id >= from })
+	for ; i < len(s.Messages) && s.Messages[i].Id <= to; i++ {
+		ranges = appendID(ranges, s.Messages[i].Id, s.Messages[i].Id)
+	}
+	return ranges
+}
+
+// missing is the complement of present between from and to
+func missing(present []idRange, from, to int) []idRange {
+	gaps := []idRange{}
+	next := from
+	for _, r := range present {
+		if r[0] > next {
+			gaps = append(gaps, idRange{next, r[0] - 1})
+		}
+		next = r[1] + 1
+	}
+	if next <= to {
+		gaps = append(gaps, idRange{next, to})
+	}
+	return gaps
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// curl -X GET 'http://localhost:8000/gdgsas022/verify?from=1&to=500' -v
+func verifyChannel(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	bounds := map[string]int{"from": 1, "to": 0}
+	for _, name := range []string{"from", "to"} {
+		if value := r.URL.Query().Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				respondJSON(w, http.StatusBadRequest, name+" should be a positive integer")
+				return
+			}
+			bounds[name] = n
+		}
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	// Critical region
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canAccess(actingUser(r)) {
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	from, to := bounds["from"], bounds["to"]
+	if to == 0 || to > subject.lastID {
+		to = subject.lastID
+	}
+	if bounds["to"] != 0 && bounds["to"] < from {
+		respondJSON(w, http.StatusBadRequest, "to should not be before from")
+		return
+	}
+	present := subject.present(from, to)
+	count := 0
+	for _, r := range present {
+		count += r[1] - r[0] + 1
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"channel": channel, "from": from, "to": to, "last_id": subject.lastID, "count": count,
+		"present": present, "missing": missing(present, from, to),
+	})
+}
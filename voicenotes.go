@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A voice note is a short recording posted as a message, the audio base64
+// encoded in the post:
+//
+//	{"username": "arthur", "voice_note": {"data": "T2dnUwACAAAA..."}}
+//
+// There is no separate upload, the audio travels and is kept with its message
+// the way a snippet body is. The server works out the codec and duration from
+// the audio itself and refuses anything longer than -max-voice-note. Listings
+// carry only that, players stream the audio from /{channel}/messages/{id}/voice,
+// which answers Range requests so they can seek
+const maxVoiceNoteSize = 1 << 20
+
+var maxVoiceNote = 2 * time.Minute
+
+type voiceNote struct {
+	ContentType string `json:"content_type"`
+	Codec       string `json:"codec"`
+	Duration    int64  `json:"duration_ms"`
+	Size        int    `json:"size"`
+	data        []byte
+}
+
+// UnmarshalJSON takes the audio from posts, it never goes out with the API form
+func (vn *voiceNote) UnmarshalJSON(data []byte) error {
+	type plain voiceNote
+	in := struct {
+		*plain
+		Data []byte `json:"data"`
+	}{plain: (*plain)(vn)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	vn.data = in.Data
+	return nil
+}
+
+// prepare checks posted audio and fills in what was found in it, whatever the
+// client claimed
+func (vn *voiceNote) prepare() error {
+	if len(vn.data) == 0 {
+		return errors.New("Empty voice note")
+	}
+	if len(vn.data) > maxVoiceNoteSize {
+		return errors.New("Voice note is larger than " + strconv.Itoa(maxVoiceNoteSize>>10) + "KB")
+	}
+	contentType, codec, duration, err := probeAudio(vn.data)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return errors.New("Voice note has no audio")
+	}
+	if duration > maxVoiceNote {
+		return errors.New("Voice note is longer than " + maxVoiceNote.String())
+	}
+	vn.ContentType, vn.Codec = contentType, codec
+	vn.Duration = duration.Milliseconds()
+	vn.Size = len(vn.data)
+	return nil
+}
+
+var errAudioFormat = errors.New("Voice notes should be Ogg Opus, Ogg Vorbis or WAV audio")
+
+// probeAudio reads the content type, codec and duration from the headers of
+// the audio, nothing is decoded
+func probeAudio(data []byte) (string, string, time.Duration, error) {
+	switch {
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return probeWAV(data)
+	case len(data) >= 4 && string(data[:4]) == "OggS":
+		return probeOgg(data)
+	}
+	return "", "", 0, errAudioFormat
+}
+
+var wavCodecs = map[uint16]string{1: "pcm", 3: "pcm_float", 6: "alaw", 7: "mulaw"}
+
+func probeWAV(data []byte) (string, string, time.Duration, error) {
+	codec, byteRate, size := "", uint32(0), -1
+	for at := 12; at+8 <= len(data); {
+		chunk := string(data[at : at+4])
+		length := int(binary.LittleEndian.Uint32(data[at+4:]))
+		body := data[at+8:]
+		switch {
+		case chunk == "fmt " && len(body) >= 16:
+			codec = wavCodecs[binary.LittleEndian.Uint16(body)]
+			byteRate = binary.LittleEndian.Uint32(body[8:])
+		case chunk == "data":
+			// a recorder cut short may leave the size it meant to write
+			size = length
+			if size > len(body) {
+				size = len(body)
+			}
+		}
+		if length < 0 || length > len(body) {
+			break
+		}
+		at += 8 + length + length&1
+	}
+	if codec == "" || byteRate == 0 || size < 0 {
+		return "", "", 0, errAudioFormat
+	}
+	return "audio/wav", codec, time.Duration(int64(size) * int64(time.Second) / int64(byteRate)), nil
+}
+
+// probeOgg takes the codec from the first packet and the duration from the
+// granule position of the last page, the sample the stream ends at
+func probeOgg(data []byte) (string, string, time.Duration, error) {
+	if len(data) < 27 || len(data) < 27+int(data[26]) {
+		return "", "", 0, errAudioFormat
+	}
+	packet := data[27+int(data[26]):]
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last+14 > len(data) {
+		return "", "", 0, errAudioFormat
+	}
+	granule := int64(binary.LittleEndian.Uint64(data[last+6:]))
+	switch {
+	case len(packet) >= 19 && string(packet[:8]) == "OpusHead":
+		// opus always counts at 48kHz, the first samples are encoder delay
+		samples := granule - int64(binary.LittleEndian.Uint16(packet[10:]))
+		return "audio/ogg", "opus", time.Duration(samples * int64(time.Second) / 48000), nil
+	case len(packet) >= 16 && string(packet[:7]) == "\x01vorbis":
+		rate := int64(binary.LittleEndian.Uint32(packet[12:]))
+		if rate == 0 {
+			return "", "", 0, errAudioFormat
+		}
+		return "audio/ogg", "vorbis", time.Duration(granule * int64(time.Second) / rate), nil
+	}
+	return "", "", 0, errAudioFormat
+}
+
+// The recording of a voice note, Range requests are answered with the part
+// asked for
+// curl -X GET http://localhost:8000/gdgsas022/messages/1/voice -H 'Range: bytes=0-1023' -v
+func getVoiceNote(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, "id should be an integer")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	rd := readerOf(r)
+	if !rd.mayRead(subject) {
+		subject.RUnlock()
+		respondJSON(w, http.StatusForbidden, "This channel is private")
+		return
+	}
+	mesg, ok := rd.message(subject.message(id))
+	if !ok {
+		subject.RUnlock()
+		respondJSON(w, http.StatusNotFound, "No message for the provided id")
+		return
+	}
+	// the audio of a message never changes, a slow listener needs no lock
+	vn, created := mesg.VoiceNote, mesg.Created
+	subject.RUnlock()
+	if vn == nil {
+		respondJSON(w, http.StatusNotFound, "This message has no voice note")
+		return
+	}
+	w.Header().Set("Content-Type", vn.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", created, bytes.NewReader(vn.data))
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Point in time recovery. With -pitr-window the node keeps snapshots, backups
+// written to dataDir every snapshotInterval, and a write-ahead log of every
+// change made after each of them. Recovering "as of" a time loads the newest
+// snapshot taken before it and replays the log up to it, e.g. to undo a bad
+// bulk operation:
+//
+//	messaging-service recover -server http://localhost:8000 -admin-token secret -as-of 2026-10-15T09:30:00Z
+//
+// Records hold whole messages, whole channel settings or whole entries of the
+// state kept outside channels, so applying one twice does no harm. That is what lets a
+// snapshot be taken while the node keeps writing: records that made it into
+// the snapshot too are simply applied again.
+//
+// The log is the source of truth the node comes back from: at startup the
+// state is rebuilt from the newest snapshot and the records after it, the same
+// way a recovery to the current time would. The log is kept for that alone,
+// with only the newest snapshot, whenever there is a -data-dir, -wal=false
+// turns it off. -wal-sync makes every record reach the disk before the change
+// is acknowledged, so not even a power cut loses a message. The records are
+// also what /cdc streams and what mirrors apply.
+//
+// There is one log for the node rather than one per channel: the state kept
+// outside channels changes along with them, a settings change and the
+// messages it affects have to be replayed in the order they were made, and
+// offsets of a single log are what /cdc readers and mirrors resume from.
+//
+// A snapshot every -snapshot-interval bounds how much log a restart replays,
+// -snapshot-keep keeps more of the older ones around than the window needs
+var pitrWindow time.Duration
+var walAlways bool
+var walSync bool
+var snapshotInterval = time.Hour
+var snapshotKeep = 1
+
+// segment and snapshot names are the time the segment was opened, they sort
+// like the times they stand for
+const walTimeFormat = "20060102T150405.000000000Z"
+
+type walRecord struct {
+	Offset   int64            `json:"offset"`
+	At       time.Time        `json:"at"`
+	Kind     string           `json:"kind"`             // message, removed, settings, channel, dropped, global, globals or restored
+	Change   string           `json:"change,omitempty"` // what a message or settings record was for, see cdc.go
+	Channel  string           `json:"channel,omitempty"`
+	Message  *storedPost      `json:"message,omitempty"`
+	Removed  []int            `json:"removed,omitempty"`
+	Before   int              `json:"before,omitempty"` // removed also covers every id below
+	Settings *archivedChannel `json:"settings,omitempty"`
+	Global   *globalEntry     `json:"global,omitempty"`
+	Globals  *globalState     `json:"globals,omitempty"` // all of it, written to databases on restore
+}
+
+var walMutex sync.Mutex
+var walFile *os.File // the open segment, nil until the first snapshot
+
+// every record gets the next offset, continued across restarts from the log
+// on disk when there is one
+var walOffset int64
+
+// mirrors and /cdc streams get every record too, see mirror.go and cdc.go. A
+// feed that falls behind is closed and its reader has to start over. The value
+// is true for mirrors, which also need the state kept outside channels
+var feeds = make(map[chan walRecord]bool)
+var mirrorCount int32
+
+// the newest records stay in memory for /cdc streams resuming from an offset
+var backlog []walRecord
+
+const feedBuffer = 1024
+
+func walEnabled() bool {
+	return (pitrWindow > 0 || walAlways) && dataDir != ""
+}
+
+// recording is true while anybody needs the records: the log on disk, the
+// database, the backlog of /cdc or a mirror
+func recording() bool {
+	return walEnabled() || storage != nil || cdcBacklog > 0 || atomic.LoadInt32(&mirrorCount) > 0
+}
+
+// subscribe registers a feed. Returns the records of the backlog after offset,
+// which the feed will not get, and the offset of the newest record
+func subscribe(feed chan walRecord, mirror bool, after int64) ([]walRecord, int64) {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	feeds[feed] = mirror
+	if mirror {
+		atomic.AddInt32(&mirrorCount, 1)
+	}
+	i := sort.Search(len(backlog), func(i int) bool { return backlog[i].Offset > after })
+	return append([]walRecord(nil), backlog[i:]...), walOffset
+}
+
+func unsubscribe(feed chan walRecord) {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	dropFeed(feed)
+}
+
+// dropFeed forgets a feed. Caller must hold walMutex
+func dropFeed(feed chan walRecord) {
+	mirror, ok := feeds[feed]
+	if !ok {
+		return
+	}
+	delete(feeds, feed)
+	if mirror {
+		atomic.AddInt32(&mirrorCount, -1)
+	}
+}
+
+func snapshotPath(name string) string {
+	return filepath.Join(dataDir, "snapshots", name+".json.gz")
+}
+
+func segmentPath(name string) string {
+	return filepath.Join(dataDir, "wal", name+".log")
+}
+
+// writeWAL numbers a record, appends it to the open segment and the backlog
+// and hands it to the feeds. With write-behind the segment and the database
+// get it with the next batch. Caller must hold walMutex
+func writeWAL(rec walRecord) {
+	walOffset++
+	rec.Offset = walOffset
+	rec.At = time.Now()
+	if cdcBacklog > 0 {
+		backlog = append(backlog, rec)
+		if len(backlog) >= 2*cdcBacklog {
+			backlog = append([]walRecord(nil), backlog[len(backlog)-cdcBacklog:]...)
+		}
+	}
+	for feed := range feeds {
+		select {
+		case feed <- rec:
+		default:
+			close(feed)
+			dropFeed(feed)
+		}
+	}
+	if holdBack(rec) {
+		return
+	}
+	storeRecords([]walRecord{rec})
+	if walFile != nil {
+		writeSegment(walFile, []walRecord{rec})
+	}
+}
+
+func appendWAL(rec walRecord) {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	writeWAL(rec)
+}
+
+// logMessage records the message as it is now. Caller must hold the subject
+// lock, which keeps the records of a channel in order
+func (s *subject) logMessage(id int, change string) {
+	s.touch()
+	forgetPages(s.title, id, id)
+	if !recording() {
+		return
+	}
+	if mesg := s.message(id); mesg != nil {
+		sp := storeMessage(*mesg)
+		appendWAL(walRecord{Kind: "message", Change: change, Channel: s.title, Message: &sp})
+	}
+}
+
+// logRemoved records deleted messages, before drops every id below it. Caller
+// must hold the subject lock
+func (s *subject) logRemoved(ids []int, before int) {
+	s.forgetRemoved(ids, before)
+	if recording() {
+		appendWAL(walRecord{Kind: "removed", Channel: s.title, Removed: ids, Before: before})
+	}
+}
+
+// logSettings records everything about the channel but its messages. Caller
+// must hold the subject lock
+func (s *subject) logSettings(change string) {
+	s.touch()
+	if s.private {
+		forgetChannelPages(s.title)
+	}
+	if recording() {
+		a := s.settings()
+		appendWAL(walRecord{Kind: "settings", Change: change, Channel: s.title, Settings: &a})
+	}
+}
+
+// logChannel records the channel with all of its messages, for changes too
+// large to describe message by message. Caller must hold the subject lock
+func (s *subject) logChannel() {
+	s.touch()
+	forgetChannelPages(s.title)
+	if recording() {
+		a := s.snapshot()
+		appendWAL(walRecord{Kind: "channel", Channel: s.title, Settings: &a})
+	}
+}
+
+func logDropped(channel string) {
+	forgetChannelPages(channel)
+	if recording() {
+		appendWAL(walRecord{Kind: "dropped", Channel: channel})
+	}
+}
+
+// logGlobal records a change of one entry of the state kept outside channels,
+// a nil value removes it, see globalEntry. Callers hold the mutex guarding the
+// entry, which keeps the records of an entry in the order of its changes
+func logGlobal(change, set, key string, value interface{}) {
+	if !walEnabled() && storage == nil && atomic.LoadInt32(&mirrorCount) == 0 {
+		return
+	}
+	e := globalEntry{Set: set, Key: key}
+	if value != nil {
+		data, err := json.Marshal(value)
+		if err != nil {
+			fmt.Println("Logging", set, "failed:", err)
+			return
+		}
+		e.Value = data
+	}
+	appendWAL(walRecord{Kind: "global", Change: change, Global: &e})
+}
+
+// takeSnapshot opens a new log segment, writes a backup next to it and forgets
+// what is no longer needed to go back pitrWindow. Changes made while the backup
+// is taken land in the new segment, whether the backup saw them or not
+func takeSnapshot(now time.Time) {
+	if !walEnabled() {
+		return
+	}
+	name := now.UTC().Format(walTimeFormat)
+	for _, dir := range []string{"snapshots", "wal"} {
+		if err := os.MkdirAll(filepath.Join(dataDir, dir), 0755); err != nil {
+			fmt.Println("Snapshot failed:", err)
+			return
+		}
+	}
+	segment, err := os.OpenFile(segmentPath(name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Println("Snapshot failed:", err)
+		return
+	}
+	var previous *os.File
+	flushWAL(func() { previous, walFile = walFile, segment })
+	if previous != nil {
+		previous.Close()
+	}
+
+	// without its snapshot the segment still extends the one before it
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(takeBackup()); err != nil {
+		fmt.Println("Snapshot failed:", err)
+		return
+	}
+	zw.Close()
+	tmp := snapshotPath(name) + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		fmt.Println("Snapshot failed:", err)
+		return
+	}
+	if err := os.Rename(tmp, snapshotPath(name)); err != nil {
+		fmt.Println("Snapshot failed:", err)
+		return
+	}
+	dataToS3(snapshotPath(name))
+	pruneSnapshots(now)
+}
+
+// pruneSnapshots keeps the newest snapshot older than the window, the base of
+// any recovery within it, and everything after. Of the snapshotKeep newest
+// snapshots none goes either
+func pruneSnapshots(now time.Time) {
+	cutoff := now.Add(-pitrWindow).UTC().Format(walTimeFormat)
+	snapshots := walNames("snapshots", ".json.gz")
+	base := ""
+	for _, name := range snapshots {
+		if name <= cutoff {
+			base = name
+		}
+	}
+	if len(snapshots) <= snapshotKeep {
+		return
+	}
+	if keep := snapshots[len(snapshots)-snapshotKeep]; keep < base {
+		base = keep
+	}
+	if base == "" {
+		return
+	}
+	for _, name := range snapshots {
+		if name < base {
+			os.Remove(snapshotPath(name))
+		}
+	}
+	for _, name := range walNames("wal", ".log") {
+		if name < base {
+			os.Remove(segmentPath(name))
+		}
+	}
+}
+
+func walNames(dir, suffix string) []string {
+	files, _ := ioutil.ReadDir(filepath.Join(dataDir, dir))
+	names := []string{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), suffix) {
+			names = append(names, strings.TrimSuffix(file.Name(), suffix))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readSegment reads the records of a log segment. A last line torn by a crash
+// in the middle of a write is left out
+func readSegment(name string) ([]walRecord, error) {
+	data, err := ioutil.ReadFile(segmentPath(name))
+	if err != nil {
+		return nil, err
+	}
+	records := []walRecord{}
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			return records, nil
+		}
+		rec := walRecord{}
+		if err := json.Unmarshal(data[:end], &rec); err != nil {
+			return nil, fmt.Errorf("segment %s: %v", name, err)
+		}
+		records = append(records, rec)
+		data = data[end+1:]
+	}
+}
+
+// readLog reads the records between two offsets from the log on disk, false
+// when some of them are gone. It goes through the whole log, which only holds
+// -pitr-window worth of changes
+func readLog(after, before int64) ([]walRecord, bool) {
+	if !walEnabled() {
+		return nil, false
+	}
+	records := []walRecord{}
+	for _, name := range walNames("wal", ".log") {
+		segment, err := readSegment(name)
+		if err != nil {
+			return nil, false
+		}
+		for _, rec := range segment {
+			if rec.Offset > after && rec.Offset < before {
+				records = append(records, rec)
+			}
+		}
+	}
+	return records, len(records) > 0 && records[0].Offset == after+1 && records[len(records)-1].Offset == before-1
+}
+
+// resumeOffsets continues the offsets where the log on disk ends. Called at
+// startup, before the first snapshot opens a new segment
+func resumeOffsets() {
+	if !walEnabled() {
+		return
+	}
+	segments := walNames("wal", ".log")
+	for i := len(segments) - 1; i >= 0; i-- {
+		records, err := readSegment(segments[i])
+		if err == nil && len(records) > 0 {
+			walOffset = records[len(records)-1].Offset
+			return
+		}
+	}
+}
+
+// rebuildState brings back the state the node had when it stopped. Archived
+// channels stay archived, see leaveArchived
+func rebuildState() error {
+	if !walEnabled() || len(walNames("snapshots", ".json.gz")) == 0 {
+		return nil
+	}
+	b, snapshot, replayed, err := stateAsOf(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := installBackup(b, true); err != nil {
+		return err
+	}
+	fmt.Println("Rebuilt", len(b.Channels), "channels from the snapshot of", snapshot.Format(time.RFC3339), "and", replayed, "logged changes")
+	return nil
+}
+
+func readSnapshot(name string) (backup, error) {
+	b := backup{}
+	f, err := os.Open(snapshotPath(name))
+	if err != nil {
+		return b, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return b, err
+	}
+	err = json.NewDecoder(zr).Decode(&b)
+	return b, err
+}
+
+// stateAsOf rebuilds the state of the node at asOf from the newest snapshot
+// finished by then and the log after it. Returns the state, when its snapshot
+// was taken and how many records were replayed on top
+func stateAsOf(asOf time.Time) (backup, time.Time, int, error) {
+	if !walEnabled() {
+		return backup{}, time.Time{}, 0, errors.New("point in time recovery needs -pitr-window and -data-dir")
+	}
+	flushWAL(nil)
+	snapshots := walNames("snapshots", ".json.gz")
+	base, b := "", backup{}
+	for i := len(snapshots) - 1; i >= 0 && base == ""; i-- {
+		if snapshots[i] > asOf.UTC().Format(walTimeFormat) {
+			continue
+		}
+		snapshot, err := readSnapshot(snapshots[i])
+		if err != nil {
+			fmt.Println("Reading snapshot", snapshots[i], "failed:", err)
+			continue
+		}
+		if !snapshot.TakenAt.After(asOf) {
+			base, b = snapshots[i], snapshot
+		}
+	}
+	if base == "" {
+		return b, time.Time{}, 0, errors.New("no snapshot was taken before " + asOf.Format(time.RFC3339))
+	}
+
+	channels := make(map[string]*archivedChannel, len(b.Channels))
+	for i := range b.Channels {
+		channels[b.Channels[i].Title] = &b.Channels[i]
+	}
+	replayed := 0
+segments:
+	for _, name := range walNames("wal", ".log") {
+		if name < base {
+			continue
+		}
+		records, err := readSegment(name)
+		if err != nil {
+			return b, time.Time{}, 0, err
+		}
+		for _, rec := range records {
+			if rec.At.After(asOf) {
+				break segments
+			}
+			if err := replay(channels, &b.globalState, rec); err != nil {
+				return b, time.Time{}, 0, err
+			}
+			replayed++
+		}
+	}
+
+	takenAt := b.TakenAt
+	b.TakenAt = asOf
+	b.Channels = make([]archivedChannel, 0, len(channels))
+	for _, a := range channels {
+		b.Channels = append(b.Channels, *a)
+	}
+	sort.Slice(b.Channels, func(i, j int) bool { return b.Channels[i].Title < b.Channels[j].Title })
+	return b, takenAt, replayed, nil
+}
+
+func replay(channels map[string]*archivedChannel, globals *globalState, rec walRecord) error {
+	a := channels[rec.Channel]
+	switch rec.Kind {
+	case "message":
+		if a != nil {
+			a.upsert(*rec.Message)
+		}
+	case "removed":
+		if a != nil {
+			a.drop(rec.Removed, rec.Before)
+		}
+	case "settings":
+		settings := *rec.Settings
+		if a != nil {
+			settings.Messages = a.Messages
+		}
+		channels[rec.Channel] = &settings
+	case "channel":
+		settings := *rec.Settings
+		channels[rec.Channel] = &settings
+	case "dropped":
+		delete(channels, rec.Channel)
+	case "global":
+		return globals.apply(*rec.Global)
+	case "globals":
+		*globals = *rec.Globals
+	case "restored":
+		return errors.New("a restore at " + rec.At.Format(time.RFC3339) + " replaced the state, recover to a time after its snapshot")
+	}
+	return nil
+}
+
+func (a *archivedChannel) upsert(sp storedPost) {
+	i := sort.Search(len(a.Messages), func(i int) bool { return a.Messages[i].Id >= sp.Id })
+	if i < len(a.Messages) && a.Messages[i].Id == sp.Id {
+		a.Messages[i] = sp
+	} else {
+		a.Messages = append(a.Messages, storedPost{})
+		copy(a.Messages[i+1:], a.Messages[i:])
+		a.Messages[i] = sp
+	}
+	if sp.Id > a.LastID {
+		a.LastID = sp.Id
+	}
+	if sp.ExpiresAt != nil {
+		if a.Expiring == nil {
+			a.Expiring = make(map[int]time.Time)
+		}
+		a.Expiring[sp.Id] = *sp.ExpiresAt
+	}
+}
+
+func (a *archivedChannel) drop(ids []int, before int) {
+	removed := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+	kept := a.Messages[:0]
+	for _, sp := range a.Messages {
+		if sp.Id >= before && !removed[sp.Id] {
+			kept = append(kept, sp)
+		}
+	}
+	a.Messages = kept
+	for id := range a.Expiring {
+		if id < before || removed[id] {
+			delete(a.Expiring, id)
+		}
+	}
+}
+
+func parseAsOf(r *http.Request) (time.Time, error) {
+	asOf, err := time.Parse(time.RFC3339, r.URL.Query().Get("as_of"))
+	if err != nil {
+		return asOf, errors.New("as_of should be a time like 2026-10-15T09:30:00Z")
+	}
+	if asOf.After(time.Now()) {
+		return asOf, errors.New("as_of is in the future")
+	}
+	return asOf, nil
+}
+
+// Replaces the state of the node with the state it had at as_of. Everything
+// written since is dropped, GET /admin/backup?as_of= exports the same state
+// without restoring it
+// curl -X POST 'http://localhost:8000/admin/recover?as_of=2026-10-15T09:30:00Z' -H 'X-Admin-Token: secret'
+func postRecover(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	asOf, err := parseAsOf(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	b, snapshot, replayed, err := stateAsOf(asOf)
+	if err != nil {
+		respondJSON(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err := restoreBackup(b); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"as_of":    asOf,
+		"snapshot": snapshot,
+		"replayed": replayed,
+		"channels": len(b.Channels),
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every channel has a lock of its own and a hot channel shows up as requests
+// waiting for it. The subject locks count how long they were waited for, and
+// the watchdog job looks at the counts every watchdogInterval together with
+// the goroutines and the heap. A channel whose lock kept a request waiting
+// longer than -watchdog-threshold is logged with the hottest channels of the
+// interval. -mutex-profile-fraction turns on the runtime mutex profile, its
+// most contended call sites come along too. GET /admin/watchdog serves the
+// newest sample and warnings
+const watchdogInterval = 10 * time.Second
+const watchdogHottest = 5
+const watchdogWarnings = 100
+
+var watchdogThreshold = 100 * time.Millisecond
+var watchdogGoroutines = 10000
+var mutexProfileFraction int
+
+// lockStats are kept with atomics, sampling must not take the lock it measures
+type lockStats struct {
+	waited  int64 // ns, total
+	longest int64 // ns, since the last sample
+	locks   int64
+}
+
+func (s *subject) Lock() {
+	start := time.Now()
+	s.RWMutex.Lock()
+	s.lockStats.record(time.Since(start))
+}
+
+func (s *subject) RLock() {
+	start := time.Now()
+	s.RWMutex.RLock()
+	s.lockStats.record(time.Since(start))
+}
+
+func (ls *lockStats) record(wait time.Duration) {
+	atomic.AddInt64(&ls.waited, int64(wait))
+	atomic.AddInt64(&ls.locks, 1)
+	for {
+		longest := atomic.LoadInt64(&ls.longest)
+		if int64(wait) <= longest || atomic.CompareAndSwapInt64(&ls.longest, longest, int64(wait)) {
+			return
+		}
+	}
+}
+
+type channelContention struct {
+	Channel string        `json:"channel"`
+	Waited  time.Duration `json:"waited_ns"`
+	Longest time.Duration `json:"longest_ns"`
+	Locks   int64         `json:"locks"`
+}
+
+type contendedSite struct {
+	Function    string `json:"function"`
+	Location    string `json:"location"`
+	Contentions int64  `json:"contentions"`
+	Cycles      int64  `json:"cycles"`
+}
+
+type watchdogSample struct {
+	At         time.Time           `json:"at"`
+	Goroutines int                 `json:"goroutines"`
+	HeapBytes  uint64              `json:"heap_bytes"`
+	GCPauseNs  uint64              `json:"gc_pause_total_ns"`
+	NumGC      uint32              `json:"num_gc"`
+	Hottest    []channelContention `json:"hottest_channels"`
+	Mutexes    []contendedSite     `json:"contended_mutexes,omitempty"`
+}
+
+type watchdogWarning struct {
+	At      time.Time `json:"at"`
+	Message string    `json:"message"`
+}
+
+var watchdogMutex sync.Mutex
+var lastSample watchdogSample
+var warnings []watchdogWarning
+
+// what the channels had waited in total at the previous sample
+var previousWaits = make(map[*subject]lockStats)
+
+func startWatchdog() {
+	if mutexProfileFraction > 0 {
+		runtime.SetMutexProfileFraction(mutexProfileFraction)
+	}
+}
+
+func watch(now time.Time) {
+	sample := watchdogSample{At: now, Goroutines: runtime.NumGoroutine(), Hottest: []channelContention{}}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	sample.HeapBytes, sample.GCPauseNs, sample.NumGC = mem.HeapAlloc, mem.PauseTotalNs, mem.NumGC
+
+	watchdogMutex.Lock()
+	defer watchdogMutex.Unlock()
+	current := make(map[*subject]lockStats)
+	for channel, subject := range allSubjects() {
+		stats := lockStats{
+			waited:  atomic.LoadInt64(&subject.lockStats.waited),
+			locks:   atomic.LoadInt64(&subject.lockStats.locks),
+			longest: atomic.SwapInt64(&subject.lockStats.longest, 0),
+		}
+		current[subject] = stats
+		previous := previousWaits[subject]
+		if stats.locks == previous.locks {
+			continue
+		}
+		sample.Hottest = append(sample.Hottest, channelContention{
+			Channel: channel,
+			Waited:  time.Duration(stats.waited - previous.waited),
+			Longest: time.Duration(stats.longest),
+			Locks:   stats.locks - previous.locks,
+		})
+	}
+	previousWaits = current
+	sort.Slice(sample.Hottest, func(i, j int) bool { return sample.Hottest[i].Waited > sample.Hottest[j].Waited })
+	if len(sample.Hottest) > watchdogHottest {
+		sample.Hottest = sample.Hottest[:watchdogHottest]
+	}
+	if mutexProfileFraction > 0 {
+		sample.Mutexes = contendedMutexes()
+	}
+	lastSample = sample
+
+	if len(sample.Hottest) > 0 && sample.Hottest[0].Longest > watchdogThreshold {
+		hot := ""
+		for _, c := range sample.Hottest {
+			hot += fmt.Sprintf(" %s (%d locks, %v waited, longest %v)", c.Channel, c.Locks, c.Waited, c.Longest)
+		}
+		warn(now, "Lock contention over "+watchdogThreshold.String()+", hottest channels:"+hot)
+	}
+	if watchdogGoroutines > 0 && sample.Goroutines > watchdogGoroutines {
+		warn(now, strconv.Itoa(sample.Goroutines)+" goroutines running")
+	}
+}
+
+// warn logs a warning and keeps it for the admin API. Caller must hold
+// watchdogMutex
+func warn(now time.Time, message string) {
+	fmt.Println("Watchdog:", message)
+	warnings = append(warnings, watchdogWarning{At: now, Message: message})
+	if len(warnings) > watchdogWarnings {
+		warnings = append([]watchdogWarning(nil), warnings[len(warnings)-watchdogWarnings:]...)
+	}
+}
+
+// contendedMutexes are the call sites of the runtime mutex profile that waited
+// longest since the start, by the function that unlocked
+func contendedMutexes() []contendedSite {
+	records := make([]runtime.BlockProfileRecord, 64)
+	for {
+		n, ok := runtime.MutexProfile(records)
+		if ok {
+			records = records[:n]
+			break
+		}
+		records = make([]runtime.BlockProfileRecord, n+16)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Cycles > records[j].Cycles })
+	if len(records) > watchdogHottest {
+		records = records[:watchdogHottest]
+	}
+	sites := []contendedSite{}
+	for _, rec := range records {
+		site := contendedSite{Contentions: rec.Count, Cycles: rec.Cycles}
+		// the innermost frame of this service released the lock, the runtime
+		// and the libraries are only where it happened
+		frames := runtime.CallersFrames(rec.Stack())
+		for {
+			frame, more := frames.Next()
+			if site.Function == "" || strings.HasPrefix(frame.Function, "main.") {
+				site.Function, site.Location = frame.Function, frame.File+":"+strconv.Itoa(frame.Line)
+			}
+			if !more || strings.HasPrefix(frame.Function, "main.") {
+				break
+			}
+		}
+		sites = append(sites, site)
+	}
+	return sites
+}
+
+// curl -X GET http://localhost:8000/admin/watchdog -H 'X-Admin-Token: secret'
+func getWatchdog(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	watchdogMutex.Lock()
+	defer watchdogMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sample":    lastSample,
+		"threshold": watchdogThreshold.String(),
+		"warnings":  append([]watchdogWarning{}, warnings...),
+	})
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// An integration lets a third party post into one channel through
+// POST /hooks/{id}. Every call is signed with the integration secret:
+//
+//	X-Timestamp: unix seconds
+//	X-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// Calls older than webhookTolerance are refused and a signature is accepted
+// only once, so a captured call can not be replayed.
+//
+// CI systems and bots that can not sign get an integration with "auth":
+// "token" instead: the secret is in its URL, POST /hooks/{token}, and calls
+// need nothing else. Anyone who learns the URL can post as the integration,
+// so it is only shown when the integration is added and removing the
+// integration is the way to revoke it
+type integration struct {
+	Id        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Name      string    `json:"name"`
+	Auth      string    `json:"auth"` // signature or token
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url,omitempty"`
+	// where the GitHub and GitLab receivers post, see repos.go
+	Routes []repoRoute `json:"routes,omitempty"`
+	secret string
+}
+
+// A repository route sends the events of the repositories matching Repository,
+// a path.Match pattern like "acme/*", to Channel instead of the channel of the
+// integration. The first match wins
+type repoRoute struct {
+	Repository string `json:"repository"`
+	Channel    string `json:"channel"`
+}
+
+const maxRepoRoutes = 50
+
+const webhookTolerance = 5 * time.Minute
+const maxWebhookBody = 64 << 10
+
+var integrationsMutex sync.Mutex
+var integrations = make(map[string]*integration)
+
+// logIntegration records the integration with its secret. Caller must hold
+// integrationsMutex
+func logIntegration(hook *integration) {
+	logGlobal("integration_changed", "integrations", hook.Id, storedIntegration{integration: *hook, Secret: hook.secret})
+}
+
+// signatures seen within the tolerance window and when they may be forgotten
+var seenSignatures = make(map[string]time.Time)
+
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhook checks the signature and freshness of a call and records the
+// signature against replays. The returned message is safe to show the caller
+func verifyWebhook(hook *integration, r *http.Request, body []byte, now time.Time) (bool, string) {
+	timestamp := r.Header.Get("X-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false, "X-Timestamp should be unix seconds"
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > webhookTolerance || skew < -webhookTolerance {
+		return false, "X-Timestamp is too far from the server time"
+	}
+	signature := r.Header.Get("X-Signature")
+	if !hmac.Equal([]byte(signature), []byte(webhookSignature(hook.secret, timestamp, body))) {
+		return false, "Bad signature"
+	}
+
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+	for seen, expires := range seenSignatures {
+		if now.After(expires) {
+			delete(seenSignatures, seen)
+		}
+	}
+	if _, replayed := seenSignatures[signature]; replayed {
+		return false, "Replayed call"
+	}
+	seenSignatures[signature] = now.Add(2 * webhookTolerance)
+	return true, ""
+}
+
+// curl -X POST http://localhost:8000/gdgsas022/integrations -H 'X-Username: arthur' -d '{"name": "ci-bot"}' -v
+func postIntegration(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	req := struct {
+		Name string `json:"name"`
+		Auth string `json:"auth"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Name = normalizeUsername(req.Name)
+	if req.Name == "" {
+		respondJSON(w, http.StatusBadRequest, "Empty name!")
+		return
+	}
+	if req.Auth == "" {
+		req.Auth = "signature"
+	}
+	if req.Auth != "signature" && req.Auth != "token" {
+		respondJSON(w, http.StatusBadRequest, "auth should be signature or token")
+		return
+	}
+	if isGuest(req.Name) || !mayActAs(r, req.Name) {
+		respondJSON(w, http.StatusForbidden, "Not allowed to name an integration after this username")
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only moderators can add integrations")
+		return
+	}
+
+	id := newToken()
+	hook := &integration{
+		Id:        id,
+		Channel:   channel,
+		Name:      req.Name,
+		Auth:      req.Auth,
+		CreatedBy: actingUser(r),
+		CreatedAt: time.Now(),
+		URL:       "/hooks/" + id,
+		secret:    newToken(),
+	}
+	if hook.Auth == "token" {
+		hook.URL = ""
+	}
+	integrationsMutex.Lock()
+	integrations[id] = hook
+	logIntegration(hook)
+	integrationsMutex.Unlock()
+	// the secret is only ever shown here
+	if hook.Auth == "token" {
+		shown := *hook
+		shown.URL = "/hooks/" + hook.secret
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"integration":      shown,
+			"discord_url":      "/api/webhooks/" + hook.Id + "/" + hook.secret,
+			"alertmanager_url": "/api/alertmanager/" + hook.Id + "/" + hook.secret,
+		})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"integration": hook, "secret": hook.secret})
+}
+
+func getIntegrations(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only moderators can list integrations")
+		return
+	}
+
+	list := []integration{}
+	integrationsMutex.Lock()
+	for _, hook := range integrations {
+		if hook.Channel == channel {
+			list = append(list, *hook)
+		}
+	}
+	integrationsMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string][]integration{"integrations": list})
+}
+
+func deleteIntegration(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	allowed := subject.canModerate(r)
+	subject.RUnlock()
+	if !allowed {
+		respondJSON(w, http.StatusForbidden, "Only moderators can remove integrations")
+		return
+	}
+
+	integrationsMutex.Lock()
+	hook, ok := integrations[vars["id"]]
+	if !ok || hook.Channel != channel {
+		integrationsMutex.Unlock()
+		respondJSON(w, http.StatusBadRequest, "Provided integration does not exist!")
+		return
+	}
+	delete(integrations, hook.Id)
+	logGlobal("integration_removed", "integrations", hook.Id, nil)
+	integrationsMutex.Unlock()
+	respondJSON(w, http.StatusOK, map[string]string{"removed": hook.Id})
+}
+
+// forgetIntegrations removes the integrations of a channel that is gone and
+// the routes of other integrations to it
+func forgetIntegrations(channel string) {
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+	for id, hook := range integrations {
+		if hook.Channel == channel {
+			delete(integrations, id)
+			logGlobal("integration_removed", "integrations", id, nil)
+			continue
+		}
+		routes := []repoRoute{}
+		for _, route := range hook.Routes {
+			if route.Channel != channel {
+				routes = append(routes, route)
+			}
+		}
+		if len(routes) < len(hook.Routes) {
+			hook.Routes = routes
+			logIntegration(hook)
+		}
+	}
+}
+
+// channelFor is where the events of repository go
+func (hook *integration) channelFor(repository string) string {
+	for _, route := range hook.Routes {
+		if matched, _ := path.Match(route.Repository, repository); matched {
+			return route.Channel
+		}
+	}
+	return hook.Channel
+}
+
+// mayRouteTo tells whether the caller may route integrations to channel,
+// which takes being one of its moderators
+func mayRouteTo(r *http.Request, channel string) (int, string) {
+	subject := lookupSubject(channel)
+	if subject == nil {
+		return http.StatusBadRequest, "Sorry No such channel exist!"
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canModerate(r) {
+		return http.StatusForbidden, "Only moderators can route integrations"
+	}
+	return http.StatusOK, ""
+}
+
+// Replaces the repository routes of an integration. Every channel routed to
+// needs the caller as moderator too
+// curl -X PUT http://localhost:8000/gdgsas022/integrations/<id>/routes -H 'X-Username: arthur' -d '{"routes": [{"repository": "acme/api", "channel": "api-dev"}, {"repository": "acme/*", "channel": "acme"}]}' -v
+func putIntegrationRoutes(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	req := struct {
+		Routes []repoRoute `json:"routes"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Routes) > maxRepoRoutes {
+		respondJSON(w, http.StatusBadRequest, "at most "+strconv.Itoa(maxRepoRoutes)+" routes")
+		return
+	}
+	if status, msg := mayRouteTo(r, channel); status != http.StatusOK {
+		respondJSON(w, status, msg)
+		return
+	}
+	routes := []repoRoute{}
+	for _, route := range req.Routes {
+		route.Channel = resolveChannel(route.Channel)
+		if _, err := path.Match(route.Repository, ""); err != nil || route.Repository == "" {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": "repository should be a name or a pattern like acme/*", "repository": route.Repository})
+			return
+		}
+		if status, msg := mayRouteTo(r, route.Channel); status != http.StatusOK {
+			respondJSON(w, status, map[string]string{"error": msg, "channel": route.Channel})
+			return
+		}
+		routes = append(routes, route)
+	}
+
+	integrationsMutex.Lock()
+	hook, ok := integrations[vars["id"]]
+	if !ok || hook.Channel != channel {
+		integrationsMutex.Unlock()
+		respondJSON(w, http.StatusBadRequest, "Provided integration does not exist!")
+		return
+	}
+	hook.Routes = routes
+	shown := *hook
+	logIntegration(hook)
+	integrationsMutex.Unlock()
+	audit(auditEntry{Actor: actor(r), Action: "integration_routed", Channel: channel, Data: map[string]interface{}{"id": shown.Id, "routes": routes}})
+	respondJSON(w, http.StatusOK, shown)
+}
+
+// webhookFor finds the integration a /hooks/ URL belongs to: a signed one by
+// its id, a token one by its secret
+func webhookFor(key string) (*integration, bool) {
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+	if hook, ok := integrations[key]; ok && hook.Auth != "token" {
+		return hook, true
+	}
+	for _, hook := range integrations {
+		if hook.Auth == "token" && subtle.ConstantTimeCompare([]byte(hook.secret), []byte(key)) == 1 {
+			return hook, true
+		}
+	}
+	return nil, false
+}
+
+// tokenIntegration finds a token integration by id and secret, for the
+// endpoints that take the calls of other tools at /api/{tool}/{id}/{token}
+func tokenIntegration(id, token string) (*integration, bool) {
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+	hook, ok := integrations[id]
+	if !ok || hook.Auth != "token" || subtle.ConstantTimeCompare([]byte(hook.secret), []byte(token)) != 1 {
+		return nil, false
+	}
+	return hook, true
+}
+
+// Incoming webhook. The post appears under the integration name unless the body
+// names someone else, integrations skip the pre-moderation queue
+// curl -X POST http://localhost:8000/hooks/<id> -H "X-Timestamp: $ts" -H "X-Signature: sha256=$sig" -d '{"message": "Build passed"}' -v
+// curl -X POST http://localhost:8000/hooks/<token> -d '{"message": "Build passed"}' -v
+func postWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hook, ok := webhookFor(vars["id"])
+	if !ok {
+		respondJSON(w, http.StatusNotFound, "No such integration")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// for token integrations the URL was the credential
+	if hook.Auth != "token" {
+		if valid, reason := verifyWebhook(hook, r, body, time.Now()); !valid {
+			respondJSON(w, http.StatusUnauthorized, reason)
+			return
+		}
+	}
+	mesg := msgPost{}
+	if err := json.Unmarshal(body, &mesg); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if mesg, ok := postAsIntegration(w, r, hook, mesg); ok {
+		respondJSON(w, http.StatusOK, map[string]int{"id": mesg.Id})
+	}
+}
+
+// postAsIntegration posts mesg into the channel of the integration, under its
+// name unless mesg names someone else. It answers the caller when it fails or
+// the scanner quarantined the post, true is for a post that went out
+func postAsIntegration(w http.ResponseWriter, r *http.Request, hook *integration, mesg msgPost) (msgPost, bool) {
+	mesg.Username = normalizeUsername(mesg.Username)
+	if mesg.Username == "" {
+		mesg.Username = hook.Name
+	}
+	if strings.TrimSpace(mesg.Message) == "" {
+		respondJSON(w, http.StatusBadRequest, "Empty message!")
+		return msgPost{}, false
+	}
+	if _, ok := priorityRank[mesg.Priority]; mesg.Priority != "" && !ok {
+		respondJSON(w, http.StatusBadRequest, "priority should be low, normal, high or urgent")
+		return msgPost{}, false
+	}
+	// registered and guest names need their token, as for any other post
+	if mesg.Username != hook.Name && !mayActAs(r, mesg.Username) {
+		respondJSON(w, http.StatusForbidden, "Not allowed to post as this username")
+		return msgPost{}, false
+	}
+	// the name of the integration itself was not proven by a token
+	post := msgPost{Username: mesg.Username, Message: mesg.Message, Priority: mesg.Priority, Alert: mesg.Alert}
+	post.Verified = mesg.Username != hook.Name && isClaimed(mesg.Username)
+
+	subject := lookupSubject(hook.Channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return msgPost{}, false
+	}
+	if shed(w) || throttled(w, hook.Channel) {
+		return msgPost{}, false
+	}
+	quarantine := scanPost(r.Context(), &post)
+	// Critical region
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return msgPost{}, false
+	}
+	defer subject.Unlock()
+	if subject.frozen {
+		respondJSON(w, http.StatusForbidden, "Channel is frozen")
+		return msgPost{}, false
+	}
+	if maxChannelMessages > 0 && subject.count() >= maxChannelMessages {
+		respondJSON(w, http.StatusForbidden, "Channel is full")
+		return msgPost{}, false
+	}
+	if quarantine != nil {
+		pendingID := subject.enqueue(post)
+		subject.pending[len(subject.pending)-1].Quarantine = quarantine
+		subject.logSettings("message_quarantined")
+		subject.publishPending(hook.Channel, "message_quarantined", subject.pending[len(subject.pending)-1])
+		respondJSON(w, http.StatusAccepted, map[string]interface{}{"pending_id": pendingID, "quarantined": true})
+		return msgPost{}, false
+	}
+	mesg = subject.add(post)
+	subject.logMessage(mesg.Id, "message_created")
+	publish(hook.Channel, "message", mesg)
+	subject.notifyPost(notice{MessageID: mesg.Id, Username: mesg.Username, Message: mesg.Message, Priority: mesg.Priority})
+	// End of Critical region
+	return mesg, true
+}
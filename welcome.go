@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/gorilla/mux"
+)
+
+// Moderators can have newcomers greeted. The welcome is a Go template with
+// .Username and .Channel, posted into the channel as a system message or sent
+// to the newcomer alone as a "welcome" event on their sync stream:
+//
+//	curl -X PUT http://localhost:8000/gdgsas022/welcome -H 'X-Username: arthur' -d '{"message": "Welcome {{.Username}}, the rules are pinned", "deliver": "post"}'
+//
+// A newcomer is somebody joining a private channel through an invite or
+// posting in the channel for the first time, "on" picks join, first_post or
+// any, which is the default. Everybody is greeted once. Whoever is a member or
+// has posted when the welcome is set counts as greeted already. The welcome
+// follows the member_joined and message events of the broker, integrations
+// and messages relayed from other nodes do not count
+type welcomeMessage struct {
+	Message string `json:"message"`
+	Deliver string `json:"deliver"` // post or direct
+	On      string `json:"on"`      // join, first_post or any
+}
+
+type welcomeJob struct {
+	channel  string
+	username string
+	trigger  string // join or first_post
+}
+
+const welcomeBuffer = 1000
+const maxWelcomeLength = 4000
+
+var welcomeQueue chan welcomeJob
+var welcomesDropped int64
+
+// startWelcomes greets the newcomers the broker tells about
+func startWelcomes() {
+	welcomeQueue = make(chan welcomeJob, welcomeBuffer)
+	broker.Handle(allChannels, toWelcome)
+	go func() {
+		for job := range welcomeQueue {
+			welcome(job)
+		}
+	}()
+}
+
+// toWelcome queues the newcomers of an event. It runs inside the critical
+// region of the publisher, the channel is looked at by the worker
+func toWelcome(ev event) {
+	if ev.Channel == "" || ev.Channel[0] == '@' || isMirror() {
+		return
+	}
+	job := welcomeJob{channel: ev.Channel}
+	switch data := ev.Data.(type) {
+	case map[string]string:
+		if ev.Type != "member_joined" {
+			return
+		}
+		job.username, job.trigger = data["username"], "join"
+	case msgPost:
+		if ev.Type != "message" || data.Type == systemMessage || relayedFrom(ev.Channel, data.Id) {
+			return
+		}
+		job.username, job.trigger = data.Username, "first_post"
+	default:
+		return
+	}
+	if job.username == "" {
+		return
+	}
+	select {
+	case welcomeQueue <- job:
+	default:
+		if atomic.AddInt64(&welcomesDropped, 1)%1000 == 1 {
+			fmt.Println("Welcome buffer is full, dropped", atomic.LoadInt64(&welcomesDropped), "welcomes so far")
+		}
+	}
+}
+
+// welcome greets the newcomer of job unless the channel greeted them before
+func welcome(job welcomeJob) {
+	// integrations post under their own name, they are not newcomers
+	integrationsMutex.Lock()
+	for _, hook := range integrations {
+		if hook.Channel == job.channel && hook.Name == job.username {
+			integrationsMutex.Unlock()
+			return
+		}
+	}
+	integrationsMutex.Unlock()
+
+	subject := lookupSubject(job.channel).lockLive()
+	if subject == nil {
+		return
+	}
+	defer subject.Unlock()
+	w := subject.welcome
+	if w == nil || subject.welcomed[job.username] || (w.On != "any" && w.On != job.trigger) {
+		return
+	}
+	subject.welcomed[job.username] = true
+	subject.logSettings("member_welcomed")
+	text, err := w.text(job.channel, job.username)
+	if err != nil {
+		fmt.Println("Welcome to", job.channel, "failed:", err)
+		return
+	}
+	if w.Deliver == "direct" {
+		notifyUser(job.username, job.channel, "welcome", map[string]string{"message": text})
+		return
+	}
+	subject.postSystem(systemEvent{Event: "welcome", Username: job.username}, text)
+}
+
+func (w *welcomeMessage) text(channel, username string) (string, error) {
+	t, err := template.New("welcome").Option("missingkey=error").Parse(w.Message)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, map[string]string{"Username": username, "Channel": channel}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// validate fills in the defaults and checks the template by rendering it
+func (w *welcomeMessage) validate() string {
+	if w.Deliver == "" {
+		w.Deliver = "post"
+	}
+	if w.On == "" {
+		w.On = "any"
+	}
+	switch {
+	case strings.TrimSpace(w.Message) == "":
+		return "Empty message!"
+	case len(w.Message) > maxWelcomeLength:
+		return fmt.Sprintf("message should be at most %d bytes", maxWelcomeLength)
+	case w.Deliver != "post" && w.Deliver != "direct":
+		return "deliver should be post or direct"
+	case w.On != "join" && w.On != "first_post" && w.On != "any":
+		return "on should be join, first_post or any"
+	}
+	if _, err := w.text("channel", "username"); err != nil {
+		return "message is not a valid template: " + err.Error()
+	}
+	return ""
+}
+
+// curl -X GET http://localhost:8000/gdgsas022/welcome -H 'X-Username: arthur' -v
+func getWelcome(w http.ResponseWriter, r *http.Request) {
+	subject := lookupSubject(mux.Vars(r)["channel"])
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	subject.RLock()
+	defer subject.RUnlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can see the welcome message")
+		return
+	}
+	if subject.welcome == nil {
+		respondJSON(w, http.StatusNotFound, "No welcome message")
+		return
+	}
+	respondJSON(w, http.StatusOK, subject.welcome)
+}
+
+// curl -X PUT http://localhost:8000/gdgsas022/welcome -H 'X-Username: arthur' -d '{"message": "Hi {{.Username}}", "deliver": "direct", "on": "join"}' -v
+func putWelcome(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	spec := welcomeMessage{}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&spec); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if problem := spec.validate(); problem != "" {
+		respondJSON(w, http.StatusBadRequest, problem)
+		return
+	}
+
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can change the welcome message")
+		return
+	}
+	// the people already around are not greeted when welcomes start
+	if subject.welcome == nil {
+		subject.welcomed = make(map[string]bool)
+		for _, set := range []map[string]bool{subject.members, subject.moderators, {subject.owner: true}} {
+			for username := range set {
+				subject.welcomed[username] = true
+			}
+		}
+		for username := range subject.countersOf().users {
+			subject.welcomed[username] = true
+		}
+	}
+	subject.welcome = &spec
+	subject.logSettings("channel_updated")
+	audit(auditEntry{Actor: actor(r), Action: "welcome_changed", Channel: channel, Data: spec})
+	respondJSON(w, http.StatusOK, spec)
+}
+
+// curl -X DELETE http://localhost:8000/gdgsas022/welcome -H 'X-Username: arthur' -v
+func deleteWelcome(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	subject := lookupSubject(channel)
+	if subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	if subject = subject.lockLive(); subject == nil {
+		respondJSON(w, http.StatusBadRequest, "Sorry No such channel exist!")
+		return
+	}
+	defer subject.Unlock()
+	if !subject.canModerate(r) {
+		respondJSON(w, http.StatusForbidden, "Only moderators can change the welcome message")
+		return
+	}
+	if subject.welcome != nil {
+		subject.welcome, subject.welcomed = nil, make(map[string]bool)
+		subject.logSettings("channel_updated")
+		audit(auditEntry{Actor: actor(r), Action: "welcome_removed", Channel: channel})
+	}
+	respondJSON(w, http.StatusOK, map[string]bool{"removed": true})
+}
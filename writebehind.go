@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Write-behind. With -write-delay the records of the log are not written one
+// at a time while the change is made but gathered and written together: one
+// write to the segment, one fsync with -wal-sync and one database transaction
+// for the whole batch. A batch goes out once it holds -write-batch records and
+// at the latest -write-delay after the one before, so under load the disk or
+// the database sees a few large writes instead of a flood of small ones.
+//
+// The change is acknowledged before its record is written, a crash loses what
+// was gathered, at most -write-delay of changes. Without -write-delay every
+// record is written before the change is acknowledged, as always
+var writeDelay time.Duration
+var writeBatch = 1000
+
+// pending are the records gathered, guarded by walMutex. flushMutex keeps the
+// batches in order and lets nobody switch segments under a batch being written
+var pending []walRecord
+var flushMutex sync.Mutex
+var flushSignal = make(chan struct{}, 1)
+
+// holdBack gathers rec for the next batch, false without write-behind. Caller
+// must hold walMutex
+func holdBack(rec walRecord) bool {
+	if writeDelay <= 0 {
+		return false
+	}
+	pending = append(pending, rec)
+	if len(pending) >= writeBatch {
+		select {
+		case flushSignal <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// writeBehind writes the batches as they fill up or the delay runs out
+func writeBehind() {
+	ticker := time.NewTicker(writeDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-flushSignal:
+		}
+		flushWAL(nil)
+	}
+}
+
+// flushWAL writes the records gathered so far to the segment they were made
+// in and the database. swap runs under walMutex right after they are taken,
+// so takeSnapshot can switch segments without records landing in the wrong
+// one. Callers must not hold walMutex
+func flushWAL(swap func()) {
+	flushMutex.Lock()
+	defer flushMutex.Unlock()
+	walMutex.Lock()
+	batch, segment := pending, walFile
+	pending = nil
+	if swap != nil {
+		swap()
+	}
+	walMutex.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	storeRecords(batch)
+	if segment != nil {
+		writeSegment(segment, batch)
+	}
+}
+
+// writeSegment appends records to a segment in a single write
+func writeSegment(segment *os.File, records []walRecord) {
+	buf := []byte{}
+	for _, rec := range records {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			fmt.Println("Writing the WAL failed:", err)
+			return
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	_, err := segment.Write(buf)
+	if err == nil && walSync {
+		err = segment.Sync()
+	}
+	if err != nil {
+		fmt.Println("Writing the WAL failed:", err)
+	}
+}
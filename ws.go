@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /{channel}/ws upgrades to a WebSocket (RFC 6455) and pushes the new
+// messages and thread replies of the channel as they come, each event of
+// /events in a text frame of its own, so clients stop polling
+// GET /messages?last_id= in a loop. With last_id the messages after it are
+// sent first, nothing posted between the last poll and the socket is lost.
+// Takes the filters of parseFilter, type defaults to message,thread. The
+// socket only goes one way, of what the client sends only pings, the close
+// handshake and the acks of -sla are looked at
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+const wsPingInterval = 30 * time.Second
+const wsWriteTimeout = 10 * time.Second
+
+// frames from clients are not meant to carry much, anything bigger ends the
+// connection
+const wsMaxFrame = 64 << 10
+
+var errFrameTooBig = errors.New("frame too big")
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// wsConn writes frames for the stream and the reader answering pings alike
+type wsConn struct {
+	sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n < 1<<16:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// closeWith sends a close frame with a status code
+func (c *wsConn) closeWith(code uint16) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	return c.write(wsClose, payload)
+}
+
+// readFrame returns the opcode and unmasked payload of the next frame. Frames
+// from clients have to be masked
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.rw, head); err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return opcode, nil, errors.New("unmasked frame")
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.rw, ext); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.rw, ext); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext)
+	}
+	if n > wsMaxFrame {
+		return opcode, nil, errFrameTooBig
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.rw, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readFrames answers pings and the close handshake and takes the acks of the
+// client on channel until it goes away, then closes done
+func (c *wsConn) readFrames(channel string, done chan struct{}) {
+	defer close(done)
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			if err != io.EOF {
+				// 1002 protocol error, 1009 too big
+				code := uint16(1002)
+				if err == errFrameTooBig {
+					code = 1009
+				}
+				c.closeWith(code)
+			}
+			return
+		}
+		switch opcode {
+		case wsText:
+			ackFrame(channel, payload)
+		case wsPing:
+			c.write(wsPong, payload)
+		case wsClose:
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			c.write(wsClose, payload)
+			return
+		}
+	}
+}
+
+// headerHas tells whether the comma separated header contains token
+func headerHas(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// curl -N http://localhost:8000/gdgsas022/ws?last_id=5 -H 'Connection: Upgrade' -H 'Upgrade: websocket' -H 'Sec-WebSocket-Version: 13' -H 'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==' --output -
+func streamWebSocket(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !headerHas(r.Header, "Connection", "upgrade") || key == "" {
+		respondJSON(w, http.StatusBadRequest, "Expected a WebSocket upgrade")
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		respondJSON(w, http.StatusUpgradeRequired, "Only WebSocket version 13 is supported")
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, "WebSocket not supported")
+		return
+	}
+	query := r.URL.Query()
+	lastID := -1
+	if value := query.Get("last_id"); value != "" {
+		var err error
+		if lastID, err = strconv.Atoi(value); err != nil {
+			respondJSON(w, http.StatusBadRequest, "last_id should be an integer")
+			return
+		}
+	}
+	if query.Get("type") == "" {
+		query.Set("type", "message,thread")
+	}
+	keep, err := parseFilter(query)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	username := actingUser(r)
+	rd := readerOf(r)
+	keep = rd.stream(keep)
+
+	subject := lookupSubject(channel)
+	newest := 0
+	if subject != nil {
+		subject.RLock()
+		allowed := rd.mayRead(subject)
+		newest = subject.lastID
+		subject.RUnlock()
+		if !allowed {
+			respondJSON(w, http.StatusForbidden, "This channel is private")
+			return
+		}
+	}
+
+	release, ok := openStream(w, r, channel, username)
+	if !ok {
+		return
+	}
+	defer release()
+	// listening before reading the backlog so a message posted in between is
+	// not lost, send skips what the backlog already had
+	l := broker.Subscribe(channel, keep)
+	defer broker.Unsubscribe(channel, l)
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer netConn.Close()
+	netConn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	if rw.Flush() != nil {
+		return
+	}
+	c := &wsConn{conn: netConn, rw: rw}
+	if username != "" {
+		streamOpened(channel, username)
+		defer streamClosed(channel, username)
+	}
+
+	drain := drainSignal(channel)
+	// the client has what it asked the backlog after, or without a backlog
+	// what was there before it subscribed
+	cursor := newest
+	if lastID >= 0 && lastID < cursor {
+		cursor = lastID
+	}
+	send := func(ev event) bool {
+		if mesg, ok := ev.Data.(msgPost); ok && ev.Type == "message" {
+			if mesg.Id <= cursor {
+				return true
+			}
+			cursor = mesg.Id
+		}
+		data, err := json.Marshal(ev)
+		if err != nil || c.write(wsText, data) != nil {
+			return false
+		}
+		delivered(ev)
+		return true
+	}
+	if lastID >= 0 && subject != nil {
+		subject.RLock()
+		backlog := rd.visible(subject.after(lastID))
+		subject.RUnlock()
+		for _, mesg := range backlog {
+			if ev := (event{Type: "message", Channel: channel, Data: mesg}); keep == nil || keep(ev) {
+				if !send(ev) {
+					return
+				}
+			}
+		}
+	}
+
+	gone := make(chan struct{})
+	go c.readFrames(channel, gone)
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case ev := <-l:
+			if !send(ev) {
+				return
+			}
+		case <-ping.C:
+			if c.write(wsPing, nil) != nil {
+				return
+			}
+		case <-drain.done:
+			for buffered := true; buffered; {
+				select {
+				case ev := <-l:
+					if !send(ev) {
+						return
+					}
+				default:
+					buffered = false
+				}
+			}
+			send(drainEvent(channel, drain.reason, cursor))
+			// 1001 going away
+			c.closeWith(1001)
+			return
+		case <-gone:
+			return
+		}
+	}
+}